@@ -6,10 +6,12 @@ package main
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/guregu/dynamo"
 )
 
@@ -25,8 +27,9 @@ type User struct {
 	Birthdate          string
 	Address            string
 	Status             string
-	Interests          string
+	Interests          []string
 	PinnedImage        string
+	PinnedPhoto        *Photo
 	RecommendedFriends []string
 	Photos             []Photo
 }
@@ -35,6 +38,10 @@ type Photo struct {
 	Username  string
 	Timestamp string
 	Location  string
+	Caption   string
+	Reactions map[string]int
+	// 0 より大きければ、リアクション数の一部が REACTIONSHARD# のアイテムにある (14 を参照)
+	ReactionShards int
 }
 
 type QuickPhoto struct {
@@ -65,6 +72,21 @@ type QuickPhoto struct {
 	ReactionType string `dynamo:"reactionType" json:"reactionType"`
 }
 
+func NewInterestsFromDynamoDbAttributeValue(av *dynamodb.AttributeValue) []string {
+	interests := make([]string, 0)
+	if av == nil {
+		return interests
+	}
+	// guregu/dynamo で投入した場合は L、String Set として投入した場合は SS になる
+	for _, v := range av.L {
+		interests = append(interests, aws.StringValue(v.S))
+	}
+	for _, v := range av.SS {
+		interests = append(interests, aws.StringValue(v))
+	}
+	return interests
+}
+
 func NewUserFromDynamoDbQueryResult(out *dynamodb.QueryOutput) *User {
 	if len(out.Items) == 0 {
 		return &User{}
@@ -79,7 +101,7 @@ func NewUserFromDynamoDbQueryResult(out *dynamodb.QueryOutput) *User {
 		Birthdate: aws.StringValue(userItem["birthdate"].S),
 		Address:   aws.StringValue(userItem["address"].S),
 		Status:    aws.StringValue(userItem["status"].S),
-		Interests: aws.StringValue(userItem["interests"].S),
+		Interests: NewInterestsFromDynamoDbAttributeValue(userItem["interests"]),
 	}
 
 	if val, ok := userItem["pinnedImage"]; ok {
@@ -98,30 +120,48 @@ func NewUserFromDynamoDbQueryResult(out *dynamodb.QueryOutput) *User {
 
 	photos := make([]Photo, 0)
 	for _, item := range photoItems {
-		photos = append(
-			photos,
-			Photo{
-				Username:  aws.StringValue(item["username"].S),
-				Timestamp: aws.StringValue(item["timestamp"].S),
-				Location:  aws.StringValue(item["location"].S),
-			},
-		)
+		photo := Photo{
+			Username:  aws.StringValue(item["username"].S),
+			Timestamp: aws.StringValue(item["timestamp"].S),
+			Location:  aws.StringValue(item["location"].S),
+			Reactions: NewReactionCountsFromDynamoDbAttributeValue(item["reactions"]),
+		}
+		if val, ok := item["caption"]; ok {
+			photo.Caption = aws.StringValue(val.S)
+		}
+		if val, ok := item["reactionShards"]; ok {
+			photo.ReactionShards, _ = strconv.Atoi(aws.StringValue(val.N))
+		}
+		photos = append(photos, photo)
+
+		// ピン留めされた写真は同じパーティションに含まれるので、シャードがなければ追加のリクエストなしでリアクション数を返せる
+		// Reactions の map は photos の要素と共有するので、シャードの合計を足すと両方に反映される
+		if user.PinnedImage != "" && aws.StringValue(item["SK"].S) == user.PinnedImage {
+			pinned := photo
+			user.PinnedPhoto = &pinned
+		}
 	}
 	user.Photos = photos
 
 	return &user
 }
 
-func main() {
-	sess := session.Must(session.NewSession())
-	db := dynamo.New(
-		sess,
-		&aws.Config{
-			Region: aws.String("ap-northeast-1"),
-		},
-	)
-	t := db.Table(TABLE)
+func NewReactionCountsFromDynamoDbAttributeValue(av *dynamodb.AttributeValue) map[string]int {
+	counts := make(map[string]int)
+	if av == nil {
+		return counts
+	}
+	for reactionType, v := range av.M {
+		n, err := strconv.Atoi(aws.StringValue(v.N))
+		if err != nil {
+			continue
+		}
+		counts[reactionType] = n
+	}
+	return counts
+}
 
+func GetUserWithPhotos(api dynamodbiface.DynamoDBAPI, username string) (*User, error) {
 	// https://aws.amazon.com/jp/getting-started/hands-on/design-a-database-for-a-mobile-app-with-dynamodb/4/
 	query := dynamodb.QueryInput{
 		TableName: aws.String(TABLE),
@@ -130,10 +170,10 @@ func main() {
 		),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":pk": {
-				S: aws.String(fmt.Sprintf("USER#%s", USER)),
+				S: aws.String(fmt.Sprintf("USER#%s", username)),
 			},
 			":metadata": {
-				S: aws.String(fmt.Sprintf("#METADATA#%s", USER)),
+				S: aws.String(fmt.Sprintf("#METADATA#%s", username)),
 			},
 			":photos": {
 				S: aws.String("PHOTO$"),
@@ -142,12 +182,81 @@ func main() {
 		ScanIndexForward: aws.Bool(true),
 	}
 
-	resp, err := db.Client().Query(&query)
+	resp, err := api.Query(&query)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	user := NewUserFromDynamoDbQueryResult(resp)
+	if err := AddShardReactionCounts(api, user.Photos); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// シャード付きの写真は、写真の reactions に REACTIONSHARD# のアイテムの合計を足したものがリアクション数になる
+// シャードは別のパーティションにあるので、全部の写真のシャードのキーをまとめて BatchGetItem で取る
+func AddShardReactionCounts(api dynamodbiface.DynamoDBAPI, photos []Photo) error {
+	byPK := make(map[string]map[string]int)
+	keys := make([]map[string]*dynamodb.AttributeValue, 0)
+	for _, photo := range photos {
+		for i := 0; i < photo.ReactionShards; i++ {
+			pk := fmt.Sprintf("REACTIONSHARD#%s#%s#%d", photo.Username, photo.Timestamp, i)
+			byPK[pk] = photo.Reactions
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				"PK": {S: aws.String(pk)},
+				"SK": {S: aws.String(fmt.Sprintf("PHOTO#%s#%s", photo.Username, photo.Timestamp))},
+			})
+		}
+	}
+	// BatchGetItem は 1 回 100 キーまで
+	for start := 0; start < len(keys); start += 100 {
+		end := start + 100
+		if end > len(keys) {
+			end = len(keys)
+		}
+		input := &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				TABLE: {
+					Keys:                 keys[start:end],
+					ProjectionExpression: aws.String("PK, reactions"),
+				},
+			},
+		}
+		for len(input.RequestItems) > 0 {
+			out, err := api.BatchGetItem(input)
+			if err != nil {
+				return err
+			}
+			for _, item := range out.Responses[TABLE] {
+				counts := byPK[aws.StringValue(item["PK"].S)]
+				for reactionType, n := range NewReactionCountsFromDynamoDbAttributeValue(item["reactions"]) {
+					counts[reactionType] += n
+				}
+			}
+			input.RequestItems = out.UnprocessedKeys
+		}
+	}
+	return nil
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	user, err := GetUserWithPhotos(db.Client(), USER)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(user)
+	if user.PinnedPhoto != nil {
+		fmt.Println(user.PinnedPhoto.Reactions)
+	}
 
 	// "github.com/guregu/dynamo" を使った場合は map ではなく、struct として取得できる
 	quickPhotos := make([]QuickPhoto, 0)
@@ -6,6 +6,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -16,7 +17,7 @@ import (
 const (
 	TABLE     = "quick-photos"
 	USER      = "david25"
-	TIMESTAMP = "2019-03-02T09:11:30"
+	TIMESTAMP = "2019-03-02T09:11:30Z"
 )
 
 type Photo struct {
@@ -69,41 +70,40 @@ type QuickPhoto struct {
 	ReactionType string `dynamo:"reactionType" json:"reactionType"`
 }
 
+// InvertedIndex で写真のソートキーを引くと、写真とリアクションのほかに、14 で追加するリアクションのシャードも返る
+// "REACTIONSHARD#" は "REACTION#" から "USER$" の範囲に入るので、並び順ではなく PK の接頭辞で見分ける
 func NewPhotoFromDynamoDbQueryResult(out *dynamodb.QueryOutput) *Photo {
-	if len(out.Items) == 0 {
-		return &Photo{}
-	}
-	// reverse items
-	items := out.Items
-	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
-		items[i], items[j] = items[j], items[i]
-	}
-	photoItem := items[0]
-	photo := Photo{
-		Username:  aws.StringValue(photoItem["username"].S),
-		Timestamp: aws.StringValue(photoItem["timestamp"].S),
-		Location:  aws.StringValue(photoItem["location"].S),
-	}
-
-	reactionItems := items[1:]
-
+	photo := Photo{}
 	reactions := make([]Reaction, 0)
-	for _, item := range reactionItems {
-		reactions = append(
-			reactions,
-			Reaction{
-				ReactingUser: aws.StringValue(item["reactingUser"].S),
-				Photo:        aws.StringValue(item["photo"].S),
-				ReactionType: aws.StringValue(item["reactionType"].S),
-				Timestamp:    aws.StringValue(item["timestamp"].S),
-			},
-		)
+	for _, item := range out.Items {
+		pk := aws.StringValue(item["PK"].S)
+		switch {
+		case strings.HasPrefix(pk, "USER#"):
+			photo.Username = aws.StringValue(item["username"].S)
+			photo.Timestamp = aws.StringValue(item["timestamp"].S)
+			photo.Location = aws.StringValue(item["location"].S)
+		case isReactionPK(pk):
+			reactions = append(
+				reactions,
+				Reaction{
+					ReactingUser: aws.StringValue(item["reactingUser"].S),
+					Photo:        aws.StringValue(item["photo"].S),
+					ReactionType: aws.StringValue(item["reactionType"].S),
+					Timestamp:    aws.StringValue(item["timestamp"].S),
+				},
+			)
+		}
 	}
 	photo.Reactions = reactions
 
 	return &photo
 }
 
+// リアクションのシャード (REACTIONSHARD#) はリアクションではない
+func isReactionPK(pk string) bool {
+	return strings.HasPrefix(pk, "REACTION#")
+}
+
 func main() {
 	sess := session.Must(session.NewSession())
 	db := dynamo.New(
@@ -152,5 +152,12 @@ func main() {
 		Range("PK", dynamo.Between, "REACTION#", "USER$").
 		Index("InvertedIndex").
 		All(&quickPhotos)
-	fmt.Println(quickPhotos)
+	// PK はインデックスのソートキーなので FilterExpression では絞れない。取得後にシャードを除く
+	photoAndReactions := make([]QuickPhoto, 0, len(quickPhotos))
+	for _, qp := range quickPhotos {
+		if strings.HasPrefix(qp.PK, "USER#") || isReactionPK(qp.PK) {
+			photoAndReactions = append(photoAndReactions, qp)
+		}
+	}
+	fmt.Println(photoAndReactions)
 }
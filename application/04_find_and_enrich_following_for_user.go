@@ -25,7 +25,7 @@ type User struct {
 	Birthdate          string
 	Address            string
 	Status             string
-	Interests          string
+	Interests          []string
 	PinnedImage        string
 	RecommendedFriends []string
 }
@@ -93,6 +93,21 @@ func NewFriendshipsFromDynamoDbQueryResult(out *dynamodb.QueryOutput) []Friendsh
 	return friendships
 }
 
+func NewInterestsFromDynamoDbAttributeValue(av *dynamodb.AttributeValue) []string {
+	interests := make([]string, 0)
+	if av == nil {
+		return interests
+	}
+	// guregu/dynamo で投入した場合は L、String Set として投入した場合は SS になる
+	for _, v := range av.L {
+		interests = append(interests, aws.StringValue(v.S))
+	}
+	for _, v := range av.SS {
+		interests = append(interests, aws.StringValue(v))
+	}
+	return interests
+}
+
 func NewUsersFromDynamoDbAttributeValues(avs []map[string]*dynamodb.AttributeValue) []User {
 	users := make([]User, 0)
 	for _, userItem := range avs {
@@ -103,7 +118,7 @@ func NewUsersFromDynamoDbAttributeValues(avs []map[string]*dynamodb.AttributeVal
 			Birthdate: aws.StringValue(userItem["birthdate"].S),
 			Address:   aws.StringValue(userItem["address"].S),
 			Status:    aws.StringValue(userItem["status"].S),
-			Interests: aws.StringValue(userItem["interests"].S),
+			Interests: NewInterestsFromDynamoDbAttributeValue(userItem["interests"]),
 		}
 		if val, ok := userItem["pinnedImage"]; ok {
 			user.PinnedImage = aws.StringValue(val.S)
@@ -5,13 +5,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
 )
 
 const (
@@ -19,7 +24,9 @@ const (
 	REACTING_USER   = "kennedyheather"
 	REACTION_TYPE   = "sunglasses"
 	PHOTO_USER      = "ppierce"
-	PHOTO_TIMESTAMP = "2019-04-14T08:09:34"
+	PHOTO_TIMESTAMP = "2019-04-14T08:09:34Z"
+	// 通知は TTL で消える
+	NOTIFICATION_TTL = 30 * 24 * time.Hour
 )
 
 type Reaction struct {
@@ -33,48 +40,73 @@ func (r *Reaction) String() string {
 	return fmt.Sprintf("Reaction<%s -- %s -- %s>", r.ReactingUser, r.Photo, r.ReactionType)
 }
 
-type QuickPhoto struct {
-	PK            string   `dynamo:"PK,hash" json:"PK"`
-	SK            string   `dynamo:",range" json:"SK"`
-	Address       string   `dynamo:"address" json:"address"`
-	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
-	Email         string   `dynamo:"email" json:"email"`
-	Name          string   `dynamo:"name" json:"name"`
-	Username      string   `dynamo:"username" json:"username"`
-	Status        string   `dynamo:"status" json:"status"`
-	Interests     []string `dynamo:"interests" json:"interests"`
-	Followers     int      `dynamo:"followers" json:"followers"`
-	Following     int      `dynamo:"following" json:"following"`
-	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
-	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
-	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
-	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
-	Location      string   `dynamo:"location" json:"location"`
-	Reactions     struct {
-		PlusOne    int `dynamo:"+1" json:"+1"`
-		Smiley     int `dynamo:"smiley" json:"smiley"`
-		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
-		Heart      int `dynamo:"heart" json:"heart"`
-	} `dynamo:"reactions" json:"reactions"`
-	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
-	Photo        string `dynamo:"photo" json:"photo"`
-	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+// 書き込むアイテムの属性だけを持たせる。ユーザーや写真の構造体で書くと、ゼロ値のカウンターまで書き込まれる
+type reactionItem struct {
+	PK           string `dynamo:"PK,hash"`
+	SK           string `dynamo:",range"`
+	ReactingUser string `dynamo:"reactingUser"`
+	ReactionType string `dynamo:"reactionType"`
+	Photo        string `dynamo:"photo"`
+	Timestamp    string `dynamo:"timestamp"`
+}
+
+type Notification struct {
+	PK           string `dynamo:"PK,hash"`
+	SK           string `dynamo:",range"`
+	Type         string `dynamo:"type"`
+	Actor        string `dynamo:"actor"`
+	Photo        string `dynamo:"photo"`
+	ReactionType string `dynamo:"reactionType"`
+	Timestamp    string `dynamo:"timestamp"`
+	ExpiresAt    int64  `dynamo:"expiresAt"`
 }
 
 func main() {
+	endpoint := flag.String("endpoint", "", "DynamoDB endpoint URL (for DynamoDB Local and similar)")
+	only := flag.String("only", "", `run only the "sdk" or the "guregu" implementation`)
+	at := flag.String("now", "", "RFC 3339 time to write instead of the current time")
+	flag.Parse()
+
+	// e2e の差分テストは、片方の実装だけを時刻を固定して実行する
+	switch *only {
+	case "", "sdk", "guregu":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -only %q\n", *only)
+		os.Exit(2)
+	}
+	now := time.Now()
+	if *at != "" {
+		var err error
+		if now, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	config := &aws.Config{
+		Region: aws.String("ap-northeast-1"),
+	}
+	if *endpoint != "" {
+		config.Endpoint = aws.String(*endpoint)
+	}
 	sess := session.Must(session.NewSession())
-	db := dynamo.New(
-		sess,
-		&aws.Config{
-			Region: aws.String("ap-northeast-1"),
-		},
-	)
-	t := db.Table(TABLE)
+	db := dynamo.New(sess, config)
 
+	if *only != "guregu" {
+		addReactionWithSDK(db.Client(), now)
+	}
+	if *only != "sdk" {
+		addReactionWithGuregu(db, now)
+	}
+}
+
+// リアクションの追加、写真のカウンターの更新、通知の書き込みを 1 つのトランザクションで行う
+func addReactionWithSDK(c dynamodbiface.DynamoDBAPI, at time.Time) {
 	reactionStr := fmt.Sprintf("REACTION#%s#%s", REACTING_USER, REACTION_TYPE)
 	photoStr := fmt.Sprintf("PHOTO#%s#%s", PHOTO_USER, PHOTO_TIMESTAMP)
 	userStr := fmt.Sprintf("USER#%s", PHOTO_USER)
-	now := time.Now().Format("2006-01-02T15:04:05")
+	now := quickphotos.NewTimestamp(at).String()
+	expiresAt := at.Add(NOTIFICATION_TTL).Unix()
 	items := []*dynamodb.TransactWriteItem{
 		{
 			Put: &dynamodb.Put{
@@ -128,37 +160,124 @@ func main() {
 				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
 			},
 		},
+		// 写真の投稿者の受信箱に通知を書き込む
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("INBOX#%s", PHOTO_USER)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("NOTIFICATION#%s#%s#%s", now, reactionStr, photoStr)),
+					},
+					"type": {
+						S: aws.String("reaction"),
+					},
+					"actor": {
+						S: aws.String(REACTING_USER),
+					},
+					"photo": {
+						S: aws.String(photoStr),
+					},
+					"reactionType": {
+						S: aws.String(REACTION_TYPE),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+					"expiresAt": {
+						N: aws.String(fmt.Sprint(expiresAt)),
+					},
+				},
+			},
+		},
+		// どちらかがブロックしていればリアクションできない
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(userStr),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", REACTING_USER)),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("USER#%s", REACTING_USER)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", PHOTO_USER)),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
 	}
 	input := &dynamodb.TransactWriteItemsInput{
 		TransactItems: items,
 	}
-	c := db.Client()
 	_, err := c.TransactWriteItems(input)
 	if err != nil {
 		fmt.Print("Exec transaction failed. Err:")
 		panic(err)
 	}
+}
+
+// addReactionWithSDK と同じ書き込みを guregu/dynamo で行う
+func addReactionWithGuregu(db *dynamo.DB, at time.Time) {
+	t := db.Table(TABLE)
 
-	// "github.com/guregu/dynamo" を使った場合
-	// "SET reactions.#t = reactions.#t + :i" の実現に
-	now2 := time.Now().Format("2006-01-02T15:04:05+09:00")
+	reactionStr := fmt.Sprintf("REACTION#%s#%s", REACTING_USER, REACTION_TYPE)
+	photoStr := fmt.Sprintf("PHOTO#%s#%s", PHOTO_USER, PHOTO_TIMESTAMP)
+	userStr := fmt.Sprintf("USER#%s", PHOTO_USER)
+	now := quickphotos.NewTimestamp(at).String()
 	tx := db.WriteTx()
 	put := t.Put(
-		QuickPhoto{
+		reactionItem{
 			PK:           reactionStr,
 			SK:           photoStr,
 			ReactingUser: REACTING_USER,
 			ReactionType: REACTION_TYPE,
 			Photo:        photoStr,
-			Timestamp:    now2,
+			Timestamp:    now,
 		},
-	)
+	).If("attribute_not_exists(SK)")
 	update := t.Update("PK", userStr).
 		Range("SK", photoStr).
 		SetExpr("reactions.$ = reactions.$ + ?", REACTION_TYPE, REACTION_TYPE, 1)
-	err = tx.
+	notification := t.Put(
+		Notification{
+			PK:           fmt.Sprintf("INBOX#%s", PHOTO_USER),
+			SK:           fmt.Sprintf("NOTIFICATION#%s#%s#%s", now, reactionStr, photoStr),
+			Type:         "reaction",
+			Actor:        REACTING_USER,
+			Photo:        photoStr,
+			ReactionType: REACTION_TYPE,
+			Timestamp:    now,
+			ExpiresAt:    at.Add(NOTIFICATION_TTL).Unix(),
+		},
+	)
+	notBlocked := t.Check("PK", userStr).
+		Range("SK", fmt.Sprintf("#BLOCK#%s", REACTING_USER)).
+		IfNotExists()
+	notBlocking := t.Check("PK", fmt.Sprintf("USER#%s", REACTING_USER)).
+		Range("SK", fmt.Sprintf("#BLOCK#%s", PHOTO_USER)).
+		IfNotExists()
+	err := tx.
 		Put(put).
 		Update(update).
+		Put(notification).
+		Check(notBlocked).
+		Check(notBlocking).
 		Run()
 	if err != nil {
 		panic(err)
@@ -5,19 +5,26 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
 )
 
 const (
 	TABLE          = "quick-photos"
 	FOLLOWED_USER  = "tmartinez"
 	FOLLOWING_USER = "john42"
+	// 通知は TTL で消える
+	NOTIFICATION_TTL = 30 * 24 * time.Hour
 )
 
 type Reaction struct {
@@ -31,50 +38,72 @@ func (r *Reaction) String() string {
 	return fmt.Sprintf("Reaction<%s -- %s -- %s>", r.ReactingUser, r.Photo, r.ReactionType)
 }
 
-type QuickPhoto struct {
-	PK            string   `dynamo:"PK,hash" json:"PK"`
-	SK            string   `dynamo:",range" json:"SK"`
-	Address       string   `dynamo:"address" json:"address"`
-	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
-	Email         string   `dynamo:"email" json:"email"`
-	Name          string   `dynamo:"name" json:"name"`
-	Username      string   `dynamo:"username" json:"username"`
-	Status        string   `dynamo:"status" json:"status"`
-	Interests     []string `dynamo:"interests" json:"interests"`
-	Followers     int      `dynamo:"followers" json:"followers"`
-	Following     int      `dynamo:"following" json:"following"`
-	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
-	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
-	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
-	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
-	Location      string   `dynamo:"location" json:"location"`
-	Reactions     struct {
-		PlusOne    int `dynamo:"+1" json:"+1"`
-		Smiley     int `dynamo:"smiley" json:"smiley"`
-		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
-		Heart      int `dynamo:"heart" json:"heart"`
-	} `dynamo:"reactions" json:"reactions"`
-	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
-	Photo        string `dynamo:"photo" json:"photo"`
-	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+// 書き込むアイテムの属性だけを持たせる。ユーザーや写真の構造体で書くと、ゼロ値のカウンターまで書き込まれる
+type friendshipItem struct {
+	PK            string `dynamo:"PK,hash"`
+	SK            string `dynamo:",range"`
+	FollowedUser  string `dynamo:"followedUser"`
+	FollowingUser string `dynamo:"followingUser"`
+	Timestamp     string `dynamo:"timestamp"`
+}
+
+type Notification struct {
+	PK        string `dynamo:"PK,hash"`
+	SK        string `dynamo:",range"`
+	Type      string `dynamo:"type"`
+	Actor     string `dynamo:"actor"`
+	Timestamp string `dynamo:"timestamp"`
+	ExpiresAt int64  `dynamo:"expiresAt"`
 }
 
 func main() {
+	endpoint := flag.String("endpoint", "", "DynamoDB endpoint URL (for DynamoDB Local and similar)")
+	only := flag.String("only", "", `run only the "sdk" or the "guregu" implementation`)
+	at := flag.String("now", "", "RFC 3339 time to write instead of the current time")
+	flag.Parse()
+
+	// e2e の差分テストは、片方の実装だけを時刻を固定して実行する
+	switch *only {
+	case "", "sdk", "guregu":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown -only %q\n", *only)
+		os.Exit(2)
+	}
+	now := time.Now()
+	if *at != "" {
+		var err error
+		if now, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	config := &aws.Config{
+		Region: aws.String("ap-northeast-1"),
+	}
+	if *endpoint != "" {
+		config.Endpoint = aws.String(*endpoint)
+	}
 	sess := session.Must(session.NewSession())
-	db := dynamo.New(
-		sess,
-		&aws.Config{
-			Region: aws.String("ap-northeast-1"),
-		},
-	)
-	t := db.Table(TABLE)
+	db := dynamo.New(sess, config)
 
+	if *only != "guregu" {
+		followWithSDK(db.Client(), now)
+	}
+	if *only != "sdk" {
+		followWithGuregu(db, now)
+	}
+}
+
+// フォロー関係の追加、両方のユーザーのカウンターの更新、通知の書き込みを 1 つのトランザクションで行う
+func followWithSDK(c dynamodbiface.DynamoDBAPI, at time.Time) {
 	userStr := fmt.Sprintf("USER#%s", FOLLOWED_USER)
 	frindStr := fmt.Sprintf("#FRIEND#%s", FOLLOWING_USER)
 	userMetadataStr := fmt.Sprintf("#METADATA#%s", FOLLOWED_USER)
 	friendUserStr := fmt.Sprintf("USER#%s", FOLLOWING_USER)
 	friendMetadataStr := fmt.Sprintf("#METADATA#%s", FOLLOWING_USER)
-	now := time.Now().Format("2006-01-02T15:04:05")
+	now := quickphotos.NewTimestamp(at).String()
+	expiresAt := at.Add(NOTIFICATION_TTL).Unix()
 
 	items := []*dynamodb.TransactWriteItem{
 		{
@@ -115,10 +144,17 @@ func main() {
 				UpdateExpression: aws.String(
 					"SET followers = followers + :i",
 				),
+				// 非公開アカウントへのフォローは 11_follow_request.go のリクエスト経由で行う
+				ConditionExpression: aws.String(
+					"attribute_not_exists(private) OR private = :false",
+				),
 				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 					":i": {
 						N: aws.String("1"),
 					},
+					":false": {
+						BOOL: aws.Bool(false),
+					},
 				},
 				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
 			},
@@ -145,41 +181,123 @@ func main() {
 				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
 			},
 		},
+		// フォローされたユーザーの受信箱に通知を書き込む
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("INBOX#%s", FOLLOWED_USER)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("NOTIFICATION#%s#%s", now, frindStr)),
+					},
+					"type": {
+						S: aws.String("follow"),
+					},
+					"actor": {
+						S: aws.String(FOLLOWING_USER),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+					"expiresAt": {
+						N: aws.String(fmt.Sprint(expiresAt)),
+					},
+				},
+			},
+		},
+		// どちらかがブロックしていればフォローできない
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(userStr),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", FOLLOWING_USER)),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(friendUserStr),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", FOLLOWED_USER)),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
 	}
 	input := &dynamodb.TransactWriteItemsInput{
 		TransactItems: items,
 	}
-	c := db.Client()
 	_, err := c.TransactWriteItems(input)
 	if err != nil {
 		fmt.Print("Could not add follow relationship Err:")
 		panic(err)
 	}
 	fmt.Println(fmt.Sprintf("User %s is now following user %s", FOLLOWING_USER, FOLLOWED_USER))
+}
+
+// followWithSDK と同じ書き込みを guregu/dynamo で行う
+func followWithGuregu(db *dynamo.DB, at time.Time) {
+	t := db.Table(TABLE)
 
-	// "github.com/guregu/dynamo" を使った場合
-	// "SET reactions.#t = reactions.#t + :i" の実現に
-	now2 := time.Now().Format("2006-01-02T15:04:05+09:00")
+	userStr := fmt.Sprintf("USER#%s", FOLLOWED_USER)
+	frindStr := fmt.Sprintf("#FRIEND#%s", FOLLOWING_USER)
+	userMetadataStr := fmt.Sprintf("#METADATA#%s", FOLLOWED_USER)
+	friendUserStr := fmt.Sprintf("USER#%s", FOLLOWING_USER)
+	friendMetadataStr := fmt.Sprintf("#METADATA#%s", FOLLOWING_USER)
+	now := quickphotos.NewTimestamp(at).String()
 	tx := db.WriteTx()
 	put := t.Put(
-		QuickPhoto{
+		friendshipItem{
 			PK:            userStr,
-			SK:            friendUserStr,
+			SK:            frindStr,
 			FollowedUser:  FOLLOWED_USER,
 			FollowingUser: FOLLOWING_USER,
-			Timestamp:     now2,
+			Timestamp:     now,
 		},
-	)
+	).If("attribute_not_exists(SK)")
 	update1 := t.Update("PK", userStr).
 		Range("SK", userMetadataStr).
-		SetExpr("followed = followed + ?", 1)
+		SetExpr("followers = followers + ?", 1).
+		If("attribute_not_exists(private) OR private = ?", false)
 	update2 := t.Update("PK", friendUserStr).
 		Range("SK", friendMetadataStr).
-		SetExpr("followed = followed + ?", 1)
-	err = tx.
+		SetExpr("following = following + ?", 1)
+	notification := t.Put(
+		Notification{
+			PK:        fmt.Sprintf("INBOX#%s", FOLLOWED_USER),
+			SK:        fmt.Sprintf("NOTIFICATION#%s#%s", now, frindStr),
+			Type:      "follow",
+			Actor:     FOLLOWING_USER,
+			Timestamp: now,
+			ExpiresAt: at.Add(NOTIFICATION_TTL).Unix(),
+		},
+	)
+	notBlocked := t.Check("PK", userStr).
+		Range("SK", fmt.Sprintf("#BLOCK#%s", FOLLOWING_USER)).
+		IfNotExists()
+	notBlocking := t.Check("PK", friendUserStr).
+		Range("SK", fmt.Sprintf("#BLOCK#%s", FOLLOWED_USER)).
+		IfNotExists()
+	err := tx.
 		Put(put).
 		Update(update1).
 		Update(update2).
+		Put(notification).
+		Check(notBlocked).
+		Check(notBlocking).
 		Run()
 	if err != nil {
 		panic(err)
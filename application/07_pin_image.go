@@ -0,0 +1,151 @@
+//go:build ignore
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+)
+
+const (
+	TABLE           = "quick-photos"
+	USER            = "haroldwatkins"
+	PHOTO_TIMESTAMP = "2018-06-09T15:00:24Z"
+)
+
+var ErrNotPhotoOwner = errors.New("pinned image must be a photo of the same user")
+
+func photoOwnedBy(pinnedImage, username string) bool {
+	return strings.HasPrefix(pinnedImage, fmt.Sprintf("PHOTO#%s#", username))
+}
+
+// 参照先の PHOTO アイテムが存在し、同じユーザーのものであることを ConditionCheck で確認してから pinnedImage を更新する
+func SetPinnedImage(api dynamodbiface.DynamoDBAPI, username, pinnedImage string) error {
+	if !photoOwnedBy(pinnedImage, username) {
+		return ErrNotPhotoOwner
+	}
+
+	userStr := fmt.Sprintf("USER#%s", username)
+	userMetadataStr := fmt.Sprintf("#METADATA#%s", username)
+	items := []*dynamodb.TransactWriteItem{
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(userStr),
+					},
+					"SK": {
+						S: aws.String(pinnedImage),
+					},
+				},
+				ConditionExpression: aws.String("attribute_exists(SK) AND username = :u"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":u": {
+						S: aws.String(username),
+					},
+				},
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(userStr),
+					},
+					"SK": {
+						S: aws.String(userMetadataStr),
+					},
+				},
+				UpdateExpression:    aws.String("SET pinnedImage = :p"),
+				ConditionExpression: aws.String("attribute_exists(PK)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":p": {
+						S: aws.String(pinnedImage),
+					},
+				},
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+	}
+	_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+func ClearPinnedImage(api dynamodbiface.DynamoDBAPI, username string) error {
+	_, err := api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(TABLE),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(fmt.Sprintf("USER#%s", username)),
+			},
+			"SK": {
+				S: aws.String(fmt.Sprintf("#METADATA#%s", username)),
+			},
+		},
+		UpdateExpression:    aws.String("REMOVE pinnedImage"),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	return err
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	photoStr := fmt.Sprintf("PHOTO#%s#%s", USER, PHOTO_TIMESTAMP)
+	c := db.Client()
+	if err := ClearPinnedImage(c, USER); err != nil {
+		fmt.Print("Could not clear pinned image. Err:")
+		panic(err)
+	}
+	if err := SetPinnedImage(c, USER, photoStr); err != nil {
+		fmt.Print("Could not set pinned image. Err:")
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("User %s pinned %s", USER, photoStr))
+
+	// "github.com/guregu/dynamo" を使った場合
+	userStr := fmt.Sprintf("USER#%s", USER)
+	userMetadataStr := fmt.Sprintf("#METADATA#%s", USER)
+	err := t.Update("PK", userStr).
+		Range("SK", userMetadataStr).
+		Remove("pinnedImage").
+		If("attribute_exists(PK)").
+		Run()
+	if err != nil {
+		panic(err)
+	}
+
+	check := t.Check("PK", userStr).
+		Range("SK", photoStr).
+		If("attribute_exists(SK)").
+		If("username = ?", USER)
+	update := t.Update("PK", userStr).
+		Range("SK", userMetadataStr).
+		Set("pinnedImage", photoStr).
+		If("attribute_exists(PK)")
+	err = db.WriteTx().
+		Check(check).
+		Update(update).
+		Run()
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,339 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+const (
+	TABLE    = "quick-photos"
+	USER     = "haroldwatkins"
+	INTEREST = "green"
+)
+
+type InterestMatch struct {
+	Username string
+	Overlap  int
+}
+
+func (m InterestMatch) String() string {
+	return fmt.Sprintf("InterestMatch<%s -- %d>", m.Username, m.Overlap)
+}
+
+type QuickPhoto struct {
+	PK            string   `dynamo:"PK,hash" json:"PK"`
+	SK            string   `dynamo:",range" json:"SK"`
+	Address       string   `dynamo:"address" json:"address"`
+	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
+	Email         string   `dynamo:"email" json:"email"`
+	Name          string   `dynamo:"name" json:"name"`
+	Username      string   `dynamo:"username" json:"username"`
+	Status        string   `dynamo:"status" json:"status"`
+	Interests     []string `dynamo:"interests" json:"interests"`
+	Interest      string   `dynamo:"interest" json:"interest"`
+	Followers     int      `dynamo:"followers" json:"followers"`
+	Following     int      `dynamo:"following" json:"following"`
+	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
+	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
+	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
+	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
+	Location      string   `dynamo:"location" json:"location"`
+	Reactions     struct {
+		PlusOne    int `dynamo:"+1" json:"+1"`
+		Smiley     int `dynamo:"smiley" json:"smiley"`
+		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
+		Heart      int `dynamo:"heart" json:"heart"`
+	} `dynamo:"reactions" json:"reactions"`
+	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
+	Photo        string `dynamo:"photo" json:"photo"`
+	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+}
+
+func NewInterestsFromDynamoDbAttributeValue(av *dynamodb.AttributeValue) []string {
+	interests := make([]string, 0)
+	if av == nil {
+		return interests
+	}
+	// guregu/dynamo で投入した場合は L、String Set として投入した場合は SS になる
+	for _, v := range av.L {
+		interests = append(interests, aws.StringValue(v.S))
+	}
+	for _, v := range av.SS {
+		interests = append(interests, aws.StringValue(v))
+	}
+	return interests
+}
+
+func NewInterestsAttributeValue(interests []string) *dynamodb.AttributeValue {
+	l := make([]*dynamodb.AttributeValue, 0, len(interests))
+	for _, interest := range interests {
+		l = append(l, &dynamodb.AttributeValue{S: aws.String(interest)})
+	}
+	return &dynamodb.AttributeValue{L: l}
+}
+
+// INTEREST#<tag> をパーティションキー、USER#<username> をソートキーとしたアイテムで興味のあるユーザーを引けるようにする
+// ユーザーの興味一覧は InvertedIndex で SK = USER#<username> を引けば取得できる
+func NewInterestItem(username, interest string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("INTEREST#%s", interest)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("USER#%s", username)),
+		},
+		"username": {
+			S: aws.String(username),
+		},
+		"interest": {
+			S: aws.String(interest),
+		},
+	}
+}
+
+func GetInterests(api dynamodbiface.DynamoDBAPI, username string) ([]string, *dynamodb.AttributeValue, error) {
+	resp, err := api.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(TABLE),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(fmt.Sprintf("USER#%s", username)),
+			},
+			"SK": {
+				S: aws.String(fmt.Sprintf("#METADATA#%s", username)),
+			},
+		},
+		ProjectionExpression: aws.String("interests"),
+		ConsistentRead:       aws.Bool(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Item == nil {
+		return nil, nil, fmt.Errorf("user %s not found", username)
+	}
+	return NewInterestsFromDynamoDbAttributeValue(resp.Item["interests"]), resp.Item["interests"], nil
+}
+
+func ListUsersByInterest(api dynamodbiface.DynamoDBAPI, interest string) ([]string, error) {
+	usernames := make([]string, 0)
+	input, err := quickphotos.PatternUsersByInterest.QueryInput(TABLE, map[string]string{"interest": interest})
+	if err != nil {
+		return nil, err
+	}
+	err = api.QueryPages(input, func(out *dynamodb.QueryOutput, _ bool) bool {
+		for _, item := range out.Items {
+			usernames = append(usernames, aws.StringValue(item["username"].S))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+func ListFollowing(api dynamodbiface.DynamoDBAPI, username string) (map[string]bool, error) {
+	following := make(map[string]bool)
+	input, err := quickphotos.PatternFollowing.QueryInput(TABLE, map[string]string{"username": username})
+	if err != nil {
+		return nil, err
+	}
+	err = api.QueryPages(input, func(out *dynamodb.QueryOutput, _ bool) bool {
+		for _, item := range out.Items {
+			following[aws.StringValue(item["followedUser"].S)] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return following, nil
+}
+
+// 自分がフォローしていないユーザーを、共通の興味の数が多い順に並べる
+func RecommendUsersByInterests(api dynamodbiface.DynamoDBAPI, username string) ([]InterestMatch, error) {
+	interests, _, err := GetInterests(api, username)
+	if err != nil {
+		return nil, err
+	}
+	following, err := ListFollowing(api, username)
+	if err != nil {
+		return nil, err
+	}
+
+	overlaps := make(map[string]int)
+	for _, interest := range interests {
+		usernames, err := ListUsersByInterest(api, interest)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range usernames {
+			if u == username || following[u] {
+				continue
+			}
+			overlaps[u]++
+		}
+	}
+
+	matches := make([]InterestMatch, 0, len(overlaps))
+	for u, n := range overlaps {
+		matches = append(matches, InterestMatch{Username: u, Overlap: n})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Overlap != matches[j].Overlap {
+			return matches[i].Overlap > matches[j].Overlap
+		}
+		return matches[i].Username < matches[j].Username
+	})
+	return matches, nil
+}
+
+// プロフィールの interests と INTEREST# アイテムを 1 つのトランザクションで更新する
+// interests が読み込み時から変わっていれば条件チェックで失敗するので、INTEREST# アイテムがずれることはない
+func UpdateInterests(api dynamodbiface.DynamoDBAPI, username string, interests []string) error {
+	current, currentAV, err := GetInterests(api, username)
+	if err != nil {
+		return err
+	}
+
+	next := make(map[string]bool)
+	for _, interest := range interests {
+		next[interest] = true
+	}
+	prev := make(map[string]bool)
+	for _, interest := range current {
+		prev[interest] = true
+	}
+
+	update := &dynamodb.Update{
+		TableName: aws.String(TABLE),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(fmt.Sprintf("USER#%s", username)),
+			},
+			"SK": {
+				S: aws.String(fmt.Sprintf("#METADATA#%s", username)),
+			},
+		},
+		UpdateExpression: aws.String("SET interests = :next"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":next": NewInterestsAttributeValue(interests),
+		},
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+	}
+	if currentAV == nil {
+		update.ConditionExpression = aws.String("attribute_exists(PK) AND attribute_not_exists(interests)")
+	} else {
+		update.ConditionExpression = aws.String("interests = :prev")
+		update.ExpressionAttributeValues[":prev"] = currentAV
+	}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Update: update,
+		},
+	}
+	for interest := range next {
+		if prev[interest] {
+			continue
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item:      NewInterestItem(username, interest),
+			},
+		})
+	}
+	for interest := range prev {
+		if next[interest] {
+			continue
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("INTEREST#%s", interest)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("USER#%s", username)),
+					},
+				},
+			},
+		})
+	}
+
+	_, err = api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	c := db.Client()
+	usernames, err := ListUsersByInterest(c, INTEREST)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(usernames)
+
+	matches, err := RecommendUsersByInterests(c, USER)
+	if err != nil {
+		panic(err)
+	}
+	for _, m := range matches {
+		fmt.Println(m)
+	}
+
+	interests, _, err := GetInterests(c, USER)
+	if err != nil {
+		panic(err)
+	}
+	if err := UpdateInterests(c, USER, append(interests, "photography")); err != nil {
+		fmt.Print("Could not update interests. Err:")
+		panic(err)
+	}
+	if err := UpdateInterests(c, USER, interests); err != nil {
+		fmt.Print("Could not update interests. Err:")
+		panic(err)
+	}
+
+	// "github.com/guregu/dynamo" を使った場合は map ではなく、struct として取得できる
+	// Query は aws-sdk と同じアクセスパターンの宣言から組み立てる
+	quickPhotos := make([]QuickPhoto, 0)
+	q, err := dynamostore.PatternQuery(t, quickphotos.PatternUsersByInterest, map[string]string{"interest": INTEREST})
+	if err != nil {
+		panic(err)
+	}
+	q.All(&quickPhotos)
+	fmt.Println(quickPhotos)
+
+	// ユーザーの興味一覧は InvertedIndex から引ける
+	userInterests := make([]QuickPhoto, 0)
+	q, err = dynamostore.PatternQuery(t, quickphotos.PatternInterestsOfUser, map[string]string{"username": USER})
+	if err != nil {
+		panic(err)
+	}
+	q.All(&userInterests)
+	fmt.Println(userInterests)
+}
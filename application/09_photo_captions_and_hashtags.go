@@ -0,0 +1,395 @@
+//go:build ignore
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+const (
+	TABLE           = "quick-photos"
+	USER            = "david25"
+	PHOTO_TIMESTAMP = "2019-03-02T09:11:30Z"
+	TAG             = "sunset"
+	PAGE_SIZE       = 10
+	// TransactWriteItems は 100 アイテムまでなので、写真本体の分を残してハッシュタグ数を制限する
+	MAX_HASHTAGS = 30
+)
+
+var (
+	hashtagPattern = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+	ErrTooManyHashtags = errors.New("too many hashtags in caption")
+)
+
+type Photo struct {
+	Username  string
+	Timestamp string
+	Location  string
+	Caption   string
+}
+
+func (p *Photo) String() string {
+	return fmt.Sprintf("Photo<%s -- %s -- %s>", p.Username, p.Timestamp, p.Caption)
+}
+
+type QuickPhoto struct {
+	PK            string   `dynamo:"PK,hash" json:"PK"`
+	SK            string   `dynamo:",range" json:"SK"`
+	Address       string   `dynamo:"address" json:"address"`
+	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
+	Email         string   `dynamo:"email" json:"email"`
+	Name          string   `dynamo:"name" json:"name"`
+	Username      string   `dynamo:"username" json:"username"`
+	Status        string   `dynamo:"status" json:"status"`
+	Interests     []string `dynamo:"interests" json:"interests"`
+	Followers     int      `dynamo:"followers" json:"followers"`
+	Following     int      `dynamo:"following" json:"following"`
+	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
+	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
+	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
+	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
+	Location      string   `dynamo:"location" json:"location"`
+	Caption       string   `dynamo:"caption" json:"caption"`
+	Tag           string   `dynamo:"tag" json:"tag"`
+	Reactions     struct {
+		PlusOne    int `dynamo:"+1" json:"+1"`
+		Smiley     int `dynamo:"smiley" json:"smiley"`
+		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
+		Heart      int `dynamo:"heart" json:"heart"`
+	} `dynamo:"reactions" json:"reactions"`
+	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
+	Photo        string `dynamo:"photo" json:"photo"`
+	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+}
+
+// キャプションからハッシュタグを小文字で重複なく取り出す
+func ExtractHashtags(caption string) []string {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, m := range hashtagPattern.FindAllStringSubmatch(caption, -1) {
+		tag := strings.ToLower(m[1])
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func photoKey(username, timestamp string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("USER#%s", username)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("PHOTO#%s#%s", username, timestamp)),
+		},
+	}
+}
+
+// TAG#<tag> のパーティションに、ソートキーを時刻始まりにしたアイテムを置くことで、タグごとの新着順を Query で取得できる
+func tagKey(tag, username, timestamp string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("TAG#%s", tag)),
+		},
+		"SK": {
+			S: aws.String(fmt.Sprintf("TIMESTAMP#%s#%s", timestamp, username)),
+		},
+	}
+}
+
+func NewTagItem(tag string, photo *Photo) map[string]*dynamodb.AttributeValue {
+	item := tagKey(tag, photo.Username, photo.Timestamp)
+	item["tag"] = &dynamodb.AttributeValue{S: aws.String(tag)}
+	item["photo"] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("PHOTO#%s#%s", photo.Username, photo.Timestamp))}
+	item["username"] = &dynamodb.AttributeValue{S: aws.String(photo.Username)}
+	item["timestamp"] = &dynamodb.AttributeValue{S: aws.String(photo.Timestamp)}
+	item["location"] = &dynamodb.AttributeValue{S: aws.String(photo.Location)}
+	item["caption"] = &dynamodb.AttributeValue{S: aws.String(photo.Caption)}
+	return item
+}
+
+func captionCondition(caption string) (*string, map[string]*dynamodb.AttributeValue) {
+	if caption == "" {
+		return aws.String("attribute_exists(SK) AND attribute_not_exists(caption)"), map[string]*dynamodb.AttributeValue{}
+	}
+	return aws.String("caption = :prev"), map[string]*dynamodb.AttributeValue{
+		":prev": {
+			S: aws.String(caption),
+		},
+	}
+}
+
+func GetPhoto(api dynamodbiface.DynamoDBAPI, username, timestamp string) (*Photo, error) {
+	resp, err := api.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(TABLE),
+		Key:            photoKey(username, timestamp),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, fmt.Errorf("photo %s#%s not found", username, timestamp)
+	}
+	photo := &Photo{
+		Username:  aws.StringValue(resp.Item["username"].S),
+		Timestamp: aws.StringValue(resp.Item["timestamp"].S),
+		Location:  aws.StringValue(resp.Item["location"].S),
+	}
+	if val, ok := resp.Item["caption"]; ok {
+		photo.Caption = aws.StringValue(val.S)
+	}
+	return photo, nil
+}
+
+func PostPhoto(api dynamodbiface.DynamoDBAPI, photo *Photo) error {
+	tags := ExtractHashtags(photo.Caption)
+	if len(tags) > MAX_HASHTAGS {
+		return ErrTooManyHashtags
+	}
+
+	item := photoKey(photo.Username, photo.Timestamp)
+	item["username"] = &dynamodb.AttributeValue{S: aws.String(photo.Username)}
+	item["timestamp"] = &dynamodb.AttributeValue{S: aws.String(photo.Timestamp)}
+	item["location"] = &dynamodb.AttributeValue{S: aws.String(photo.Location)}
+	item["reactions"] = &dynamodb.AttributeValue{
+		M: map[string]*dynamodb.AttributeValue{
+			"+1":         {N: aws.String("0")},
+			"smiley":     {N: aws.String("0")},
+			"sunglasses": {N: aws.String("0")},
+			"heart":      {N: aws.String("0")},
+		},
+	}
+	if photo.Caption != "" {
+		item["caption"] = &dynamodb.AttributeValue{S: aws.String(photo.Caption)}
+	}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(TABLE),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+	}
+	for _, tag := range tags {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item:      NewTagItem(tag, photo),
+			},
+		})
+	}
+	_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+// キャプションの更新と TAG# アイテムの追加・削除を 1 つのトランザクションで行う
+// 読み込み後にキャプションが変わっていれば条件チェックで失敗する
+func EditCaption(api dynamodbiface.DynamoDBAPI, username, timestamp, caption string) error {
+	photo, err := GetPhoto(api, username, timestamp)
+	if err != nil {
+		return err
+	}
+	prevTags := ExtractHashtags(photo.Caption)
+	nextTags := ExtractHashtags(caption)
+	if len(nextTags) > MAX_HASHTAGS {
+		return ErrTooManyHashtags
+	}
+
+	condition, values := captionCondition(photo.Caption)
+	update := &dynamodb.Update{
+		TableName:                 aws.String(TABLE),
+		Key:                       photoKey(username, timestamp),
+		ConditionExpression:       condition,
+		ExpressionAttributeValues: values,
+	}
+	if caption == "" {
+		update.UpdateExpression = aws.String("REMOVE caption")
+	} else {
+		update.UpdateExpression = aws.String("SET caption = :c")
+		values[":c"] = &dynamodb.AttributeValue{S: aws.String(caption)}
+	}
+	if len(values) == 0 {
+		update.ExpressionAttributeValues = nil
+	}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Update: update,
+		},
+	}
+	next := make(map[string]bool)
+	photo.Caption = caption
+	for _, tag := range nextTags {
+		next[tag] = true
+		// 残るタグもキャプションを複製しているので上書きする
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item:      NewTagItem(tag, photo),
+			},
+		})
+	}
+	for _, tag := range prevTags {
+		if next[tag] {
+			continue
+		}
+		items = append(items, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(TABLE),
+				Key:       tagKey(tag, username, timestamp),
+			},
+		})
+	}
+
+	_, err = api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+func DeletePhoto(api dynamodbiface.DynamoDBAPI, username, timestamp string) error {
+	photo, err := GetPhoto(api, username, timestamp)
+	if err != nil {
+		return err
+	}
+
+	condition, values := captionCondition(photo.Caption)
+	del := &dynamodb.Delete{
+		TableName:           aws.String(TABLE),
+		Key:                 photoKey(username, timestamp),
+		ConditionExpression: condition,
+	}
+	if len(values) > 0 {
+		del.ExpressionAttributeValues = values
+	}
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Delete: del,
+		},
+	}
+	for _, tag := range ExtractHashtags(photo.Caption) {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(TABLE),
+				Key:       tagKey(tag, username, timestamp),
+			},
+		})
+	}
+	_, err = api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+// cursor には前のページの最後のソートキーを渡す。空文字列なら先頭から取得する
+// limit が 0 以下ならすべての写真を返す (1 MB を超えた分は次のページになる)
+func ListPhotosByTag(api dynamodbiface.DynamoDBAPI, tag string, limit int64, cursor string) ([]Photo, string, error) {
+	args := map[string]string{"tag": strings.ToLower(tag)}
+	input, err := quickphotos.PatternPhotosByTag.QueryInput(TABLE, args)
+	if err != nil {
+		return nil, "", err
+	}
+	pk, _, err := quickphotos.PatternPhotosByTag.Bind(args)
+	if err != nil {
+		return nil, "", err
+	}
+	// Limit に 0 を渡すと ValidationException になるので、0 以下なら指定しない
+	if limit > 0 {
+		input.Limit = aws.Int64(limit)
+	}
+	if cursor != "" {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(pk),
+			},
+			"SK": {
+				S: aws.String(cursor),
+			},
+		}
+	}
+
+	resp, err := api.Query(input)
+	if err != nil {
+		return nil, "", err
+	}
+	photos := make([]Photo, 0)
+	for _, item := range resp.Items {
+		photos = append(photos, Photo{
+			Username:  aws.StringValue(item["username"].S),
+			Timestamp: aws.StringValue(item["timestamp"].S),
+			Location:  aws.StringValue(item["location"].S),
+			Caption:   aws.StringValue(item["caption"].S),
+		})
+	}
+	next := ""
+	if val, ok := resp.LastEvaluatedKey["SK"]; ok {
+		next = aws.StringValue(val.S)
+	}
+	return photos, next, nil
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	c := db.Client()
+	err := EditCaption(c, USER, PHOTO_TIMESTAMP, "Evening at the beach #Sunset #beach")
+	if err != nil {
+		fmt.Print("Could not edit caption. Err:")
+		panic(err)
+	}
+
+	cursor := ""
+	for {
+		photos, next, err := ListPhotosByTag(c, TAG, PAGE_SIZE, cursor)
+		if err != nil {
+			panic(err)
+		}
+		for _, p := range photos {
+			fmt.Println(&p)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	// "github.com/guregu/dynamo" を使った場合は map ではなく、struct として取得できる
+	quickPhotos := make([]QuickPhoto, 0)
+	q, err := dynamostore.PatternQuery(t, quickphotos.PatternPhotosByTag, map[string]string{"tag": TAG})
+	if err != nil {
+		panic(err)
+	}
+	_, err = q.Limit(PAGE_SIZE).AllWithLastEvaluatedKey(&quickPhotos)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(quickPhotos)
+}
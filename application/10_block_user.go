@@ -0,0 +1,244 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+const (
+	TABLE         = "quick-photos"
+	BLOCKING_USER = "tmartinez"
+	BLOCKED_USER  = "john42"
+)
+
+type QuickPhoto struct {
+	PK            string   `dynamo:"PK,hash" json:"PK"`
+	SK            string   `dynamo:",range" json:"SK"`
+	Address       string   `dynamo:"address" json:"address"`
+	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
+	Email         string   `dynamo:"email" json:"email"`
+	Name          string   `dynamo:"name" json:"name"`
+	Username      string   `dynamo:"username" json:"username"`
+	Status        string   `dynamo:"status" json:"status"`
+	Interests     []string `dynamo:"interests" json:"interests"`
+	Followers     int      `dynamo:"followers" json:"followers"`
+	Following     int      `dynamo:"following" json:"following"`
+	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
+	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
+	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
+	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
+	BlockingUser  string   `dynamo:"blockingUser" json:"blockingUser"`
+	BlockedUser   string   `dynamo:"blockedUser" json:"blockedUser"`
+	Location      string   `dynamo:"location" json:"location"`
+	Reactions     struct {
+		PlusOne    int `dynamo:"+1" json:"+1"`
+		Smiley     int `dynamo:"smiley" json:"smiley"`
+		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
+		Heart      int `dynamo:"heart" json:"heart"`
+	} `dynamo:"reactions" json:"reactions"`
+	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
+	Photo        string `dynamo:"photo" json:"photo"`
+	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+}
+
+func userKey(pk, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(pk),
+		},
+		"SK": {
+			S: aws.String(sk),
+		},
+	}
+}
+
+// followedUser を followingUser がフォローしているかどうか
+func isFollowing(api dynamodbiface.DynamoDBAPI, followedUser, followingUser string) (bool, error) {
+	resp, err := api.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(TABLE),
+		Key: userKey(
+			fmt.Sprintf("USER#%s", followedUser),
+			fmt.Sprintf("#FRIEND#%s", followingUser),
+		),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	return resp.Item != nil, nil
+}
+
+// フォロー関係を削除するか、存在しないことを確認する TransactWriteItem を返す
+// 読み込み後にフォロー関係が変わっていればトランザクションが失敗するので、カウンターがずれることはない
+func friendshipWriteItem(followedUser, followingUser string, exists bool) *dynamodb.TransactWriteItem {
+	key := userKey(
+		fmt.Sprintf("USER#%s", followedUser),
+		fmt.Sprintf("#FRIEND#%s", followingUser),
+	)
+	if exists {
+		return &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName:           aws.String(TABLE),
+				Key:                 key,
+				ConditionExpression: aws.String("attribute_exists(SK)"),
+			},
+		}
+	}
+	return &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			TableName:           aws.String(TABLE),
+			Key:                 key,
+			ConditionExpression: aws.String("attribute_not_exists(SK)"),
+		},
+	}
+}
+
+func counterUpdate(username string, followers, following int) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName: aws.String(TABLE),
+			Key: userKey(
+				fmt.Sprintf("USER#%s", username),
+				fmt.Sprintf("#METADATA#%s", username),
+			),
+			UpdateExpression: aws.String(
+				"SET followers = followers - :followers, following = following - :following",
+			),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":followers": {
+					N: aws.String(fmt.Sprint(followers)),
+				},
+				":following": {
+					N: aws.String(fmt.Sprint(following)),
+				},
+			},
+			ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+		},
+	}
+}
+
+// ブロックすると、双方向のフォロー関係を削除してカウンターを合わせる
+func Block(api dynamodbiface.DynamoDBAPI, blockingUser, blockedUser string) error {
+	if blockingUser == blockedUser {
+		return fmt.Errorf("user %s cannot block themselves", blockingUser)
+	}
+	blockedFollows, err := isFollowing(api, blockingUser, blockedUser)
+	if err != nil {
+		return err
+	}
+	blockingFollows, err := isFollowing(api, blockedUser, blockingUser)
+	if err != nil {
+		return err
+	}
+
+	now := quickphotos.NewTimestamp(time.Now()).String()
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("USER#%s", blockingUser)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", blockedUser)),
+					},
+					"blockingUser": {
+						S: aws.String(blockingUser),
+					},
+					"blockedUser": {
+						S: aws.String(blockedUser),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+				},
+				ConditionExpression:                 aws.String("attribute_not_exists(SK)"),
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+		friendshipWriteItem(blockingUser, blockedUser, blockedFollows),
+		friendshipWriteItem(blockedUser, blockingUser, blockingFollows),
+	}
+
+	blockingFollowers, blockingFollowing := 0, 0
+	blockedFollowers, blockedFollowing := 0, 0
+	if blockedFollows {
+		blockingFollowers++
+		blockedFollowing++
+	}
+	if blockingFollows {
+		blockedFollowers++
+		blockingFollowing++
+	}
+	if blockedFollows || blockingFollows {
+		items = append(
+			items,
+			counterUpdate(blockingUser, blockingFollowers, blockingFollowing),
+			counterUpdate(blockedUser, blockedFollowers, blockedFollowing),
+		)
+	}
+
+	_, err = api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+func Unblock(api dynamodbiface.DynamoDBAPI, blockingUser, blockedUser string) error {
+	_, err := api.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(TABLE),
+		Key: userKey(
+			fmt.Sprintf("USER#%s", blockingUser),
+			fmt.Sprintf("#BLOCK#%s", blockedUser),
+		),
+		ConditionExpression: aws.String("attribute_exists(SK)"),
+	})
+	return err
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	c := db.Client()
+	if err := Block(c, BLOCKING_USER, BLOCKED_USER); err != nil {
+		fmt.Print("Could not block user. Err:")
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("User %s blocked user %s", BLOCKING_USER, BLOCKED_USER))
+
+	// "github.com/guregu/dynamo" を使った場合は map ではなく、struct として取得できる
+	quickPhotos := make([]QuickPhoto, 0)
+	q, err := dynamostore.PatternQuery(t, quickphotos.PatternBlocks, map[string]string{"username": BLOCKING_USER})
+	if err != nil {
+		panic(err)
+	}
+	q.All(&quickPhotos)
+	fmt.Println(quickPhotos)
+
+	err = t.Delete("PK", fmt.Sprintf("USER#%s", BLOCKING_USER)).
+		Range("SK", fmt.Sprintf("#BLOCK#%s", BLOCKED_USER)).
+		If("attribute_exists(SK)").
+		Run()
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,410 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+const (
+	TABLE          = "quick-photos"
+	FOLLOWED_USER  = "tmartinez"
+	FOLLOWING_USER = "john42"
+	// 承認されないフォローリクエストは TTL で消える
+	FOLLOW_REQUEST_TTL = 14 * 24 * time.Hour
+	NOTIFICATION_TTL   = 30 * 24 * time.Hour
+)
+
+type FollowRequest struct {
+	FollowedUser  string
+	FollowingUser string
+	Timestamp     string
+	ExpiresAt     int64
+}
+
+func (r FollowRequest) String() string {
+	return fmt.Sprintf("FollowRequest<%s -- %s>", r.FollowedUser, r.FollowingUser)
+}
+
+type QuickPhoto struct {
+	PK            string   `dynamo:"PK,hash" json:"PK"`
+	SK            string   `dynamo:",range" json:"SK"`
+	Address       string   `dynamo:"address" json:"address"`
+	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
+	Email         string   `dynamo:"email" json:"email"`
+	Name          string   `dynamo:"name" json:"name"`
+	Username      string   `dynamo:"username" json:"username"`
+	Status        string   `dynamo:"status" json:"status"`
+	Interests     []string `dynamo:"interests" json:"interests"`
+	Followers     int      `dynamo:"followers" json:"followers"`
+	Following     int      `dynamo:"following" json:"following"`
+	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
+	Private       bool     `dynamo:"private" json:"private"`
+	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
+	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
+	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
+	ExpiresAt     int64    `dynamo:"expiresAt" json:"expiresAt"`
+	Location      string   `dynamo:"location" json:"location"`
+	Reactions     struct {
+		PlusOne    int `dynamo:"+1" json:"+1"`
+		Smiley     int `dynamo:"smiley" json:"smiley"`
+		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
+		Heart      int `dynamo:"heart" json:"heart"`
+	} `dynamo:"reactions" json:"reactions"`
+	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
+	Photo        string `dynamo:"photo" json:"photo"`
+	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+}
+
+func itemKey(pk, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(pk),
+		},
+		"SK": {
+			S: aws.String(sk),
+		},
+	}
+}
+
+func followRequestKey(followedUser, followingUser string) map[string]*dynamodb.AttributeValue {
+	return itemKey(
+		fmt.Sprintf("USER#%s", followedUser),
+		fmt.Sprintf("#FOLLOWREQUEST#%s", followingUser),
+	)
+}
+
+// 06_follow_user.go と同じ、フォロー関係の追加とカウンター更新、通知のトランザクション
+func NewFollowTransactItems(followedUser, followingUser string) []*dynamodb.TransactWriteItem {
+	userStr := fmt.Sprintf("USER#%s", followedUser)
+	friendUserStr := fmt.Sprintf("USER#%s", followingUser)
+	now := quickphotos.NewTimestamp(time.Now()).String()
+
+	return []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(userStr),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#FRIEND#%s", followingUser)),
+					},
+					"followedUser": {
+						S: aws.String(followedUser),
+					},
+					"followingUser": {
+						S: aws.String(followingUser),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+				},
+				ConditionExpression:                 aws.String("attribute_not_exists(SK)"),
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				TableName:        aws.String(TABLE),
+				Key:              itemKey(userStr, fmt.Sprintf("#METADATA#%s", followedUser)),
+				UpdateExpression: aws.String("SET followers = followers + :i"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":i": {
+						N: aws.String("1"),
+					},
+				},
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				TableName:        aws.String(TABLE),
+				Key:              itemKey(friendUserStr, fmt.Sprintf("#METADATA#%s", followingUser)),
+				UpdateExpression: aws.String("SET following = following + :i"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":i": {
+						N: aws.String("1"),
+					},
+				},
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(TABLE),
+				Key:                 itemKey(userStr, fmt.Sprintf("#BLOCK#%s", followingUser)),
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(TABLE),
+				Key:                 itemKey(friendUserStr, fmt.Sprintf("#BLOCK#%s", followedUser)),
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("INBOX#%s", followedUser)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("NOTIFICATION#%s#%s", now, fmt.Sprintf("#FRIEND#%s", followingUser))),
+					},
+					"type": {
+						S: aws.String("follow"),
+					},
+					"actor": {
+						S: aws.String(followingUser),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+					"expiresAt": {
+						N: aws.String(strconv.FormatInt(time.Now().Add(NOTIFICATION_TTL).Unix(), 10)),
+					},
+				},
+			},
+		},
+	}
+}
+
+func SetPrivate(api dynamodbiface.DynamoDBAPI, username string, private bool) error {
+	_, err := api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(TABLE),
+		Key: itemKey(
+			fmt.Sprintf("USER#%s", username),
+			fmt.Sprintf("#METADATA#%s", username),
+		),
+		UpdateExpression:    aws.String("SET private = :p"),
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {
+				BOOL: aws.Bool(private),
+			},
+		},
+	})
+	return err
+}
+
+func isPrivate(api dynamodbiface.DynamoDBAPI, username string) (bool, error) {
+	resp, err := api.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(TABLE),
+		Key: itemKey(
+			fmt.Sprintf("USER#%s", username),
+			fmt.Sprintf("#METADATA#%s", username),
+		),
+		ProjectionExpression: aws.String("private"),
+		ConsistentRead:       aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	if resp.Item == nil {
+		return false, fmt.Errorf("user %s not found", username)
+	}
+	if val, ok := resp.Item["private"]; ok {
+		return aws.BoolValue(val.BOOL), nil
+	}
+	return false, nil
+}
+
+// 公開アカウントならそのままフォローし、非公開アカウントならフォローリクエストを作る
+// 戻り値はフォローリクエストを作ったかどうか
+func FollowUser(api dynamodbiface.DynamoDBAPI, followedUser, followingUser string) (bool, error) {
+	private, err := isPrivate(api, followedUser)
+	if err != nil {
+		return false, err
+	}
+
+	metadataKey := itemKey(
+		fmt.Sprintf("USER#%s", followedUser),
+		fmt.Sprintf("#METADATA#%s", followedUser),
+	)
+	if !private {
+		items := NewFollowTransactItems(followedUser, followingUser)
+		// 読み込み後に非公開へ切り替えられていれば失敗させる
+		items[1].Update.ConditionExpression = aws.String("attribute_not_exists(private) OR private = :false")
+		items[1].Update.ExpressionAttributeValues[":false"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+		_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: items,
+		})
+		return false, err
+	}
+
+	now := time.Now()
+	item := followRequestKey(followedUser, followingUser)
+	item["followedUser"] = &dynamodb.AttributeValue{S: aws.String(followedUser)}
+	item["followingUser"] = &dynamodb.AttributeValue{S: aws.String(followingUser)}
+	item["timestamp"] = &dynamodb.AttributeValue{S: aws.String(quickphotos.NewTimestamp(now).String())}
+	item["expiresAt"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(FOLLOW_REQUEST_TTL).Unix(), 10))}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item:      item,
+				// TTL で削除される前の期限切れリクエストは上書きしてよい
+				ConditionExpression: aws.String("attribute_not_exists(SK) OR expiresAt < :now"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":now": {
+						N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+					},
+				},
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(TABLE),
+				Key:                 metadataKey,
+				ConditionExpression: aws.String("private = :true"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":true": {
+						BOOL: aws.Bool(true),
+					},
+				},
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: itemKey(
+					fmt.Sprintf("USER#%s", followedUser),
+					fmt.Sprintf("#FRIEND#%s", followingUser),
+				),
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+	}
+	// ブロックの確認はフォローと同じものを使う
+	items = append(items, NewFollowTransactItems(followedUser, followingUser)[3:5]...)
+
+	_, err = api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return true, err
+}
+
+func ListFollowRequests(api dynamodbiface.DynamoDBAPI, username string) ([]FollowRequest, error) {
+	requests := make([]FollowRequest, 0)
+	input, err := quickphotos.PatternFollowRequests.QueryInput(TABLE, map[string]string{"username": username})
+	if err != nil {
+		return nil, err
+	}
+	// TTL による削除は即時ではないので、期限切れのものは除く
+	input.FilterExpression = aws.String("expiresAt > :now")
+	input.ExpressionAttributeValues[":now"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+	}
+	err = api.QueryPages(input, func(out *dynamodb.QueryOutput, _ bool) bool {
+		for _, item := range out.Items {
+			expiresAt, _ := strconv.ParseInt(aws.StringValue(item["expiresAt"].N), 10, 64)
+			requests = append(requests, FollowRequest{
+				FollowedUser:  aws.StringValue(item["followedUser"].S),
+				FollowingUser: aws.StringValue(item["followingUser"].S),
+				Timestamp:     aws.StringValue(item["timestamp"].S),
+				ExpiresAt:     expiresAt,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// 承認はリクエストの削除とフォローのトランザクションを 1 つにまとめて実行する
+func ApproveFollowRequest(api dynamodbiface.DynamoDBAPI, followedUser, followingUser string) error {
+	items := NewFollowTransactItems(followedUser, followingUser)
+	items = append(items, &dynamodb.TransactWriteItem{
+		Delete: &dynamodb.Delete{
+			TableName:           aws.String(TABLE),
+			Key:                 followRequestKey(followedUser, followingUser),
+			ConditionExpression: aws.String("attribute_exists(SK) AND expiresAt > :now"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now": {
+					N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+				},
+			},
+		},
+	})
+	_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+func DenyFollowRequest(api dynamodbiface.DynamoDBAPI, followedUser, followingUser string) error {
+	_, err := api.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(TABLE),
+		Key:                 followRequestKey(followedUser, followingUser),
+		ConditionExpression: aws.String("attribute_exists(SK)"),
+	})
+	return err
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	c := db.Client()
+	if err := SetPrivate(c, FOLLOWED_USER, true); err != nil {
+		panic(err)
+	}
+	requested, err := FollowUser(c, FOLLOWED_USER, FOLLOWING_USER)
+	if err != nil {
+		fmt.Print("Could not follow user. Err:")
+		panic(err)
+	}
+	if !requested {
+		fmt.Println(fmt.Sprintf("User %s is now following user %s", FOLLOWING_USER, FOLLOWED_USER))
+		return
+	}
+
+	requests, err := ListFollowRequests(c, FOLLOWED_USER)
+	if err != nil {
+		panic(err)
+	}
+	for _, r := range requests {
+		fmt.Println(r)
+	}
+	if err := ApproveFollowRequest(c, FOLLOWED_USER, FOLLOWING_USER); err != nil {
+		fmt.Print("Could not approve follow request. Err:")
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("User %s is now following user %s", FOLLOWING_USER, FOLLOWED_USER))
+
+	// "github.com/guregu/dynamo" を使った場合は map ではなく、struct として取得できる
+	// 自分が送ったリクエストは InvertedIndex から引ける
+	quickPhotos := make([]QuickPhoto, 0)
+	q, err := dynamostore.PatternQuery(t, quickphotos.PatternSentFollowRequests, map[string]string{"username": FOLLOWING_USER})
+	if err != nil {
+		panic(err)
+	}
+	q.Filter("expiresAt > ?", time.Now().Unix()).
+		All(&quickPhotos)
+	fmt.Println(quickPhotos)
+}
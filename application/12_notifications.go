@@ -0,0 +1,234 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+const (
+	TABLE     = "quick-photos"
+	USER      = "tmartinez"
+	PAGE_SIZE = 20
+)
+
+type Notification struct {
+	ID           string
+	Type         string
+	Actor        string
+	Photo        string
+	ReactionType string
+	Timestamp    string
+	Read         bool
+}
+
+func (n Notification) String() string {
+	return fmt.Sprintf("Notification<%s -- %s -- %s>", n.Type, n.Actor, n.Timestamp)
+}
+
+type QuickPhoto struct {
+	PK           string `dynamo:"PK,hash" json:"PK"`
+	SK           string `dynamo:",range" json:"SK"`
+	Type         string `dynamo:"type" json:"type"`
+	Actor        string `dynamo:"actor" json:"actor"`
+	Photo        string `dynamo:"photo" json:"photo"`
+	ReactionType string `dynamo:"reactionType" json:"reactionType"`
+	Timestamp    string `dynamo:"timestamp" json:"timestamp"`
+	ExpiresAt    int64  `dynamo:"expiresAt" json:"expiresAt"`
+	ReadUntil    string `dynamo:"readUntil" json:"readUntil"`
+}
+
+// 通知は INBOX#<user> のパーティションに NOTIFICATION#<timestamp>#... のソートキーで並ぶ
+// 既読位置は同じパーティションの #READ アイテムに 1 つだけ持つので、既読化はアイテム数によらず 1 回の書き込みで済む
+func inboxKey(username string) string {
+	return fmt.Sprintf("INBOX#%s", username)
+}
+
+func readCursorKey(username string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(inboxKey(username)),
+		},
+		"SK": {
+			S: aws.String("#READ"),
+		},
+	}
+}
+
+func getReadUntil(api dynamodbiface.DynamoDBAPI, username string) (string, error) {
+	resp, err := api.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(TABLE),
+		Key:            readCursorKey(username),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	if val, ok := resp.Item["readUntil"]; ok {
+		return aws.StringValue(val.S), nil
+	}
+	return "", nil
+}
+
+// cursor には前のページの最後の ID を渡す。空文字列なら最新から取得する
+func ListNotifications(api dynamodbiface.DynamoDBAPI, username string, limit int64, cursor string) ([]Notification, string, error) {
+	readUntil, err := getReadUntil(api, username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	input, err := quickphotos.PatternNotifications.QueryInput(TABLE, map[string]string{"username": username})
+	if err != nil {
+		return nil, "", err
+	}
+	// TTL による削除は即時ではないので、期限切れのものは除く
+	input.FilterExpression = aws.String("expiresAt > :now")
+	input.ExpressionAttributeValues[":now"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+	}
+	input.Limit = aws.Int64(limit)
+	if cursor != "" {
+		input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(inboxKey(username)),
+			},
+			"SK": {
+				S: aws.String(cursor),
+			},
+		}
+	}
+
+	resp, err := api.Query(input)
+	if err != nil {
+		return nil, "", err
+	}
+	notifications := make([]Notification, 0)
+	for _, item := range resp.Items {
+		id := aws.StringValue(item["SK"].S)
+		n := Notification{
+			ID:        id,
+			Type:      aws.StringValue(item["type"].S),
+			Actor:     aws.StringValue(item["actor"].S),
+			Timestamp: aws.StringValue(item["timestamp"].S),
+			Read:      id <= readUntil,
+		}
+		if val, ok := item["photo"]; ok {
+			n.Photo = aws.StringValue(val.S)
+		}
+		if val, ok := item["reactionType"]; ok {
+			n.ReactionType = aws.StringValue(val.S)
+		}
+		notifications = append(notifications, n)
+	}
+	next := ""
+	if val, ok := resp.LastEvaluatedKey["SK"]; ok {
+		next = aws.StringValue(val.S)
+	}
+	return notifications, next, nil
+}
+
+func CountUnread(api dynamodbiface.DynamoDBAPI, username string) (int64, error) {
+	readUntil, err := getReadUntil(api, username)
+	if err != nil {
+		return 0, err
+	}
+	// #READ は NOTIFICATION# より前に並ぶので、既読位置より後ろはすべて通知アイテム
+	after := "NOTIFICATION#"
+	if readUntil > after {
+		after = readUntil
+	}
+
+	var count int64
+	input, err := quickphotos.PatternUnreadNotifications.QueryInput(TABLE, map[string]string{"username": username, "after": after})
+	if err != nil {
+		return 0, err
+	}
+	input.FilterExpression = aws.String("expiresAt > :now")
+	input.ExpressionAttributeValues[":now"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+	}
+	input.Select = aws.String(dynamodb.SelectCount)
+	err = api.QueryPages(input, func(out *dynamodb.QueryOutput, _ bool) bool {
+		count += aws.Int64Value(out.Count)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// 既読位置は前にしか進めない
+// すでに cursor 以降まで読んでいれば条件を満たさないが、既読にすること自体はできているので成功として扱う
+func MarkRead(api dynamodbiface.DynamoDBAPI, username, cursor string) error {
+	_, err := api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(TABLE),
+		Key:                 readCursorKey(username),
+		UpdateExpression:    aws.String("SET readUntil = :c"),
+		ConditionExpression: aws.String("attribute_not_exists(readUntil) OR readUntil < :c"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":c": {
+				S: aws.String(cursor),
+			},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+	return err
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	c := db.Client()
+	unread, err := CountUnread(c, USER)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("User %s has %d unread notifications", USER, unread))
+
+	notifications, _, err := ListNotifications(c, USER, PAGE_SIZE, "")
+	if err != nil {
+		panic(err)
+	}
+	for _, n := range notifications {
+		fmt.Println(n)
+	}
+	if len(notifications) > 0 {
+		if err := MarkRead(c, USER, notifications[0].ID); err != nil {
+			fmt.Print("Could not mark notifications read. Err:")
+			panic(err)
+		}
+	}
+
+	// "github.com/guregu/dynamo" を使った場合は map ではなく、struct として取得できる
+	quickPhotos := make([]QuickPhoto, 0)
+	q, err := dynamostore.PatternQuery(t, quickphotos.PatternNotifications, map[string]string{"username": USER})
+	if err != nil {
+		panic(err)
+	}
+	q.Filter("expiresAt > ?", time.Now().Unix()).
+		Limit(PAGE_SIZE).
+		All(&quickPhotos)
+	fmt.Println(quickPhotos)
+}
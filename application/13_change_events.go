@@ -0,0 +1,110 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+const (
+	TABLE = "quick-photos"
+	USER  = "haroldwatkins"
+)
+
+// 書き込みのコードには手を入れずに、クライアントを quickphotos.StreamingClient に差し替えて ChangeEvent を受け取る
+// 受け取ったイベントから、ユーザーのメタデータのキャッシュを捨てる副作用を組み立てる
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+
+	stream := quickphotos.NewLocalChangeStream()
+	stream.Subscribe(quickphotos.ENTITY_USER, func(e quickphotos.ChangeEvent) {
+		fmt.Println(e)
+		if e.OldImage != nil && e.NewImage != nil {
+			fmt.Println(fmt.Sprintf(
+				"status: %s -> %s",
+				aws.StringValue(e.OldImage["status"].S),
+				aws.StringValue(e.NewImage["status"].S),
+			))
+		}
+	})
+	stream.Subscribe(quickphotos.ENTITY_FRIENDSHIP, func(e quickphotos.ChangeEvent) {
+		fmt.Println(e)
+	})
+	stream.Subscribe(quickphotos.ENTITY_REACTION, func(e quickphotos.ChangeEvent) {
+		fmt.Println(e)
+	})
+	stream.SubscribeErrors(func(err error) {
+		fmt.Println("change event lost:", err)
+	})
+
+	// Store のキャッシュは、Store を通さない書き込みもイベントで知って捨てる
+	store := quickphotos.New(db.Client(), TABLE)
+	cache := quickphotos.NewMetadataCache(100, time.Minute)
+	store.UseMetadataCache(cache)
+	cache.InvalidateOn(stream)
+	user, err := store.GetUser(USER)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("cached status: %s", user.Status))
+
+	c := quickphotos.NewStreamingClient(db.Client(), stream)
+	_, err = c.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(TABLE),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(fmt.Sprintf("USER#%s", USER)),
+			},
+			"SK": {
+				S: aws.String(fmt.Sprintf("#METADATA#%s", USER)),
+			},
+		},
+		UpdateExpression: aws.String("SET #s = :s"),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {
+				S: aws.String("Resource scientist reduce value according well."),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK)"),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// "github.com/guregu/dynamo" を使った場合も、クライアントを差し替えれば同じようにイベントが流れる
+	// 上と同じ値で上書きするので、アイテムは変わらずイベントは流れない
+	streamed := dynamo.NewFromIface(c)
+	t := streamed.Table(TABLE)
+	err = t.Update("PK", fmt.Sprintf("USER#%s", USER)).
+		Range("SK", fmt.Sprintf("#METADATA#%s", USER)).
+		Set("status", "Resource scientist reduce value according well.").
+		If("attribute_exists(PK)").
+		Run()
+	if err != nil {
+		panic(err)
+	}
+
+	// イベントでキャッシュが捨てられているので、書き込んだ後の値を読む
+	user, err = store.GetUser(USER)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("status after the event: %s", user.Status))
+}
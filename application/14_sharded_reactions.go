@@ -0,0 +1,384 @@
+//go:build ignore
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+const (
+	TABLE           = "quick-photos"
+	REACTING_USER   = "kennedyheather"
+	REACTION_TYPE   = "sunglasses"
+	PHOTO_USER      = "ppierce"
+	PHOTO_TIMESTAMP = "2019-04-14T08:09:34Z"
+	REACTION_SHARDS = 10
+	// シャードの作成は写真の更新と 1 つのトランザクションで行うので、TransactWriteItems の上限から 1 つ引いた数まで
+	MAX_REACTION_SHARDS = 99
+	// 通知は TTL で消える
+	NOTIFICATION_TTL = 30 * 24 * time.Hour
+)
+
+var (
+	reactionTypes = []string{"+1", "smiley", "sunglasses", "heart"}
+
+	ErrInvalidShardCount = errors.New("invalid reaction shard count")
+)
+
+type QuickPhoto struct {
+	PK             string         `dynamo:"PK,hash" json:"PK"`
+	SK             string         `dynamo:",range" json:"SK"`
+	Photo          string         `dynamo:"photo" json:"photo"`
+	Shard          int            `dynamo:"shard" json:"shard"`
+	ReactionShards int            `dynamo:"reactionShards" json:"reactionShards"`
+	Reactions      map[string]int `dynamo:"reactions" json:"reactions"`
+}
+
+func photoSK(username, timestamp string) string {
+	return fmt.Sprintf("PHOTO#%s#%s", username, timestamp)
+}
+
+func photoKey(username, timestamp string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("USER#%s", username)),
+		},
+		"SK": {
+			S: aws.String(photoSK(username, timestamp)),
+		},
+	}
+}
+
+// シャードは写真ごと・番号ごとに別のパーティションに置き、ソートキーは写真と同じにする
+// InvertedIndex で写真のソートキーを引けば、写真・リアクション・シャードがまとめて取れる
+// そのためリアクションだけが欲しい読み出し (02 など) は、PK が "REACTION#" で始まるものに絞る
+func reactionShardKey(username, timestamp string, shard int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(fmt.Sprintf("REACTIONSHARD#%s#%s#%d", username, timestamp, shard)),
+		},
+		"SK": {
+			S: aws.String(photoSK(username, timestamp)),
+		},
+	}
+}
+
+func zeroReactions() *dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue)
+	for _, t := range reactionTypes {
+		m[t] = &dynamodb.AttributeValue{N: aws.String("0")}
+	}
+	return &dynamodb.AttributeValue{M: m}
+}
+
+// 写真をシャード付きカウンターに切り替える
+// シャードはあらかじめ 0 で作っておくので、リアクション時は既存の写真と同じ "reactions.#t + :i" で加算できる
+func EnableShardedReactions(api dynamodbiface.DynamoDBAPI, username, timestamp string, shards int) error {
+	if shards < 1 || shards > MAX_REACTION_SHARDS {
+		return ErrInvalidShardCount
+	}
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Update: &dynamodb.Update{
+				TableName:           aws.String(TABLE),
+				Key:                 photoKey(username, timestamp),
+				UpdateExpression:    aws.String("SET reactionShards = :n"),
+				ConditionExpression: aws.String("attribute_exists(SK) AND attribute_not_exists(reactionShards)"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":n": {
+						N: aws.String(strconv.Itoa(shards)),
+					},
+				},
+			},
+		},
+	}
+	for i := 0; i < shards; i++ {
+		item := reactionShardKey(username, timestamp, i)
+		item["photo"] = &dynamodb.AttributeValue{S: aws.String(photoSK(username, timestamp))}
+		item["shard"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(i))}
+		item["reactions"] = zeroReactions()
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(TABLE),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		})
+	}
+	_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+// 05_add_reaction.go と同じトランザクションで、写真ではなくランダムに選んだシャードを加算する
+// 写真の reactionShards が shards と一致することを条件にするので、モードの食い違いで数え漏れることはない
+func AddShardedReaction(api dynamodbiface.DynamoDBAPI, reactingUser, reactionType, photoUser, timestamp string, shards int) error {
+	if shards < 1 || shards > MAX_REACTION_SHARDS {
+		return ErrInvalidShardCount
+	}
+	reactionStr := fmt.Sprintf("REACTION#%s#%s", reactingUser, reactionType)
+	photoStr := photoSK(photoUser, timestamp)
+	userStr := fmt.Sprintf("USER#%s", photoUser)
+	now := quickphotos.NewTimestamp(time.Now()).String()
+	expiresAt := time.Now().Add(NOTIFICATION_TTL).Unix()
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(reactionStr),
+					},
+					"SK": {
+						S: aws.String(photoStr),
+					},
+					"reactingUser": {
+						S: aws.String(reactingUser),
+					},
+					"reactionType": {
+						S: aws.String(reactionType),
+					},
+					"photo": {
+						S: aws.String(photoStr),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+				},
+				ConditionExpression:                 aws.String("attribute_not_exists(SK)"),
+				ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValueAllOld),
+			},
+		},
+		{
+			Update: &dynamodb.Update{
+				TableName: aws.String(TABLE),
+				Key:       reactionShardKey(photoUser, timestamp, rand.Intn(shards)),
+				UpdateExpression: aws.String(
+					"SET reactions.#t = reactions.#t + :i",
+				),
+				ConditionExpression: aws.String("attribute_exists(SK)"),
+				ExpressionAttributeNames: map[string]*string{
+					"#t": aws.String(reactionType),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":i": {
+						N: aws.String("1"),
+					},
+				},
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(TABLE),
+				Key:                 photoKey(photoUser, timestamp),
+				ConditionExpression: aws.String("reactionShards = :n"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":n": {
+						N: aws.String(strconv.Itoa(shards)),
+					},
+				},
+			},
+		},
+		// 写真の投稿者の受信箱に通知を書き込む
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(TABLE),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("INBOX#%s", photoUser)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("NOTIFICATION#%s#%s#%s", now, reactionStr, photoStr)),
+					},
+					"type": {
+						S: aws.String("reaction"),
+					},
+					"actor": {
+						S: aws.String(reactingUser),
+					},
+					"photo": {
+						S: aws.String(photoStr),
+					},
+					"reactionType": {
+						S: aws.String(reactionType),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+					"expiresAt": {
+						N: aws.String(fmt.Sprint(expiresAt)),
+					},
+				},
+			},
+		},
+		// どちらかがブロックしていればリアクションできない
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(userStr),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", reactingUser)),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName: aws.String(TABLE),
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(fmt.Sprintf("USER#%s", reactingUser)),
+					},
+					"SK": {
+						S: aws.String(fmt.Sprintf("#BLOCK#%s", photoUser)),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+	}
+	_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return err
+}
+
+func addReactionCounts(counts map[string]int, av *dynamodb.AttributeValue) error {
+	if av == nil {
+		return nil
+	}
+	for t, v := range av.M {
+		n, err := strconv.Atoi(aws.StringValue(v.N))
+		if err != nil {
+			return err
+		}
+		counts[t] += n
+	}
+	return nil
+}
+
+// 写真の reactions にシャードの合計を足したものが、リアクション数になる
+// 圧縮ジョブが写真とシャードの間で値を移している最中でも、トランザクションで移すので合計は変わらない
+func GetReactionCounts(api dynamodbiface.DynamoDBAPI, username, timestamp string) (map[string]int, error) {
+	resp, err := api.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(TABLE),
+		Key:            photoKey(username, timestamp),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, fmt.Errorf("photo %s#%s not found", username, timestamp)
+	}
+	counts := make(map[string]int)
+	if err := addReactionCounts(counts, resp.Item["reactions"]); err != nil {
+		return nil, err
+	}
+
+	shards := 0
+	if val, ok := resp.Item["reactionShards"]; ok {
+		shards, err = strconv.Atoi(aws.StringValue(val.N))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if shards == 0 {
+		return counts, nil
+	}
+
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, shards)
+	for i := 0; i < shards; i++ {
+		keys = append(keys, reactionShardKey(username, timestamp, i))
+	}
+	// BatchGetItem は 1 回 100 キーまでで、MAX_REACTION_SHARDS はそれ以下
+	input := &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			TABLE: {
+				Keys:                 keys,
+				ConsistentRead:       aws.Bool(true),
+				ProjectionExpression: aws.String("reactions"),
+			},
+		},
+	}
+	for len(input.RequestItems) > 0 {
+		out, err := api.BatchGetItem(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Responses[TABLE] {
+			if err := addReactionCounts(counts, item["reactions"]); err != nil {
+				return nil, err
+			}
+		}
+		input.RequestItems = out.UnprocessedKeys
+	}
+	return counts, nil
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(TABLE)
+
+	c := db.Client()
+	err := EnableShardedReactions(c, PHOTO_USER, PHOTO_TIMESTAMP, REACTION_SHARDS)
+	if err != nil {
+		// すでにシャード付きになっていれば、そのまま続ける
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeTransactionCanceledException {
+			fmt.Print("Enable sharded reactions failed. Err:")
+			panic(err)
+		}
+	}
+
+	if err := AddShardedReaction(c, REACTING_USER, REACTION_TYPE, PHOTO_USER, PHOTO_TIMESTAMP, REACTION_SHARDS); err != nil {
+		fmt.Print("Exec transaction failed. Err:")
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("Added reaction %s by %s to %s", REACTION_TYPE, REACTING_USER, photoSK(PHOTO_USER, PHOTO_TIMESTAMP)))
+
+	counts, err := GetReactionCounts(c, PHOTO_USER, PHOTO_TIMESTAMP)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(counts)
+
+	// "github.com/guregu/dynamo" を使った場合は、InvertedIndex で写真とシャードをまとめて取得できる
+	quickPhotos := make([]QuickPhoto, 0)
+	t.Get("SK", photoSK(PHOTO_USER, PHOTO_TIMESTAMP)).
+		Index("InvertedIndex").
+		All(&quickPhotos)
+	total := make(map[string]int)
+	for _, qp := range quickPhotos {
+		if strings.HasPrefix(qp.PK, "USER#") || strings.HasPrefix(qp.PK, "REACTIONSHARD#") {
+			for rt, n := range qp.Reactions {
+				total[rt] += n
+			}
+		}
+	}
+	fmt.Println(total)
+}
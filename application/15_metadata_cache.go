@@ -0,0 +1,111 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+const (
+	TABLE      = "quick-photos"
+	USER       = "haroldwatkins"
+	CACHE_SIZE = 1000
+	CACHE_TTL  = 30 * time.Second
+)
+
+// キャッシュの本体は quickphotos.MetadataCache と quickphotos.CachingClient にある
+
+type QuickPhoto struct {
+	PK            string `dynamo:"PK,hash" json:"PK"`
+	SK            string `dynamo:",range" json:"SK"`
+	Username      string `dynamo:"username" json:"username"`
+	Name          string `dynamo:"name" json:"name"`
+	Status        string `dynamo:"status" json:"status"`
+	FollowedUser  string `dynamo:"followedUser" json:"followedUser"`
+	FollowingUser string `dynamo:"followingUser" json:"followingUser"`
+}
+
+// 04_find_and_enrich_following_for_user.go と同じ読み込みを、キャッシュ付きのクライアントで行う
+func enrichFollowing(t dynamo.Table, username string) ([]QuickPhoto, error) {
+	friendships := make([]QuickPhoto, 0)
+	err := t.Get("SK", fmt.Sprintf("#FRIEND#%s", username)).
+		Index("InvertedIndex").
+		All(&friendships)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]QuickPhoto, 0)
+	if len(friendships) == 0 {
+		return users, nil
+	}
+	keys := make([]dynamo.Keyed, 0)
+	for _, f := range friendships {
+		keys = append(keys, dynamo.Keys{fmt.Sprintf("USER#%s", f.FollowedUser), fmt.Sprintf("#METADATA#%s", f.FollowedUser)})
+	}
+	err = t.Batch("PK", "SK").Get(keys...).All(&users)
+	return users, err
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	api := dynamodb.New(sess, &aws.Config{
+		Region: aws.String("ap-northeast-1"),
+	})
+	cache := quickphotos.NewMetadataCache(CACHE_SIZE, CACHE_TTL)
+	db := dynamo.NewFromIface(quickphotos.NewCachingClient(api, cache))
+	t := db.Table(TABLE)
+
+	// 同じユーザーを同時に読み込んでも、DynamoDB への読み込みは 1 回になる
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := enrichFollowing(t, USER); err != nil {
+				panic(err)
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Println(cache.Stats())
+
+	users, err := enrichFollowing(t, USER)
+	if err != nil {
+		panic(err)
+	}
+	if len(users) == 0 {
+		return
+	}
+	fmt.Println(cache.Stats())
+
+	// このクライアントを通して書き込めば、次の読み込みは DynamoDB から最新の値を取り直す
+	followed := users[0]
+	err = t.Update("PK", followed.PK).
+		Range("SK", followed.SK).
+		Set("status", followed.Status).
+		Run()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := enrichFollowing(t, USER); err != nil {
+		panic(err)
+	}
+	fmt.Println(cache.Stats())
+
+	// quickphotos.Store に同じキャッシュを組み込めば、GetUser もキャッシュから返す
+	store := quickphotos.New(api, TABLE)
+	store.UseMetadataCache(cache)
+	if _, err := store.GetUser(followed.Username); err != nil {
+		panic(err)
+	}
+	fmt.Println(cache.Stats())
+}
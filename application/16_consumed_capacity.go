@@ -0,0 +1,72 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+const (
+	TABLE = "quick-photos"
+	USER  = "haroldwatkins"
+)
+
+// 消費キャパシティの計測は quickphotos.CapacityMeter にある
+// quickphotos.WithCapacityMeter を渡した Store は、呼ばれたメソッドごとに集計する
+
+type QuickPhoto struct {
+	PK            string `dynamo:"PK,hash" json:"PK"`
+	SK            string `dynamo:",range" json:"SK"`
+	Username      string `dynamo:"username" json:"username"`
+	FollowedUser  string `dynamo:"followedUser" json:"followedUser"`
+	FollowingUser string `dynamo:"followingUser" json:"followingUser"`
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	api := dynamodb.New(sess, &aws.Config{
+		Region: aws.String("ap-northeast-1"),
+	})
+	meter := quickphotos.NewCapacityMeter()
+
+	// 01_fetch_user_and_photos.go のアクセスパターン
+	// Store の呼び出しは、呼んだメソッドの名前 (ここでは GetUserWithPhotos) で記録される
+	store := quickphotos.New(api, TABLE, quickphotos.WithCapacityMeter(meter))
+	if _, err := store.GetUserWithPhotos(USER); err != nil {
+		panic(err)
+	}
+
+	// 04_find_and_enrich_following_for_user.go のアクセスパターン
+	// "github.com/guregu/dynamo" を使った場合は、名前をつけて計測するクライアントに差し替える
+	t := dynamo.NewFromIface(meter.Pattern(api, "FindAndEnrichFollowing")).Table(TABLE)
+	quickPhotos := make([]QuickPhoto, 0)
+	err := t.Get("SK", fmt.Sprintf("#FRIEND#%s", USER)).
+		Index("InvertedIndex").
+		All(&quickPhotos)
+	if err != nil {
+		panic(err)
+	}
+	if len(quickPhotos) > 0 {
+		dynamoKeys := make([]dynamo.Keyed, 0)
+		for _, qp := range quickPhotos {
+			dynamoKeys = append(dynamoKeys, dynamo.Keys{fmt.Sprintf("USER#%s", qp.FollowedUser), fmt.Sprintf("#METADATA#%s", qp.FollowedUser)})
+		}
+		users := make([]QuickPhoto, 0)
+		if err := t.Batch("PK", "SK").Get(dynamoKeys...).All(&users); err != nil {
+			panic(err)
+		}
+	}
+
+	fmt.Println(meter.Totals("GetUserWithPhotos"))
+	if err := meter.WriteReport(os.Stdout); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,27 @@
+// localdynamo は、DynamoDB の JSON ワイヤープロトコルを話すローカルのサーバーを起動する
+//
+//	localdynamo [-addr :8000]
+//
+// quickphotos の -endpoint や、aws-sdk の Endpoint に http://localhost:8000 を渡すと、
+// コードを変えずに AWS へ接続しないで動かせる。データはメモリーにだけ置く
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/localdynamo"
+)
+
+func main() {
+	addr := flag.String("addr", ":8000", "listen address")
+	flag.Parse()
+
+	errorLog := log.New(os.Stderr, "", log.LstdFlags)
+	server := localdynamo.New()
+	server.ErrorLog = errorLog
+	errorLog.Printf("listening on %s", *addr)
+	errorLog.Fatal(http.ListenAndServe(*addr, server))
+}
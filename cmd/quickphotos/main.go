@@ -0,0 +1,731 @@
+// quickphotos は、チュートリアルのアクセスパターンをサブコマンドとして実行する CLI
+//
+//	quickphotos [-table quick-photos] [-region ap-northeast-1] [-endpoint URL] [-capacity] <command> [flags]
+//
+// 終了コードは 0: 成功、1: 想定外のエラー、2: 引数の誤り、3: 見つからない、4: すでに存在する、5: ブロックされている
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"google.golang.org/grpc"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/graphqlapi"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/grpcapi"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/grpcapi/quickphotospb"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/httpapi"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/itemview"
+)
+
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitNotFound  = 3
+	exitConflict  = 4
+	exitForbidden = 5
+)
+
+const usage = `Usage: quickphotos [global flags] <command> [flags]
+
+Commands:
+  schema apply      create the table, InvertedIndex and TTL if missing
+  load              bulk load a JSONL item file
+  user get          show a user (and photos with -photos)
+  photo get         show a photo with reaction counts
+  following         list users that -user follows
+  followers         list users that follow -user
+  follow            make -from follow -to
+  unfollow          make -from unfollow -to
+  react             add a reaction from -user to a photo
+  serve             serve the JSON API and /graphql (and gRPC with -grpc-addr)
+  patterns          list access patterns and indexes (check the live table with -verify)
+  collections       show items grouped by partition (-index InvertedIndex for the GSI view)
+  migrate up        apply pending migrations (holds the migration lock while running)
+  migrate status    show applied and pending migrations and who holds the lock
+  migrate dry-run   show what pending migrations would change without changing anything
+
+Global flags:
+`
+
+// collections で指定したパーティションにアイテムがないとき
+var errNoItems = errors.New("no items")
+
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+func exitCode(err error) int {
+	var uerr usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &uerr),
+		errors.Is(err, flag.ErrHelp),
+		errors.Is(err, quickphotos.ErrCannotFollowSelf),
+		errors.Is(err, quickphotos.ErrInvalidReactionType),
+		errors.Is(err, quickphotos.ErrInvalidCursor):
+		return exitUsage
+	case errors.Is(err, quickphotos.ErrUserNotFound),
+		errors.Is(err, quickphotos.ErrPhotoNotFound),
+		errors.Is(err, quickphotos.ErrNotFollowing),
+		errors.Is(err, errNoItems):
+		return exitNotFound
+	case errors.Is(err, quickphotos.ErrAlreadyFollowing),
+		errors.Is(err, quickphotos.ErrAlreadyRequested),
+		errors.Is(err, quickphotos.ErrAlreadyReacted),
+		errors.Is(err, quickphotos.ErrConcurrentModification),
+		errors.Is(err, quickphotos.ErrMigrationLocked),
+		errors.Is(err, quickphotos.ErrMigrationLockLost):
+		return exitConflict
+	case errors.Is(err, quickphotos.ErrBlocked):
+		return exitForbidden
+	}
+	return exitError
+}
+
+type command struct {
+	name string
+	run  func(c *cli, args []string) error
+}
+
+var commands = []command{
+	{"schema apply", (*cli).schemaApply},
+	{"load", (*cli).load},
+	{"user get", (*cli).userGet},
+	{"photo get", (*cli).photoGet},
+	{"following", (*cli).following},
+	{"followers", (*cli).followers},
+	{"follow", (*cli).follow},
+	{"unfollow", (*cli).unfollow},
+	{"react", (*cli).react},
+	{"serve", (*cli).serve},
+	{"patterns", (*cli).patterns},
+	{"collections", (*cli).collections},
+	{"migrate up", (*cli).migrateUp},
+	{"migrate status", (*cli).migrateStatus},
+	{"migrate dry-run", (*cli).migrateDryRun},
+}
+
+type cli struct {
+	store *quickphotos.Store
+	// -capacity のときだけ設定する
+	meter  *quickphotos.CapacityMeter
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("quickphotos", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	table := global.String("table", quickphotos.DEFAULT_TABLE, "table name")
+	region := global.String("region", "ap-northeast-1", "AWS region")
+	endpoint := global.String("endpoint", "", "DynamoDB endpoint URL (for DynamoDB Local and similar)")
+	zone := global.String("legacy-zone", quickphotos.DEFAULT_LEGACY_ZONE, "time zone of timestamps written without an offset")
+	capacity := global.Bool("capacity", false, "report consumed capacity per Store method on stderr after the command (serve reports it on /debug/capacity)")
+	global.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		global.PrintDefaults()
+	}
+	if err := global.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	cmd, rest, ok := findCommand(global.Args())
+	if !ok {
+		global.Usage()
+		return exitUsage
+	}
+
+	// 既定のタイムゾーンは tzdata が無くても読めるものを使う
+	legacy := quickphotos.DefaultLegacyLocation()
+	if *zone != quickphotos.DEFAULT_LEGACY_ZONE {
+		loc, err := time.LoadLocation(*zone)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		legacy = loc
+	}
+
+	config := &aws.Config{
+		Region: aws.String(*region),
+	}
+	if *endpoint != "" {
+		config.Endpoint = aws.String(*endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitError
+	}
+	c := &cli{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	opts := []quickphotos.Option{quickphotos.WithLegacyLocation(legacy)}
+	if *capacity {
+		c.meter = quickphotos.NewCapacityMeter()
+		opts = append(opts, quickphotos.WithCapacityMeter(c.meter))
+	}
+	c.store = quickphotos.New(dynamodb.New(sess), *table, opts...)
+	err = cmd.run(c, rest)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(stderr, fmt.Sprintf("quickphotos %s: %s", cmd.name, err))
+	}
+	// 失敗した呼び出しもキャパシティを消費していることがあるので、エラーでも出す
+	if c.meter != nil {
+		if werr := c.meter.WriteReport(stderr); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return exitCode(err)
+}
+
+// "user get" のように 2 語のコマンドがあるので、語ごとに照合する
+func findCommand(args []string) (command, []string, bool) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) {
+			continue
+		}
+		matched := true
+		for i, w := range words {
+			if args[i] != w {
+				matched = false
+			}
+		}
+		if matched {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+func (c *cli) flags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	output := fs.String("output", "table", "output format: table, json or jsonl")
+	return fs, output
+}
+
+func parse(fs *flag.FlagSet, args []string, output *string, required ...string) (format, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", usageError{fmt.Sprintf("unexpected arguments: %s", strings.Join(fs.Args(), " "))}
+	}
+	for _, name := range required {
+		if fs.Lookup(name).Value.String() == "" {
+			return "", usageError{fmt.Sprintf("-%s is required", name)}
+		}
+	}
+	f := format(*output)
+	switch f {
+	case formatTable, formatJSON, formatJSONL:
+		return f, nil
+	}
+	return "", usageError{fmt.Sprintf("unknown output format %q", *output)}
+}
+
+func (c *cli) schemaApply(args []string) error {
+	fs, output := c.flags("schema apply")
+	f, err := parse(fs, args, output)
+	if err != nil {
+		return err
+	}
+	changes, err := c.store.ApplySchema()
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{
+		"table":   c.store.Table(),
+		"changes": changes,
+	}
+	rows := make([][]string, 0, len(changes))
+	for _, change := range changes {
+		rows = append(rows, []string{change})
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{"up to date"})
+	}
+	return write(c.stdout, f, result, []string{"CHANGE"}, rows)
+}
+
+func (c *cli) load(args []string) error {
+	fs, output := c.flags("load")
+	file := fs.String("file", "./scripts/items.json", "JSONL file to load (- for stdin)")
+	f, err := parse(fs, args, output, "file")
+	if err != nil {
+		return err
+	}
+	r := c.stdin
+	if *file != "-" {
+		in, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		r = in
+	}
+	loaded, err := c.store.Load(r)
+	if err != nil {
+		return err
+	}
+	result := map[string]interface{}{
+		"table":  c.store.Table(),
+		"loaded": loaded,
+	}
+	return write(c.stdout, f, result, []string{"TABLE", "LOADED"}, [][]string{{c.store.Table(), fmt.Sprint(loaded)}})
+}
+
+func (c *cli) userGet(args []string) error {
+	fs, output := c.flags("user get")
+	username := fs.String("user", "", "username")
+	photos := fs.Bool("photos", false, "include the user's photos")
+	f, err := parse(fs, args, output, "user")
+	if err != nil {
+		return err
+	}
+	var user *quickphotos.User
+	if *photos {
+		user, err = c.store.GetUserWithPhotos(*username)
+	} else {
+		user, err = c.store.GetUser(*username)
+	}
+	if err != nil {
+		return err
+	}
+	if err := write(c.stdout, f, user, userHeader, [][]string{userRow(*user)}); err != nil {
+		return err
+	}
+	if *photos && f == formatTable && len(user.Photos) > 0 {
+		fmt.Fprintln(c.stdout)
+		rows := make([][]string, 0, len(user.Photos))
+		for _, p := range user.Photos {
+			rows = append(rows, photoRow(p))
+		}
+		return write(c.stdout, f, user.Photos, photoHeader, rows)
+	}
+	return nil
+}
+
+func (c *cli) photoGet(args []string) error {
+	fs, output := c.flags("photo get")
+	username := fs.String("user", "", "photo owner")
+	timestamp := fs.String("timestamp", "", "photo timestamp")
+	f, err := parse(fs, args, output, "user", "timestamp")
+	if err != nil {
+		return err
+	}
+	photo, err := c.store.GetPhoto(*username, *timestamp)
+	if err != nil {
+		return err
+	}
+	return write(c.stdout, f, photo, photoHeader, [][]string{photoRow(*photo)})
+}
+
+type listFunc func(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+
+func (c *cli) friendships(name string, list listFunc, args []string) error {
+	fs, output := c.flags(name)
+	username := fs.String("user", "", "username")
+	limit := fs.Int("limit", 0, "maximum number of results (0 means all)")
+	cursor := fs.String("cursor", "", "cursor returned by the previous page")
+	f, err := parse(fs, args, output, "user")
+	if err != nil {
+		return err
+	}
+	friendships, next, err := list(*username, *limit, *cursor)
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(friendships))
+	for _, fr := range friendships {
+		rows = append(rows, []string{fr.FollowedUser, fr.FollowingUser, fr.Timestamp})
+	}
+	if err := writePage(c.stdout, f, friendships, next, []string{"FOLLOWED", "FOLLOWING", "TIMESTAMP"}, rows); err != nil {
+		return err
+	}
+	if next != "" && f != formatJSON {
+		fmt.Fprintln(c.stderr, fmt.Sprintf("next cursor: %s", next))
+	}
+	return nil
+}
+
+func (c *cli) following(args []string) error {
+	return c.friendships("following", c.store.ListFollowing, args)
+}
+
+func (c *cli) followers(args []string) error {
+	return c.friendships("followers", c.store.ListFollowers, args)
+}
+
+func (c *cli) follow(args []string) error {
+	fs, output := c.flags("follow")
+	from := fs.String("from", "", "user who follows")
+	to := fs.String("to", "", "user to be followed")
+	f, err := parse(fs, args, output, "from", "to")
+	if err != nil {
+		return err
+	}
+	requested, err := c.store.Follow(*to, *from)
+	if err != nil {
+		return err
+	}
+	status := "following"
+	if requested {
+		status = "requested"
+	}
+	result := map[string]interface{}{
+		"followedUser":  *to,
+		"followingUser": *from,
+		"status":        status,
+	}
+	return write(c.stdout, f, result, []string{"FOLLOWED", "FOLLOWING", "STATUS"}, [][]string{{*to, *from, status}})
+}
+
+func (c *cli) unfollow(args []string) error {
+	fs, output := c.flags("unfollow")
+	from := fs.String("from", "", "user who follows")
+	to := fs.String("to", "", "user to be unfollowed")
+	f, err := parse(fs, args, output, "from", "to")
+	if err != nil {
+		return err
+	}
+	if err := c.store.Unfollow(*to, *from); err != nil {
+		return err
+	}
+	result := map[string]interface{}{
+		"followedUser":  *to,
+		"followingUser": *from,
+		"status":        "unfollowed",
+	}
+	return write(c.stdout, f, result, []string{"FOLLOWED", "FOLLOWING", "STATUS"}, [][]string{{*to, *from, "unfollowed"}})
+}
+
+func (c *cli) react(args []string) error {
+	fs, output := c.flags("react")
+	username := fs.String("user", "", "reacting user")
+	reactionType := fs.String("type", "", fmt.Sprintf("reaction type (%s)", strings.Join(quickphotos.ReactionTypes, ", ")))
+	photoUser := fs.String("photo-user", "", "photo owner")
+	timestamp := fs.String("timestamp", "", "photo timestamp")
+	f, err := parse(fs, args, output, "user", "type", "photo-user", "timestamp")
+	if err != nil {
+		return err
+	}
+	reaction, err := c.store.React(*username, *reactionType, *photoUser, *timestamp)
+	if err != nil {
+		return err
+	}
+	return write(c.stdout, f, reaction, []string{"USER", "PHOTO", "TYPE", "TIMESTAMP"}, [][]string{{reaction.ReactingUser, reaction.Photo, reaction.ReactionType, reaction.Timestamp}})
+}
+
+func (c *cli) serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	addr := fs.String("addr", ":8080", "listen address")
+	grpcAddr := fs.String("grpc-addr", "", "listen address for the gRPC service (disabled if empty)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError{fmt.Sprintf("unexpected arguments: %s", strings.Join(fs.Args(), " "))}
+	}
+	logger := log.New(c.stderr, "", log.LstdFlags)
+	rest := httpapi.New(c.store)
+	rest.ErrorLog = logger
+	gql, err := graphqlapi.New(c.store, logger)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/graphql", gql)
+	mux.Handle("/", rest)
+	if c.meter != nil {
+		mux.HandleFunc("/debug/capacity", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			c.meter.WriteReport(w)
+		})
+	}
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          logger,
+	}
+	errs := make(chan error, 2)
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return err
+		}
+		service := grpcapi.New(c.store)
+		service.ErrorLog = logger
+		grpcServer := grpc.NewServer()
+		quickphotospb.RegisterQuickPhotosServer(grpcServer, service)
+		logger.Printf("serving gRPC on %s", *grpcAddr)
+		go func() { errs <- grpcServer.Serve(lis) }()
+	}
+	logger.Printf("serving table %s on %s", c.store.Table(), *addr)
+	go func() { errs <- server.ListenAndServe() }()
+	// どちらかが止まったら終了する
+	return <-errs
+}
+
+// 宣言したアクセスパターンとインデックスを一覧にする
+// -verify のときは DescribeTable の結果と照らし合わせ、例の引数で実際に Query する
+func (c *cli) patterns(args []string) error {
+	fs, output := c.flags("patterns")
+	verify := fs.Bool("verify", false, "check the patterns against the live table")
+	f, err := parse(fs, args, output)
+	if err != nil {
+		return err
+	}
+	problems := quickphotos.VerifyPatterns(quickphotos.AccessPatterns, quickphotos.Indexes())
+	if *verify && len(problems) == 0 {
+		if problems, err = c.store.VerifyPatterns(); err != nil {
+			return err
+		}
+	}
+
+	patterns := make([]map[string]interface{}, 0, len(quickphotos.AccessPatterns))
+	patternRows := make([][]string, 0, len(quickphotos.AccessPatterns))
+	for _, p := range quickphotos.AccessPatterns {
+		order := "ascending"
+		if !p.Forward {
+			order = "descending"
+		}
+		patterns = append(patterns, map[string]interface{}{
+			"name":         p.Name,
+			"entity":       p.Entity,
+			"index":        indexLabel(p.Index),
+			"keyCondition": p.Key.String(),
+			"order":        order,
+			"results":      p.Results,
+			"createdBy":    p.CreatedBy,
+		})
+		patternRows = append(patternRows, []string{p.Name, p.Entity, indexLabel(p.Index), p.Key.String(), order, strings.Join(p.Results, ",")})
+	}
+	indexes := make([]map[string]interface{}, 0)
+	indexRows := make([][]string, 0)
+	for _, idx := range quickphotos.Indexes() {
+		indexes = append(indexes, map[string]interface{}{
+			"index":      indexLabel(idx.Name),
+			"hashKey":    idx.HashKey,
+			"rangeKey":   idx.RangeKey,
+			"projection": idx.Projection,
+		})
+		indexRows = append(indexRows, []string{indexLabel(idx.Name), idx.HashKey, idx.RangeKey, idx.Projection})
+	}
+	messages := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+
+	if f == formatTable {
+		if err := write(c.stdout, f, nil, []string{"PATTERN", "ENTITY", "INDEX", "KEY CONDITION", "ORDER", "RESULTS"}, patternRows); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout)
+		if err := write(c.stdout, f, nil, []string{"INDEX", "HASH KEY", "RANGE KEY", "PROJECTION"}, indexRows); err != nil {
+			return err
+		}
+		for _, message := range messages {
+			fmt.Fprintln(c.stderr, message)
+		}
+	} else {
+		result := map[string]interface{}{
+			"patterns": patterns,
+			"indexes":  indexes,
+			"problems": messages,
+		}
+		if err := write(c.stdout, f, result, nil, nil); err != nil {
+			return err
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) found in access patterns", len(problems))
+	}
+	return nil
+}
+
+func indexLabel(name string) string {
+	if name == "" {
+		return "(table)"
+	}
+	return name
+}
+
+// パーティションごとにアイテムをまとめて表示する
+// -file を指定すると、テーブルではなく JSONL ファイルのアイテムを表示する
+func (c *cli) collections(args []string) error {
+	fs, output := c.flags("collections")
+	partition := fs.String("partition", "", "partition key value to show (all partitions if empty)")
+	index := fs.String("index", "", "show the items as this index groups them (e.g. "+quickphotos.INVERTED_INDEX+")")
+	file := fs.String("file", "", "read items from a JSONL file instead of the table")
+	htmlPath := fs.String("html", "", "also write a static HTML page to this file (- for stdout instead of the text view)")
+	f, err := parse(fs, args, output)
+	if err != nil {
+		return err
+	}
+	if _, ok := quickphotos.FindIndex(*index); !ok {
+		return usageError{fmt.Sprintf("unknown index %q", *index)}
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	if *file != "" {
+		in, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if items, err = quickphotos.ReadItems(in); err != nil {
+			return err
+		}
+	} else if items, err = c.store.Items(*index, *partition); err != nil {
+		return err
+	}
+	view, err := itemview.Build(c.store.Table(), *index, items)
+	if err != nil {
+		return err
+	}
+	if *partition != "" {
+		view = view.Partition(*partition)
+	}
+	if len(view.Collections) == 0 && *partition != "" {
+		return fmt.Errorf("partition %q: %w", *partition, errNoItems)
+	}
+
+	switch *htmlPath {
+	case "":
+	case "-":
+		return view.WriteHTML(c.stdout)
+	default:
+		out, err := os.Create(*htmlPath)
+		if err != nil {
+			return err
+		}
+		if err := view.WriteHTML(out); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	switch f {
+	case formatTable:
+		return view.WriteText(c.stdout)
+	case formatJSONL:
+		return write(c.stdout, f, view.Collections, nil, nil)
+	}
+	return write(c.stdout, f, view, nil, nil)
+}
+
+func (c *cli) migrateUp(args []string) error {
+	return c.migrate("migrate up", false, args)
+}
+
+func (c *cli) migrateDryRun(args []string) error {
+	return c.migrate("migrate dry-run", true, args)
+}
+
+// 途中で失敗したときも、それまでに適用したものを表示してからエラーを返す
+func (c *cli) migrate(name string, dryRun bool, args []string) error {
+	fs, output := c.flags(name)
+	owner := fs.String("owner", defaultOwner(), "name recorded on the lock and applied migrations")
+	f, err := parse(fs, args, output, "owner")
+	if err != nil {
+		return err
+	}
+	ran, runErr := c.store.Migrate(*owner, dryRun)
+	if runErr != nil && len(ran) == 0 {
+		return runErr
+	}
+	rows := make([][]string, 0, len(ran))
+	for _, m := range ran {
+		changes := strings.Join(m.Changes, "; ")
+		if changes == "" {
+			changes = "no changes"
+		}
+		rows = append(rows, []string{fmt.Sprint(m.Version), m.Name, changes})
+	}
+	if len(rows) == 0 && runErr == nil {
+		rows = append(rows, []string{"-", "up to date", ""})
+	}
+	if err := write(c.stdout, f, ran, []string{"VERSION", "NAME", "CHANGES"}, rows); err != nil {
+		return err
+	}
+	return runErr
+}
+
+func (c *cli) migrateStatus(args []string) error {
+	fs, output := c.flags("migrate status")
+	f, err := parse(fs, args, output)
+	if err != nil {
+		return err
+	}
+	statuses, lock, err := c.store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(statuses))
+	for _, m := range statuses {
+		state := "pending"
+		if m.Applied() {
+			state = "applied"
+		}
+		rows = append(rows, []string{fmt.Sprint(m.Version), m.Name, state, m.AppliedAt, m.AppliedBy})
+	}
+	if f != formatTable {
+		return write(c.stdout, f, map[string]interface{}{
+			"migrations": statuses,
+			"lock":       lock,
+		}, nil, nil)
+	}
+	if err := write(c.stdout, f, nil, []string{"VERSION", "NAME", "STATUS", "APPLIED AT", "APPLIED BY"}, rows); err != nil {
+		return err
+	}
+	if lock != nil {
+		fmt.Fprintf(c.stdout, "\nlocked: %s\n", lock)
+	}
+	return nil
+}
+
+// 同じ人が 2 つの端末で実行しても区別できるように、プロセス ID まで含める
+func defaultOwner() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s:%d", user, host, os.Getpid())
+}
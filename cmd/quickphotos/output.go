@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+type format string
+
+const (
+	formatTable format = "table"
+	formatJSON  format = "json"
+	formatJSONL format = "jsonl"
+)
+
+var (
+	userHeader  = []string{"USERNAME", "NAME", "FOLLOWERS", "FOLLOWING", "PRIVATE", "INTERESTS", "PINNED"}
+	photoHeader = []string{"USER", "TIMESTAMP", "LOCATION", "REACTIONS", "CAPTION"}
+)
+
+func userRow(u quickphotos.User) []string {
+	return []string{
+		u.Username,
+		u.Name,
+		fmt.Sprint(u.Followers),
+		fmt.Sprint(u.Following),
+		fmt.Sprint(u.Private),
+		strings.Join(u.Interests, ","),
+		u.PinnedImage,
+	}
+}
+
+func photoRow(p quickphotos.Photo) []string {
+	counts := make([]string, 0, len(quickphotos.ReactionTypes))
+	for _, t := range quickphotos.ReactionTypes {
+		counts = append(counts, fmt.Sprintf("%s=%d", t, p.Reactions[t]))
+	}
+	return []string{p.Username, p.Timestamp, p.Location, strings.Join(counts, " "), p.Caption}
+}
+
+// json はそのまま 1 つの値として、jsonl はスライスなら要素ごとに 1 行で出力する
+func write(w io.Writer, f format, v interface{}, header []string, rows [][]string) error {
+	switch f {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case formatJSONL:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			return enc.Encode(v)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := enc.Encode(rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		// 住所などに含まれる改行で表が崩れないようにする
+		cells := make([]string, 0, len(row))
+		for _, cell := range row {
+			cells = append(cells, strings.ReplaceAll(cell, "\n", " "))
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// json では次のページのカーソルも含めて 1 つの値にする
+// table と jsonl は行だけを出力し、カーソルは呼び出し側が標準エラーに出す
+func writePage(w io.Writer, f format, items interface{}, next string, header []string, rows [][]string) error {
+	if f == formatJSON {
+		page := map[string]interface{}{
+			"items": items,
+		}
+		if next != "" {
+			page["nextCursor"] = next
+		}
+		return write(w, f, page, header, rows)
+	}
+	return write(w, f, items, header, rows)
+}
@@ -0,0 +1,65 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// 同じ書き込みを aws-sdk と guregu/dynamo の両方で行う application のプログラム
+// どれも -endpoint、-only (sdk か guregu)、-now を受け取る
+var ApplicationPrograms = []string{
+	"05_add_reaction.go",
+	"06_follow_user.go",
+}
+
+// go build した application のプログラムを、aws-sdk の実装と guregu/dynamo の実装だけでそれぞれ、
+// 読み込んだばかりのテーブルに対して実行し、終わり方と実行後のテーブルの中身を比べる。違いがなければ空を返す
+func ApplicationDifferential(binary, itemsPath string) ([]string, error) {
+	raw, err := runApplication(binary, "sdk", itemsPath)
+	if err != nil {
+		return nil, err
+	}
+	guregu, err := runApplication(binary, "guregu", itemsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	if raw.err != guregu.err {
+		diffs = append(diffs, fmt.Sprintf("error:\n- aws-sdk: %s\n+ guregu:  %s", raw.err, guregu.err))
+	}
+	diffs = append(diffs, diffTables(raw.table, guregu.table)...)
+	return diffs, nil
+}
+
+func runApplication(binary, only, itemsPath string) (*outcome, error) {
+	env, err := NewEnv(itemsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer env.Close()
+
+	cmd := exec.Command(binary, "-endpoint", env.Client.Endpoint, "-only", only, "-now", Clock.Format(time.RFC3339))
+	// localdynamo は認証情報を確かめないが、無いと SDK がリクエストを送らない
+	cmd.Env = append(os.Environ(), "AWS_ACCESS_KEY_ID=local", "AWS_SECRET_ACCESS_KEY=local")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	o := &outcome{}
+	if err := cmd.Run(); err != nil {
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) {
+			return nil, err
+		}
+		// panic のスタックトレースはアドレスが実行ごとに変わるので、最初の行だけを比べる
+		o.err = strings.SplitN(stderr.String(), "\n", 2)[0]
+	}
+	if o.table, err = Snapshot(env.Client); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
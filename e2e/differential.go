@@ -0,0 +1,171 @@
+package e2e
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// フローを aws-sdk の実装と guregu/dynamo の実装で、それぞれ読み込んだばかりのテーブルに対して実行し、
+// 戻り値と実行後のテーブルの中身を比べる。違いがなければ空を返す
+func Differential(flow Flow, itemsPath string) ([]string, error) {
+	raw, err := runOn(flow, itemsPath, func(env *Env) Backend { return env.Store })
+	if err != nil {
+		return nil, err
+	}
+	guregu, err := runOn(flow, itemsPath, func(env *Env) Backend { return env.Dynamo })
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	if raw.err != guregu.err {
+		diffs = append(diffs, fmt.Sprintf("error:\n- aws-sdk: %s\n+ guregu:  %s", raw.err, guregu.err))
+	}
+	if raw.result != guregu.result {
+		diffs = append(diffs, "return value:\n"+Diff(raw.result, guregu.result))
+	}
+	diffs = append(diffs, diffTables(raw.table, guregu.table)...)
+	return diffs, nil
+}
+
+type outcome struct {
+	result string
+	err    string
+	table  map[string]string
+}
+
+func runOn(flow Flow, itemsPath string, backend func(env *Env) Backend) (*outcome, error) {
+	env, err := NewEnv(itemsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer env.Close()
+
+	if err := flow.setup(env); err != nil {
+		return nil, err
+	}
+	o := &outcome{}
+	result, err := flow.Run(backend(env))
+	if err != nil {
+		o.err = err.Error()
+	}
+	b, err := Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	o.result = string(b)
+	if o.table, err = Snapshot(env.Client); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// テーブルのアイテムを "PK / SK" をキーにして、型つきの JSON にしたもの
+// guregu/dynamo は数値のゼロ値や空のリストを書き込むことがあるので、型まで含めて比べる
+func Snapshot(client *dynamodb.DynamoDB) (map[string]string, error) {
+	snapshot := make(map[string]string)
+	var marshalErr error
+	err := client.ScanPages(&dynamodb.ScanInput{
+		TableName:      aws.String(quickphotos.DEFAULT_TABLE),
+		ConsistentRead: aws.Bool(true),
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			b, err := Marshal(typedItem(item))
+			if err != nil {
+				marshalErr = err
+				return false
+			}
+			key := fmt.Sprintf("%s / %s", aws.StringValue(item["PK"].S), aws.StringValue(item["SK"].S))
+			snapshot[key] = string(b)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, marshalErr
+}
+
+func typedItem(item map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	result := make(map[string]interface{}, len(item))
+	for name, v := range item {
+		result[name] = typedValue(v)
+	}
+	return result
+}
+
+func typedValue(v *dynamodb.AttributeValue) interface{} {
+	switch {
+	case v.S != nil:
+		return map[string]interface{}{"S": *v.S}
+	case v.N != nil:
+		return map[string]interface{}{"N": *v.N}
+	case v.B != nil:
+		return map[string]interface{}{"B": v.B}
+	case v.BOOL != nil:
+		return map[string]interface{}{"BOOL": *v.BOOL}
+	case v.NULL != nil:
+		return map[string]interface{}{"NULL": *v.NULL}
+	case v.SS != nil:
+		return map[string]interface{}{"SS": sortedStrings(v.SS)}
+	case v.NS != nil:
+		return map[string]interface{}{"NS": sortedStrings(v.NS)}
+	case v.BS != nil:
+		return map[string]interface{}{"BS": v.BS}
+	case v.M != nil:
+		return map[string]interface{}{"M": typedItem(v.M)}
+	case v.L != nil:
+		list := make([]interface{}, 0, len(v.L))
+		for _, e := range v.L {
+			list = append(list, typedValue(e))
+		}
+		return map[string]interface{}{"L": list}
+	}
+	return nil
+}
+
+// セットの要素の順番は意味を持たない
+func sortedStrings(values []*string) []string {
+	result := aws.StringValueSlice(values)
+	sort.Strings(result)
+	return result
+}
+
+func diffTables(raw, guregu map[string]string) []string {
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	for key := range guregu {
+		if _, ok := raw[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var diffs []string
+	for _, key := range keys {
+		a, inRaw := raw[key]
+		b, inGuregu := guregu[key]
+		switch {
+		case !inGuregu:
+			diffs = append(diffs, fmt.Sprintf("item %s: only written by aws-sdk\n%s", key, indent(a, "- ")))
+		case !inRaw:
+			diffs = append(diffs, fmt.Sprintf("item %s: only written by guregu\n%s", key, indent(b, "+ ")))
+		case a != b:
+			diffs = append(diffs, fmt.Sprintf("item %s:\n%s", key, Diff(a, b)))
+		}
+	}
+	return diffs
+}
+
+func indent(s, prefix string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	return prefix + strings.Join(lines, "\n"+prefix) + "\n"
+}
@@ -0,0 +1,55 @@
+package e2e
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// aws-sdk の quickphotos.Store と guregu/dynamo の dynamostore.Store で、戻り値と実行後のテーブルの中身が同じになることを確かめる
+// 差分は - が aws-sdk、+ が guregu/dynamo の結果
+func TestDifferential(t *testing.T) {
+	for _, flow := range Flows {
+		flow := flow
+		t.Run(flow.Name, func(t *testing.T) {
+			diffs, err := Differential(flow, itemsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diffs) > 0 {
+				t.Errorf("aws-sdk and guregu/dynamo differ\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+// application のプログラムも、aws-sdk の部分と guregu/dynamo の部分で書き込むアイテムが同じになることを確かめる
+// プログラムを go build するので、-short では飛ばす
+func TestApplicationDifferential(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the application programs")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	dir := t.TempDir()
+	for _, program := range ApplicationPrograms {
+		program := program
+		t.Run(strings.TrimSuffix(program, ".go"), func(t *testing.T) {
+			binary := filepath.Join(dir, strings.TrimSuffix(program, ".go"))
+			out, err := exec.Command(gobin, "build", "-o", binary, filepath.Join("..", "application", program)).CombinedOutput()
+			if err != nil {
+				t.Fatalf("go build %s: %s\n%s", program, err, out)
+			}
+			diffs, err := ApplicationDifferential(binary, itemsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(diffs) > 0 {
+				t.Errorf("aws-sdk and guregu/dynamo differ\n%s", strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
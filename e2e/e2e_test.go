@@ -0,0 +1,47 @@
+package e2e
+
+import (
+	"errors"
+	"flag"
+	"path/filepath"
+	"testing"
+)
+
+// キーの組み立てや変換を意図して変えたときは、go test ./e2e -update で golden ファイルを書き直す
+var update = flag.Bool("update", false, "rewrite golden files with the current results")
+
+// テストはパッケージのディレクトリで動くので、リポジトリのルートからの相対パスにする
+var itemsPath = filepath.Join("..", "scripts", "items.json")
+
+const goldenDir = "golden"
+
+// 結果が golden ファイルと違えば、差分 (- が golden ファイル、+ が今回の結果) を出して失敗する
+// go test ./e2e -run 'TestFlows/05_' のようにフローを絞れる
+func TestFlows(t *testing.T) {
+	for _, flow := range Flows {
+		flow := flow
+		t.Run(flow.Name, func(t *testing.T) {
+			// 書き込みのフローがほかのフローに影響しないように、フローごとに読み込み直す
+			env, err := NewEnv(itemsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer env.Close()
+			if err := flow.setup(env); err != nil {
+				t.Fatal(err)
+			}
+			result, err := flow.Run(env.Store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Compare(goldenDir, flow.Name, result, *update)
+			var mismatch *MismatchError
+			if errors.As(err, &mismatch) {
+				t.Fatalf("%s does not match\n%s", mismatch.Path, mismatch.Diff)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Package e2e は、scripts/items.json を localdynamo に読み込んで、チュートリアルのアクセスパターンを通しで確かめる
+// 結果は golden ディレクトリの JSON と比べる。go test ./e2e で実行する
+package e2e
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/localdynamo"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+// 書き込みの時刻を固定して、golden ファイルが実行のたびに変わらないようにする
+var Clock = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// localdynamo を立ち上げて、テーブルを作り、アイテムを読み込んだ状態
+// Store と Dynamo は同じテーブルを読み書きする
+type Env struct {
+	Client *dynamodb.DynamoDB
+	Store  *quickphotos.Store
+	Dynamo *dynamostore.Store
+	stop   func()
+}
+
+func NewEnv(itemsPath string) (*Env, error) {
+	client, stop, err := localdynamo.Start()
+	if err != nil {
+		return nil, err
+	}
+	env := &Env{
+		Client: client,
+		stop:   stop,
+	}
+	env.Store = quickphotos.New(env.Client, quickphotos.DEFAULT_TABLE)
+	env.Store.SetClock(func() time.Time { return Clock })
+	env.Dynamo = dynamostore.New(dynamo.NewFromIface(env.Client), quickphotos.DEFAULT_TABLE)
+	env.Dynamo.SetClock(func() time.Time { return Clock })
+
+	if _, err := env.Store.ApplySchema(); err != nil {
+		env.Close()
+		return nil, fmt.Errorf("apply schema: %w", err)
+	}
+	f, err := os.Open(itemsPath)
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := env.Store.Load(f); err != nil {
+		env.Close()
+		return nil, fmt.Errorf("load %s: %w", itemsPath, err)
+	}
+	return env, nil
+}
+
+// 型のない JSON 1 行分のアイテムを書き込む
+func (e *Env) put(line string) error {
+	_, err := e.Store.Load(strings.NewReader(line))
+	return err
+}
+
+// expression の :v を value にして、アイテムを書き換える
+func (e *Env) update(pk, sk, expression string, value *dynamodb.AttributeValue) error {
+	_, err := e.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(quickphotos.DEFAULT_TABLE),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(pk)},
+			"SK": {S: aws.String(sk)},
+		},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(SK)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": value},
+	})
+	return err
+}
+
+func (e *Env) Close() {
+	e.stop()
+}
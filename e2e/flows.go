@@ -0,0 +1,354 @@
+package e2e
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/dynamostore"
+)
+
+// フローが使う操作
+// aws-sdk で書いた quickphotos.Store と、guregu/dynamo で書いた dynamostore.Store のどちらでも実行できる
+type Backend interface {
+	GetUser(username string) (*quickphotos.User, error)
+	GetUserWithPhotos(username string) (*quickphotos.User, error)
+	BatchGetUsers(usernames []string) (map[string]*quickphotos.User, error)
+	BatchGetPhotos(ids []string) (map[string]*quickphotos.Photo, error)
+	ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error)
+	GetPhoto(username, timestamp string) (*quickphotos.Photo, error)
+	ListReactions(username, timestamp string, limit int, cursor string) ([]quickphotos.Reaction, string, error)
+	ListFollowing(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	ListFollowers(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	React(reactingUser, reactionType, photoUser, timestamp string) (*quickphotos.Reaction, error)
+	Follow(followedUser, followingUser string) (bool, error)
+	Unfollow(followedUser, followingUser string) error
+}
+
+var (
+	_ Backend = (*quickphotos.Store)(nil)
+	_ Backend = (*dynamostore.Store)(nil)
+)
+
+// 1 つのアクセスパターンを通しで実行して、アプリから見える結果を返す
+// Name は golden ファイルの名前にもなる
+// Setup があれば、Run の前にテーブルを直接書き換えて、Backend の操作では作れない状態 (非公開アカウントなど) にする
+type Flow struct {
+	Name  string
+	Setup func(env *Env) error
+	Run   func(s Backend) (interface{}, error)
+}
+
+// Setup が無ければ何もしない
+func (f Flow) setup(env *Env) error {
+	if f.Setup == nil {
+		return nil
+	}
+	if err := f.Setup(env); err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+	return nil
+}
+
+// 01_ から 06_ は application/01_ から 06_ と同じユーザーと写真を使う
+var Flows = []Flow{
+	{Name: "01_fetch_user_and_photos", Run: fetchUserAndPhotos},
+	{Name: "02_fetch_photo_and_reactions", Run: fetchPhotoAndReactions},
+	{Name: "03_find_following_for_user", Run: findFollowing},
+	{Name: "04_find_and_enrich_following_for_user", Run: findAndEnrichFollowing},
+	{Name: "05_add_reaction", Run: addReaction},
+	{Name: "06_follow_user", Run: followUser},
+	{Name: "07_unfollow_user", Run: unfollowUser},
+	{Name: "08_follow_private_user", Setup: makePrivate("tmartinez"), Run: followPrivateUser},
+	{Name: "09_blocked_follow_and_react", Setup: block("tmartinez", "john42"), Run: blockedFollowAndReact},
+	{Name: "10_sharded_reactions", Setup: shardReactions, Run: readShardedPhoto},
+	{Name: "11_batch_get", Run: batchGet},
+}
+
+const PAGE_SIZE = 100
+
+func fetchUserAndPhotos(s Backend) (interface{}, error) {
+	return s.GetUserWithPhotos("jacksonjason")
+}
+
+func fetchPhotoAndReactions(s Backend) (interface{}, error) {
+	photo, err := s.GetPhoto("david25", "2019-03-02T09:11:30Z")
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := allReactions(s, photo.Username, photo.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"photo":     photo,
+		"reactions": reactions,
+	}, nil
+}
+
+func findFollowing(s Backend) (interface{}, error) {
+	return allFollowing(s, "haroldwatkins")
+}
+
+// フォローしているユーザーのプロフィールを、フォロー関係の順番に並べる
+func findAndEnrichFollowing(s Backend) (interface{}, error) {
+	following, err := allFollowing(s, "haroldwatkins")
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(following))
+	for _, f := range following {
+		usernames = append(usernames, f.FollowedUser)
+	}
+	found, err := s.BatchGetUsers(usernames)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]*quickphotos.User, 0, len(usernames))
+	for _, username := range usernames {
+		users = append(users, found[username])
+	}
+	return users, nil
+}
+
+// 書き込みのフローは、戻り値と書き込んだあとに読み直した結果をまとめて比べる
+func addReaction(s Backend) (interface{}, error) {
+	reaction, err := s.React("kennedyheather", "sunglasses", "ppierce", "2019-04-14T08:09:34Z")
+	if err != nil {
+		return nil, err
+	}
+	photo, err := s.GetPhoto("ppierce", "2019-04-14T08:09:34Z")
+	if err != nil {
+		return nil, err
+	}
+	reactions, err := allReactions(s, "ppierce", "2019-04-14T08:09:34Z")
+	if err != nil {
+		return nil, err
+	}
+	_, again := s.React("kennedyheather", "sunglasses", "ppierce", "2019-04-14T08:09:34Z")
+	return map[string]interface{}{
+		"reaction":  reaction,
+		"photo":     photo,
+		"reactions": reactions,
+		"again":     errorText(again),
+	}, nil
+}
+
+func followUser(s Backend) (interface{}, error) {
+	requested, err := s.Follow("tmartinez", "john42")
+	if err != nil {
+		return nil, err
+	}
+	followed, err := s.GetUser("tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	following, err := s.GetUser("john42")
+	if err != nil {
+		return nil, err
+	}
+	followers, err := allFollowers(s, "tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	_, again := s.Follow("tmartinez", "john42")
+	return map[string]interface{}{
+		"requested": requested,
+		"followed":  followed,
+		"following": following,
+		"followers": followers,
+		"again":     errorText(again),
+	}, nil
+}
+
+func unfollowUser(s Backend) (interface{}, error) {
+	if err := s.Unfollow("tmartinez", "haroldwatkins"); err != nil {
+		return nil, err
+	}
+	followed, err := s.GetUser("tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	following, err := s.GetUser("haroldwatkins")
+	if err != nil {
+		return nil, err
+	}
+	followers, err := allFollowers(s, "tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	again := s.Unfollow("tmartinez", "haroldwatkins")
+	return map[string]interface{}{
+		"followed":  followed,
+		"following": following,
+		"followers": followers,
+		"again":     errorText(again),
+	}, nil
+}
+
+// 非公開アカウントへのフォローはフォローリクエストになり、フォロワーもカウンターも変わらない
+func followPrivateUser(s Backend) (interface{}, error) {
+	requested, err := s.Follow("tmartinez", "john42")
+	if err != nil {
+		return nil, err
+	}
+	followed, err := s.GetUser("tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	followers, err := allFollowers(s, "tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	_, again := s.Follow("tmartinez", "john42")
+	return map[string]interface{}{
+		"requested": requested,
+		"followed":  followed,
+		"followers": followers,
+		"again":     errorText(again),
+	}, nil
+}
+
+// tmartinez が john42 をブロックしているので、john42 からのフォローもリアクションも失敗する
+func blockedFollowAndReact(s Backend) (interface{}, error) {
+	_, follow := s.Follow("tmartinez", "john42")
+	_, react := s.React("john42", "heart", "tmartinez", "2018-09-12T03:13:05Z")
+	photo, err := s.GetPhoto("tmartinez", "2018-09-12T03:13:05Z")
+	if err != nil {
+		return nil, err
+	}
+	followed, err := s.GetUser("tmartinez")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"follow":   errorText(follow),
+		"react":    errorText(react),
+		"photo":    photo,
+		"followed": followed,
+	}, nil
+}
+
+// シャードの選び方は乱数なので、リアクションの追加ではなく、シャードの合計を足す読み込みだけを比べる
+func readShardedPhoto(s Backend) (interface{}, error) {
+	photo, err := s.GetPhoto("ppierce", "2019-04-14T08:09:34Z")
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.GetUserWithPhotos("ppierce")
+	if err != nil {
+		return nil, err
+	}
+	photos, _, err := s.ListPhotos("ppierce", PAGE_SIZE, "")
+	if err != nil {
+		return nil, err
+	}
+	batch, err := s.BatchGetPhotos([]string{photo.ID()})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"photo":  photo,
+		"user":   user,
+		"photos": photos,
+		"batch":  batch,
+	}, nil
+}
+
+// 重複したキー、存在しないキー、PhotoID として読めないキーを混ぜる
+func batchGet(s Backend) (interface{}, error) {
+	users, err := s.BatchGetUsers([]string{"tmartinez", "john42", "tmartinez", "nobody"})
+	if err != nil {
+		return nil, err
+	}
+	photos, err := s.BatchGetPhotos([]string{
+		"PHOTO#tmartinez#2018-09-12T03:13:05Z",
+		"PHOTO#david25#2019-03-02T09:11:30Z",
+		"PHOTO#tmartinez#2018-09-12T03:13:05Z",
+		"PHOTO#nobody#2019-01-01T00:00:00Z",
+		"not-a-photo",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"users":  users,
+		"photos": photos,
+	}, nil
+}
+
+func makePrivate(username string) func(env *Env) error {
+	return func(env *Env) error {
+		return env.update(fmt.Sprintf("USER#%s", username), fmt.Sprintf("#METADATA#%s", username), "SET private = :v", &dynamodb.AttributeValue{BOOL: aws.Bool(true)})
+	}
+}
+
+func block(blockingUser, blockedUser string) func(env *Env) error {
+	return func(env *Env) error {
+		return env.put(fmt.Sprintf(`{"PK":"USER#%s","SK":"#BLOCK#%s","blockingUser":%q,"blockedUser":%q}`, blockingUser, blockedUser, blockingUser, blockedUser))
+	}
+}
+
+// 14_sharded_reactions.go の EnableShardedReactions と同じ形で、写真を 2 つのシャードに分け、シャードにもリアクション数を入れる
+func shardReactions(env *Env) error {
+	photo := "PHOTO#ppierce#2019-04-14T08:09:34Z"
+	if err := env.update("USER#ppierce", photo, "SET reactionShards = :v", &dynamodb.AttributeValue{N: aws.String("2")}); err != nil {
+		return err
+	}
+	for i, reactions := range []string{`{"+1":2,"smiley":0,"sunglasses":1,"heart":0}`, `{"+1":0,"smiley":3,"sunglasses":0,"heart":1}`} {
+		err := env.put(fmt.Sprintf(`{"PK":%q,"SK":%q,"photo":%q,"reactions":%s}`, quickphotos.ReactionShardPK(photo, i), photo, photo, reactions))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func errorText(err error) interface{} {
+	if err == nil {
+		return nil
+	}
+	return err.Error()
+}
+
+func allReactions(s Backend, username, timestamp string) ([]quickphotos.Reaction, error) {
+	result := []quickphotos.Reaction{}
+	cursor := ""
+	for {
+		reactions, next, err := s.ListReactions(username, timestamp, PAGE_SIZE, cursor)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, reactions...)
+		if next == "" {
+			return result, nil
+		}
+		cursor = next
+	}
+}
+
+func allFollowing(s Backend, username string) ([]quickphotos.Friendship, error) {
+	return allFriendships(s.ListFollowing, username)
+}
+
+func allFollowers(s Backend, username string) ([]quickphotos.Friendship, error) {
+	return allFriendships(s.ListFollowers, username)
+}
+
+func allFriendships(list func(string, int, string) ([]quickphotos.Friendship, string, error), username string) ([]quickphotos.Friendship, error) {
+	result := []quickphotos.Friendship{}
+	cursor := ""
+	for {
+		friendships, next, err := list(username, PAGE_SIZE, cursor)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, friendships...)
+		if next == "" {
+			return result, nil
+		}
+		cursor = next
+	}
+}
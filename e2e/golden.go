@@ -0,0 +1,153 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 差分の前後に表示する行数
+const DIFF_CONTEXT = 3
+
+var ErrMismatch = errors.New("result does not match golden file")
+
+// golden ファイルと違ったときのエラー。Diff に読める形の差分が入る
+type MismatchError struct {
+	Path string
+	Diff string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s: %s\n%s", e.Path, ErrMismatch, e.Diff)
+}
+
+func (e *MismatchError) Unwrap() error {
+	return ErrMismatch
+}
+
+// キーの順番と字下げをそろえて、行ごとに比べられる形にする
+func Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// 構造体のフィールド順ではなく、キーの名前順にそろえる
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func GoldenPath(dir, name string) string {
+	return filepath.Join(dir, name+".json")
+}
+
+// 結果を golden ファイルと比べる。update なら golden ファイルを書き直す
+func Compare(dir, name string, v interface{}, update bool) error {
+	got, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	path := GoldenPath(dir, name)
+	if update {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, got, 0o644)
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(want, got) {
+		return nil
+	}
+	return &MismatchError{Path: path, Diff: Diff(string(want), string(got))}
+}
+
+// 行単位の unified 形式に近い差分
+// - が want にだけある行、+ が got にだけある行で、@@ には want と got の行番号を出す
+func Diff(want, got string) string {
+	a := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+
+	// 最長共通部分列の長さを後ろから求める
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+		a, b int
+	}
+	lines := make([]line, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i], i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, line{'+', b[j], i, j})
+			j++
+		default:
+			lines = append(lines, line{'-', a[i], i, j})
+			i++
+		}
+	}
+
+	// 変更のある行の前後だけを、行番号つきのまとまりにして出す
+	var out strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		from := start - DIFF_CONTEXT
+		if from < 0 {
+			from = 0
+		}
+		end := start
+		for k := start; k < len(lines) && k <= end+2*DIFF_CONTEXT; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		to := end + DIFF_CONTEXT + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+		fmt.Fprintf(&out, "@@ -%d +%d @@\n", lines[from].a+1, lines[from].b+1)
+		for _, l := range lines[from:to] {
+			fmt.Fprintf(&out, "%c %s\n", l.op, l.text)
+		}
+		start = to
+	}
+	return out.String()
+}
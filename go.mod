@@ -1,12 +1,21 @@
 module github.com/s14t284/dynamodb-tutorial-for-mobile-app
 
-go 1.18
+go 1.21
+
+require (
+	github.com/aws/aws-sdk-go v1.42.47
+	github.com/cenkalti/backoff/v4 v4.1.2
+	github.com/graphql-go/graphql v0.8.1
+	github.com/guregu/dynamo v1.15.0
+	google.golang.org/grpc v1.64.1
+	google.golang.org/protobuf v1.33.0
+)
 
 require (
-	github.com/aws/aws-sdk-go v1.42.47 // indirect
-	github.com/cenkalti/backoff/v4 v4.1.2 // indirect
 	github.com/gofrs/uuid v4.2.0+incompatible // indirect
-	github.com/guregu/dynamo v1.15.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240318140521-94a12d6c2237 // indirect
 )
@@ -0,0 +1,32 @@
+package localdynamo
+
+import (
+	"net/http/httptest"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// 同じプロセスの中で空のサーバーを立ち上げて、つないだクライアントを返す
+// テストや e2e のように、ポートを決めずにその場で使うためのもの。戻り値の関数でサーバーを止める
+func Start() (*dynamodb.DynamoDB, func(), error) {
+	return StartServer(New())
+}
+
+// Start と同じだが、OnWrite を設定したサーバーのように、呼び出し側で作った s を使う
+// 認証情報は確かめないので、固定の値を渡している
+func StartServer(s *Server) (*dynamodb.DynamoDB, func(), error) {
+	server := httptest.NewServer(s)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(DEFAULT_REGION),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+	})
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return dynamodb.New(sess), server.Close, nil
+}
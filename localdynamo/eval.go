@@ -0,0 +1,715 @@
+package localdynamo
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type item = map[string]*dynamodb.AttributeValue
+
+// DynamoDB のデータ型の記号。値が空なら ""
+func typeOf(av *dynamodb.AttributeValue) string {
+	switch {
+	case av == nil:
+		return ""
+	case av.S != nil:
+		return "S"
+	case av.N != nil:
+		return "N"
+	case av.B != nil:
+		return "B"
+	case av.BOOL != nil:
+		return "BOOL"
+	case av.NULL != nil:
+		return "NULL"
+	case av.M != nil:
+		return "M"
+	case av.L != nil:
+		return "L"
+	case av.SS != nil:
+		return "SS"
+	case av.NS != nil:
+		return "NS"
+	case av.BS != nil:
+		return "BS"
+	}
+	return ""
+}
+
+// 数値は 38 桁までの十進数なので、float64 ではなく big.Rat で扱う
+func parseNumber(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(strings.TrimSpace(s))
+}
+
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := r.FloatString(38)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func validNumber(s string) bool {
+	_, ok := parseNumber(s)
+	return ok
+}
+
+func copyValue(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	c := *av
+	if av.M != nil {
+		c.M = make(map[string]*dynamodb.AttributeValue, len(av.M))
+		for k, v := range av.M {
+			c.M[k] = copyValue(v)
+		}
+	}
+	if av.L != nil {
+		c.L = make([]*dynamodb.AttributeValue, 0, len(av.L))
+		for _, v := range av.L {
+			c.L = append(c.L, copyValue(v))
+		}
+	}
+	if av.SS != nil {
+		c.SS = append([]*string{}, av.SS...)
+	}
+	if av.NS != nil {
+		c.NS = append([]*string{}, av.NS...)
+	}
+	if av.BS != nil {
+		c.BS = append([][]byte{}, av.BS...)
+	}
+	return &c
+}
+
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	c := make(item, len(it))
+	for k, v := range it {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+// 同じ型で同じ値なら等しい。セットは順番を問わない
+func equalValues(a, b *dynamodb.AttributeValue) bool {
+	ta, tb := typeOf(a), typeOf(b)
+	if ta != tb || ta == "" {
+		return false
+	}
+	switch ta {
+	case "S":
+		return *a.S == *b.S
+	case "N":
+		x, ok1 := parseNumber(*a.N)
+		y, ok2 := parseNumber(*b.N)
+		return ok1 && ok2 && x.Cmp(y) == 0
+	case "B":
+		return bytes.Equal(a.B, b.B)
+	case "BOOL":
+		return *a.BOOL == *b.BOOL
+	case "NULL":
+		return true
+	case "M":
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, v := range a.M {
+			if !equalValues(v, b.M[k]) {
+				return false
+			}
+		}
+		return true
+	case "L":
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !equalValues(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	x, y := setMembers(a), setMembers(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for _, v := range x {
+		if !containsMember(y, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// セットの要素を 1 つずつの値にする
+func setMembers(av *dynamodb.AttributeValue) []*dynamodb.AttributeValue {
+	members := make([]*dynamodb.AttributeValue, 0)
+	for _, s := range av.SS {
+		members = append(members, &dynamodb.AttributeValue{S: s})
+	}
+	for _, n := range av.NS {
+		members = append(members, &dynamodb.AttributeValue{N: n})
+	}
+	for _, b := range av.BS {
+		members = append(members, &dynamodb.AttributeValue{B: b})
+	}
+	return members
+}
+
+func containsMember(members []*dynamodb.AttributeValue, v *dynamodb.AttributeValue) bool {
+	for _, m := range members {
+		if equalValues(m, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func newSet(setType string, members []*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	av := &dynamodb.AttributeValue{}
+	switch setType {
+	case "SS":
+		av.SS = make([]*string, 0, len(members))
+		for _, m := range members {
+			av.SS = append(av.SS, m.S)
+		}
+	case "NS":
+		av.NS = make([]*string, 0, len(members))
+		for _, m := range members {
+			av.NS = append(av.NS, m.N)
+		}
+	case "BS":
+		av.BS = make([][]byte, 0, len(members))
+		for _, m := range members {
+			av.BS = append(av.BS, m.B)
+		}
+	}
+	return av
+}
+
+// S、N、B だけが大小を比較できる
+func compareValues(a, b *dynamodb.AttributeValue) (int, bool) {
+	ta := typeOf(a)
+	if ta != typeOf(b) {
+		return 0, false
+	}
+	switch ta {
+	case "S":
+		return strings.Compare(*a.S, *b.S), true
+	case "N":
+		x, ok1 := parseNumber(*a.N)
+		y, ok2 := parseNumber(*b.N)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case "B":
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+func resolvePath(it item, p path) (*dynamodb.AttributeValue, bool) {
+	if it == nil || len(p) == 0 {
+		return nil, false
+	}
+	current, ok := it[p[0].name]
+	if !ok {
+		return nil, false
+	}
+	for _, e := range p[1:] {
+		if e.list {
+			if current.L == nil || e.index >= len(current.L) {
+				return nil, false
+			}
+			current = current.L[e.index]
+		} else {
+			if current.M == nil {
+				return nil, false
+			}
+			if current, ok = current.M[e.name]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return current, current != nil
+}
+
+func sizeOf(av *dynamodb.AttributeValue) (int, bool) {
+	switch typeOf(av) {
+	case "S":
+		return len(*av.S), true
+	case "B":
+		return len(av.B), true
+	case "M":
+		return len(av.M), true
+	case "L":
+		return len(av.L), true
+	case "SS":
+		return len(av.SS), true
+	case "NS":
+		return len(av.NS), true
+	case "BS":
+		return len(av.BS), true
+	}
+	return 0, false
+}
+
+func evalOperand(it item, o operand) (*dynamodb.AttributeValue, bool) {
+	switch o := o.(type) {
+	case valueOperand:
+		return o.value, true
+	case pathOperand:
+		return resolvePath(it, o.path)
+	case sizeOperand:
+		v, ok := resolvePath(it, o.path)
+		if !ok {
+			return nil, false
+		}
+		n, ok := sizeOf(v)
+		if !ok {
+			return nil, false
+		}
+		return &dynamodb.AttributeValue{N: aws.String(big.NewInt(int64(n)).String())}, true
+	}
+	return nil, false
+}
+
+var attributeTypes = map[string]bool{
+	"S": true, "N": true, "B": true, "BOOL": true, "NULL": true,
+	"M": true, "L": true, "SS": true, "NS": true, "BS": true,
+}
+
+// 存在しない属性との比較は false になる
+func evalCondition(it item, c condition) (bool, error) {
+	switch c := c.(type) {
+	case andCondition:
+		a, err := evalCondition(it, c.a)
+		if err != nil || !a {
+			return false, err
+		}
+		return evalCondition(it, c.b)
+	case orCondition:
+		a, err := evalCondition(it, c.a)
+		if err != nil || a {
+			return a, err
+		}
+		return evalCondition(it, c.b)
+	case notCondition:
+		v, err := evalCondition(it, c.c)
+		return !v, err
+	case compareCondition:
+		a, ok1 := evalOperand(it, c.a)
+		b, ok2 := evalOperand(it, c.b)
+		if !ok1 || !ok2 {
+			// 片方が存在しなければ、<> だけが成り立つ
+			return c.op == "<>" && ok1 != ok2, nil
+		}
+		switch c.op {
+		case "=":
+			return equalValues(a, b), nil
+		case "<>":
+			return !equalValues(a, b), nil
+		}
+		cmp, ok := compareValues(a, b)
+		if !ok {
+			return false, nil
+		}
+		switch c.op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		}
+	case betweenCondition:
+		v, ok1 := evalOperand(it, c.v)
+		lo, ok2 := evalOperand(it, c.lo)
+		hi, ok3 := evalOperand(it, c.hi)
+		if !ok1 || !ok2 || !ok3 {
+			return false, nil
+		}
+		if cmp, ok := compareValues(lo, hi); ok && cmp > 0 {
+			return false, validationError("Invalid ConditionExpression: The BETWEEN operator requires upper bound to be greater than or equal to lower bound")
+		}
+		x, ok1 := compareValues(v, lo)
+		y, ok2 := compareValues(v, hi)
+		return ok1 && ok2 && x >= 0 && y <= 0, nil
+	case inCondition:
+		v, ok := evalOperand(it, c.v)
+		if !ok {
+			return false, nil
+		}
+		for _, o := range c.list {
+			if w, ok := evalOperand(it, o); ok && equalValues(v, w) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case functionCondition:
+		return evalFunction(it, c)
+	}
+	return false, nil
+}
+
+func evalFunction(it item, c functionCondition) (bool, error) {
+	target, exists := evalOperand(it, c.args[0])
+	switch c.name {
+	case "attribute_exists":
+		return exists, nil
+	case "attribute_not_exists":
+		return !exists, nil
+	case "attribute_type":
+		t, ok := evalOperand(it, c.args[1])
+		if !ok || t.S == nil || !attributeTypes[*t.S] {
+			return false, validationError("Invalid ConditionExpression: Invalid attribute type name found in type; type: %s", aws.StringValue(t.S))
+		}
+		return exists && typeOf(target) == *t.S, nil
+	case "begins_with":
+		prefix, ok := evalOperand(it, c.args[1])
+		if !exists || !ok {
+			return false, nil
+		}
+		switch {
+		case target.S != nil && prefix.S != nil:
+			return strings.HasPrefix(*target.S, *prefix.S), nil
+		case target.B != nil && prefix.B != nil:
+			return bytes.HasPrefix(target.B, prefix.B), nil
+		}
+		return false, nil
+	case "contains":
+		operand, ok := evalOperand(it, c.args[1])
+		if !exists || !ok {
+			return false, nil
+		}
+		switch typeOf(target) {
+		case "S":
+			return operand.S != nil && strings.Contains(*target.S, *operand.S), nil
+		case "B":
+			return operand.B != nil && bytes.Contains(target.B, operand.B), nil
+		case "L":
+			for _, v := range target.L {
+				if equalValues(v, operand) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case "SS", "NS", "BS":
+			return containsMember(setMembers(target), operand), nil
+		}
+	}
+	return false, nil
+}
+
+func invalidOperand(op string) error {
+	return validationError("An operand in the update expression has an incorrect data type; operator or function: %s", op)
+}
+
+// SET の右辺はすべて更新前のアイテムで評価する
+func evalSetValue(it item, o operand) (*dynamodb.AttributeValue, error) {
+	switch o := o.(type) {
+	case valueOperand:
+		return copyValue(o.value), nil
+	case pathOperand:
+		v, ok := resolvePath(it, o.path)
+		if !ok {
+			return nil, validationError("The provided expression refers to an attribute that does not exist in the item")
+		}
+		return copyValue(v), nil
+	case ifNotExistsOperand:
+		if v, ok := resolvePath(it, o.path); ok {
+			return copyValue(v), nil
+		}
+		return evalSetValue(it, o.value)
+	case listAppendOperand:
+		a, err := evalSetValue(it, o.a)
+		if err != nil {
+			return nil, err
+		}
+		b, err := evalSetValue(it, o.b)
+		if err != nil {
+			return nil, err
+		}
+		if a.L == nil || b.L == nil {
+			return nil, invalidOperand("list_append")
+		}
+		return &dynamodb.AttributeValue{L: append(append([]*dynamodb.AttributeValue{}, a.L...), b.L...)}, nil
+	case arithOperand:
+		a, err := evalSetValue(it, o.a)
+		if err != nil {
+			return nil, err
+		}
+		b, err := evalSetValue(it, o.b)
+		if err != nil {
+			return nil, err
+		}
+		if a.N == nil || b.N == nil {
+			return nil, invalidOperand(o.op)
+		}
+		x, ok1 := parseNumber(*a.N)
+		y, ok2 := parseNumber(*b.N)
+		if !ok1 || !ok2 {
+			return nil, invalidOperand(o.op)
+		}
+		if o.op == "+" {
+			x.Add(x, y)
+		} else {
+			x.Sub(x, y)
+		}
+		return &dynamodb.AttributeValue{N: aws.String(formatNumber(x))}, nil
+	}
+	return nil, validationError("Invalid UpdateExpression")
+}
+
+func invalidPath() error {
+	return validationError("The document path provided in the update expression is invalid for update")
+}
+
+// 親の属性がなければエラーにする。リストの範囲外の添え字は末尾への追加になる
+func setPath(it item, p path, v *dynamodb.AttributeValue) error {
+	if len(p) == 1 {
+		it[p[0].name] = v
+		return nil
+	}
+	parent, ok := resolvePath(it, p[:len(p)-1])
+	if !ok {
+		return invalidPath()
+	}
+	last := p[len(p)-1]
+	if last.list {
+		if parent.L == nil {
+			return invalidPath()
+		}
+		if last.index >= len(parent.L) {
+			parent.L = append(parent.L, v)
+		} else {
+			parent.L[last.index] = v
+		}
+		return nil
+	}
+	if parent.M == nil {
+		return invalidPath()
+	}
+	parent.M[last.name] = v
+	return nil
+}
+
+func removePath(it item, p path) {
+	if len(p) == 1 {
+		delete(it, p[0].name)
+		return
+	}
+	parent, ok := resolvePath(it, p[:len(p)-1])
+	if !ok {
+		return
+	}
+	last := p[len(p)-1]
+	if last.list {
+		if parent.L != nil && last.index < len(parent.L) {
+			parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+		}
+		return
+	}
+	if parent.M != nil {
+		delete(parent.M, last.name)
+	}
+}
+
+// 更新後のアイテムを新しく作って返す。元のアイテムは変更しない
+func applyUpdate(old item, u *update) (item, error) {
+	values := make([]*dynamodb.AttributeValue, 0, len(u.set))
+	for _, a := range u.set {
+		v, err := evalSetValue(old, a.value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	it := copyItem(old)
+	if it == nil {
+		it = make(item)
+	}
+	for i, a := range u.set {
+		if err := setPath(it, a.path, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	// 添え字がずれないように、後ろの要素から削除する
+	removes := append([]path{}, u.remove...)
+	sort.SliceStable(removes, func(i, j int) bool {
+		a, b := removes[i], removes[j]
+		return a[len(a)-1].index > b[len(b)-1].index
+	})
+	for _, p := range removes {
+		removePath(it, p)
+	}
+	for _, a := range u.add {
+		current, exists := resolvePath(it, a.path)
+		t := typeOf(a.value)
+		switch {
+		case t == "N":
+			sum, ok := parseNumber(*a.value.N)
+			if !ok {
+				return nil, invalidOperand("ADD")
+			}
+			if exists {
+				if current.N == nil {
+					return nil, invalidOperand("ADD")
+				}
+				n, ok := parseNumber(*current.N)
+				if !ok {
+					return nil, invalidOperand("ADD")
+				}
+				sum.Add(sum, n)
+			}
+			if err := setPath(it, a.path, &dynamodb.AttributeValue{N: aws.String(formatNumber(sum))}); err != nil {
+				return nil, err
+			}
+		case t == "SS" || t == "NS" || t == "BS":
+			members := make([]*dynamodb.AttributeValue, 0)
+			if exists {
+				if typeOf(current) != t {
+					return nil, invalidOperand("ADD")
+				}
+				members = setMembers(current)
+			}
+			for _, m := range setMembers(a.value) {
+				if !containsMember(members, m) {
+					members = append(members, m)
+				}
+			}
+			if err := setPath(it, a.path, newSet(t, members)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, invalidOperand("ADD")
+		}
+	}
+	for _, a := range u.delete {
+		current, exists := resolvePath(it, a.path)
+		t := typeOf(a.value)
+		if t != "SS" && t != "NS" && t != "BS" {
+			return nil, invalidOperand("DELETE")
+		}
+		if !exists {
+			continue
+		}
+		if typeOf(current) != t {
+			return nil, invalidOperand("DELETE")
+		}
+		remove := setMembers(a.value)
+		members := make([]*dynamodb.AttributeValue, 0)
+		for _, m := range setMembers(current) {
+			if !containsMember(remove, m) {
+				members = append(members, m)
+			}
+		}
+		// 空のセットは保存できないので、属性ごと削除する
+		if len(members) == 0 {
+			removePath(it, a.path)
+		} else if err := setPath(it, a.path, newSet(t, members)); err != nil {
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// 更新式で変更された最上位の属性
+func updatedAttributes(u *update) map[string]bool {
+	names := make(map[string]bool)
+	for _, a := range u.set {
+		names[a.path[0].name] = true
+	}
+	for _, p := range u.remove {
+		names[p[0].name] = true
+	}
+	for _, a := range u.add {
+		names[a.path[0].name] = true
+	}
+	for _, a := range u.delete {
+		names[a.path[0].name] = true
+	}
+	return names
+}
+
+// 指定したパスだけを残したアイテムを作る
+// 入れ子のパスは、親の Map や List をたどって必要な部分だけを残す
+func project(it item, paths []path) item {
+	if paths == nil {
+		return copyItem(it)
+	}
+	result := make(item)
+	for _, p := range paths {
+		v, ok := resolvePath(it, p)
+		if !ok {
+			continue
+		}
+		projectInto(result, it, p, copyValue(v))
+	}
+	return result
+}
+
+func projectInto(result item, it item, p path, v *dynamodb.AttributeValue) {
+	if len(p) == 1 {
+		result[p[0].name] = v
+		return
+	}
+	// 親を作ってから、その中に値を入れる
+	container, ok := result[p[0].name]
+	if !ok {
+		src := it[p[0].name]
+		container = &dynamodb.AttributeValue{}
+		if src.L != nil {
+			container.L = make([]*dynamodb.AttributeValue, 0)
+		} else {
+			container.M = make(map[string]*dynamodb.AttributeValue)
+		}
+		result[p[0].name] = container
+	}
+	src := it[p[0].name]
+	for i, e := range p[1:] {
+		last := i == len(p)-2
+		var next *dynamodb.AttributeValue
+		var srcNext *dynamodb.AttributeValue
+		if e.list {
+			srcNext = src.L[e.index]
+		} else {
+			srcNext = src.M[e.name]
+		}
+		if last {
+			next = v
+		} else {
+			next = &dynamodb.AttributeValue{}
+			if srcNext.L != nil {
+				next.L = make([]*dynamodb.AttributeValue, 0)
+			} else {
+				next.M = make(map[string]*dynamodb.AttributeValue)
+			}
+		}
+		if e.list {
+			// 射影したリストは、選んだ要素だけを元の順番で詰めたものになる
+			container.L = append(container.L, next)
+		} else {
+			if existing, ok := container.M[e.name]; ok && !last {
+				next = existing
+			} else {
+				container.M[e.name] = next
+			}
+		}
+		container, src = next, srcNext
+	}
+}
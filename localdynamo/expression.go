@@ -0,0 +1,707 @@
+package localdynamo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// 式の字句
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokName   // #name
+	tokValue  // :value
+	tokNumber // リストの添え字
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func tokenize(expr string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || c == ':':
+			j := i + 1
+			for j < len(expr) && isIdentChar(expr[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("Syntax error; token: %q, near: %q", string(c), expr[i:])
+			}
+			kind := tokName
+			if c == ':' {
+				kind = tokValue
+			}
+			tokens = append(tokens, token{kind, expr[i:j], i})
+			i = j
+		case '0' <= c && c <= '9':
+			j := i
+			for j < len(expr) && '0' <= expr[j] && expr[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, expr[i:j], i})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(expr) && isIdentChar(expr[j]) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, expr[i:j], i})
+			i = j
+		default:
+			if i+1 < len(expr) {
+				two := expr[i : i+2]
+				if two == "<>" || two == "<=" || two == ">=" {
+					tokens = append(tokens, token{tokSymbol, two, i})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("=<>(),.[]+-", rune(c)) {
+				return nil, fmt.Errorf("Invalid character %q in expression", string(c))
+			}
+			tokens = append(tokens, token{tokSymbol, string(c), i})
+			i++
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(expr)}), nil
+}
+
+// 属性へのパス。a.b[0].#c のような入れ子を表す
+type pathElem struct {
+	name  string
+	index int
+	list  bool
+}
+
+type path []pathElem
+
+func (p path) String() string {
+	var b strings.Builder
+	for i, e := range p {
+		if e.list {
+			fmt.Fprintf(&b, "[%d]", e.index)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(e.name)
+	}
+	return b.String()
+}
+
+// 式の中の値
+type operand interface{}
+
+type pathOperand struct{ path path }
+type valueOperand struct{ value *dynamodb.AttributeValue }
+type sizeOperand struct{ path path }
+
+// SET の右辺だけで使う
+type ifNotExistsOperand struct {
+	path  path
+	value operand
+}
+type listAppendOperand struct{ a, b operand }
+type arithOperand struct {
+	op   string
+	a, b operand
+}
+
+// 条件式
+type condition interface{}
+
+type andCondition struct{ a, b condition }
+type orCondition struct{ a, b condition }
+type notCondition struct{ c condition }
+type compareCondition struct {
+	op   string
+	a, b operand
+}
+type betweenCondition struct{ v, lo, hi operand }
+type inCondition struct {
+	v    operand
+	list []operand
+}
+type functionCondition struct {
+	name string
+	args []operand
+}
+
+// 更新式
+type setAction struct {
+	path  path
+	value operand
+}
+type pathValueAction struct {
+	path  path
+	value *dynamodb.AttributeValue
+}
+
+type update struct {
+	set    []setAction
+	remove []path
+	add    []pathValueAction
+	delete []pathValueAction
+}
+
+// 1 つのリクエストの中の式で共有する ExpressionAttributeNames と ExpressionAttributeValues
+// DynamoDB と同じように、使われなかった名前や値があればエラーにする
+type expressionContext struct {
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newExpressionContext(names map[string]*string, values map[string]*dynamodb.AttributeValue) *expressionContext {
+	return &expressionContext{
+		names:      names,
+		values:     values,
+		usedNames:  make(map[string]bool),
+		usedValues: make(map[string]bool),
+	}
+}
+
+func (ec *expressionContext) checkUnused() error {
+	for name := range ec.names {
+		if !ec.usedNames[name] {
+			return validationError("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", name)
+		}
+	}
+	for name := range ec.values {
+		if !ec.usedValues[name] {
+			return validationError("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", name)
+		}
+	}
+	return nil
+}
+
+type parser struct {
+	ec     *expressionContext
+	kind   string
+	tokens []token
+	pos    int
+}
+
+func (ec *expressionContext) newParser(kind, expr string) (*parser, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, validationError("Invalid %s: The expression can not be empty;", kind)
+	}
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, validationError("Invalid %s: %s", kind, err)
+	}
+	return &parser{ec: ec, kind: kind, tokens: tokens}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isSymbol(s string) bool {
+	t := p.peek()
+	return t.kind == tokSymbol && t.text == s
+}
+
+func (p *parser) isKeyword(s string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, s)
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return validationError("Invalid %s: %s", p.kind, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) syntaxError() error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return p.errorf("Syntax error; token: <EOF>")
+	}
+	return p.errorf("Syntax error; token: %q", t.text)
+}
+
+func (p *parser) expectSymbol(s string) error {
+	if !p.isSymbol(s) {
+		return p.syntaxError()
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) expectEOF() error {
+	if p.peek().kind != tokEOF {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *parser) attributeName(t token) (string, error) {
+	switch t.kind {
+	case tokIdent:
+		return t.text, nil
+	case tokName:
+		name, ok := p.ec.names[t.text]
+		if !ok {
+			return "", p.errorf("An expression attribute name used in the document path is not defined; attribute name: %s", t.text)
+		}
+		p.ec.usedNames[t.text] = true
+		return aws.StringValue(name), nil
+	}
+	return "", p.errorf("Syntax error; token: %q", t.text)
+}
+
+func (p *parser) parsePath() (path, error) {
+	first, err := p.attributeName(p.next())
+	if err != nil {
+		return nil, err
+	}
+	result := path{{name: first}}
+	for {
+		switch {
+		case p.isSymbol("."):
+			p.next()
+			name, err := p.attributeName(p.next())
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, pathElem{name: name})
+		case p.isSymbol("["):
+			p.next()
+			t := p.next()
+			if t.kind != tokNumber {
+				return nil, p.errorf("Syntax error; token: %q", t.text)
+			}
+			n, _ := strconv.Atoi(t.text)
+			if err := p.expectSymbol("]"); err != nil {
+				return nil, err
+			}
+			result = append(result, pathElem{index: n, list: true})
+		default:
+			return result, nil
+		}
+	}
+}
+
+func (p *parser) parseValue() (*dynamodb.AttributeValue, error) {
+	t := p.next()
+	if t.kind != tokValue {
+		return nil, p.errorf("Syntax error; token: %q", t.text)
+	}
+	v, ok := p.ec.values[t.text]
+	if !ok {
+		return nil, p.errorf("An expression attribute value used in expression is not defined; attribute value: %s", t.text)
+	}
+	p.ec.usedValues[t.text] = true
+	return v, nil
+}
+
+// 条件式の値。パス、:value、size(path) のどれか
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokValue:
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return valueOperand{v}, nil
+	case t.kind == tokIdent && strings.EqualFold(t.text, "size") && p.tokens[p.pos+1].text == "(":
+		p.next()
+		p.next()
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return sizeOperand{target}, nil
+	case t.kind == tokIdent || t.kind == tokName:
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return pathOperand{target}, nil
+	}
+	return nil, p.syntaxError()
+}
+
+func (p *parser) parseCondition() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+var conditionFunctions = map[string]int{
+	"attribute_exists":     1,
+	"attribute_not_exists": 1,
+	"attribute_type":       2,
+	"begins_with":          2,
+	"contains":             2,
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	if p.isSymbol("(") {
+		p.next()
+		c, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	t := p.peek()
+	if t.kind == tokIdent && p.tokens[p.pos+1].text == "(" {
+		name := strings.ToLower(t.text)
+		if arity, ok := conditionFunctions[name]; ok {
+			p.next()
+			p.next()
+			args := make([]operand, 0, arity)
+			for i := 0; i < arity; i++ {
+				if i > 0 {
+					if err := p.expectSymbol(","); err != nil {
+						return nil, err
+					}
+				}
+				arg, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			if _, ok := args[0].(pathOperand); !ok {
+				return nil, p.errorf("Incorrect operand type for operator or function; operator or function: %s", name)
+			}
+			return functionCondition{name, args}, nil
+		}
+		if name != "size" {
+			return nil, p.errorf("Invalid function name; function: %s", t.text)
+		}
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, p.syntaxError()
+		}
+		p.next()
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenCondition{left, lo, hi}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		list := make([]operand, 0)
+		for {
+			v, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return inCondition{left, list}, nil
+	}
+	op := p.peek()
+	if op.kind != tokSymbol {
+		return nil, p.syntaxError()
+	}
+	switch op.text {
+	case "=", "<>", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return compareCondition{op.text, left, right}, nil
+	}
+	return nil, p.syntaxError()
+}
+
+func (ec *expressionContext) parseCondition(kind, expr string) (condition, error) {
+	p, err := ec.newParser(kind, expr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	return c, p.expectEOF()
+}
+
+// SET の右辺。operand、operand + operand、operand - operand のどれか
+func (p *parser) parseSetValue() (operand, error) {
+	left, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.isSymbol("+") || p.isSymbol("-") {
+		op := p.next().text
+		right, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return arithOperand{op, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseSetOperand() (operand, error) {
+	t := p.peek()
+	if t.kind == tokIdent && p.tokens[p.pos+1].text == "(" {
+		name := strings.ToLower(t.text)
+		p.next()
+		p.next()
+		var result operand
+		switch name {
+		case "if_not_exists":
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+			v, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			result = ifNotExistsOperand{target, v}
+		case "list_append":
+			a, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			result = listAppendOperand{a, b}
+		default:
+			return nil, p.errorf("Invalid function name; function: %s", t.text)
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if t.kind == tokValue {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return valueOperand{v}, nil
+	}
+	target, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{target}, nil
+}
+
+func (ec *expressionContext) parseUpdate(expr string) (*update, error) {
+	p, err := ec.newParser("UpdateExpression", expr)
+	if err != nil {
+		return nil, err
+	}
+	u := &update{}
+	seen := make(map[string]bool)
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokIdent || (clause != "SET" && clause != "REMOVE" && clause != "ADD" && clause != "DELETE") {
+			return nil, p.errorf("Syntax error; token: %q", t.text)
+		}
+		if seen[clause] {
+			return nil, p.errorf("The \"%s\" section can only be used once in an update expression;", clause)
+		}
+		seen[clause] = true
+		for {
+			target, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			switch clause {
+			case "SET":
+				if err := p.expectSymbol("="); err != nil {
+					return nil, err
+				}
+				v, err := p.parseSetValue()
+				if err != nil {
+					return nil, err
+				}
+				u.set = append(u.set, setAction{target, v})
+			case "REMOVE":
+				u.remove = append(u.remove, target)
+			case "ADD", "DELETE":
+				v, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				if clause == "ADD" {
+					u.add = append(u.add, pathValueAction{target, v})
+				} else {
+					u.delete = append(u.delete, pathValueAction{target, v})
+				}
+			}
+			if !p.isSymbol(",") {
+				break
+			}
+			p.next()
+		}
+	}
+	if err := u.checkOverlap(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// 同じパスや親子関係にあるパスを 1 つの更新式で 2 回変更することはできない
+func (u *update) checkOverlap() error {
+	paths := make([]path, 0)
+	for _, a := range u.set {
+		paths = append(paths, a.path)
+	}
+	paths = append(paths, u.remove...)
+	for _, a := range u.add {
+		paths = append(paths, a.path)
+	}
+	for _, a := range u.delete {
+		paths = append(paths, a.path)
+	}
+	for i := range paths {
+		for j := i + 1; j < len(paths); j++ {
+			if overlaps(paths[i], paths[j]) {
+				return validationError("Invalid UpdateExpression: Two document paths overlap with each other; must remove or rewrite one of these paths; path one: [%s], path two: [%s]", paths[i], paths[j])
+			}
+		}
+	}
+	return nil
+}
+
+func overlaps(a, b path) bool {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (ec *expressionContext) parseProjection(expr string) ([]path, error) {
+	p, err := ec.newParser("ProjectionExpression", expr)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]path, 0)
+	for {
+		target, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, target)
+		if !p.isSymbol(",") {
+			break
+		}
+		p.next()
+	}
+	return paths, p.expectEOF()
+}
@@ -0,0 +1,162 @@
+package localdynamo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var profile = item{
+	"PK":        s("USER#a"),
+	"SK":        s("#METADATA#a"),
+	"name":      s("Alice"),
+	"followers": n("3"),
+	"tags":      ss("go", "aws"),
+	"photos":    l(s("p1"), s("p2")),
+	"reactions": m(item{"heart": n("2")}),
+}
+
+type values = map[string]*dynamodb.AttributeValue
+
+// 条件を満たせば true、満たさなければ false、式が誤っていれば ValidationException のメッセージを返す
+func TestConditionExpressions(t *testing.T) {
+	api := newTestClient(t, profile)
+	for _, tc := range []struct {
+		expr   string
+		names  map[string]string
+		values values
+		want   string
+	}{
+		{expr: "attribute_exists(PK)", want: "true"},
+		{expr: "attribute_not_exists(private)", want: "true"},
+		{expr: "followers > :n", values: values{":n": n("2")}, want: "true"},
+		{expr: "followers <> :n", values: values{":n": n("3.0")}, want: "false"},
+		{expr: "followers BETWEEN :lo AND :hi", values: values{":lo": n("4"), ":hi": n("5")}, want: "false"},
+		{expr: "#n IN (:a, :b)", names: map[string]string{"#n": "name"}, values: values{":a": s("Bob"), ":b": s("Alice")}, want: "true"},
+		{expr: "begins_with(#n, :p)", names: map[string]string{"#n": "name"}, values: values{":p": s("Al")}, want: "true"},
+		{expr: "contains(tags, :t)", values: values{":t": s("go")}, want: "true"},
+		{expr: "contains(photos, :p)", values: values{":p": s("p3")}, want: "false"},
+		{expr: "size(photos) = :two", values: values{":two": n("2")}, want: "true"},
+		{expr: "reactions.heart >= :n", values: values{":n": n("2")}, want: "true"},
+		{expr: "photos[1] = :p", values: values{":p": s("p2")}, want: "true"},
+		{expr: "attribute_type(followers, :t)", values: values{":t": s("N")}, want: "true"},
+		// 比較できない型同士は、エラーではなく条件を満たさない
+		{expr: "#n < :n", names: map[string]string{"#n": "name"}, values: values{":n": n("1")}, want: "false"},
+		// AND は OR より先に結びつく
+		{expr: "attribute_exists(PK) OR followers = :x AND followers = :y", values: values{":x": n("1"), ":y": n("2")}, want: "true"},
+		{expr: "(attribute_exists(PK) OR followers = :x) AND followers = :y", values: values{":x": n("1"), ":y": n("2")}, want: "false"},
+		{expr: "NOT attribute_exists(private) AND NOT followers = :n", values: values{":n": n("3")}, want: "false"},
+
+		{expr: "followers >", want: "Invalid ConditionExpression: Syntax error; token: <EOF>"},
+		{expr: "followers = :n)", values: values{":n": n("3")}, want: `Invalid ConditionExpression: Syntax error; token: ")"`},
+		{expr: "exists(PK)", want: "Invalid ConditionExpression: Invalid function name; function: exists"},
+		{expr: "begins_with(:p, PK)", values: values{":p": s("USER#")}, want: "Invalid ConditionExpression: Incorrect operand type for operator or function; operator or function: begins_with"},
+		{expr: "followers = :missing", want: "Invalid ConditionExpression: An expression attribute value used in expression is not defined; attribute value: :missing"},
+		{expr: "#missing = :n", values: values{":n": n("3")}, want: "Invalid ConditionExpression: An expression attribute name used in the document path is not defined; attribute name: #missing"},
+		{expr: "attribute_exists(PK)", values: values{":unused": n("1")}, want: "Value provided in ExpressionAttributeValues unused in expressions: keys: {:unused}"},
+		{expr: "followers BETWEEN :hi AND :lo", values: values{":lo": n("1"), ":hi": n("5")}, want: "Invalid ConditionExpression: The BETWEEN operator requires upper bound to be greater than or equal to lower bound"},
+		{expr: " ", want: "Invalid ConditionExpression: The expression can not be empty;"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			input := &dynamodb.PutItemInput{
+				TableName:           aws.String(testTable),
+				Item:                profile,
+				ConditionExpression: aws.String(tc.expr),
+			}
+			if len(tc.names) > 0 {
+				input.ExpressionAttributeNames = aws.StringMap(tc.names)
+			}
+			if len(tc.values) > 0 {
+				input.ExpressionAttributeValues = tc.values
+			}
+			_, err := api.PutItem(input)
+			got := "true"
+			switch code := errorCode(err); {
+			case err == nil:
+			case code == dynamodb.ErrCodeConditionalCheckFailedException:
+				got = "false"
+			case code == "ValidationException":
+				got = strings.TrimPrefix(err.Error(), "ValidationException: ")
+				got = strings.SplitN(got, "\n", 2)[0]
+			default:
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// 更新後の attribute の値を確かめる。want が nil なら属性が消えていること、err なら ValidationException のメッセージ
+func TestUpdateExpressions(t *testing.T) {
+	api := newTestClient(t)
+	for _, tc := range []struct {
+		expr      string
+		names     map[string]string
+		values    values
+		attribute string
+		want      *dynamodb.AttributeValue
+		err       string
+	}{
+		{expr: "SET followers = followers + :one", values: values{":one": n("1")}, attribute: "followers", want: n("4")},
+		{expr: "SET followers = followers - :half", values: values{":half": n("0.5")}, attribute: "followers", want: n("2.5")},
+		{expr: "SET bio = if_not_exists(bio, :b)", values: values{":b": s("hi")}, attribute: "bio", want: s("hi")},
+		{expr: "SET #n = if_not_exists(#n, :b)", names: map[string]string{"#n": "name"}, values: values{":b": s("Bob")}, attribute: "name", want: s("Alice")},
+		{expr: "SET photos = list_append(photos, :more)", values: values{":more": l(s("p3"))}, attribute: "photos", want: l(s("p1"), s("p2"), s("p3"))},
+		{expr: "SET reactions.heart = reactions.heart + :one", values: values{":one": n("1")}, attribute: "reactions", want: m(item{"heart": n("3")})},
+		{expr: "SET photos[0] = :p", values: values{":p": s("p0")}, attribute: "photos", want: l(s("p0"), s("p2"))},
+		{expr: "SET visits = :one REMOVE tags", values: values{":one": n("1")}, attribute: "tags"},
+		{expr: "REMOVE photos[0]", attribute: "photos", want: l(s("p2"))},
+		{expr: "ADD followers :one", values: values{":one": n("1")}, attribute: "followers", want: n("4")},
+		{expr: "ADD visits :one", values: values{":one": n("1")}, attribute: "visits", want: n("1")},
+		{expr: "ADD tags :t", values: values{":t": ss("dynamo")}, attribute: "tags", want: ss("aws", "dynamo", "go")},
+		{expr: "DELETE tags :t", values: values{":t": ss("go")}, attribute: "tags", want: ss("aws")},
+
+		{expr: "SET followers = :one, followers = :one", values: values{":one": n("1")}, err: "Invalid UpdateExpression: Two document paths overlap with each other; must remove or rewrite one of these paths; path one: [followers], path two: [followers]"},
+		{expr: "SET reactions = :one REMOVE reactions.heart", values: values{":one": n("1")}, err: "Invalid UpdateExpression: Two document paths overlap with each other; must remove or rewrite one of these paths; path one: [reactions], path two: [reactions.heart]"},
+		{expr: "SET a = :one SET b = :one", values: values{":one": n("1")}, err: `Invalid UpdateExpression: The "SET" section can only be used once in an update expression;`},
+		{expr: "UPSERT a = :one", values: values{":one": n("1")}, err: `Invalid UpdateExpression: Syntax error; token: "UPSERT"`},
+		{expr: "SET photos = list_append(:one)", values: values{":one": l()}, err: `Invalid UpdateExpression: Syntax error; token: ")"`},
+		{expr: "SET a = size(photos)", err: "Invalid UpdateExpression: Invalid function name; function: size"},
+		{expr: "SET total = #n + :one", names: map[string]string{"#n": "name"}, values: values{":one": n("1")}, err: "An operand in the update expression has an incorrect data type; operator or function: +"},
+		{expr: "SET total = missing + :one", values: values{":one": n("1")}, err: "The provided expression refers to an attribute that does not exist in the item"},
+		{expr: "ADD #n :one", names: map[string]string{"#n": "name"}, values: values{":one": n("1")}, err: "An operand in the update expression has an incorrect data type; operator or function: ADD"},
+		{expr: "SET PK = :k", values: values{":k": s("USER#b")}, err: "One or more parameter values were invalid: Cannot update attribute PK. This attribute is part of the key"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			put(t, api, profile)
+			input := &dynamodb.UpdateItemInput{
+				TableName:        aws.String(testTable),
+				Key:              key("USER#a", "#METADATA#a"),
+				UpdateExpression: aws.String(tc.expr),
+				ReturnValues:     aws.String(dynamodb.ReturnValueAllNew),
+			}
+			if len(tc.names) > 0 {
+				input.ExpressionAttributeNames = aws.StringMap(tc.names)
+			}
+			if len(tc.values) > 0 {
+				input.ExpressionAttributeValues = tc.values
+			}
+			out, err := api.UpdateItem(input)
+			if tc.err != "" {
+				if errorCode(err) != "ValidationException" || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("err = %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := out.Attributes[tc.attribute]
+			switch {
+			case tc.want == nil && ok:
+				t.Errorf("%s = %s, want it removed", tc.attribute, got)
+			case tc.want != nil && !equalValues(got, tc.want):
+				t.Errorf("%s = %s, want %s", tc.attribute, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1024 @@
+package localdynamo
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	MAX_ITEM_SIZE        = 400 * 1024
+	MAX_PAGE_SIZE        = 1024 * 1024
+	MAX_BATCH_GET        = 100
+	MAX_BATCH_WRITE      = 25
+	MAX_TRANSACT_ITEMS   = 100
+	READ_UNIT_SIZE       = 4 * 1024
+	WRITE_UNIT_SIZE      = 1024
+	conditionalCheckText = "The conditional request failed"
+)
+
+// DynamoDB の項目サイズの数え方に合わせる
+// 属性名の長さと値の大きさの合計で、Map と List は 3 バイトと要素ごとに 1 バイトを足す
+func itemSize(it item) int {
+	size := 0
+	for name, v := range it {
+		size += len(name) + valueSize(v)
+	}
+	return size
+}
+
+func valueSize(v *dynamodb.AttributeValue) int {
+	switch typeOf(v) {
+	case "S":
+		return len(*v.S)
+	case "N":
+		return numberSize(*v.N)
+	case "B":
+		return len(v.B)
+	case "BOOL", "NULL":
+		return 1
+	case "M":
+		size := 3
+		for name, child := range v.M {
+			size += 1 + len(name) + valueSize(child)
+		}
+		return size
+	case "L":
+		size := 3
+		for _, child := range v.L {
+			size += 1 + valueSize(child)
+		}
+		return size
+	}
+	size := 0
+	for _, m := range setMembers(v) {
+		size += valueSize(m)
+	}
+	return size
+}
+
+// 数値は有効数字 2 桁ごとに 1 バイトと、1 バイトを足した大きさになる
+func numberSize(n string) int {
+	digits := strings.TrimLeft(strings.Map(func(r rune) rune {
+		if '0' <= r && r <= '9' {
+			return r
+		}
+		return -1
+	}, strings.SplitN(strings.ToLower(n), "e", 2)[0]), "0")
+	digits = strings.TrimRight(digits, "0")
+	return (len(digits)+1)/2 + 1
+}
+
+func units(size, unit int) float64 {
+	n := (size + unit - 1) / unit
+	if n == 0 {
+		n = 1
+	}
+	return float64(n)
+}
+
+func readUnits(size int, consistent bool) float64 {
+	u := units(size, READ_UNIT_SIZE)
+	if !consistent {
+		return u / 2
+	}
+	return u
+}
+
+// ReturnConsumedCapacity が TOTAL か INDEXES のときだけ返す
+func consumed(mode *string, table, indexName string, capacity float64) *dynamodb.ConsumedCapacity {
+	switch aws.StringValue(mode) {
+	case dynamodb.ReturnConsumedCapacityTotal:
+		return &dynamodb.ConsumedCapacity{TableName: aws.String(table), CapacityUnits: aws.Float64(capacity)}
+	case dynamodb.ReturnConsumedCapacityIndexes:
+		cc := &dynamodb.ConsumedCapacity{TableName: aws.String(table), CapacityUnits: aws.Float64(capacity)}
+		if indexName != "" {
+			cc.GlobalSecondaryIndexes = map[string]*dynamodb.Capacity{
+				indexName: {CapacityUnits: aws.Float64(capacity)},
+			}
+		} else {
+			cc.Table = &dynamodb.Capacity{CapacityUnits: aws.Float64(capacity)}
+		}
+		return cc
+	}
+	return nil
+}
+
+func (s *Server) validateStoredItem(t *table, it item) error {
+	if err := t.validateItem(it); err != nil {
+		return err
+	}
+	if itemSize(it) > MAX_ITEM_SIZE {
+		return validationError("Item size has exceeded the maximum allowed size")
+	}
+	return nil
+}
+
+func (s *Server) lookup(t *table, key item) (item, error) {
+	if err := t.validateKey(key, true); err != nil {
+		return nil, err
+	}
+	return t.items[t.storageKey(key)], nil
+}
+
+func conditionFailed() error {
+	return &apiError{code: "ConditionalCheckFailedException", message: conditionalCheckText}
+}
+
+// 条件式がなければ常に成り立つ
+func checkCondition(ec *expressionContext, expr *string, it item) (bool, error) {
+	if expr == nil {
+		return true, nil
+	}
+	c, err := ec.parseCondition("ConditionExpression", *expr)
+	if err != nil {
+		return false, err
+	}
+	return evalCondition(it, c)
+}
+
+func (s *Server) getItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	ec := newExpressionContext(input.ExpressionAttributeNames, nil)
+	var paths []path
+	if input.ProjectionExpression != nil {
+		if paths, err = ec.parseProjection(*input.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := ec.checkUnused(); err != nil {
+		return nil, err
+	}
+	it, err := s.lookup(t, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodb.GetItemOutput{
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, t.name, "", readUnits(itemSize(it), aws.BoolValue(input.ConsistentRead))),
+	}
+	if it != nil {
+		out.Item = project(it, paths)
+	}
+	return out, nil
+}
+
+func (s *Server) putItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	rv := aws.StringValue(input.ReturnValues)
+	if rv != "" && rv != dynamodb.ReturnValueNone && rv != dynamodb.ReturnValueAllOld {
+		return nil, validationError("ReturnValues can only be ALL_OLD or NONE")
+	}
+	if err := s.validateStoredItem(t, input.Item); err != nil {
+		return nil, err
+	}
+	old := t.items[t.storageKey(input.Item)]
+	ec := newExpressionContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	ok, err := checkCondition(ec, input.ConditionExpression, old)
+	if err != nil {
+		return nil, err
+	}
+	if err := ec.checkUnused(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+	s.store(t, t.storageKey(input.Item), copyItem(input.Item))
+	out := &dynamodb.PutItemOutput{
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, t.name, "", writeUnits(old, input.Item)),
+	}
+	if rv == dynamodb.ReturnValueAllOld && old != nil {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+// key のアイテムを it にする。it が nil なら削除する
+// OnWrite の関数があれば、変わったアイテムの前後のイメージのコピーを残しておく
+func (s *Server) store(t *table, key string, it item) {
+	old := t.items[key]
+	if it == nil {
+		delete(t.items, key)
+	} else {
+		t.items[key] = it
+	}
+	if len(s.onWrite) == 0 || (old == nil && it == nil) {
+		return
+	}
+	if old != nil && it != nil && equalValues(&dynamodb.AttributeValue{M: old}, &dynamodb.AttributeValue{M: it}) {
+		return
+	}
+	s.changes = append(s.changes, change{t.name, copyItem(old), copyItem(it)})
+}
+
+// 書き込み前と書き込み後の大きい方で数える
+func writeUnits(old, new item) float64 {
+	size := itemSize(old)
+	if n := itemSize(new); n > size {
+		size = n
+	}
+	return units(size, WRITE_UNIT_SIZE)
+}
+
+// 更新式を適用した結果を返す。書き込みはしない
+func (s *Server) prepareUpdate(t *table, ec *expressionContext, key item, expr *string) (item, *update, error) {
+	old, err := s.lookup(t, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expr == nil {
+		// 更新式がなければ、キーだけのアイテムを作る
+		if old != nil {
+			return copyItem(old), &update{}, nil
+		}
+		return copyItem(key), &update{}, nil
+	}
+	u, err := ec.parseUpdate(*expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name := range updatedAttributes(u) {
+		for _, k := range t.keys.names() {
+			if name == k {
+				return nil, nil, validationError("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", name)
+			}
+		}
+	}
+	base := old
+	if base == nil {
+		base = copyItem(key)
+	}
+	updated, err := applyUpdate(base, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.validateStoredItem(t, updated); err != nil {
+		return nil, nil, err
+	}
+	return updated, u, nil
+}
+
+func (s *Server) updateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.AttributeUpdates != nil || input.Expected != nil {
+		return nil, legacyParameter()
+	}
+	ec := newExpressionContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	updated, u, err := s.prepareUpdate(t, ec, input.Key, input.UpdateExpression)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[t.storageKey(input.Key)]
+	ok, err := checkCondition(ec, input.ConditionExpression, old)
+	if err != nil {
+		return nil, err
+	}
+	if err := ec.checkUnused(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+	s.store(t, t.storageKey(input.Key), updated)
+
+	out := &dynamodb.UpdateItemOutput{
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, t.name, "", writeUnits(old, updated)),
+	}
+	changed := updatedAttributes(u)
+	pick := func(it item, onlyChanged bool) item {
+		if it == nil {
+			return nil
+		}
+		result := make(item)
+		for name, v := range it {
+			if !onlyChanged || changed[name] {
+				result[name] = copyValue(v)
+			}
+		}
+		if len(result) == 0 {
+			return nil
+		}
+		return result
+	}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllOld:
+		out.Attributes = pick(old, false)
+	case dynamodb.ReturnValueUpdatedOld:
+		out.Attributes = pick(old, true)
+	case dynamodb.ReturnValueAllNew:
+		out.Attributes = pick(updated, false)
+	case dynamodb.ReturnValueUpdatedNew:
+		out.Attributes = pick(updated, true)
+	}
+	return out, nil
+}
+
+func (s *Server) deleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.Expected != nil {
+		return nil, legacyParameter()
+	}
+	old, err := s.lookup(t, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	ec := newExpressionContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	ok, err := checkCondition(ec, input.ConditionExpression, old)
+	if err != nil {
+		return nil, err
+	}
+	if err := ec.checkUnused(); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, conditionFailed()
+	}
+	s.store(t, t.storageKey(input.Key), nil)
+	out := &dynamodb.DeleteItemOutput{
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, t.name, "", writeUnits(old, nil)),
+	}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld && old != nil {
+		out.Attributes = copyItem(old)
+	}
+	return out, nil
+}
+
+// Query と Scan が読む対象。GSI なら射影したアイテムを GSI のキーの順番で並べる
+type source struct {
+	table     *table
+	index     *index
+	keys      keySchema
+	indexName string
+}
+
+func (s *Server) source(tableName, indexName *string, consistent *bool) (*source, error) {
+	t, err := s.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	src := &source{table: t, keys: t.keys}
+	if indexName != nil {
+		idx, err := t.index(aws.StringValue(indexName))
+		if err != nil {
+			return nil, err
+		}
+		if aws.BoolValue(consistent) {
+			return nil, validationError("Consistent reads are not supported on global secondary indexes")
+		}
+		src.index, src.keys, src.indexName = idx, idx.keys, idx.name
+	}
+	return src, nil
+}
+
+// GSI では同じキーのアイテムが複数あるので、テーブルのキーも使って順番を決める
+func (src *source) compare(a, b item) int {
+	if c := compareKeys(src.keys, a, b); c != 0 || src.index == nil {
+		return c
+	}
+	return compareKeys(src.table.keys, a, b)
+}
+
+func (src *source) items(filter func(item) bool) []item {
+	items := make([]item, 0)
+	for _, it := range src.table.items {
+		if src.index != nil {
+			if !src.index.contains(it) {
+				continue
+			}
+			it = src.index.project(src.table, it)
+		}
+		if filter == nil || filter(it) {
+			items = append(items, it)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return src.compare(items[i], items[j]) < 0
+	})
+	return items
+}
+
+// LastEvaluatedKey には、テーブルのキーと GSI のキーを入れる
+func (src *source) lastEvaluatedKey(it item) item {
+	key := keyOf(src.table.keys, it)
+	if src.index != nil {
+		for name, v := range keyOf(src.index.keys, it) {
+			key[name] = v
+		}
+	}
+	return key
+}
+
+type page struct {
+	items        []item
+	count        int
+	scannedCount int
+	lastKey      item
+	size         int
+}
+
+// ExclusiveStartKey の次から、Limit 件か 1MB まで読んでフィルターと射影をかける
+func (src *source) read(items []item, forward bool, start item, limit int64, filter condition, paths []path) (*page, error) {
+	if !forward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if start != nil {
+		pos := len(items)
+		for i, it := range items {
+			c := src.compare(it, start)
+			if (forward && c > 0) || (!forward && c < 0) {
+				pos = i
+				break
+			}
+		}
+		items = items[pos:]
+	}
+	p := &page{items: make([]item, 0)}
+	for i, it := range items {
+		if limit > 0 && int64(p.scannedCount) == limit {
+			p.lastKey = src.lastEvaluatedKey(items[i-1])
+			break
+		}
+		if p.size >= MAX_PAGE_SIZE {
+			p.lastKey = src.lastEvaluatedKey(items[i-1])
+			break
+		}
+		p.scannedCount++
+		p.size += itemSize(it)
+		if filter != nil {
+			ok, err := evalCondition(it, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		p.count++
+		p.items = append(p.items, project(it, paths))
+	}
+	return p, nil
+}
+
+func (src *source) validateStartKey(start item) error {
+	if start == nil {
+		return nil
+	}
+	names := append([]string{}, src.table.keys.names()...)
+	if src.index != nil {
+		names = append(names, src.index.keys.names()...)
+	}
+	for _, name := range names {
+		if _, ok := start[name]; !ok {
+			return validationError("The provided starting key is invalid: The provided key element does not match the schema")
+		}
+	}
+	return nil
+}
+
+// キー条件は、ハッシュキーの等号と、レンジキーへの条件 1 つだけを AND でつなげられる
+func keyConditionParts(c condition) []condition {
+	if and, ok := c.(andCondition); ok {
+		return append(keyConditionParts(and.a), keyConditionParts(and.b)...)
+	}
+	return []condition{c}
+}
+
+func keyAttribute(o operand) (string, bool) {
+	p, ok := o.(pathOperand)
+	if !ok || len(p.path) != 1 {
+		return "", false
+	}
+	return p.path[0].name, true
+}
+
+func isValue(o operand) bool {
+	_, ok := o.(valueOperand)
+	return ok
+}
+
+func validateKeyCondition(c condition, keys keySchema) (*dynamodb.AttributeValue, error) {
+	var hashValue *dynamodb.AttributeValue
+	rangeUsed := false
+	for _, part := range keyConditionParts(c) {
+		name := ""
+		valid := false
+		switch part := part.(type) {
+		case compareCondition:
+			name, valid = keyAttribute(part.a)
+			valid = valid && isValue(part.b) && part.op != "<>"
+			if valid && name == keys.hash {
+				if part.op != "=" {
+					return nil, validationError("Query key condition not supported")
+				}
+				hashValue = part.b.(valueOperand).value
+				continue
+			}
+		case betweenCondition:
+			name, valid = keyAttribute(part.v)
+			valid = valid && isValue(part.lo) && isValue(part.hi)
+		case functionCondition:
+			name, valid = keyAttribute(part.args[0])
+			valid = valid && part.name == "begins_with" && isValue(part.args[1])
+		}
+		if !valid || name == "" {
+			return nil, validationError("Invalid KeyConditionExpression: Query key condition not supported")
+		}
+		if name != keys.rangeKey || rangeUsed {
+			return nil, validationError("Query condition missed key schema element")
+		}
+		rangeUsed = true
+	}
+	if hashValue == nil {
+		return nil, validationError("Query condition missed key schema element: %s", keys.hash)
+	}
+	return hashValue, nil
+}
+
+// guregu/dynamo は Query で KeyConditions を送ってくるので、キー条件だけは古い形式も受け付けて式に置き換える
+func keyConditions(conditions map[string]*dynamodb.Condition) (condition, error) {
+	names := make([]string, 0, len(conditions))
+	for name := range conditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result condition
+	for _, name := range names {
+		c := conditions[name]
+		attr := pathOperand{path: path{{name: name}}}
+		values := make([]operand, len(c.AttributeValueList))
+		for i, v := range c.AttributeValueList {
+			values[i] = valueOperand{value: v}
+		}
+		want := 1
+		var part condition
+		switch op := aws.StringValue(c.ComparisonOperator); op {
+		case dynamodb.ComparisonOperatorEq, dynamodb.ComparisonOperatorLt, dynamodb.ComparisonOperatorLe, dynamodb.ComparisonOperatorGt, dynamodb.ComparisonOperatorGe:
+			symbols := map[string]string{"EQ": "=", "LT": "<", "LE": "<=", "GT": ">", "GE": ">="}
+			if len(values) == want {
+				part = compareCondition{op: symbols[op], a: attr, b: values[0]}
+			}
+		case dynamodb.ComparisonOperatorBeginsWith:
+			if len(values) == want {
+				part = functionCondition{name: "begins_with", args: []operand{attr, values[0]}}
+			}
+		case dynamodb.ComparisonOperatorBetween:
+			want = 2
+			if len(values) == want {
+				part = betweenCondition{v: attr, lo: values[0], hi: values[1]}
+			}
+		default:
+			return nil, validationError("One or more parameter values were invalid: Unsupported operator on KeyCondition: %s", op)
+		}
+		if part == nil {
+			return nil, validationError("One or more parameter values were invalid: Invalid number of argument(s) for the %s ComparisonOperator", aws.StringValue(c.ComparisonOperator))
+		}
+		if result == nil {
+			result = part
+		} else {
+			result = andCondition{a: result, b: part}
+		}
+	}
+	if result == nil {
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request.")
+	}
+	return result, nil
+}
+
+func (s *Server) query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	if input.QueryFilter != nil || input.AttributesToGet != nil {
+		return nil, legacyParameter()
+	}
+	src, err := s.source(input.TableName, input.IndexName, input.ConsistentRead)
+	if err != nil {
+		return nil, err
+	}
+	ec := newExpressionContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	var keyCondition condition
+	switch {
+	case input.KeyConditions != nil && input.KeyConditionExpression != nil:
+		return nil, validationError("Can not use both expression and non-expression parameters in the same request: Non-expression parameters: {KeyConditions} Expression parameters: {KeyConditionExpression}")
+	case input.KeyConditions != nil:
+		keyCondition, err = keyConditions(input.KeyConditions)
+	case input.KeyConditionExpression != nil:
+		keyCondition, err = ec.parseCondition("KeyConditionExpression", *input.KeyConditionExpression)
+	default:
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request.")
+	}
+	if err != nil {
+		return nil, err
+	}
+	hashValue, err := validateKeyCondition(keyCondition, src.keys)
+	if err != nil {
+		return nil, err
+	}
+	var filter condition
+	if input.FilterExpression != nil {
+		if filter, err = ec.parseCondition("FilterExpression", *input.FilterExpression); err != nil {
+			return nil, err
+		}
+	}
+	var paths []path
+	if input.ProjectionExpression != nil {
+		if paths, err = ec.parseProjection(*input.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := ec.checkUnused(); err != nil {
+		return nil, err
+	}
+	if err := src.validateStartKey(input.ExclusiveStartKey); err != nil {
+		return nil, err
+	}
+	if typeOf(hashValue) != src.table.attributes[src.keys.hash] {
+		return nil, validationError("One or more parameter values were invalid: Condition parameter type does not match schema type")
+	}
+
+	var evalErr error
+	items := src.items(func(it item) bool {
+		if !equalValues(it[src.keys.hash], hashValue) {
+			return false
+		}
+		ok, err := evalCondition(it, keyCondition)
+		if err != nil {
+			evalErr = err
+		}
+		return ok
+	})
+	if evalErr != nil {
+		return nil, evalErr
+	}
+	p, err := src.read(items, input.ScanIndexForward == nil || *input.ScanIndexForward, input.ExclusiveStartKey, aws.Int64Value(input.Limit), filter, paths)
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodb.QueryOutput{
+		Count:            aws.Int64(int64(p.count)),
+		ScannedCount:     aws.Int64(int64(p.scannedCount)),
+		LastEvaluatedKey: p.lastKey,
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, src.table.name, src.indexName, readUnits(p.size, aws.BoolValue(input.ConsistentRead))),
+	}
+	if aws.StringValue(input.Select) != dynamodb.SelectCount {
+		out.Items = p.items
+	}
+	return out, nil
+}
+
+// 並列スキャンでは、ハッシュキーのハッシュ値でセグメントに分ける
+func segmentOf(it item, keys keySchema, total int64) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(encodeKeyValue(it[keys.hash])))
+	return int64(h.Sum32()) % total
+}
+
+func (s *Server) scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	if input.ScanFilter != nil || input.AttributesToGet != nil {
+		return nil, legacyParameter()
+	}
+	src, err := s.source(input.TableName, input.IndexName, input.ConsistentRead)
+	if err != nil {
+		return nil, err
+	}
+	total := aws.Int64Value(input.TotalSegments)
+	segment := aws.Int64Value(input.Segment)
+	if (input.Segment == nil) != (input.TotalSegments == nil) {
+		return nil, validationError("The Segment parameter is required but was not present in the request when parameter TotalSegments is present")
+	}
+	if input.TotalSegments != nil && (total < 1 || segment < 0 || segment >= total) {
+		return nil, validationError("The Segment parameter is zero-based and must be less than parameter TotalSegments")
+	}
+	ec := newExpressionContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	var filter condition
+	if input.FilterExpression != nil {
+		if filter, err = ec.parseCondition("FilterExpression", *input.FilterExpression); err != nil {
+			return nil, err
+		}
+	}
+	var paths []path
+	if input.ProjectionExpression != nil {
+		if paths, err = ec.parseProjection(*input.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := ec.checkUnused(); err != nil {
+		return nil, err
+	}
+	if err := src.validateStartKey(input.ExclusiveStartKey); err != nil {
+		return nil, err
+	}
+	items := src.items(func(it item) bool {
+		return input.TotalSegments == nil || segmentOf(it, src.table.keys, total) == segment
+	})
+	p, err := src.read(items, true, input.ExclusiveStartKey, aws.Int64Value(input.Limit), filter, paths)
+	if err != nil {
+		return nil, err
+	}
+	out := &dynamodb.ScanOutput{
+		Count:            aws.Int64(int64(p.count)),
+		ScannedCount:     aws.Int64(int64(p.scannedCount)),
+		LastEvaluatedKey: p.lastKey,
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, src.table.name, src.indexName, readUnits(p.size, aws.BoolValue(input.ConsistentRead))),
+	}
+	if aws.StringValue(input.Select) != dynamodb.SelectCount {
+		out.Items = p.items
+	}
+	return out, nil
+}
+
+// 処理しきれなかったキーは返さないので、UnprocessedKeys は常に空になる
+func (s *Server) batchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	total := 0
+	for _, ka := range input.RequestItems {
+		total += len(ka.Keys)
+	}
+	if total == 0 || total > MAX_BATCH_GET {
+		return nil, validationError("Too many items requested for the BatchGetItem call")
+	}
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       make(map[string][]map[string]*dynamodb.AttributeValue),
+		UnprocessedKeys: make(map[string]*dynamodb.KeysAndAttributes),
+	}
+	for name, ka := range input.RequestItems {
+		t, err := s.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		if ka.AttributesToGet != nil {
+			return nil, legacyParameter()
+		}
+		ec := newExpressionContext(ka.ExpressionAttributeNames, nil)
+		var paths []path
+		if ka.ProjectionExpression != nil {
+			if paths, err = ec.parseProjection(*ka.ProjectionExpression); err != nil {
+				return nil, err
+			}
+		}
+		if err := ec.checkUnused(); err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(ka.Keys))
+		size := 0
+		out.Responses[name] = make([]map[string]*dynamodb.AttributeValue, 0)
+		for _, key := range ka.Keys {
+			it, err := s.lookup(t, key)
+			if err != nil {
+				return nil, err
+			}
+			if seen[t.storageKey(key)] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			seen[t.storageKey(key)] = true
+			if it != nil {
+				size += itemSize(it)
+				out.Responses[name] = append(out.Responses[name], project(it, paths))
+			}
+		}
+		if cc := consumed(input.ReturnConsumedCapacity, name, "", readUnits(size, aws.BoolValue(ka.ConsistentRead))); cc != nil {
+			out.ConsumedCapacity = append(out.ConsumedCapacity, cc)
+		}
+	}
+	return out, nil
+}
+
+func (s *Server) batchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	total := 0
+	for _, requests := range input.RequestItems {
+		total += len(requests)
+	}
+	if total == 0 || total > MAX_BATCH_WRITE {
+		return nil, validationError("Too many items requested for the BatchWriteItem call")
+	}
+	type write struct {
+		table *table
+		key   string
+		item  item
+	}
+	writes := make([]write, 0, total)
+	seen := make(map[string]bool, total)
+	for name, requests := range input.RequestItems {
+		t, err := s.table(aws.String(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range requests {
+			var w write
+			switch {
+			case r.PutRequest != nil && r.DeleteRequest == nil:
+				if err := s.validateStoredItem(t, r.PutRequest.Item); err != nil {
+					return nil, err
+				}
+				w = write{t, t.storageKey(r.PutRequest.Item), r.PutRequest.Item}
+			case r.DeleteRequest != nil && r.PutRequest == nil:
+				if err := t.validateKey(r.DeleteRequest.Key, true); err != nil {
+					return nil, err
+				}
+				w = write{t, t.storageKey(r.DeleteRequest.Key), nil}
+			default:
+				return nil, validationError("Supplied AttributeValue has more than one datatypes set, must contain exactly one of the supported datatypes")
+			}
+			if seen[name+"\x00"+w.key] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			seen[name+"\x00"+w.key] = true
+			writes = append(writes, w)
+		}
+	}
+	out := &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: make(map[string][]*dynamodb.WriteRequest),
+	}
+	capacity := make(map[string]float64)
+	for _, w := range writes {
+		old := w.table.items[w.key]
+		capacity[w.table.name] += writeUnits(old, w.item)
+		s.store(w.table, w.key, copyItem(w.item))
+	}
+	for name, c := range capacity {
+		if cc := consumed(input.ReturnConsumedCapacity, name, "", c); cc != nil {
+			out.ConsumedCapacity = append(out.ConsumedCapacity, cc)
+		}
+	}
+	return out, nil
+}
+
+func (s *Server) transactGetItems(input *dynamodb.TransactGetItemsInput) (*dynamodb.TransactGetItemsOutput, error) {
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > MAX_TRANSACT_ITEMS {
+		return nil, validationError("Member must have length less than or equal to %d", MAX_TRANSACT_ITEMS)
+	}
+	out := &dynamodb.TransactGetItemsOutput{}
+	capacity := make(map[string]float64)
+	for _, ti := range input.TransactItems {
+		get := ti.Get
+		if get == nil {
+			return nil, validationError("TransactItems must contain Get")
+		}
+		t, err := s.table(get.TableName)
+		if err != nil {
+			return nil, err
+		}
+		ec := newExpressionContext(get.ExpressionAttributeNames, nil)
+		var paths []path
+		if get.ProjectionExpression != nil {
+			if paths, err = ec.parseProjection(*get.ProjectionExpression); err != nil {
+				return nil, err
+			}
+		}
+		if err := ec.checkUnused(); err != nil {
+			return nil, err
+		}
+		it, err := s.lookup(t, get.Key)
+		if err != nil {
+			return nil, err
+		}
+		capacity[t.name] += 2 * units(itemSize(it), READ_UNIT_SIZE)
+		resp := &dynamodb.ItemResponse{}
+		if it != nil {
+			resp.Item = project(it, paths)
+		}
+		out.Responses = append(out.Responses, resp)
+	}
+	for name, c := range capacity {
+		if cc := consumed(input.ReturnConsumedCapacity, name, "", c); cc != nil {
+			out.ConsumedCapacity = append(out.ConsumedCapacity, cc)
+		}
+	}
+	return out, nil
+}
+
+// すべての条件を確かめてから、まとめて書き込む
+// 条件を満たさないものがあれば、何も書き込まずに TransactionCanceledException を返す
+func (s *Server) transactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if len(input.TransactItems) == 0 || len(input.TransactItems) > MAX_TRANSACT_ITEMS {
+		return nil, validationError("Member must have length less than or equal to %d", MAX_TRANSACT_ITEMS)
+	}
+	type write struct {
+		table *table
+		key   string
+		item  item
+	}
+	writes := make([]write, 0, len(input.TransactItems))
+	reasons := make([]*dynamodb.CancellationReason, 0, len(input.TransactItems))
+	canceled := false
+	seen := make(map[string]bool)
+	for _, ti := range input.TransactItems {
+		var (
+			tableName *string
+			key       item
+			expr      *string
+			names     map[string]*string
+			values    map[string]*dynamodb.AttributeValue
+			onFailure *string
+		)
+		ops := 0
+		if ti.ConditionCheck != nil {
+			ops++
+			c := ti.ConditionCheck
+			tableName, key, expr, names, values, onFailure = c.TableName, c.Key, c.ConditionExpression, c.ExpressionAttributeNames, c.ExpressionAttributeValues, c.ReturnValuesOnConditionCheckFailure
+			if expr == nil {
+				return nil, validationError("ConditionCheck requires a ConditionExpression")
+			}
+		}
+		if ti.Put != nil {
+			ops++
+			c := ti.Put
+			tableName, key, expr, names, values, onFailure = c.TableName, c.Item, c.ConditionExpression, c.ExpressionAttributeNames, c.ExpressionAttributeValues, c.ReturnValuesOnConditionCheckFailure
+		}
+		if ti.Update != nil {
+			ops++
+			c := ti.Update
+			tableName, key, expr, names, values, onFailure = c.TableName, c.Key, c.ConditionExpression, c.ExpressionAttributeNames, c.ExpressionAttributeValues, c.ReturnValuesOnConditionCheckFailure
+		}
+		if ti.Delete != nil {
+			ops++
+			c := ti.Delete
+			tableName, key, expr, names, values, onFailure = c.TableName, c.Key, c.ConditionExpression, c.ExpressionAttributeNames, c.ExpressionAttributeValues, c.ReturnValuesOnConditionCheckFailure
+		}
+		if ops != 1 {
+			return nil, validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+		}
+		t, err := s.table(tableName)
+		if err != nil {
+			return nil, err
+		}
+		ec := newExpressionContext(names, values)
+
+		w := write{table: t}
+		switch {
+		case ti.Put != nil:
+			if err := s.validateStoredItem(t, key); err != nil {
+				return nil, err
+			}
+			w.item = copyItem(key)
+			key = keyOf(t.keys, key)
+		case ti.Update != nil:
+			updated, _, err := s.prepareUpdate(t, ec, key, ti.Update.UpdateExpression)
+			if err != nil {
+				return nil, err
+			}
+			w.item = updated
+		}
+		old, err := s.lookup(t, key)
+		if err != nil {
+			return nil, err
+		}
+		w.key = t.storageKey(key)
+		if seen[t.name+"\x00"+w.key] {
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[t.name+"\x00"+w.key] = true
+
+		ok, err := checkCondition(ec, expr, old)
+		if err != nil {
+			return nil, err
+		}
+		if err := ec.checkUnused(); err != nil {
+			return nil, err
+		}
+		if !ok {
+			canceled = true
+			reason := &dynamodb.CancellationReason{
+				Code:    aws.String("ConditionalCheckFailed"),
+				Message: aws.String(conditionalCheckText),
+			}
+			if aws.StringValue(onFailure) == dynamodb.ReturnValuesOnConditionCheckFailureAllOld && old != nil {
+				reason.Item = copyItem(old)
+			}
+			reasons = append(reasons, reason)
+		} else {
+			reasons = append(reasons, &dynamodb.CancellationReason{Code: aws.String("None")})
+		}
+		if ti.ConditionCheck == nil {
+			writes = append(writes, w)
+		}
+	}
+	if canceled {
+		return nil, transactionCanceled(reasons)
+	}
+	out := &dynamodb.TransactWriteItemsOutput{}
+	capacity := make(map[string]float64)
+	for _, w := range writes {
+		capacity[w.table.name] += 2 * writeUnits(w.table.items[w.key], w.item)
+		s.store(w.table, w.key, w.item)
+	}
+	for name, c := range capacity {
+		if cc := consumed(input.ReturnConsumedCapacity, name, "", c); cc != nil {
+			out.ConsumedCapacity = append(out.ConsumedCapacity, cc)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,176 @@
+package localdynamo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var following = item{
+	"PK": s("FOLLOW#b"),
+	"SK": s("FOLLOWER#a"),
+}
+
+func conditionCheck(k item, expr string, v values) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{ConditionCheck: &dynamodb.ConditionCheck{
+		TableName:                           aws.String(testTable),
+		Key:                                 k,
+		ConditionExpression:                 aws.String(expr),
+		ExpressionAttributeValues:           v,
+		ReturnValuesOnConditionCheckFailure: aws.String(dynamodb.ReturnValuesOnConditionCheckFailureAllOld),
+	}}
+}
+
+func putIfNotExists(it item) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+		TableName:           aws.String(testTable),
+		Item:                it,
+		ConditionExpression: aws.String("attribute_not_exists(SK)"),
+	}}
+}
+
+// followers を持たないアイテムは 0 から数える
+func incrementFollowers(k item) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{Update: &dynamodb.Update{
+		TableName:                 aws.String(testTable),
+		Key:                       k,
+		UpdateExpression:          aws.String("SET followers = if_not_exists(followers, :zero) + :one"),
+		ExpressionAttributeValues: values{":zero": n("0"), ":one": n("1")},
+	}}
+}
+
+// 取り消しの理由はリクエストのアイテムと同じ順番に並び、条件を満たしたアイテムは None になる
+// ALL_OLD を指定したアイテムは、理由に書き込む前のアイテムが入る
+func TestTransactWriteItemsCancellationReasons(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		items   []*dynamodb.TransactWriteItem
+		reasons []string
+		old     item
+	}{
+		{
+			name:  "all conditions hold",
+			items: []*dynamodb.TransactWriteItem{putIfNotExists(following), incrementFollowers(key("USER#a", "#METADATA#a"))},
+		},
+		{
+			name: "first item fails",
+			items: []*dynamodb.TransactWriteItem{
+				conditionCheck(key("USER#a", "#METADATA#a"), "attribute_not_exists(PK)", nil),
+				putIfNotExists(following),
+				incrementFollowers(key("USER#b", "#METADATA#b")),
+			},
+			reasons: []string{"ConditionalCheckFailed", "None", "None"},
+			old:     profile,
+		},
+		{
+			name: "middle item fails",
+			items: []*dynamodb.TransactWriteItem{
+				putIfNotExists(following),
+				conditionCheck(key("USER#a", "#METADATA#a"), "followers > :n", values{":n": n("10")}),
+				incrementFollowers(key("USER#b", "#METADATA#b")),
+			},
+			reasons: []string{"None", "ConditionalCheckFailed", "None"},
+			old:     profile,
+		},
+		{
+			name: "missing item has no old image",
+			items: []*dynamodb.TransactWriteItem{
+				putIfNotExists(following),
+				conditionCheck(key("USER#c", "#METADATA#c"), "attribute_exists(PK)", nil),
+			},
+			reasons: []string{"None", "ConditionalCheckFailed"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := newTestClient(t, profile, key("USER#b", "#METADATA#b"))
+			_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: tc.items})
+			if tc.reasons == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if items := queryIndex(t, api, "InvertedIndex", "SK", s("FOLLOWER#a")); len(items) != 1 {
+					t.Errorf("got %d followings, want the written one", len(items))
+				}
+				return
+			}
+
+			var canceled *dynamodb.TransactionCanceledException
+			if !errors.As(err, &canceled) {
+				t.Fatalf("err = %v, want TransactionCanceledException", err)
+			}
+			var got []string
+			for _, r := range canceled.CancellationReasons {
+				got = append(got, aws.StringValue(r.Code))
+			}
+			if strings.Join(got, ",") != strings.Join(tc.reasons, ",") {
+				t.Errorf("reasons = %v, want %v", got, tc.reasons)
+			}
+			for i, r := range canceled.CancellationReasons {
+				if r.Item == nil {
+					continue
+				}
+				if tc.reasons[i] != "ConditionalCheckFailed" || tc.old == nil || projectedNames(r.Item) != projectedNames(tc.old) {
+					t.Errorf("reason %d item = %v, want %v", i, r.Item, tc.old)
+				}
+			}
+			if tc.old != nil && !hasItem(canceled.CancellationReasons) {
+				t.Error("no old image in the reasons, want ALL_OLD")
+			}
+
+			// 取り消したトランザクションは何も書き込まない
+			if items := queryIndex(t, api, "InvertedIndex", "SK", s("FOLLOWER#a")); len(items) != 0 {
+				t.Errorf("got %d followings after the cancel, want none", len(items))
+			}
+			out, err := api.GetItem(&dynamodb.GetItemInput{TableName: aws.String(testTable), Key: key("USER#a", "#METADATA#a")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalValues(out.Item["followers"], profile["followers"]) {
+				t.Errorf("followers = %s after the cancel, want %s", out.Item["followers"], profile["followers"])
+			}
+		})
+	}
+}
+
+func hasItem(reasons []*dynamodb.CancellationReason) bool {
+	for _, r := range reasons {
+		if r.Item != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// リクエストそのものの誤りは、取り消しではなく ValidationException になる
+func TestTransactWriteItemsValidation(t *testing.T) {
+	api := newTestClient(t, profile)
+	for _, tc := range []struct {
+		name  string
+		items []*dynamodb.TransactWriteItem
+		want  string
+	}{
+		{
+			name:  "two operations on one item",
+			items: []*dynamodb.TransactWriteItem{incrementFollowers(key("USER#a", "#METADATA#a")), conditionCheck(key("USER#a", "#METADATA#a"), "attribute_exists(PK)", nil)},
+			want:  "Transaction request cannot include multiple operations on one item",
+		},
+		{
+			name: "two operations in one entry",
+			items: []*dynamodb.TransactWriteItem{{
+				Put:    putIfNotExists(following).Put,
+				Delete: &dynamodb.Delete{TableName: aws.String(testTable), Key: key("USER#a", "#METADATA#a")},
+			}},
+			want: "TransactItems can only contain one of Check, Put, Update or Delete",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: tc.items})
+			if errorCode(err) != "ValidationException" || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("err = %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
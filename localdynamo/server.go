@@ -0,0 +1,244 @@
+// localdynamo は、このリポジトリが使う DynamoDB の操作だけを JSON のワイヤープロトコルで受け付けるサーバー
+//
+// aws-sdk と guregu/dynamo のコードに手を入れずに、エンドポイントを差し替えるだけでオフラインで動かすためのもの
+// アイテムはメモリーに置き、リクエストはひとつずつ順番に処理する
+package localdynamo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	TARGET_PREFIX  = "DynamoDB_20120810."
+	ERROR_PREFIX   = "com.amazonaws.dynamodb.v20120810#"
+	CONTENT_TYPE   = "application/x-amz-json-1.0"
+	DEFAULT_REGION = "ap-northeast-1"
+	MAX_BODY_SIZE  = 16 * 1024 * 1024
+)
+
+type Server struct {
+	mu     sync.Mutex
+	tables map[string]*table
+	region string
+	now    func() time.Time
+	// 処理中のリクエストで変わったアイテム。リクエストを処理し終えてから onWrite に渡す
+	changes []change
+	onWrite []WriteFunc
+
+	// nil でなければ、内部エラーを書き出す
+	ErrorLog *log.Logger
+}
+
+func New() *Server {
+	return &Server{
+		tables: make(map[string]*table),
+		region: DEFAULT_REGION,
+		now:    time.Now,
+	}
+}
+
+// 書き込みで変わったアイテムの、書き込み前と書き込み後のイメージを受け取る関数
+// 新しく作られたアイテムの old と、削除されたアイテムの new は nil になる
+type WriteFunc func(table string, old, new map[string]*dynamodb.AttributeValue)
+
+type change struct {
+	table    string
+	old, new item
+}
+
+// アイテムが変わるたびに fn を呼ぶ。DynamoDB Streams の NEW_AND_OLD_IMAGES の代わりに使う
+// トランザクションとバッチは、書き込みが確定した後にアイテムの順番どおりに呼ぶ。値の変わらない書き込みでは呼ばない
+func (s *Server) OnWrite(fn WriteFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onWrite = append(s.onWrite, fn)
+}
+
+// 操作ごとに、入力の型と処理する関数を結びつける
+type operation struct {
+	input func() interface{}
+	run   func(s *Server, input interface{}) (interface{}, error)
+}
+
+func op[I any, O any](fn func(s *Server, input *I) (*O, error)) operation {
+	return operation{
+		input: func() interface{} { return new(I) },
+		run: func(s *Server, input interface{}) (interface{}, error) {
+			return fn(s, input.(*I))
+		},
+	}
+}
+
+var operations = map[string]operation{
+	"CreateTable":        op((*Server).createTable),
+	"UpdateTable":        op((*Server).updateTable),
+	"DescribeTable":      op((*Server).describeTable),
+	"DeleteTable":        op((*Server).deleteTable),
+	"ListTables":         op((*Server).listTables),
+	"DescribeTimeToLive": op((*Server).describeTimeToLive),
+	"UpdateTimeToLive":   op((*Server).updateTimeToLive),
+	"GetItem":            op((*Server).getItem),
+	"PutItem":            op((*Server).putItem),
+	"UpdateItem":         op((*Server).updateItem),
+	"DeleteItem":         op((*Server).deleteItem),
+	"Query":              op((*Server).query),
+	"Scan":               op((*Server).scan),
+	"BatchGetItem":       op((*Server).batchGetItem),
+	"BatchWriteItem":     op((*Server).batchWriteItem),
+	"TransactGetItems":   op((*Server).transactGetItems),
+	"TransactWriteItems": op((*Server).transactWriteItems),
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-amzn-RequestId", requestID())
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeError(w, &apiError{code: "UnknownOperationException", status: http.StatusMethodNotAllowed})
+		return
+	}
+	target := r.Header.Get("X-Amz-Target")
+	operation, ok := operations[strings.TrimPrefix(target, TARGET_PREFIX)]
+	if !ok || !strings.HasPrefix(target, TARGET_PREFIX) {
+		s.writeError(w, &apiError{code: "UnknownOperationException"})
+		return
+	}
+
+	input := operation.input()
+	if err := jsonutil.UnmarshalJSON(input, http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)); err != nil {
+		s.writeError(w, &apiError{code: "SerializationException", message: err.Error()})
+		return
+	}
+	if v, ok := input.(request.Validator); ok {
+		if err := v.Validate(); err != nil {
+			s.writeError(w, validationError("%s", validateText(err)))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	output, err := operation.run(s, input)
+	changes, onWrite := s.changes, s.onWrite
+	s.changes = nil
+	s.mu.Unlock()
+	// ロックを放してから呼ぶので、関数の中からこのサーバーに書き込んでもよい
+	for _, c := range changes {
+		for _, fn := range onWrite {
+			fn(c.table, c.old, c.new)
+		}
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	body, err := jsonutil.BuildJSON(output)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	w.Write(body)
+}
+
+// SDK の検証エラーは改行を含むので、1 行にまとめる
+func validateText(err error) string {
+	var invalid request.ErrInvalidParams
+	if errors.As(err, &invalid) {
+		messages := make([]string, 0, invalid.Len())
+		for _, e := range invalid.OrigErrs() {
+			messages = append(messages, e.Error())
+		}
+		return strings.Join(messages, "; ")
+	}
+	return err.Error()
+}
+
+func requestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+type apiError struct {
+	code    string
+	message string
+	status  int
+	reasons []*dynamodb.CancellationReason
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+// SDK は __type の # より後ろをエラーコードとして読む
+// TransactionCanceledException の CancellationReasons は、SDK がそのまま awserr に詰め直す
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	var aerr *apiError
+	if !errors.As(err, &aerr) {
+		if s.ErrorLog != nil {
+			s.ErrorLog.Printf("localdynamo: %s", err)
+		}
+		aerr = &apiError{code: "InternalServerError", message: "Internal server error", status: http.StatusInternalServerError}
+	}
+	status := aerr.status
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	body := struct {
+		Type                string            `json:"__type"`
+		Message             string            `json:"message,omitempty"`
+		CancellationReasons []json.RawMessage `json:"CancellationReasons,omitempty"`
+	}{Type: ERROR_PREFIX + aerr.code, Message: aerr.message}
+	// AttributeValue はワイヤー形式で書き出す必要があるので、SDK のエンコーダーを通す
+	for _, r := range aerr.reasons {
+		b, err := jsonutil.BuildJSON(r)
+		if err != nil {
+			b = []byte("{}")
+		}
+		body.CancellationReasons = append(body.CancellationReasons, b)
+	}
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func validationError(format string, args ...interface{}) error {
+	return &apiError{code: "ValidationException", message: fmt.Sprintf(format, args...)}
+}
+
+func resourceNotFound(format string, args ...interface{}) error {
+	return &apiError{code: "ResourceNotFoundException", message: fmt.Sprintf(format, args...)}
+}
+
+func resourceInUse(format string, args ...interface{}) error {
+	return &apiError{code: "ResourceInUseException", message: fmt.Sprintf(format, args...)}
+}
+
+// Expected や QueryFilter などの古いパラメーターは、このリポジトリで使っていないので受け付けない
+func legacyParameter() error {
+	return validationError("Legacy parameters are not supported; use expressions instead")
+}
+
+func transactionCanceled(reasons []*dynamodb.CancellationReason) error {
+	codes := make([]string, 0, len(reasons))
+	for _, r := range reasons {
+		codes = append(codes, *r.Code)
+	}
+	return &apiError{
+		code:    "TransactionCanceledException",
+		message: fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", ")),
+		reasons: reasons,
+	}
+}
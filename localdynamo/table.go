@@ -0,0 +1,563 @@
+package localdynamo
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type keySchema struct {
+	hash     string
+	rangeKey string
+}
+
+func newKeySchema(elements []*dynamodb.KeySchemaElement) (keySchema, error) {
+	var ks keySchema
+	for _, e := range elements {
+		switch aws.StringValue(e.KeyType) {
+		case dynamodb.KeyTypeHash:
+			if ks.hash != "" {
+				return ks, validationError("Invalid KeySchema: Too many hash keys")
+			}
+			ks.hash = aws.StringValue(e.AttributeName)
+		case dynamodb.KeyTypeRange:
+			if ks.rangeKey != "" {
+				return ks, validationError("Invalid KeySchema: Too many range keys")
+			}
+			ks.rangeKey = aws.StringValue(e.AttributeName)
+		default:
+			return ks, validationError("Invalid KeyType: %s", aws.StringValue(e.KeyType))
+		}
+	}
+	if ks.hash == "" {
+		return ks, validationError("Invalid KeySchema: No Hash Key specified")
+	}
+	return ks, nil
+}
+
+func (ks keySchema) elements() []*dynamodb.KeySchemaElement {
+	elements := []*dynamodb.KeySchemaElement{
+		{AttributeName: aws.String(ks.hash), KeyType: aws.String(dynamodb.KeyTypeHash)},
+	}
+	if ks.rangeKey != "" {
+		elements = append(elements, &dynamodb.KeySchemaElement{
+			AttributeName: aws.String(ks.rangeKey),
+			KeyType:       aws.String(dynamodb.KeyTypeRange),
+		})
+	}
+	return elements
+}
+
+func (ks keySchema) names() []string {
+	if ks.rangeKey == "" {
+		return []string{ks.hash}
+	}
+	return []string{ks.hash, ks.rangeKey}
+}
+
+type index struct {
+	name       string
+	keys       keySchema
+	projection *dynamodb.Projection
+	throughput *dynamodb.ProvisionedThroughput
+}
+
+// GSI に射影される属性だけを残す
+// テーブルのキーと GSI のキーは常に含まれる
+func (idx *index) project(t *table, it item) item {
+	switch aws.StringValue(idx.projection.ProjectionType) {
+	case dynamodb.ProjectionTypeAll:
+		return copyItem(it)
+	}
+	keep := make(map[string]bool)
+	for _, name := range append(t.keys.names(), idx.keys.names()...) {
+		keep[name] = true
+	}
+	if aws.StringValue(idx.projection.ProjectionType) == dynamodb.ProjectionTypeInclude {
+		for _, name := range idx.projection.NonKeyAttributes {
+			keep[aws.StringValue(name)] = true
+		}
+	}
+	result := make(item, len(keep))
+	for name := range keep {
+		if v, ok := it[name]; ok {
+			result[name] = copyValue(v)
+		}
+	}
+	return result
+}
+
+type table struct {
+	name         string
+	keys         keySchema
+	attributes   map[string]string
+	indexes      []*index
+	billingMode  string
+	throughput   *dynamodb.ProvisionedThroughput
+	ttlAttribute string
+	createdAt    time.Time
+	items        map[string]item
+}
+
+// キーの属性値を、型を含めた文字列にしてアイテムの識別に使う
+func encodeKeyValue(av *dynamodb.AttributeValue) string {
+	switch {
+	case av.S != nil:
+		return "S:" + *av.S
+	case av.N != nil:
+		n, ok := parseNumber(*av.N)
+		if ok {
+			return "N:" + formatNumber(n)
+		}
+		return "N:" + *av.N
+	case av.B != nil:
+		return fmt.Sprintf("B:%x", av.B)
+	}
+	return ""
+}
+
+func (t *table) storageKey(it item) string {
+	key := encodeKeyValue(it[t.keys.hash])
+	if t.keys.rangeKey != "" {
+		key += "\x00" + encodeKeyValue(it[t.keys.rangeKey])
+	}
+	return key
+}
+
+func (t *table) index(name string) (*index, error) {
+	for _, idx := range t.indexes {
+		if idx.name == name {
+			return idx, nil
+		}
+	}
+	return nil, validationError("The table does not have the specified index: %s", name)
+}
+
+// キーの属性がそろっていて、型が AttributeDefinitions と一致していることを確かめる
+func (t *table) validateKey(key item, exact bool) error {
+	names := t.keys.names()
+	if exact && len(key) != len(names) {
+		return validationError("The provided key element does not match the schema")
+	}
+	for _, name := range names {
+		v, ok := key[name]
+		if !ok {
+			if exact {
+				return validationError("The provided key element does not match the schema")
+			}
+			return validationError("One or more parameter values were invalid: Missing the key %s in the item", name)
+		}
+		if typeOf(v) != t.attributes[name] {
+			return validationError("One or more parameter values were invalid: Type mismatch for key %s expected: %s actual: %s", name, t.attributes[name], typeOf(v))
+		}
+		if (v.S != nil && *v.S == "") || (v.B != nil && len(v.B) == 0) {
+			return validationError("One or more parameter values are not valid. The AttributeValue for a key attribute cannot contain an empty string value. Key: %s", name)
+		}
+	}
+	return nil
+}
+
+// GSI のキーになる属性は、あれば型が一致していなければならない
+func (t *table) validateItem(it item) error {
+	if err := t.validateKey(it, false); err != nil {
+		return err
+	}
+	for _, idx := range t.indexes {
+		for _, name := range idx.keys.names() {
+			if v, ok := it[name]; ok && typeOf(v) != t.attributes[name] {
+				return validationError("One or more parameter values were invalid: Type mismatch for Index Key %s Expected: %s Actual: %s IndexName: %s", name, t.attributes[name], typeOf(v), idx.name)
+			}
+		}
+	}
+	for name, v := range it {
+		if err := validateValue(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateValue(name string, v *dynamodb.AttributeValue) error {
+	switch typeOf(v) {
+	case "":
+		return validationError("Supplied AttributeValue is empty, must contain exactly one of the supported datatypes")
+	case "N":
+		if !validNumber(*v.N) {
+			return validationError("The parameter cannot be converted to a numeric value: %s", *v.N)
+		}
+	case "SS", "NS", "BS":
+		members := setMembers(v)
+		if len(members) == 0 {
+			return validationError("One or more parameter values were invalid: An %s may not be empty", setName(typeOf(v)))
+		}
+		for i := range members {
+			if members[i].N != nil && !validNumber(*members[i].N) {
+				return validationError("The parameter cannot be converted to a numeric value: %s", *members[i].N)
+			}
+			for j := i + 1; j < len(members); j++ {
+				if equalValues(members[i], members[j]) {
+					return validationError("One or more parameter values were invalid: Input collection contains duplicates")
+				}
+			}
+		}
+	case "M":
+		for k, child := range v.M {
+			if err := validateValue(k, child); err != nil {
+				return err
+			}
+		}
+	case "L":
+		for _, child := range v.L {
+			if err := validateValue(name, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setName(typ string) string {
+	switch typ {
+	case "SS":
+		return "string set"
+	case "NS":
+		return "number set"
+	}
+	return "binary set"
+}
+
+func keyOf(keys keySchema, it item) item {
+	key := make(item, 2)
+	for _, name := range keys.names() {
+		if v, ok := it[name]; ok {
+			key[name] = copyValue(v)
+		}
+	}
+	return key
+}
+
+// キーの並び順。ハッシュキーの順番は DynamoDB では決まっていないが、ページングのために固定する
+func compareKeys(keys keySchema, a, b item) int {
+	if c := compareKeyValue(a[keys.hash], b[keys.hash]); c != 0 {
+		return c
+	}
+	if keys.rangeKey == "" {
+		return 0
+	}
+	return compareKeyValue(a[keys.rangeKey], b[keys.rangeKey])
+}
+
+func compareKeyValue(a, b *dynamodb.AttributeValue) int {
+	if c, ok := compareValues(a, b); ok {
+		return c
+	}
+	return bytes.Compare([]byte(encodeKeyValue(a)), []byte(encodeKeyValue(b)))
+}
+
+// テーブルのアイテムをキーの順番に並べて返す
+func (t *table) sortedItems() []item {
+	items := make([]item, 0, len(t.items))
+	for _, it := range t.items {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return compareKeys(t.keys, items[i], items[j]) < 0
+	})
+	return items
+}
+
+func (s *Server) table(name *string) (*table, error) {
+	t, ok := s.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, resourceNotFound("Requested resource not found: Table: %s not found", aws.StringValue(name))
+	}
+	return t, nil
+}
+
+func (s *Server) describe(t *table) *dynamodb.TableDescription {
+	attributes := make([]*dynamodb.AttributeDefinition, 0, len(t.attributes))
+	for name, typ := range t.attributes {
+		attributes = append(attributes, &dynamodb.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: aws.String(typ),
+		})
+	}
+	sort.Slice(attributes, func(i, j int) bool {
+		return aws.StringValue(attributes[i].AttributeName) < aws.StringValue(attributes[j].AttributeName)
+	})
+	desc := &dynamodb.TableDescription{
+		TableName:            aws.String(t.name),
+		TableArn:             aws.String(fmt.Sprintf("arn:aws:dynamodb:%s:000000000000:table/%s", s.region, t.name)),
+		TableStatus:          aws.String(dynamodb.TableStatusActive),
+		KeySchema:            t.keys.elements(),
+		AttributeDefinitions: attributes,
+		CreationDateTime:     aws.Time(t.createdAt),
+		ItemCount:            aws.Int64(int64(len(t.items))),
+		TableSizeBytes:       aws.Int64(t.sizeBytes()),
+	}
+	if t.billingMode == dynamodb.BillingModePayPerRequest {
+		desc.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: aws.String(t.billingMode)}
+	} else if t.throughput != nil {
+		desc.ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{
+			ReadCapacityUnits:  t.throughput.ReadCapacityUnits,
+			WriteCapacityUnits: t.throughput.WriteCapacityUnits,
+		}
+	}
+	for _, idx := range t.indexes {
+		count := 0
+		for _, it := range t.items {
+			if idx.contains(it) {
+				count++
+			}
+		}
+		d := &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   aws.String(idx.name),
+			IndexArn:    aws.String(aws.StringValue(desc.TableArn) + "/index/" + idx.name),
+			IndexStatus: aws.String(dynamodb.IndexStatusActive),
+			KeySchema:   idx.keys.elements(),
+			Projection:  idx.projection,
+			ItemCount:   aws.Int64(int64(count)),
+		}
+		if idx.throughput != nil {
+			d.ProvisionedThroughput = &dynamodb.ProvisionedThroughputDescription{
+				ReadCapacityUnits:  idx.throughput.ReadCapacityUnits,
+				WriteCapacityUnits: idx.throughput.WriteCapacityUnits,
+			}
+		}
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, d)
+	}
+	return desc
+}
+
+func (t *table) sizeBytes() int64 {
+	size := int64(0)
+	for _, it := range t.items {
+		size += int64(itemSize(it))
+	}
+	return size
+}
+
+// GSI のキー属性をすべて持つアイテムだけが GSI に入る
+func (idx *index) contains(it item) bool {
+	for _, name := range idx.keys.names() {
+		if _, ok := it[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) newIndex(t *table, name *string, elements []*dynamodb.KeySchemaElement, projection *dynamodb.Projection, throughput *dynamodb.ProvisionedThroughput) (*index, error) {
+	keys, err := newKeySchema(elements)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys.names() {
+		if _, ok := t.attributes[k]; !ok {
+			return nil, validationError("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions. Keys: [%s], AttributeDefinitions: [%s]", strings.Join(keys.names(), ", "), strings.Join(attributeNames(t.attributes), ", "))
+		}
+	}
+	if projection == nil || projection.ProjectionType == nil {
+		return nil, validationError("One or more parameter values were invalid: Unknown ProjectionType: null")
+	}
+	if _, err := t.index(aws.StringValue(name)); err == nil {
+		return nil, validationError("One or more parameter values were invalid: Duplicate index name: %s", aws.StringValue(name))
+	}
+	return &index{name: aws.StringValue(name), keys: keys, projection: projection, throughput: throughput}, nil
+}
+
+func attributeNames(attributes map[string]string) []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) createTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	name := aws.StringValue(input.TableName)
+	if _, ok := s.tables[name]; ok {
+		return nil, resourceInUse("Table already exists: %s", name)
+	}
+	keys, err := newKeySchema(input.KeySchema)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{
+		name:        name,
+		keys:        keys,
+		attributes:  make(map[string]string),
+		billingMode: aws.StringValue(input.BillingMode),
+		throughput:  input.ProvisionedThroughput,
+		createdAt:   s.now(),
+		items:       make(map[string]item),
+	}
+	if t.billingMode == "" {
+		t.billingMode = dynamodb.BillingModeProvisioned
+	}
+	if t.billingMode == dynamodb.BillingModeProvisioned && t.throughput == nil {
+		return nil, validationError("One or more parameter values were invalid: ReadCapacityUnits and WriteCapacityUnits must both be specified when BillingMode is PROVISIONED")
+	}
+	for _, def := range input.AttributeDefinitions {
+		t.attributes[aws.StringValue(def.AttributeName)] = aws.StringValue(def.AttributeType)
+	}
+	for _, k := range keys.names() {
+		if _, ok := t.attributes[k]; !ok {
+			return nil, validationError("One or more parameter values were invalid: Some index key attributes are not defined in AttributeDefinitions. Keys: [%s], AttributeDefinitions: [%s]", strings.Join(keys.names(), ", "), strings.Join(attributeNames(t.attributes), ", "))
+		}
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		idx, err := s.newIndex(t, gsi.IndexName, gsi.KeySchema, gsi.Projection, gsi.ProvisionedThroughput)
+		if err != nil {
+			return nil, err
+		}
+		t.indexes = append(t.indexes, idx)
+	}
+	s.tables[name] = t
+	return &dynamodb.CreateTableOutput{TableDescription: s.describe(t)}, nil
+}
+
+// GSI の追加と削除、スループットの変更に対応する
+// GSI は作ったときから ACTIVE で、既存のアイテムもすぐに検索できる
+func (s *Server) updateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	for _, def := range input.AttributeDefinitions {
+		name := aws.StringValue(def.AttributeName)
+		if typ, ok := t.attributes[name]; ok && typ != aws.StringValue(def.AttributeType) {
+			return nil, validationError("One or more parameter values were invalid: Cannot change the type of attribute %s", name)
+		}
+		t.attributes[name] = aws.StringValue(def.AttributeType)
+	}
+	for _, u := range input.GlobalSecondaryIndexUpdates {
+		switch {
+		case u.Create != nil:
+			idx, err := s.newIndex(t, u.Create.IndexName, u.Create.KeySchema, u.Create.Projection, u.Create.ProvisionedThroughput)
+			if err != nil {
+				return nil, err
+			}
+			for _, it := range t.items {
+				for _, name := range idx.keys.names() {
+					if v, ok := it[name]; ok && typeOf(v) != t.attributes[name] {
+						return nil, validationError("One or more parameter values were invalid: Type mismatch for Index Key %s Expected: %s Actual: %s IndexName: %s", name, t.attributes[name], typeOf(v), idx.name)
+					}
+				}
+			}
+			t.indexes = append(t.indexes, idx)
+		case u.Delete != nil:
+			idx, err := t.index(aws.StringValue(u.Delete.IndexName))
+			if err != nil {
+				return nil, resourceNotFound("Requested resource not found: Index: %s not found", aws.StringValue(u.Delete.IndexName))
+			}
+			indexes := make([]*index, 0, len(t.indexes))
+			for _, other := range t.indexes {
+				if other != idx {
+					indexes = append(indexes, other)
+				}
+			}
+			t.indexes = indexes
+		case u.Update != nil:
+			idx, err := t.index(aws.StringValue(u.Update.IndexName))
+			if err != nil {
+				return nil, resourceNotFound("Requested resource not found: Index: %s not found", aws.StringValue(u.Update.IndexName))
+			}
+			idx.throughput = u.Update.ProvisionedThroughput
+		}
+	}
+	if input.ProvisionedThroughput != nil {
+		t.throughput = input.ProvisionedThroughput
+	}
+	if input.BillingMode != nil {
+		t.billingMode = aws.StringValue(input.BillingMode)
+	}
+	return &dynamodb.UpdateTableOutput{TableDescription: s.describe(t)}, nil
+}
+
+func (s *Server) describeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: s.describe(t)}, nil
+}
+
+func (s *Server) deleteTable(input *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := s.describe(t)
+	desc.TableStatus = aws.String(dynamodb.TableStatusDeleting)
+	delete(s.tables, t.name)
+	return &dynamodb.DeleteTableOutput{TableDescription: desc}, nil
+}
+
+func (s *Server) listTables(input *dynamodb.ListTablesInput) (*dynamodb.ListTablesOutput, error) {
+	names := make([]string, 0, len(s.tables))
+	for name := range s.tables {
+		if name > aws.StringValue(input.ExclusiveStartTableName) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	out := &dynamodb.ListTablesOutput{TableNames: []*string{}}
+	limit := int(aws.Int64Value(input.Limit))
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	for i, name := range names {
+		if i == limit {
+			out.LastEvaluatedTableName = aws.String(names[i-1])
+			break
+		}
+		out.TableNames = append(out.TableNames, aws.String(name))
+	}
+	return out, nil
+}
+
+// TTL の設定は保存するが、期限切れのアイテムは削除しない
+// 実際の DynamoDB でも削除は数日遅れることがあるので、読み込み側で期限を確かめる前提にしておく
+func (s *Server) describeTimeToLive(input *dynamodb.DescribeTimeToLiveInput) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	desc := &dynamodb.TimeToLiveDescription{TimeToLiveStatus: aws.String(dynamodb.TimeToLiveStatusDisabled)}
+	if t.ttlAttribute != "" {
+		desc.TimeToLiveStatus = aws.String(dynamodb.TimeToLiveStatusEnabled)
+		desc.AttributeName = aws.String(t.ttlAttribute)
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+func (s *Server) updateTimeToLive(input *dynamodb.UpdateTimeToLiveInput) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	t, err := s.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	spec := input.TimeToLiveSpecification
+	if spec == nil {
+		return nil, validationError("TimeToLiveSpecification is required")
+	}
+	enabled := aws.BoolValue(spec.Enabled)
+	if enabled == (t.ttlAttribute != "") {
+		if enabled {
+			return nil, validationError("TimeToLive is already enabled")
+		}
+		return nil, validationError("TimeToLive is already disabled")
+	}
+	if enabled {
+		t.ttlAttribute = aws.StringValue(spec.AttributeName)
+	} else {
+		t.ttlAttribute = ""
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: spec}, nil
+}
@@ -0,0 +1,230 @@
+package localdynamo
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const testTable = "quick-photos"
+
+func s(v string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{S: aws.String(v)} }
+func n(v string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{N: aws.String(v)} }
+
+func ss(values ...string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{SS: aws.StringSlice(values)}
+}
+
+func l(values ...*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{L: values}
+}
+
+func m(values item) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{M: values}
+}
+
+func key(pk, sk string) item {
+	return item{"PK": s(pk), "SK": s(sk)}
+}
+
+// quickphotos のテーブルと同じキーに、射影の違う GSI を足したテーブルを作り、items を書き込む
+//
+//	InvertedIndex  SK / PK、ALL
+//	ByStatus       status、KEYS_ONLY
+//	ByEmail        email、INCLUDE name
+func newTestClient(t *testing.T, items ...item) *dynamodb.DynamoDB {
+	t.Helper()
+	api, stop, err := Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	gsi := func(name, hash, rangeKey string, projection *dynamodb.Projection) *dynamodb.GlobalSecondaryIndex {
+		keys := []*dynamodb.KeySchemaElement{{AttributeName: aws.String(hash), KeyType: aws.String(dynamodb.KeyTypeHash)}}
+		if rangeKey != "" {
+			keys = append(keys, &dynamodb.KeySchemaElement{AttributeName: aws.String(rangeKey), KeyType: aws.String(dynamodb.KeyTypeRange)})
+		}
+		return &dynamodb.GlobalSecondaryIndex{IndexName: aws.String(name), KeySchema: keys, Projection: projection}
+	}
+	_, err = api.CreateTable(&dynamodb.CreateTableInput{
+		TableName:   aws.String(testTable),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("PK"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("SK"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("status"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("email"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("SK"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			gsi("InvertedIndex", "SK", "PK", &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)}),
+			gsi("ByStatus", "status", "", &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)}),
+			gsi("ByEmail", "email", "", &dynamodb.Projection{
+				ProjectionType:   aws.String(dynamodb.ProjectionTypeInclude),
+				NonKeyAttributes: aws.StringSlice([]string{"name"}),
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, it := range items {
+		put(t, api, it)
+	}
+	return api
+}
+
+func put(t *testing.T, api *dynamodb.DynamoDB, it item) {
+	t.Helper()
+	if _, err := api.PutItem(&dynamodb.PutItemInput{TableName: aws.String(testTable), Item: it}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func errorCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// アイテムの属性名を並べて "PK,SK,name" のようにする
+func projectedNames(it item) string {
+	names := make([]string, 0, len(it))
+	for name := range it {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func queryIndex(t *testing.T, api *dynamodb.DynamoDB, index, hashKey string, hash *dynamodb.AttributeValue) []item {
+	t.Helper()
+	out, err := api.Query(&dynamodb.QueryInput{
+		TableName:                 aws.String(testTable),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    aws.String("#h = :h"),
+		ExpressionAttributeNames:  map[string]*string{"#h": aws.String(hashKey)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":h": hash},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Items
+}
+
+var metadata = item{
+	"PK":     s("USER#a"),
+	"SK":     s("#METADATA#a"),
+	"status": s("active"),
+	"email":  s("a@example.com"),
+	"name":   s("Alice"),
+	"bio":    s("photos"),
+}
+
+// GSI は宣言した射影の属性だけを返し、テーブルと GSI のキーは常に含む
+func TestGlobalSecondaryIndexProjection(t *testing.T) {
+	api := newTestClient(t, metadata)
+	for _, tc := range []struct {
+		index   string
+		hashKey string
+		hash    *dynamodb.AttributeValue
+		want    string
+	}{
+		{"InvertedIndex", "SK", s("#METADATA#a"), "PK,SK,bio,email,name,status"},
+		{"ByStatus", "status", s("active"), "PK,SK,status"},
+		{"ByEmail", "email", s("a@example.com"), "PK,SK,email,name"},
+	} {
+		t.Run(tc.index, func(t *testing.T) {
+			items := queryIndex(t, api, tc.index, tc.hashKey, tc.hash)
+			if len(items) != 1 {
+				t.Fatalf("got %d items, want 1", len(items))
+			}
+			if got := projectedNames(items[0]); got != tc.want {
+				t.Errorf("attributes = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// GSI のキーを持たないアイテムは GSI に入らず、キーを足したり消したりすると出入りする
+func TestSparseGlobalSecondaryIndex(t *testing.T) {
+	photo := item{"PK": s("USER#a"), "SK": s("PHOTO#a#2020-01-01T00:00:00Z"), "name": s("sunset")}
+	api := newTestClient(t, metadata, photo)
+	countIndex := func(index string) int {
+		t.Helper()
+		out, err := api.Scan(&dynamodb.ScanInput{TableName: aws.String(testTable), IndexName: aws.String(index)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(aws.Int64Value(out.Count))
+	}
+	update := func(expr string, values map[string]*dynamodb.AttributeValue) {
+		t.Helper()
+		_, err := api.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(testTable),
+			Key:                       key("USER#a", "PHOTO#a#2020-01-01T00:00:00Z"),
+			UpdateExpression:          aws.String(expr),
+			ExpressionAttributeNames:  map[string]*string{"#s": aws.String("status")},
+			ExpressionAttributeValues: values,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, step := range []struct {
+		name string
+		run  func()
+		want map[string]int
+	}{
+		{
+			name: "only the metadata has a status",
+			run:  func() {},
+			want: map[string]int{"InvertedIndex": 2, "ByStatus": 1, "ByEmail": 1},
+		},
+		{
+			name: "set the key",
+			run:  func() { update("SET #s = :s", map[string]*dynamodb.AttributeValue{":s": s("active")}) },
+			want: map[string]int{"InvertedIndex": 2, "ByStatus": 2, "ByEmail": 1},
+		},
+		{
+			name: "remove the key",
+			run:  func() { update("REMOVE #s", nil) },
+			want: map[string]int{"InvertedIndex": 2, "ByStatus": 1, "ByEmail": 1},
+		},
+		{
+			name: "delete the item",
+			run: func() {
+				if _, err := api.DeleteItem(&dynamodb.DeleteItemInput{TableName: aws.String(testTable), Key: key("USER#a", "#METADATA#a")}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]int{"InvertedIndex": 1, "ByStatus": 0, "ByEmail": 0},
+		},
+	} {
+		step.run()
+		for index, want := range step.want {
+			if got := countIndex(index); got != want {
+				t.Errorf("%s: %s has %d items, want %d", step.name, index, got, want)
+			}
+		}
+	}
+
+	// GSI のキーの型が属性の定義と違うアイテムは書き込めない
+	bad := copyItem(metadata)
+	bad["status"] = n("1")
+	_, err := api.PutItem(&dynamodb.PutItemInput{TableName: aws.String(testTable), Item: bad})
+	if code := errorCode(err); code != "ValidationException" {
+		t.Errorf("err = %v, want ValidationException for a GSI key of the wrong type", err)
+	}
+}
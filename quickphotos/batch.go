@@ -0,0 +1,152 @@
+package quickphotos
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// BatchGetItem で 1 回に取得できるキーの上限
+const MAX_BATCH_GET = 100
+
+// 上限ごとに分けて BatchGetItem を呼び、UnprocessedKeys も間隔を空けて取得し直す
+// 見つからなかったキーは結果に含まれず、結果の順番はキーの順番と一致しない
+func (s *Store) batchGet(keys []map[string]*dynamodb.AttributeValue, projection string, consistent bool) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for start := 0; start < len(keys); start += MAX_BATCH_GET {
+		end := start + MAX_BATCH_GET
+		if end > len(keys) {
+			end = len(keys)
+		}
+		ka := &dynamodb.KeysAndAttributes{
+			Keys:           keys[start:end],
+			ConsistentRead: aws.Bool(consistent),
+		}
+		if projection != "" {
+			ka.ProjectionExpression = aws.String(projection)
+		}
+		input := &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				s.table: ka,
+			},
+		}
+		err := retryUnprocessed(func() (bool, error) {
+			out, err := s.api.BatchGetItem(input)
+			if err != nil {
+				return false, err
+			}
+			items = append(items, out.Responses[s.table]...)
+			input = &dynamodb.BatchGetItemInput{RequestItems: out.UnprocessedKeys}
+			return len(input.RequestItems) > 0, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// 04_find_and_enrich_following_for_user.go と同じように、複数のユーザーを BatchGetItem でまとめて取得する
+// 戻り値はユーザー名をキーにしたもので、存在しないユーザーは含まれない
+func (s *Store) BatchGetUsers(usernames []string) (map[string]*User, error) {
+	s = s.metered("BatchGetUsers")
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(usernames))
+	seen := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		keys = append(keys, metadataKey(username))
+	}
+	items, err := s.batchGet(keys, "", false)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*User, len(items))
+	for _, item := range items {
+		user := newUser(item)
+		users[user.Username] = &user
+	}
+	return users, nil
+}
+
+// PhotoID で指定した写真をまとめて取得する
+// シャード付きカウンターの写真は、シャードもまとめて取得して合計する
+func (s *Store) BatchGetPhotos(ids []string) (map[string]*Photo, error) {
+	s = s.metered("BatchGetPhotos")
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		username, timestamp, ok := ParsePhotoID(id)
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		keys = append(keys, photoKey(username, timestamp))
+	}
+	items, err := s.batchGet(keys, "", true)
+	if err != nil {
+		return nil, err
+	}
+	photos := make(map[string]*Photo, len(items))
+	list := make([]Photo, 0, len(items))
+	for _, item := range items {
+		list = append(list, newPhoto(item, s.legacy))
+	}
+	if err := s.addShardTotals(list, items, true); err != nil {
+		return nil, err
+	}
+	// 呼び出し元が指定した ID (アイテムの SK) で返す
+	for i := range list {
+		photos[stringValue(items[i], "SK")] = &list[i]
+	}
+	return photos, nil
+}
+
+// シャード付きカウンターの写真に、シャードの合計を足す
+// photos[i] は items[i] から作ったもので、全部の写真のシャードを 1 回の batchGet でまとめて取得する
+// シャードのソートキーは写真のアイテムの SK なので、それで写真に振り分ける
+func (s *Store) addShardTotals(photos []Photo, items []map[string]*dynamodb.AttributeValue, consistent bool) error {
+	bySK := make(map[string]map[string]int)
+	keys := make([]map[string]*dynamodb.AttributeValue, 0)
+	for i, item := range items {
+		shards := intValue(item, "reactionShards")
+		if shards == 0 {
+			continue
+		}
+		sk := stringValue(item, "SK")
+		bySK[sk] = photos[i].Reactions
+		for n := 0; n < shards; n++ {
+			keys = append(keys, itemKey(ReactionShardPK(sk, n), sk))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	shards, err := s.batchGet(keys, "SK, reactions", consistent)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if counts, ok := bySK[stringValue(shard, "SK")]; ok {
+			addReactionCounts(counts, shard["reactions"])
+		}
+	}
+	return nil
+}
+
+// PhotoID の逆変換
+// タイムスタンプには # が含まれないので、最後の # で分割する
+func ParsePhotoID(id string) (string, string, bool) {
+	if !strings.HasPrefix(id, "PHOTO#") {
+		return "", "", false
+	}
+	rest := strings.TrimPrefix(id, "PHOTO#")
+	i := strings.LastIndex(rest, "#")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
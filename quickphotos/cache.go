@@ -0,0 +1,469 @@
+package quickphotos
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Coalesced int64
+	Evictions int64
+}
+
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("CacheStats<hits %d -- misses %d -- coalesced %d -- evictions %d -- hit rate %.2f>", s.Hits, s.Misses, s.Coalesced, s.Evictions, s.HitRate())
+}
+
+// invalidated は書き込みで捨てたことを表す目印で、item は持たない
+// 次の読み込みは、書き込みより前の値を読まないように強い整合性で行う
+type cacheEntry struct {
+	key         string
+	item        map[string]*dynamodb.AttributeValue
+	expiresAt   time.Time
+	invalidated bool
+}
+
+// 同じキーを読み込み中のリクエストは、この call の完了を待つ
+// 読み込み中に書き込みがあれば stale にして、古い値をキャッシュに入れないようにする
+type call struct {
+	wg    sync.WaitGroup
+	item  map[string]*dynamodb.AttributeValue
+	err   error
+	stale bool
+}
+
+// 件数の上限を超えたら最後に使われてから最も古いものを捨てる
+// アイテムが存在しないことも nil としてキャッシュする
+type MetadataCache struct {
+	mu       sync.Mutex
+	size     int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+	inflight map[string]*call
+	stats    CacheStats
+	now      func() time.Time
+}
+
+func NewMetadataCache(size int, ttl time.Duration) *MetadataCache {
+	return &MetadataCache{
+		size:     size,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]*call),
+		now:      time.Now,
+	}
+}
+
+func (c *MetadataCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// 2 つ目の戻り値はキャッシュにあったかどうか、3 つ目は強い整合性で読み込み直すべきかどうか
+func (c *MetadataCache) lookup(key string) (map[string]*dynamodb.AttributeValue, bool, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.invalidated {
+		return nil, false, true
+	}
+	if c.now().After(entry.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false, false
+	}
+	c.order.MoveToFront(el)
+	return entry.item, true, false
+}
+
+func (c *MetadataCache) store(key string, item map[string]*dynamodb.AttributeValue) {
+	c.put(&cacheEntry{key: key, item: item, expiresAt: c.now().Add(c.ttl)})
+}
+
+// 目印も件数の上限に含めるので、書き込みが続いても大きくならない
+func (c *MetadataCache) put(entry *cacheEntry) {
+	if el, ok := c.entries[entry.key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// 捨てたキーは、次に読み込むときに強い整合性で読み込む
+func (c *MetadataCache) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.put(&cacheEntry{key: key, invalidated: true})
+		if cl, ok := c.inflight[key]; ok {
+			cl.stale = true
+			delete(c.inflight, key)
+		}
+	}
+}
+
+// キャッシュにないキーを読み込む関数
+// consistent が true なら、書き込みの後なので強い整合性で読み込む
+type LoadFunc func(keys []string, consistent bool) (map[string]map[string]*dynamodb.AttributeValue, error)
+
+// キャッシュにないキーだけをまとめて load で読み込む
+// 他のリクエストが読み込み中のキーは、もう一度読み込まずにその結果を待つ
+func (c *MetadataCache) GetMany(keys []string, load LoadFunc) (map[string]map[string]*dynamodb.AttributeValue, error) {
+	results := make(map[string]map[string]*dynamodb.AttributeValue)
+	waiting := make(map[string]*call)
+	loading := make(map[string]*call)
+	// 0 は結果整合性、1 は強い整合性で読み込むキー
+	missing := [2][]string{}
+
+	c.mu.Lock()
+	for _, key := range keys {
+		if _, ok := results[key]; ok {
+			continue
+		}
+		if _, ok := loading[key]; ok {
+			continue
+		}
+		item, ok, consistent := c.lookup(key)
+		if ok {
+			c.stats.Hits++
+			results[key] = item
+			continue
+		}
+		c.stats.Misses++
+		if cl, ok := c.inflight[key]; ok {
+			c.stats.Coalesced++
+			waiting[key] = cl
+			continue
+		}
+		cl := &call{}
+		cl.wg.Add(1)
+		c.inflight[key] = cl
+		loading[key] = cl
+		if consistent {
+			missing[1] = append(missing[1], key)
+		} else {
+			missing[0] = append(missing[0], key)
+		}
+	}
+	c.mu.Unlock()
+
+	// 片方が失敗しても、読み込み中にしたキーはすべて終わらせる
+	items := make(map[string]map[string]*dynamodb.AttributeValue)
+	var err error
+	for i, group := range missing {
+		if len(group) == 0 || err != nil {
+			continue
+		}
+		var loaded map[string]map[string]*dynamodb.AttributeValue
+		loaded, err = load(group, i == 1)
+		for key, item := range loaded {
+			items[key] = item
+		}
+	}
+	if len(loading) > 0 {
+		c.mu.Lock()
+		for key, cl := range loading {
+			cl.item, cl.err = items[key], err
+			if !cl.stale {
+				delete(c.inflight, key)
+				if err == nil {
+					c.store(key, cl.item)
+				}
+			}
+			cl.wg.Done()
+		}
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key := range loading {
+		results[key] = items[key]
+	}
+
+	for key, cl := range waiting {
+		cl.wg.Wait()
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		results[key] = cl.item
+	}
+	return results, nil
+}
+
+func cacheKey(table string, key map[string]*dynamodb.AttributeValue) string {
+	return fmt.Sprintf("%s|%s|%s", table, aws.StringValue(key["PK"].S), aws.StringValue(key["SK"].S))
+}
+
+func isMetadataKey(key map[string]*dynamodb.AttributeValue) bool {
+	return key["PK"] != nil && key["SK"] != nil && strings.HasPrefix(aws.StringValue(key["SK"].S), "#METADATA#")
+}
+
+func keyOf(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": item["PK"],
+		"SK": item["SK"],
+	}
+}
+
+// 呼び出し側が書き換えてもキャッシュが壊れないように、トップレベルだけコピーして返す
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	out := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		out[k] = v
+	}
+	return out
+}
+
+// #METADATA# アイテムの GetItem と BatchGetItem をキャッシュから返す dynamodbiface.DynamoDBAPI
+// Store.UseMetadataCache で Store に組み込むと、GetUser と BatchGetUsers がキャッシュを使う
+// このクライアントを通した書き込みは、書き込んだアイテムのキャッシュを捨てる
+// ConsistentRead や ProjectionExpression を指定した読み込みはキャッシュを使わない
+type CachingClient struct {
+	dynamodbiface.DynamoDBAPI
+	cache *MetadataCache
+}
+
+func NewCachingClient(api dynamodbiface.DynamoDBAPI, cache *MetadataCache) *CachingClient {
+	return &CachingClient{
+		DynamoDBAPI: api,
+		cache:       cache,
+	}
+}
+
+func (c *CachingClient) load(ctx aws.Context, table string, keys map[string]map[string]*dynamodb.AttributeValue, opts ...request.Option) LoadFunc {
+	return func(missing []string, consistent bool) (map[string]map[string]*dynamodb.AttributeValue, error) {
+		items := make(map[string]map[string]*dynamodb.AttributeValue)
+		for start := 0; start < len(missing); start += MAX_BATCH_GET {
+			end := start + MAX_BATCH_GET
+			if end > len(missing) {
+				end = len(missing)
+			}
+			requested := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+			for _, k := range missing[start:end] {
+				requested = append(requested, keys[k])
+			}
+			input := &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]*dynamodb.KeysAndAttributes{
+					table: {
+						Keys:           requested,
+						ConsistentRead: aws.Bool(consistent),
+					},
+				},
+			}
+			err := retryUnprocessed(func() (bool, error) {
+				out, err := c.DynamoDBAPI.BatchGetItemWithContext(ctx, input, opts...)
+				if err != nil {
+					return false, err
+				}
+				for _, item := range out.Responses[table] {
+					items[cacheKey(table, item)] = item
+				}
+				input = &dynamodb.BatchGetItemInput{RequestItems: out.UnprocessedKeys}
+				return len(input.RequestItems) > 0, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+}
+
+func cacheable(keys *dynamodb.KeysAndAttributes) bool {
+	if aws.BoolValue(keys.ConsistentRead) || keys.ProjectionExpression != nil || len(keys.AttributesToGet) > 0 {
+		return false
+	}
+	for _, k := range keys.Keys {
+		if !isMetadataKey(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CachingClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	keys := &dynamodb.KeysAndAttributes{
+		Keys:                 []map[string]*dynamodb.AttributeValue{input.Key},
+		ConsistentRead:       input.ConsistentRead,
+		ProjectionExpression: input.ProjectionExpression,
+		AttributesToGet:      input.AttributesToGet,
+	}
+	if !cacheable(keys) {
+		return c.DynamoDBAPI.GetItemWithContext(ctx, input, opts...)
+	}
+	table := aws.StringValue(input.TableName)
+	key := cacheKey(table, input.Key)
+	items, err := c.cache.GetMany([]string{key}, c.load(ctx, table, map[string]map[string]*dynamodb.AttributeValue{key: input.Key}, opts...))
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(items[key])}, nil
+}
+
+func (c *CachingClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return c.GetItemWithContext(aws.BackgroundContext(), input)
+}
+
+// キャッシュできるテーブルの分だけキャッシュから返し、残りはそのまま BatchGetItem に渡す
+func (c *CachingClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       make(map[string][]map[string]*dynamodb.AttributeValue),
+		UnprocessedKeys: make(map[string]*dynamodb.KeysAndAttributes),
+	}
+	passthrough := make(map[string]*dynamodb.KeysAndAttributes)
+	for table, keys := range input.RequestItems {
+		if !cacheable(keys) {
+			passthrough[table] = keys
+			continue
+		}
+		requested := make(map[string]map[string]*dynamodb.AttributeValue)
+		order := make([]string, 0, len(keys.Keys))
+		for _, k := range keys.Keys {
+			key := cacheKey(table, k)
+			requested[key] = k
+			order = append(order, key)
+		}
+		items, err := c.cache.GetMany(order, c.load(ctx, table, requested, opts...))
+		if err != nil {
+			return nil, err
+		}
+		responses := make([]map[string]*dynamodb.AttributeValue, 0, len(order))
+		for _, key := range order {
+			if item := items[key]; item != nil {
+				responses = append(responses, copyItem(item))
+			}
+		}
+		out.Responses[table] = responses
+	}
+	if len(passthrough) > 0 {
+		rest, err := c.DynamoDBAPI.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems:           passthrough,
+			ReturnConsumedCapacity: input.ReturnConsumedCapacity,
+		}, opts...)
+		if err != nil {
+			return nil, err
+		}
+		for table, items := range rest.Responses {
+			out.Responses[table] = items
+		}
+		out.UnprocessedKeys = rest.UnprocessedKeys
+		out.ConsumedCapacity = rest.ConsumedCapacity
+	}
+	return out, nil
+}
+
+func (c *CachingClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return c.BatchGetItemWithContext(aws.BackgroundContext(), input)
+}
+
+// タイムアウトのように書き込まれたかどうか分からないエラーもあるので、失敗しても捨てる
+func (c *CachingClient) invalidate(table string, keys ...map[string]*dynamodb.AttributeValue) {
+	cacheKeys := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if isMetadataKey(k) {
+			cacheKeys = append(cacheKeys, cacheKey(table, k))
+		}
+	}
+	c.cache.Invalidate(cacheKeys...)
+}
+
+// Store は WithContext の無い API を、guregu/dynamo は WithContext の API を呼ぶ
+// WithContext の無い API は WithContext の方に渡して、どちらもキャッシュを捨てる
+func (c *CachingClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	defer c.invalidate(aws.StringValue(input.TableName), keyOf(input.Item))
+	return c.DynamoDBAPI.PutItemWithContext(ctx, input, opts...)
+}
+
+func (c *CachingClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return c.PutItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *CachingClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	defer c.invalidate(aws.StringValue(input.TableName), input.Key)
+	return c.DynamoDBAPI.UpdateItemWithContext(ctx, input, opts...)
+}
+
+func (c *CachingClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return c.UpdateItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *CachingClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	defer c.invalidate(aws.StringValue(input.TableName), input.Key)
+	return c.DynamoDBAPI.DeleteItemWithContext(ctx, input, opts...)
+}
+
+func (c *CachingClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return c.DeleteItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *CachingClient) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	defer func() {
+		for _, item := range input.TransactItems {
+			switch {
+			case item.Put != nil:
+				c.invalidate(aws.StringValue(item.Put.TableName), keyOf(item.Put.Item))
+			case item.Update != nil:
+				c.invalidate(aws.StringValue(item.Update.TableName), item.Update.Key)
+			case item.Delete != nil:
+				c.invalidate(aws.StringValue(item.Delete.TableName), item.Delete.Key)
+			}
+		}
+	}()
+	return c.DynamoDBAPI.TransactWriteItemsWithContext(ctx, input, opts...)
+}
+
+func (c *CachingClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return c.TransactWriteItemsWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *CachingClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	defer func() {
+		for table, requests := range input.RequestItems {
+			for _, r := range requests {
+				switch {
+				case r.PutRequest != nil:
+					c.invalidate(table, keyOf(r.PutRequest.Item))
+				case r.DeleteRequest != nil:
+					c.invalidate(table, r.DeleteRequest.Key)
+				}
+			}
+		}
+	}()
+	return c.DynamoDBAPI.BatchWriteItemWithContext(ctx, input, opts...)
+}
+
+func (c *CachingClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return c.BatchWriteItemWithContext(aws.BackgroundContext(), input)
+}
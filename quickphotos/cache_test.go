@@ -0,0 +1,150 @@
+package quickphotos
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// BatchGetItem で読み込んだキーの数と ConsistentRead を記録する
+type batchGetRecorder struct {
+	dynamodbiface.DynamoDBAPI
+	mu    sync.Mutex
+	reads []string
+}
+
+func (r *batchGetRecorder) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	r.mu.Lock()
+	for _, ka := range input.RequestItems {
+		for _, k := range ka.Keys {
+			read := aws.StringValue(k["PK"].S)
+			if aws.BoolValue(ka.ConsistentRead) {
+				read += " consistent"
+			}
+			r.reads = append(r.reads, read)
+		}
+	}
+	r.mu.Unlock()
+	return r.DynamoDBAPI.BatchGetItemWithContext(ctx, input, opts...)
+}
+
+func (r *batchGetRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reads := r.reads
+	r.reads = nil
+	return reads
+}
+
+func TestMetadataCacheInvalidatesOnStoreWrites(t *testing.T) {
+	api := &batchGetRecorder{DynamoDBAPI: newLocalAPI(t, testItems)}
+	store := New(api, DEFAULT_TABLE)
+	cache := NewMetadataCache(10, time.Minute)
+	store.UseMetadataCache(cache)
+
+	if _, err := store.GetUser("a"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := store.BatchGetUsers([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("users = %v", users)
+	}
+	// a は GetUser で読み込んだものを使う
+	if got := api.take(); len(got) != 2 || got[0] != "USER#a" || got[1] != "USER#b" {
+		t.Errorf("reads = %v, want a then only b", got)
+	}
+
+	// フォローでカウンターが変わるので、両方のキャッシュを捨てる
+	if _, err := store.Follow("b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.GetUser("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Followers != 1 {
+		t.Errorf("followers = %d, want the value after the follow", b.Followers)
+	}
+	if got := api.take(); len(got) != 1 || got[0] != "USER#b consistent" {
+		t.Errorf("reads = %v, want a consistent read of b", got)
+	}
+	// 読み込み直した後は、またキャッシュから返す
+	if _, err := store.BatchGetUsers([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.take(); len(got) != 1 || got[0] != "USER#a consistent" {
+		t.Errorf("reads = %v, want only a consistent read of a", got)
+	}
+	if stats := cache.Stats(); stats.Hits != 3 || stats.Misses != 4 {
+		t.Errorf("stats = %s, want 3 hits and 4 misses", stats)
+	}
+}
+
+// 同じキーを同時に読み込むと、load は 1 回だけ呼ばれて全員が同じ結果を受け取る
+func TestMetadataCacheCoalescesLoads(t *testing.T) {
+	cache := NewMetadataCache(10, time.Minute)
+	item := map[string]*dynamodb.AttributeValue{"username": {S: aws.String("a")}}
+	release := make(chan struct{})
+	loads := 0
+	load := func(keys []string, consistent bool) (map[string]map[string]*dynamodb.AttributeValue, error) {
+		loads++
+		<-release
+		return map[string]map[string]*dynamodb.AttributeValue{"a": item}, nil
+	}
+
+	const readers = 5
+	results := make(chan map[string]map[string]*dynamodb.AttributeValue, readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			got, err := cache.GetMany([]string{"a"}, load)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- got
+		}()
+	}
+	for cache.Stats().Misses < readers {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < readers; i++ {
+		if got := <-results; got["a"] == nil {
+			t.Errorf("reader got %v", got)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want 1", loads)
+	}
+	if stats := cache.Stats(); stats.Coalesced != readers-1 {
+		t.Errorf("stats = %s, want %d coalesced", stats, readers-1)
+	}
+}
+
+// 読み込み中に捨てたキーは、読み込んだ古い値をキャッシュに入れずに強い整合性で読み込み直す
+func TestMetadataCacheDropsLoadsRacingAnInvalidation(t *testing.T) {
+	cache := NewMetadataCache(10, time.Minute)
+	reads := make([]bool, 0)
+	load := func(keys []string, consistent bool) (map[string]map[string]*dynamodb.AttributeValue, error) {
+		reads = append(reads, consistent)
+		if len(reads) == 1 {
+			cache.Invalidate("a")
+		}
+		return map[string]map[string]*dynamodb.AttributeValue{"a": {}}, nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetMany([]string{"a"}, load); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reads) != 2 || reads[0] || !reads[1] {
+		t.Errorf("reads = %v, want an eventual read, a consistent read and then the cache", reads)
+	}
+}
@@ -0,0 +1,571 @@
+package quickphotos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	// 読み込みは 4KB、書き込みは 1KB ごとに 1 ユニット
+	READ_UNIT_SIZE  = 4096
+	WRITE_UNIT_SIZE = 1024
+)
+
+// アクセスパターンごとの消費キャパシティの合計
+// ByResource はテーブル名、またはテーブル名/インデックス名ごとの内訳
+// Failed はエラーになった呼び出しの数で、Calls にも含まれる
+type CapacityTotals struct {
+	Calls              int
+	Failed             int
+	ReadCapacityUnits  float64
+	WriteCapacityUnits float64
+	Estimated          int
+	ByResource         map[string]float64
+}
+
+func (t CapacityTotals) String() string {
+	return fmt.Sprintf("CapacityTotals<calls %d -- failed %d -- RCU %.1f -- WCU %.1f>", t.Calls, t.Failed, t.ReadCapacityUnits, t.WriteCapacityUnits)
+}
+
+type CapacityMeter struct {
+	mu     sync.Mutex
+	totals map[string]*CapacityTotals
+}
+
+func NewCapacityMeter() *CapacityMeter {
+	return &CapacityMeter{
+		totals: make(map[string]*CapacityTotals),
+	}
+}
+
+// name のアクセスパターンとして計測するクライアントを返す
+// Store はメソッドごとに WithCapacityMeter で計測するので、Store を通さない呼び出しに使う
+// 例: dynamo.NewFromIface(meter.Pattern(api, "FindAndEnrichFollowing"))
+func (m *CapacityMeter) Pattern(api dynamodbiface.DynamoDBAPI, name string) *MeteredClient {
+	return &MeteredClient{
+		DynamoDBAPI: api,
+		meter:       m,
+		pattern:     name,
+	}
+}
+
+func (m *CapacityMeter) add(pattern string, write, estimated, failed bool, units float64, resources map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totals[pattern]
+	if !ok {
+		t = &CapacityTotals{ByResource: make(map[string]float64)}
+		m.totals[pattern] = t
+	}
+	t.Calls++
+	if failed {
+		t.Failed++
+	}
+	if estimated {
+		t.Estimated++
+	}
+	for resource, u := range resources {
+		t.ByResource[resource] += u
+	}
+	if write {
+		t.WriteCapacityUnits += units
+	} else {
+		t.ReadCapacityUnits += units
+	}
+}
+
+// 実行中でも呼び出せるように、コピーを返す
+func (m *CapacityMeter) Totals(pattern string) CapacityTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.totals[pattern]
+	if !ok {
+		return CapacityTotals{ByResource: map[string]float64{}}
+	}
+	out := *t
+	out.ByResource = make(map[string]float64, len(t.ByResource))
+	for k, v := range t.ByResource {
+		out.ByResource[k] = v
+	}
+	return out
+}
+
+func (m *CapacityMeter) Patterns() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.totals))
+	for name := range m.totals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *CapacityMeter) WriteReport(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATTERN\tCALLS\tFAILED\tRCU\tWCU\tESTIMATED\tRESOURCE\tUNITS")
+	for _, name := range m.Patterns() {
+		t := m.Totals(name)
+		resources := make([]string, 0, len(t.ByResource))
+		for r := range t.ByResource {
+			resources = append(resources, r)
+		}
+		sort.Strings(resources)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%d\t\t\n", name, t.Calls, t.Failed, t.ReadCapacityUnits, t.WriteCapacityUnits, t.Estimated)
+		for _, r := range resources {
+			fmt.Fprintf(tw, "\t\t\t\t\t\t%s\t%.1f\n", r, t.ByResource[r])
+		}
+	}
+	return tw.Flush()
+}
+
+func resourcesOf(ccs ...*dynamodb.ConsumedCapacity) map[string]float64 {
+	resources := make(map[string]float64)
+	for _, cc := range ccs {
+		if cc == nil {
+			continue
+		}
+		table := aws.StringValue(cc.TableName)
+		if cc.Table != nil {
+			resources[table] += aws.Float64Value(cc.Table.CapacityUnits)
+		} else {
+			resources[table] += aws.Float64Value(cc.CapacityUnits)
+		}
+		for name, index := range cc.GlobalSecondaryIndexes {
+			resources[fmt.Sprintf("%s/%s", table, name)] += aws.Float64Value(index.CapacityUnits)
+		}
+		for name, index := range cc.LocalSecondaryIndexes {
+			resources[fmt.Sprintf("%s/%s", table, name)] += aws.Float64Value(index.CapacityUnits)
+		}
+	}
+	return resources
+}
+
+// DynamoDB の項目サイズの計算方法に合わせて、属性名と値のバイト数を足す
+func ItemSize(item map[string]*dynamodb.AttributeValue) int {
+	size := 0
+	for name, av := range item {
+		size += len(name) + attributeSize(av)
+	}
+	return size
+}
+
+func attributeSize(av *dynamodb.AttributeValue) int {
+	if av == nil {
+		return 0
+	}
+	switch {
+	case av.S != nil:
+		return len(*av.S)
+	case av.N != nil:
+		return numberSize(*av.N)
+	case av.B != nil:
+		return len(av.B)
+	case av.BOOL != nil, av.NULL != nil:
+		return 1
+	case av.SS != nil:
+		size := 0
+		for _, s := range av.SS {
+			size += len(aws.StringValue(s))
+		}
+		return size
+	case av.NS != nil:
+		size := 0
+		for _, n := range av.NS {
+			size += numberSize(aws.StringValue(n))
+		}
+		return size
+	case av.BS != nil:
+		size := 0
+		for _, b := range av.BS {
+			size += len(b)
+		}
+		return size
+	case av.L != nil:
+		size := 3
+		for _, v := range av.L {
+			size += 1 + attributeSize(v)
+		}
+		return size
+	case av.M != nil:
+		size := 3
+		for k, v := range av.M {
+			size += 1 + len(k) + attributeSize(v)
+		}
+		return size
+	}
+	return 0
+}
+
+// 数値は有効桁 2 桁ごとに 1 バイトと 1 バイト
+func numberSize(n string) int {
+	digits := 0
+	for _, r := range n {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return (digits+1)/2 + 1
+}
+
+func readUnits(size int, consistent bool) float64 {
+	units := math.Max(1, math.Ceil(float64(size)/READ_UNIT_SIZE))
+	if !consistent {
+		return units / 2
+	}
+	return units
+}
+
+func writeUnits(size int) float64 {
+	return math.Max(1, math.Ceil(float64(size)/WRITE_UNIT_SIZE))
+}
+
+// ConsumedCapacity を返さないバックエンド (ローカルの代替実装など) のために、項目サイズからユニット数を見積もる
+// 更新と削除は項目サイズが分からないので 1 ユニットとして数える
+func estimateRead(table, index string, items []map[string]*dynamodb.AttributeValue, consistent bool, perItem bool) map[string]float64 {
+	units := 0.0
+	if perItem {
+		for _, item := range items {
+			units += readUnits(ItemSize(item), consistent)
+		}
+	} else {
+		size := 0
+		for _, item := range items {
+			size += ItemSize(item)
+		}
+		units = readUnits(size, consistent)
+	}
+	if index != "" {
+		return map[string]float64{fmt.Sprintf("%s/%s", table, index): units}
+	}
+	return map[string]float64{table: units}
+}
+
+// 指定したアクセスパターンとして消費キャパシティを記録する dynamodbiface.DynamoDBAPI
+// すべての呼び出しで ReturnConsumedCapacity を INDEXES にするので、InvertedIndex の分も内訳に出る
+type MeteredClient struct {
+	dynamodbiface.DynamoDBAPI
+	meter   *CapacityMeter
+	pattern string
+}
+
+var indexes = aws.String(dynamodb.ReturnConsumedCapacityIndexes)
+
+// 合計は ConsumedCapacity の CapacityUnits を使う。インデックスの分はテーブルの内訳には含まれない
+func (c *MeteredClient) record(write bool, ccs []*dynamodb.ConsumedCapacity, estimate func() map[string]float64) {
+	units := 0.0
+	returned := false
+	for _, cc := range ccs {
+		if cc != nil {
+			units += aws.Float64Value(cc.CapacityUnits)
+			returned = true
+		}
+	}
+	if returned {
+		c.meter.add(c.pattern, write, false, false, units, resourcesOf(ccs...))
+		return
+	}
+	resources := estimate()
+	for _, u := range resources {
+		units += u
+	}
+	c.meter.add(c.pattern, write, true, false, units, resources)
+}
+
+// 失敗した呼び出しは ConsumedCapacity が返らない
+// 条件を満たさずに失敗した書き込みはキャパシティを消費するので、成功したときと同じように見積もる
+// それ以外の失敗 (スロットリングや入力の誤り) は 0 ユニットとして回数だけ数える
+func (c *MeteredClient) recordFailure(write bool, err error, estimate func() map[string]float64) {
+	var canceled *dynamodb.TransactionCanceledException
+	if !write || estimate == nil || !(isConditionFailed(err) || errors.As(err, &canceled)) {
+		c.meter.add(c.pattern, write, false, true, 0, map[string]float64{})
+		return
+	}
+	units := 0.0
+	resources := estimate()
+	for _, u := range resources {
+		units += u
+	}
+	c.meter.add(c.pattern, write, true, true, units, resources)
+}
+
+// Store は WithContext の無い API を、guregu/dynamo は WithContext の API を呼ぶ
+// WithContext の無い API は WithContext の方に渡して、どちらも同じように計測する
+func (c *MeteredClient) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	out, err := c.DynamoDBAPI.GetItemWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(false, err, nil)
+		return out, err
+	}
+	c.record(false, []*dynamodb.ConsumedCapacity{out.ConsumedCapacity}, func() map[string]float64 {
+		return estimateRead(aws.StringValue(in.TableName), "", []map[string]*dynamodb.AttributeValue{out.Item}, aws.BoolValue(in.ConsistentRead), true)
+	})
+	return out, err
+}
+
+func (c *MeteredClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return c.GetItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	out, err := c.DynamoDBAPI.BatchGetItemWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(false, err, nil)
+		return out, err
+	}
+	c.record(false, out.ConsumedCapacity, func() map[string]float64 {
+		resources := make(map[string]float64)
+		for table, items := range out.Responses {
+			consistent := in.RequestItems[table] != nil && aws.BoolValue(in.RequestItems[table].ConsistentRead)
+			for r, u := range estimateRead(table, "", items, consistent, true) {
+				resources[r] += u
+			}
+		}
+		return resources
+	})
+	return out, err
+}
+
+func (c *MeteredClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return c.BatchGetItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) TransactGetItemsWithContext(ctx aws.Context, input *dynamodb.TransactGetItemsInput, opts ...request.Option) (*dynamodb.TransactGetItemsOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	out, err := c.DynamoDBAPI.TransactGetItemsWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(false, err, nil)
+		return out, err
+	}
+	c.record(false, out.ConsumedCapacity, func() map[string]float64 {
+		// トランザクションの読み込みは強い整合性の読み込みの 2 倍
+		resources := make(map[string]float64)
+		for i, r := range out.Responses {
+			table := aws.StringValue(in.TransactItems[i].Get.TableName)
+			resources[table] += 2 * readUnits(ItemSize(r.Item), true)
+		}
+		return resources
+	})
+	return out, err
+}
+
+func (c *MeteredClient) TransactGetItems(input *dynamodb.TransactGetItemsInput) (*dynamodb.TransactGetItemsOutput, error) {
+	return c.TransactGetItemsWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	out, err := c.DynamoDBAPI.QueryWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(false, err, nil)
+		return out, err
+	}
+	c.record(false, []*dynamodb.ConsumedCapacity{out.ConsumedCapacity}, func() map[string]float64 {
+		return estimateRead(aws.StringValue(in.TableName), aws.StringValue(in.IndexName), out.Items, aws.BoolValue(in.ConsistentRead), false)
+	})
+	return out, err
+}
+
+func (c *MeteredClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return c.QueryWithContext(aws.BackgroundContext(), input)
+}
+
+// 埋め込んだクライアントの QueryPages は内部で Query を呼ぶので、ページごとに QueryWithContext を呼び直す
+func (c *MeteredClient) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, opts ...request.Option) error {
+	in := *input
+	for {
+		out, err := c.QueryWithContext(ctx, &in, opts...)
+		if err != nil {
+			return err
+		}
+		last := len(out.LastEvaluatedKey) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (c *MeteredClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	return c.QueryPagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (c *MeteredClient) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	out, err := c.DynamoDBAPI.ScanWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(false, err, nil)
+		return out, err
+	}
+	c.record(false, []*dynamodb.ConsumedCapacity{out.ConsumedCapacity}, func() map[string]float64 {
+		return estimateRead(aws.StringValue(in.TableName), aws.StringValue(in.IndexName), out.Items, aws.BoolValue(in.ConsistentRead), false)
+	})
+	return out, err
+}
+
+func (c *MeteredClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return c.ScanWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	in := *input
+	for {
+		out, err := c.ScanWithContext(ctx, &in, opts...)
+		if err != nil {
+			return err
+		}
+		last := len(out.LastEvaluatedKey) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (c *MeteredClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	return c.ScanPagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (c *MeteredClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	estimate := func() map[string]float64 {
+		return map[string]float64{aws.StringValue(in.TableName): writeUnits(ItemSize(in.Item))}
+	}
+	out, err := c.DynamoDBAPI.PutItemWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(true, err, estimate)
+		return out, err
+	}
+	c.record(true, []*dynamodb.ConsumedCapacity{out.ConsumedCapacity}, estimate)
+	return out, err
+}
+
+func (c *MeteredClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return c.PutItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	estimate := func() map[string]float64 {
+		return map[string]float64{aws.StringValue(in.TableName): 1}
+	}
+	out, err := c.DynamoDBAPI.UpdateItemWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(true, err, estimate)
+		return out, err
+	}
+	c.record(true, []*dynamodb.ConsumedCapacity{out.ConsumedCapacity}, estimate)
+	return out, err
+}
+
+func (c *MeteredClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return c.UpdateItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	estimate := func() map[string]float64 {
+		return map[string]float64{aws.StringValue(in.TableName): 1}
+	}
+	out, err := c.DynamoDBAPI.DeleteItemWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(true, err, estimate)
+		return out, err
+	}
+	c.record(true, []*dynamodb.ConsumedCapacity{out.ConsumedCapacity}, estimate)
+	return out, err
+}
+
+func (c *MeteredClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return c.DeleteItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	estimate := func() map[string]float64 {
+		// トランザクションの書き込みは通常の書き込みの 2 倍
+		resources := make(map[string]float64)
+		for _, item := range in.TransactItems {
+			switch {
+			case item.Put != nil:
+				resources[aws.StringValue(item.Put.TableName)] += 2 * writeUnits(ItemSize(item.Put.Item))
+			case item.Update != nil:
+				resources[aws.StringValue(item.Update.TableName)] += 2
+			case item.Delete != nil:
+				resources[aws.StringValue(item.Delete.TableName)] += 2
+			case item.ConditionCheck != nil:
+				resources[aws.StringValue(item.ConditionCheck.TableName)] += 2
+			}
+		}
+		return resources
+	}
+	out, err := c.DynamoDBAPI.TransactWriteItemsWithContext(ctx, &in, opts...)
+	if err != nil {
+		c.recordFailure(true, err, estimate)
+		return out, err
+	}
+	c.record(true, out.ConsumedCapacity, estimate)
+	return out, err
+}
+
+func (c *MeteredClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return c.TransactWriteItemsWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *MeteredClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	in := *input
+	in.ReturnConsumedCapacity = indexes
+	out, err := c.DynamoDBAPI.BatchWriteItemWithContext(ctx, &in, opts...)
+	if err != nil {
+		// BatchWriteItem には条件が無いので、失敗したときは何も書き込まれていない
+		c.recordFailure(true, err, nil)
+		return out, err
+	}
+	c.record(true, out.ConsumedCapacity, func() map[string]float64 {
+		// 処理されなかったリクエストの分は差し引く
+		resources := make(map[string]float64)
+		for table, requests := range in.RequestItems {
+			resources[table] += batchWriteUnits(requests) - batchWriteUnits(out.UnprocessedItems[table])
+		}
+		return resources
+	})
+	return out, err
+}
+
+func batchWriteUnits(requests []*dynamodb.WriteRequest) float64 {
+	units := 0.0
+	for _, r := range requests {
+		switch {
+		case r.PutRequest != nil:
+			units += writeUnits(ItemSize(r.PutRequest.Item))
+		case r.DeleteRequest != nil:
+			units++
+		}
+	}
+	return units
+}
+
+func (c *MeteredClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return c.BatchWriteItemWithContext(aws.BackgroundContext(), input)
+}
@@ -0,0 +1,116 @@
+package quickphotos
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestCapacityMeterRecordsEachPattern(t *testing.T) {
+	api := newLocalAPI(t, testItems)
+	meter := NewCapacityMeter()
+
+	if _, err := New(meter.Pattern(api, "GetUser"), DEFAULT_TABLE).GetUser("a"); err != nil {
+		t.Fatal(err)
+	}
+	react := New(meter.Pattern(api, "React"), DEFAULT_TABLE)
+	if _, err := react.React("b", "heart", "a", "2020-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	got := meter.Totals("GetUser")
+	if got.Calls != 1 || got.Failed != 0 || got.ReadCapacityUnits != 0.5 || got.WriteCapacityUnits != 0 {
+		t.Errorf("GetUser = %s, want 1 call of 0.5 RCU", got)
+	}
+	if got.ByResource[DEFAULT_TABLE] != 0.5 {
+		t.Errorf("GetUser resources = %v", got.ByResource)
+	}
+	reacted := meter.Totals("React")
+	if reacted.Calls != 2 || reacted.Failed != 0 || reacted.ReadCapacityUnits != 1 || reacted.WriteCapacityUnits != 6 {
+		t.Errorf("React = %s, want a consistent read and a transaction of 6 WCU", reacted)
+	}
+	if reacted.Estimated != 0 {
+		t.Errorf("React estimated %d calls although localdynamo returns the capacity", reacted.Estimated)
+	}
+
+	// 条件を満たさない書き込みもキャパシティを消費する
+	if _, err := react.React("b", "heart", "a", "2020-01-01T00:00:00Z"); err == nil {
+		t.Fatal("reacted twice")
+	}
+	again := meter.Totals("React")
+	if again.Calls != 4 || again.Failed != 1 || again.Estimated != 1 {
+		t.Errorf("React after a failure = %s, want 4 calls with 1 failed and estimated", again)
+	}
+	// 失敗したトランザクションは ConsumedCapacity が返らないので、5 件の操作をそれぞれ 2 ユニットとして見積もる
+	if again.ReadCapacityUnits != 2 || again.WriteCapacityUnits != 16 {
+		t.Errorf("React after a failure = %s, want 2 RCU and 6+10 WCU", again)
+	}
+	if got := meter.Patterns(); strings.Join(got, ",") != "GetUser,React" {
+		t.Errorf("patterns = %v", got)
+	}
+}
+
+// Store はクライアントの名前ではなく、呼ばれた公開メソッドの名前で記録する
+func TestStoreRecordsCapacityPerMethod(t *testing.T) {
+	api := newLocalAPI(t, testItems)
+	meter := NewCapacityMeter()
+	store := New(api, DEFAULT_TABLE, WithCapacityMeter(meter))
+	store.UseMetadataCache(NewMetadataCache(10, time.Minute))
+
+	if _, err := store.GetUserWithPhotos("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.React("b", "heart", "a", "2020-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	// Follow の中で読むユーザーは、GetUser ではなく Follow の分になる
+	if _, err := store.Follow("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	// キャッシュから返した読み込みはキャパシティを消費しない
+	for i := 0; i < 2; i++ {
+		if _, err := store.GetUser("b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := meter.Patterns(); strings.Join(got, ",") != "Follow,GetUser,GetUserWithPhotos,React" {
+		t.Errorf("patterns = %v", got)
+	}
+	if got := meter.Totals("React"); got.Calls != 2 || got.ReadCapacityUnits != 1 || got.WriteCapacityUnits != 6 {
+		t.Errorf("React = %s, want a consistent read and a transaction of 6 WCU", got)
+	}
+	if got := meter.Totals("Follow"); got.Calls != 2 || got.ReadCapacityUnits == 0 || got.WriteCapacityUnits == 0 {
+		t.Errorf("Follow = %s, want the user read and the transaction", got)
+	}
+	if got := meter.Totals("GetUser"); got.Calls != 1 {
+		t.Errorf("GetUser = %s, want 1 call for two reads through the cache", got)
+	}
+}
+
+// キャパシティを消費しない失敗は、回数だけ数える
+func TestCapacityMeterCountsFailedReads(t *testing.T) {
+	api := newLocalAPI(t, testItems)
+	meter := NewCapacityMeter()
+	if _, err := New(meter.Pattern(api, "GetUser"), "missing").GetUser("a"); err == nil {
+		t.Fatal("read from a missing table")
+	}
+	got := meter.Totals("GetUser")
+	if got.Calls != 1 || got.Failed != 1 || got.ReadCapacityUnits != 0 {
+		t.Errorf("GetUser = %s, want 1 failed call without units", got)
+	}
+}
+
+func TestItemSize(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"PK":        {S: aws.String("USER#a")},
+		"followers": {N: aws.String("123")},
+		"reactions": {M: map[string]*dynamodb.AttributeValue{"heart": {N: aws.String("1")}}},
+	}
+	// 2+6, 9+3, 9+(3+1+5+2)
+	if got := ItemSize(item); got != 40 {
+		t.Errorf("ItemSize = %d, want 40", got)
+	}
+}
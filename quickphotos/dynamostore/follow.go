@@ -0,0 +1,136 @@
+package dynamostore
+
+import (
+	"fmt"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// username がフォローしているユーザー
+func (s *Store) ListFollowing(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error) {
+	items, next, err := s.page(quickphotos.PatternFollowing, map[string]string{"username": username}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.friendships(items), next, nil
+}
+
+// username をフォローしているユーザー
+func (s *Store) ListFollowers(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error) {
+	items, next, err := s.page(quickphotos.PatternFollowers, map[string]string{"username": username}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.friendships(items), next, nil
+}
+
+func (s *Store) friendships(items []quickPhoto) []quickphotos.Friendship {
+	result := make([]quickphotos.Friendship, 0, len(items))
+	for _, item := range items {
+		result = append(result, item.friendship(s.legacy))
+	}
+	return result
+}
+
+func (s *Store) counterUpdate(username, counter string, delta int) *dynamo.Update {
+	return s.table.Update("PK", userPK(username)).
+		Range("SK", metadataSK(username)).
+		SetExpr("$ = $ + ?", counter, counter, delta).
+		If("attribute_exists(SK)")
+}
+
+// 06_follow_user.go の guregu/dynamo の処理に、quickphotos.Store と同じ非公開アカウントの扱いを足したもの
+// 戻り値はフォローリクエストを作ったかどうか
+func (s *Store) Follow(followedUser, followingUser string) (bool, error) {
+	if followedUser == followingUser {
+		return false, quickphotos.ErrCannotFollowSelf
+	}
+	followed, err := s.GetUser(followedUser)
+	if err != nil {
+		return false, err
+	}
+	if followed.Private {
+		return true, s.requestFollow(followedUser, followingUser)
+	}
+
+	now := s.timestamp()
+	tx := s.db.WriteTx()
+	tx.Put(s.table.Put(friendshipItem{
+		PK:            userPK(followedUser),
+		SK:            friendSK(followingUser),
+		FollowedUser:  followedUser,
+		FollowingUser: followingUser,
+		Timestamp:     now,
+	}).If("attribute_not_exists(SK)"))
+	// 読み込み後に非公開へ切り替えられていれば失敗させる
+	tx.Update(s.counterUpdate(followedUser, "followers", 1).
+		If("attribute_not_exists(private) OR private = ?", false))
+	tx.Update(s.counterUpdate(followingUser, "following", 1))
+	for _, check := range s.blockChecks(followedUser, followingUser) {
+		tx.Check(check)
+	}
+	tx.Put(s.table.Put(notificationItem{
+		PK:        inboxPK(followedUser),
+		SK:        fmt.Sprintf("NOTIFICATION#%s#%s", now, friendSK(followingUser)),
+		Type:      "follow",
+		Actor:     followingUser,
+		Timestamp: now,
+		ExpiresAt: s.now().Add(quickphotos.NOTIFICATION_TTL).Unix(),
+	}))
+
+	return false, translateTransactionError(tx.Run(), map[int]error{
+		0: quickphotos.ErrAlreadyFollowing,
+		2: quickphotos.ErrUserNotFound,
+		3: quickphotos.ErrBlocked,
+		4: quickphotos.ErrBlocked,
+	})
+}
+
+func (s *Store) requestFollow(followedUser, followingUser string) error {
+	now := s.now()
+	tx := s.db.WriteTx()
+	// TTL で削除される前の期限切れリクエストは上書きしてよい
+	tx.Put(s.table.Put(friendshipItem{
+		PK:            userPK(followedUser),
+		SK:            fmt.Sprintf("#FOLLOWREQUEST#%s", followingUser),
+		FollowedUser:  followedUser,
+		FollowingUser: followingUser,
+		Timestamp:     s.timestamp(),
+		ExpiresAt:     now.Add(quickphotos.FOLLOW_REQUEST_TTL).Unix(),
+	}).If("attribute_not_exists(SK) OR expiresAt < ?", now.Unix()))
+	tx.Check(s.table.Check("PK", userPK(followedUser)).
+		Range("SK", metadataSK(followedUser)).
+		If("private = ?", true))
+	tx.Check(s.table.Check("PK", userPK(followedUser)).
+		Range("SK", friendSK(followingUser)).
+		IfNotExists())
+	tx.Check(s.table.Check("PK", userPK(followingUser)).
+		Range("SK", metadataSK(followingUser)).
+		IfExists())
+	for _, check := range s.blockChecks(followedUser, followingUser) {
+		tx.Check(check)
+	}
+
+	return translateTransactionError(tx.Run(), map[int]error{
+		0: quickphotos.ErrAlreadyRequested,
+		2: quickphotos.ErrAlreadyFollowing,
+		3: quickphotos.ErrUserNotFound,
+		4: quickphotos.ErrBlocked,
+		5: quickphotos.ErrBlocked,
+	})
+}
+
+// フォロー関係の削除とカウンターの更新を 1 つのトランザクションで行う
+func (s *Store) Unfollow(followedUser, followingUser string) error {
+	tx := s.db.WriteTx()
+	tx.Delete(s.table.Delete("PK", userPK(followedUser)).
+		Range("SK", friendSK(followingUser)).
+		If("attribute_exists(SK)"))
+	tx.Update(s.counterUpdate(followedUser, "followers", -1))
+	tx.Update(s.counterUpdate(followingUser, "following", -1))
+	return translateTransactionError(tx.Run(), map[int]error{
+		0: quickphotos.ErrNotFollowing,
+	})
+}
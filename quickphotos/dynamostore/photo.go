@@ -0,0 +1,183 @@
+package dynamostore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+func photoPK(username string) string {
+	return userPK(username)
+}
+
+func reactionPK(reactingUser, reactionType string) string {
+	return fmt.Sprintf("REACTION#%s#%s", reactingUser, reactionType)
+}
+
+func reactionShardPK(username, timestamp string, shard int) string {
+	return quickphotos.ReactionShardPK(quickphotos.PhotoID(username, timestamp), shard)
+}
+
+func (s *Store) getPhotoItem(username, timestamp string) (*quickPhoto, error) {
+	var item quickPhoto
+	err := s.table.Get("PK", photoPK(username)).
+		Range("SK", dynamo.Equal, quickphotos.PhotoID(username, timestamp)).
+		Consistent(true).
+		One(&item)
+	if errors.Is(err, dynamo.ErrNotFound) {
+		return nil, quickphotos.ErrPhotoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// シャード付きカウンターの写真は、写真の reactions にシャードの合計を足したものがリアクション数になる
+func (s *Store) GetPhoto(username, timestamp string) (*quickphotos.Photo, error) {
+	item, err := s.getPhotoItem(username, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	photos := []quickphotos.Photo{item.photo(s.legacy)}
+	if err := s.addShardTotals(photos, []quickPhoto{*item}, true); err != nil {
+		return nil, err
+	}
+	return &photos[0], nil
+}
+
+// シャード付きカウンターの写真に、シャードの合計を足す
+// photos[i] は items[i] から作ったもので、全部の写真のシャードを 1 回の BatchGet でまとめて取得する
+// シャードのソートキーは写真のアイテムの SK なので、それで写真に振り分ける
+func (s *Store) addShardTotals(photos []quickphotos.Photo, items []quickPhoto, consistent bool) error {
+	bySK := make(map[string]map[string]int)
+	keys := make([]dynamo.Keyed, 0)
+	for i, item := range items {
+		if item.ReactionShards == 0 {
+			continue
+		}
+		bySK[item.SK] = photos[i].Reactions
+		for n := 0; n < item.ReactionShards; n++ {
+			keys = append(keys, dynamo.Keys{quickphotos.ReactionShardPK(item.SK, n), item.SK})
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	shards := make([]quickPhoto, 0, len(keys))
+	err := s.table.Batch("PK", "SK").Get(keys...).Consistent(consistent).All(&shards)
+	if err != nil && !errors.Is(err, dynamo.ErrNotFound) {
+		return err
+	}
+	for _, shard := range shards {
+		if counts, ok := bySK[shard.SK]; ok {
+			for t, n := range shard.Reactions {
+				counts[t] += n
+			}
+		}
+	}
+	return nil
+}
+
+// 02_fetch_photo_and_reactions.go と同じく InvertedIndex を写真の ID で引き、PK が REACTION# のものだけに絞る
+func (s *Store) ListReactions(username, timestamp string, limit int, cursor string) ([]quickphotos.Reaction, string, error) {
+	items, next, err := s.page(quickphotos.PatternReactionsForPhoto, map[string]string{"username": username, "timestamp": timestamp}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) == 0 && cursor == "" {
+		if _, err := s.getPhotoItem(username, timestamp); err != nil {
+			return nil, "", err
+		}
+	}
+	reactions := make([]quickphotos.Reaction, 0, len(items))
+	for _, item := range items {
+		reactions = append(reactions, item.reaction(s.legacy))
+	}
+	return reactions, next, nil
+}
+
+func validReactionType(reactionType string) bool {
+	for _, t := range quickphotos.ReactionTypes {
+		if t == reactionType {
+			return true
+		}
+	}
+	return false
+}
+
+// 05_add_reaction.go の guregu/dynamo の処理に、quickphotos.Store と同じ条件チェックを足したもの
+func (s *Store) React(reactingUser, reactionType, photoUser, timestamp string) (*quickphotos.Reaction, error) {
+	if !validReactionType(reactionType) {
+		return nil, quickphotos.ErrInvalidReactionType
+	}
+	photoItem, err := s.getPhotoItem(photoUser, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	shards := photoItem.ReactionShards
+
+	photoStr := quickphotos.PhotoID(photoUser, timestamp)
+	reactionStr := reactionPK(reactingUser, reactionType)
+	now := s.timestamp()
+	reaction := reactionItem{
+		PK:           reactionStr,
+		SK:           photoStr,
+		ReactingUser: reactingUser,
+		ReactionType: reactionType,
+		Photo:        photoStr,
+		Timestamp:    now,
+	}
+
+	tx := s.db.WriteTx()
+	tx.Put(s.table.Put(reaction).If("attribute_not_exists(SK)"))
+	blockIndex := 2
+	if shards > 0 {
+		// 同じアイテムを 1 つのトランザクションで 2 回は扱えないので、シャードを加算するときだけ写真を条件チェックする
+		tx.Update(s.table.Update("PK", reactionShardPK(photoUser, timestamp, rand.Intn(shards))).
+			Range("SK", photoStr).
+			SetExpr("reactions.$ = reactions.$ + ?", reactionType, reactionType, 1).
+			If("attribute_exists(SK)"))
+		tx.Check(s.table.Check("PK", photoPK(photoUser)).
+			Range("SK", photoStr).
+			If("reactionShards = ?", shards))
+		blockIndex = 3
+	} else {
+		tx.Update(s.table.Update("PK", photoPK(photoUser)).
+			Range("SK", photoStr).
+			SetExpr("reactions.$ = reactions.$ + ?", reactionType, reactionType, 1).
+			If("attribute_exists(SK) AND attribute_not_exists(reactionShards)"))
+	}
+	for _, check := range s.blockChecks(photoUser, reactingUser) {
+		tx.Check(check)
+	}
+	// 写真の投稿者の受信箱に通知を書き込む
+	tx.Put(s.table.Put(notificationItem{
+		PK:           inboxPK(photoUser),
+		SK:           fmt.Sprintf("NOTIFICATION#%s#%s#%s", now, reactionStr, photoStr),
+		Type:         "reaction",
+		Actor:        reactingUser,
+		Photo:        photoStr,
+		ReactionType: reactionType,
+		Timestamp:    now,
+		ExpiresAt:    s.now().Add(quickphotos.NOTIFICATION_TTL).Unix(),
+	}))
+
+	if err := tx.Run(); err != nil {
+		return nil, translateTransactionError(err, map[int]error{
+			0:              quickphotos.ErrAlreadyReacted,
+			blockIndex:     quickphotos.ErrBlocked,
+			blockIndex + 1: quickphotos.ErrBlocked,
+		})
+	}
+	return &quickphotos.Reaction{
+		ReactingUser: reaction.ReactingUser,
+		Photo:        reaction.Photo,
+		ReactionType: reaction.ReactionType,
+		Timestamp:    reaction.Timestamp,
+	}, nil
+}
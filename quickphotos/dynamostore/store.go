@@ -0,0 +1,308 @@
+// Package dynamostore は、quickphotos.Store と同じアクセスパターンを guregu/dynamo で書いたもの
+// application/ の各ファイルの後半にある guregu/dynamo の処理をまとめている
+// 戻り値とエラーは quickphotos.Store と同じものを返すので、e2e の TestDifferential で 2 つの実装の結果を比べられる
+package dynamostore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+type Store struct {
+	db     *dynamo.DB
+	table  dynamo.Table
+	now    func() time.Time
+	legacy *time.Location
+}
+
+// quickphotos.Option と同じように、New に渡して Store の振る舞いを変える
+type Option func(s *Store)
+
+// タイムゾーンの無い古い形式の時刻を loc のタイムゾーンとして読む
+// 指定しなければ quickphotos.DEFAULT_LEGACY_ZONE として読む
+func WithLegacyLocation(loc *time.Location) Option {
+	return func(s *Store) {
+		s.legacy = loc
+	}
+}
+
+func New(db *dynamo.DB, table string, opts ...Option) *Store {
+	s := &Store{
+		db:     db,
+		table:  db.Table(table),
+		now:    time.Now,
+		legacy: quickphotos.DefaultLegacyLocation(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// 書き込みに記録する時刻を固定したいときに使う
+func (s *Store) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+func (s *Store) timestamp() string {
+	return s.now().UTC().Format(quickphotos.TIMESTAMP_LAYOUT)
+}
+
+// 読み込みは application/ と同じように、どのエンティティも 1 つの構造体で受け取る
+type quickPhoto struct {
+	PK             string         `dynamo:"PK,hash"`
+	SK             string         `dynamo:",range"`
+	Address        string         `dynamo:"address"`
+	Birthdate      string         `dynamo:"birthdate"`
+	Email          string         `dynamo:"email"`
+	Name           string         `dynamo:"name"`
+	Username       string         `dynamo:"username"`
+	Status         string         `dynamo:"status"`
+	Interests      []string       `dynamo:"interests"`
+	Followers      int            `dynamo:"followers"`
+	Following      int            `dynamo:"following"`
+	PinnedImage    string         `dynamo:"pinnedImage"`
+	Private        bool           `dynamo:"private"`
+	Timestamp      string         `dynamo:"timestamp"`
+	FollowedUser   string         `dynamo:"followedUser"`
+	FollowingUser  string         `dynamo:"followingUser"`
+	Location       string         `dynamo:"location"`
+	Caption        string         `dynamo:"caption"`
+	Reactions      map[string]int `dynamo:"reactions"`
+	ReactionShards int            `dynamo:"reactionShards"`
+	ReactingUser   string         `dynamo:"reactingUser"`
+	Photo          string         `dynamo:"photo"`
+	ReactionType   string         `dynamo:"reactionType"`
+}
+
+func (q quickPhoto) user() *quickphotos.User {
+	interests := q.Interests
+	if interests == nil {
+		interests = []string{}
+	}
+	return &quickphotos.User{
+		Username:    q.Username,
+		Name:        q.Name,
+		Email:       q.Email,
+		Birthdate:   q.Birthdate,
+		Address:     q.Address,
+		Status:      q.Status,
+		Interests:   interests,
+		Followers:   q.Followers,
+		Following:   q.Following,
+		PinnedImage: q.PinnedImage,
+		Private:     q.Private,
+	}
+}
+
+// 古い形式で書き込まれた時刻も、TIMESTAMP_LAYOUT の形式にして返す
+// legacy はタイムゾーンの無い形式を読むときのタイムゾーン
+func (q quickPhoto) photo(legacy *time.Location) quickphotos.Photo {
+	photo := quickphotos.Photo{
+		Username:  q.Username,
+		Timestamp: quickphotos.CanonicalTimestampIn(q.Timestamp, legacy),
+		Location:  q.Location,
+		Caption:   q.Caption,
+		Reactions: make(map[string]int),
+	}
+	for _, t := range quickphotos.ReactionTypes {
+		photo.Reactions[t] = 0
+	}
+	for t, n := range q.Reactions {
+		photo.Reactions[t] += n
+	}
+	return photo
+}
+
+func (q quickPhoto) reaction(legacy *time.Location) quickphotos.Reaction {
+	return quickphotos.Reaction{
+		ReactingUser: q.ReactingUser,
+		Photo:        q.Photo,
+		ReactionType: q.ReactionType,
+		Timestamp:    quickphotos.CanonicalTimestampIn(q.Timestamp, legacy),
+	}
+}
+
+func (q quickPhoto) friendship(legacy *time.Location) quickphotos.Friendship {
+	return quickphotos.Friendship{
+		FollowedUser:  q.FollowedUser,
+		FollowingUser: q.FollowingUser,
+		Timestamp:     quickphotos.CanonicalTimestampIn(q.Timestamp, legacy),
+	}
+}
+
+// 書き込みはエンティティごとの構造体を使う
+// quickPhoto のまま Put すると、数値の属性がゼロ値で書き込まれてしまう
+type reactionItem struct {
+	PK           string `dynamo:"PK,hash"`
+	SK           string `dynamo:",range"`
+	ReactingUser string `dynamo:"reactingUser"`
+	ReactionType string `dynamo:"reactionType"`
+	Photo        string `dynamo:"photo"`
+	Timestamp    string `dynamo:"timestamp"`
+}
+
+type friendshipItem struct {
+	PK            string `dynamo:"PK,hash"`
+	SK            string `dynamo:",range"`
+	FollowedUser  string `dynamo:"followedUser"`
+	FollowingUser string `dynamo:"followingUser"`
+	Timestamp     string `dynamo:"timestamp"`
+	ExpiresAt     int64  `dynamo:"expiresAt,omitempty"`
+}
+
+type notificationItem struct {
+	PK           string `dynamo:"PK,hash"`
+	SK           string `dynamo:",range"`
+	Type         string `dynamo:"type"`
+	Actor        string `dynamo:"actor"`
+	Photo        string `dynamo:"photo,omitempty"`
+	ReactionType string `dynamo:"reactionType,omitempty"`
+	Timestamp    string `dynamo:"timestamp"`
+	ExpiresAt    int64  `dynamo:"expiresAt"`
+}
+
+func userPK(username string) string {
+	return fmt.Sprintf("USER#%s", username)
+}
+
+func metadataSK(username string) string {
+	return fmt.Sprintf("#METADATA#%s", username)
+}
+
+func friendSK(followingUser string) string {
+	return fmt.Sprintf("#FRIEND#%s", followingUser)
+}
+
+func blockSK(blockedUser string) string {
+	return fmt.Sprintf("#BLOCK#%s", blockedUser)
+}
+
+func inboxPK(username string) string {
+	return fmt.Sprintf("INBOX#%s", username)
+}
+
+// どちらかがブロックしていれば失敗する ConditionCheck
+func (s *Store) blockChecks(a, b string) []*dynamo.ConditionCheck {
+	return []*dynamo.ConditionCheck{
+		s.table.Check("PK", userPK(a)).Range("SK", blockSK(b)).IfNotExists(),
+		s.table.Check("PK", userPK(b)).Range("SK", blockSK(a)).IfNotExists(),
+	}
+}
+
+// 条件チェックで失敗したアイテムの位置を、quickphotos と同じドメインのエラーに変換する
+func translateTransactionError(err error, errs map[int]error) error {
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return err
+	}
+	for i, r := range canceled.CancellationReasons {
+		if aws.StringValue(r.Code) != "ConditionalCheckFailed" {
+			continue
+		}
+		if e, ok := errs[i]; ok {
+			return e
+		}
+		return quickphotos.ErrConcurrentModification
+	}
+	return err
+}
+
+// カーソルの形式は quickphotos と同じにして、どちらの実装にも渡せるようにする
+func encodeCursor(key dynamo.PagingKey) string {
+	if len(key) == 0 {
+		return ""
+	}
+	values := make(map[string]string, len(key))
+	for k, v := range key {
+		values[k] = aws.StringValue(v.S)
+	}
+	b, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (dynamo.PagingKey, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, quickphotos.ErrInvalidCursor
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, quickphotos.ErrInvalidCursor
+	}
+	key := make(dynamo.PagingKey, len(values))
+	for k, v := range values {
+		key[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return key, nil
+}
+
+// limit が 0 以下なら最後まで読み込む
+func page(q *dynamo.Query, limit int, cursor string) ([]quickPhoto, string, error) {
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if start != nil {
+		q = q.StartFrom(start)
+	}
+	if limit > 0 {
+		q = q.Limit(int64(limit))
+	}
+	items := make([]quickPhoto, 0)
+	next, err := q.AllWithLastEvaluatedKey(&items)
+	if err != nil {
+		return nil, "", err
+	}
+	return items, encodeCursor(next), nil
+}
+
+// アクセスパターンの宣言から Query を組み立てる
+func (s *Store) query(p *quickphotos.AccessPattern, args map[string]string) (*dynamo.Query, error) {
+	return PatternQuery(s.table, p, args)
+}
+
+// guregu/dynamo でアクセスパターンを実行する Query。application/ のサンプルからも使う
+func PatternQuery(table dynamo.Table, p *quickphotos.AccessPattern, args map[string]string) (*dynamo.Query, error) {
+	hash, values, err := p.Bind(args)
+	if err != nil {
+		return nil, err
+	}
+	q := table.Get(p.Key.HashKey, hash)
+	if p.Index != "" {
+		q = q.Index(p.Index)
+	}
+	switch p.Key.RangeOp {
+	case quickphotos.RANGE_BEGINS_WITH:
+		q = q.Range(p.Key.RangeKey, dynamo.BeginsWith, values[0])
+	case quickphotos.RANGE_BETWEEN:
+		q = q.Range(p.Key.RangeKey, dynamo.Between, values[0], values[1])
+	case quickphotos.RANGE_AFTER:
+		q = q.Range(p.Key.RangeKey, dynamo.Greater, values[0])
+	}
+	if p.Forward {
+		return q.Order(dynamo.Ascending), nil
+	}
+	return q.Order(dynamo.Descending), nil
+}
+
+// アクセスパターンを limit 件ずつ読み込む
+func (s *Store) page(p *quickphotos.AccessPattern, args map[string]string, limit int, cursor string) ([]quickPhoto, string, error) {
+	q, err := s.query(p, args)
+	if err != nil {
+		return nil, "", err
+	}
+	return page(q, limit, cursor)
+}
@@ -0,0 +1,132 @@
+package dynamostore
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+func (s *Store) GetUser(username string) (*quickphotos.User, error) {
+	var item quickPhoto
+	err := s.table.Get("PK", userPK(username)).
+		Range("SK", dynamo.Equal, metadataSK(username)).
+		One(&item)
+	if errors.Is(err, dynamo.ErrNotFound) {
+		return nil, quickphotos.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.user(), nil
+}
+
+// 01_fetch_user_and_photos.go と同じく、"#METADATA#<user>" から "PHOTO$" までを 1 回の Query で取得する
+func (s *Store) GetUserWithPhotos(username string) (*quickphotos.User, error) {
+	items := make([]quickPhoto, 0)
+	q, err := s.query(quickphotos.PatternUserWithPhotos, map[string]string{"username": username})
+	if err != nil {
+		return nil, err
+	}
+	err = q.All(&items)
+	if err != nil && !errors.Is(err, dynamo.ErrNotFound) {
+		return nil, err
+	}
+	if len(items) == 0 || !strings.HasPrefix(items[0].SK, "#METADATA#") {
+		return nil, quickphotos.ErrUserNotFound
+	}
+	user := items[0].user()
+	user.Photos = make([]quickphotos.Photo, 0, len(items)-1)
+	for _, item := range items[1:] {
+		user.Photos = append(user.Photos, item.photo(s.legacy))
+	}
+	if err := s.addShardTotals(user.Photos, items[1:], false); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// 写真は新しいものから返す。シャードの合計はページごとに 1 回の BatchGet で足す
+func (s *Store) ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error) {
+	items, next, err := s.page(quickphotos.PatternPhotosByUser, map[string]string{"username": username}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) == 0 && cursor == "" {
+		if _, err := s.GetUser(username); err != nil {
+			return nil, "", err
+		}
+	}
+	photos := make([]quickphotos.Photo, 0, len(items))
+	for _, item := range items {
+		photos = append(photos, item.photo(s.legacy))
+	}
+	if err := s.addShardTotals(photos, items, false); err != nil {
+		return nil, "", err
+	}
+	return photos, next, nil
+}
+
+// 存在しないユーザーは含まれない
+func (s *Store) BatchGetUsers(usernames []string) (map[string]*quickphotos.User, error) {
+	keys := make([]dynamo.Keyed, 0, len(usernames))
+	seen := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		keys = append(keys, dynamo.Keys{userPK(username), metadataSK(username)})
+	}
+	users := make(map[string]*quickphotos.User, len(keys))
+	if len(keys) == 0 {
+		return users, nil
+	}
+	items := make([]quickPhoto, 0, len(keys))
+	err := s.table.Batch("PK", "SK").Get(keys...).All(&items)
+	if err != nil && !errors.Is(err, dynamo.ErrNotFound) {
+		return nil, err
+	}
+	for _, item := range items {
+		users[item.Username] = item.user()
+	}
+	return users, nil
+}
+
+// PhotoID で指定した写真をまとめて取得する
+// シャード付きカウンターの写真は、シャードもまとめて取得して合計する
+func (s *Store) BatchGetPhotos(ids []string) (map[string]*quickphotos.Photo, error) {
+	keys := make([]dynamo.Keyed, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		username, _, ok := quickphotos.ParsePhotoID(id)
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		keys = append(keys, dynamo.Keys{photoPK(username), id})
+	}
+	photos := make(map[string]*quickphotos.Photo, len(keys))
+	if len(keys) == 0 {
+		return photos, nil
+	}
+	items := make([]quickPhoto, 0, len(keys))
+	err := s.table.Batch("PK", "SK").Get(keys...).Consistent(true).All(&items)
+	if err != nil && !errors.Is(err, dynamo.ErrNotFound) {
+		return nil, err
+	}
+	list := make([]quickphotos.Photo, 0, len(items))
+	for _, item := range items {
+		list = append(list, item.photo(s.legacy))
+	}
+	if err := s.addShardTotals(list, items, true); err != nil {
+		return nil, err
+	}
+	// 呼び出し元が指定した ID (アイテムの SK) で返す
+	for i := range list {
+		photos[items[i].SK] = &list[i]
+	}
+	return photos, nil
+}
@@ -0,0 +1,212 @@
+package quickphotos
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// username がフォローしているユーザー
+// フォロー関係は USER#<followed> / #FRIEND#<following> に置くので、InvertedIndex を #FRIEND#<user> で引く
+func (s *Store) ListFollowing(username string, limit int, cursor string) ([]Friendship, string, error) {
+	s = s.metered("ListFollowing")
+	items, next, err := s.queryPattern(PatternFollowing, map[string]string{"username": username}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	friendships := make([]Friendship, 0, len(items))
+	for _, item := range items {
+		friendships = append(friendships, newFriendship(item, s.legacy))
+	}
+	return friendships, next, nil
+}
+
+// username をフォローしているユーザー
+func (s *Store) ListFollowers(username string, limit int, cursor string) ([]Friendship, string, error) {
+	s = s.metered("ListFollowers")
+	items, next, err := s.queryPattern(PatternFollowers, map[string]string{"username": username}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	friendships := make([]Friendship, 0, len(items))
+	for _, item := range items {
+		friendships = append(friendships, newFriendship(item, s.legacy))
+	}
+	return friendships, next, nil
+}
+
+func (s *Store) counterUpdate(username, counter string, delta int) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:           aws.String(s.table),
+			Key:                 metadataKey(username),
+			UpdateExpression:    aws.String(fmt.Sprintf("SET %s = %s + :i", counter, counter)),
+			ConditionExpression: aws.String("attribute_exists(SK)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":i": {
+					N: aws.String(strconv.Itoa(delta)),
+				},
+			},
+		},
+	}
+}
+
+// 公開アカウントならそのままフォローし、非公開アカウントならフォローリクエストを作る
+// 戻り値はフォローリクエストを作ったかどうか
+func (s *Store) Follow(followedUser, followingUser string) (bool, error) {
+	s = s.metered("Follow")
+	if followedUser == followingUser {
+		return false, ErrCannotFollowSelf
+	}
+	followed, err := s.GetUser(followedUser)
+	if err != nil {
+		return false, err
+	}
+	if followed.Private {
+		return true, s.requestFollow(followedUser, followingUser)
+	}
+
+	now := s.timestamp()
+	followers := s.counterUpdate(followedUser, "followers", 1)
+	// 読み込み後に非公開へ切り替えられていれば失敗させる
+	followers.Update.ConditionExpression = aws.String("attribute_exists(SK) AND (attribute_not_exists(private) OR private = :false)")
+	followers.Update.ExpressionAttributeValues[":false"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+
+	item := friendKey(followedUser, followingUser)
+	item["followedUser"] = &dynamodb.AttributeValue{S: aws.String(followedUser)}
+	item["followingUser"] = &dynamodb.AttributeValue{S: aws.String(followingUser)}
+	item["timestamp"] = &dynamodb.AttributeValue{S: aws.String(now)}
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(s.table),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		followers,
+		s.counterUpdate(followingUser, "following", 1),
+	}
+	items = append(items, s.blockChecks(followedUser, followingUser)...)
+	items = append(items, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(s.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(inboxPK(followedUser)),
+				},
+				"SK": {
+					S: aws.String(fmt.Sprintf("NOTIFICATION#%s#%s", now, friendSK(followingUser))),
+				},
+				"type": {
+					S: aws.String("follow"),
+				},
+				"actor": {
+					S: aws.String(followingUser),
+				},
+				"timestamp": {
+					S: aws.String(now),
+				},
+				"expiresAt": {
+					N: aws.String(strconv.FormatInt(s.now().Add(NOTIFICATION_TTL).Unix(), 10)),
+				},
+			},
+		},
+	})
+
+	_, err = s.api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return false, translateTransactionError(err, map[int]error{
+		0: ErrAlreadyFollowing,
+		2: ErrUserNotFound,
+		3: ErrBlocked,
+		4: ErrBlocked,
+	})
+}
+
+func (s *Store) requestFollow(followedUser, followingUser string) error {
+	now := s.now()
+	item := followRequestKey(followedUser, followingUser)
+	item["followedUser"] = &dynamodb.AttributeValue{S: aws.String(followedUser)}
+	item["followingUser"] = &dynamodb.AttributeValue{S: aws.String(followingUser)}
+	item["timestamp"] = &dynamodb.AttributeValue{S: aws.String(s.timestamp())}
+	item[TTL_ATTRIBUTE] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(FOLLOW_REQUEST_TTL).Unix(), 10))}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(s.table),
+				Item:      item,
+				// TTL で削除される前の期限切れリクエストは上書きしてよい
+				ConditionExpression: aws.String("attribute_not_exists(SK) OR expiresAt < :now"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":now": {
+						N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+					},
+				},
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(s.table),
+				Key:                 metadataKey(followedUser),
+				ConditionExpression: aws.String("private = :true"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":true": {
+						BOOL: aws.Bool(true),
+					},
+				},
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(s.table),
+				Key:                 friendKey(followedUser, followingUser),
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(s.table),
+				Key:                 metadataKey(followingUser),
+				ConditionExpression: aws.String("attribute_exists(SK)"),
+			},
+		},
+	}
+	items = append(items, s.blockChecks(followedUser, followingUser)...)
+
+	_, err := s.api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	return translateTransactionError(err, map[int]error{
+		0: ErrAlreadyRequested,
+		2: ErrAlreadyFollowing,
+		3: ErrUserNotFound,
+		4: ErrBlocked,
+		5: ErrBlocked,
+	})
+}
+
+// フォロー関係の削除とカウンターの更新を 1 つのトランザクションで行う
+func (s *Store) Unfollow(followedUser, followingUser string) error {
+	s = s.metered("Unfollow")
+	_, err := s.api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Delete: &dynamodb.Delete{
+					TableName:           aws.String(s.table),
+					Key:                 friendKey(followedUser, followingUser),
+					ConditionExpression: aws.String("attribute_exists(SK)"),
+				},
+			},
+			s.counterUpdate(followedUser, "followers", -1),
+			s.counterUpdate(followingUser, "following", -1),
+		},
+	})
+	return translateTransactionError(err, map[int]error{
+		0: ErrNotFollowing,
+	})
+}
@@ -0,0 +1,76 @@
+// Package graphqlapi は、User、Photo、Reaction、Friendship を GraphQL で公開する
+//
+//	POST /graphql {"query": "...", "variables": {...}, "operationName": "..."}
+//
+// ユーザー → 写真 → リアクション → リアクションしたユーザー のように入れ子で取得しても、
+// 入れ子のユーザーと写真は階層ごとに 1 回の BatchGetItem で読み込む
+package graphqlapi
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+)
+
+const MAX_BODY_SIZE = 64 * 1024
+
+type Handler struct {
+	backend Backend
+	schema  graphql.Schema
+}
+
+// errorLog には、クライアントに内容を隠したエラーを出力する。nil なら出力しない
+func New(backend Backend, errorLog *log.Logger) (*Handler, error) {
+	schema, err := NewSchema(backend, errorLog)
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{backend: backend, schema: schema}, nil
+}
+
+type request struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// リクエストごとにローダーを作るので、別のリクエストと結果を共有しない
+func (h *Handler) Do(r *http.Request, req request) *graphql.Result {
+	return graphql.Do(graphql.Params{
+		Schema:         h.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        withLoaders(r.Context(), h.backend),
+	})
+}
+
+// GraphQL の慣習どおり、クエリのエラーも 200 で errors に入れて返す
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var req request
+	if err := json.NewDecoder(io.LimitReader(r.Body, MAX_BODY_SIZE)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body: " + err.Error()})
+		return
+	}
+	if req.Query == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "query is required"})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Do(r, req))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(body)
+}
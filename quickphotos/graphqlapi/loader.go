@@ -0,0 +1,121 @@
+package graphqlapi
+
+import (
+	"context"
+	"sync"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+type result struct {
+	value interface{}
+	err   error
+}
+
+// 同じ階層のリゾルバーが要求したキーをためておき、最初に値が必要になったときに 1 回の取得でまとめて読み込む
+// graphql-go はリゾルバーが返した関数を階層ごとに順番に呼ぶので、N+1 回の GetItem が 1 回の BatchGetItem になる
+// 取得した値はリクエストの間だけ覚えておく
+type loader struct {
+	fetch func(keys []string) (map[string]interface{}, error)
+
+	mu      sync.Mutex
+	pending []string
+	results map[string]result
+}
+
+func newLoader(fetch func(keys []string) (map[string]interface{}, error)) *loader {
+	return &loader{
+		fetch:   fetch,
+		results: make(map[string]result),
+	}
+}
+
+func (l *loader) load(key string) func() (interface{}, error) {
+	l.mu.Lock()
+	if _, ok := l.results[key]; !ok && !l.isPending(key) {
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.results[key]; !ok {
+			l.dispatch()
+		}
+		r := l.results[key]
+		return r.value, r.err
+	}
+}
+
+func (l *loader) isPending(key string) bool {
+	for _, k := range l.pending {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// 見つからなかったキーは null になる
+func (l *loader) dispatch() {
+	keys := l.pending
+	l.pending = nil
+	values, err := l.fetch(keys)
+	for _, key := range keys {
+		if err != nil {
+			l.results[key] = result{err: err}
+			continue
+		}
+		if v, ok := values[key]; ok {
+			l.results[key] = result{value: v}
+		} else {
+			l.results[key] = result{}
+		}
+	}
+}
+
+type loaders struct {
+	users  *loader
+	photos *loader
+}
+
+type loadersKey struct{}
+
+func withLoaders(ctx context.Context, backend Backend) context.Context {
+	return context.WithValue(ctx, loadersKey{}, &loaders{
+		users: newLoader(func(keys []string) (map[string]interface{}, error) {
+			users, err := backend.BatchGetUsers(keys)
+			if err != nil {
+				return nil, err
+			}
+			values := make(map[string]interface{}, len(users))
+			for k, v := range users {
+				values[k] = v
+			}
+			return values, nil
+		}),
+		photos: newLoader(func(keys []string) (map[string]interface{}, error) {
+			photos, err := backend.BatchGetPhotos(keys)
+			if err != nil {
+				return nil, err
+			}
+			values := make(map[string]interface{}, len(photos))
+			for k, v := range photos {
+				values[k] = v
+			}
+			return values, nil
+		}),
+	})
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
+
+func loadUser(ctx context.Context, username string) func() (interface{}, error) {
+	return loadersFrom(ctx).users.load(username)
+}
+
+func loadPhoto(ctx context.Context, username, timestamp string) func() (interface{}, error) {
+	return loadersFrom(ctx).photos.load(quickphotos.PhotoID(username, timestamp))
+}
@@ -0,0 +1,449 @@
+package graphqlapi
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/graphql-go/graphql"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+)
+
+// *quickphotos.Store が満たす
+// 入れ子のユーザーと写真は BatchGetUsers と BatchGetPhotos でまとめて取得する
+type Backend interface {
+	BatchGetUsers(usernames []string) (map[string]*quickphotos.User, error)
+	BatchGetPhotos(ids []string) (map[string]*quickphotos.Photo, error)
+	ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error)
+	ListFollowers(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	ListFollowing(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	ListReactions(username, timestamp string, limit int, cursor string) ([]quickphotos.Reaction, string, error)
+	Follow(followedUser, followingUser string) (bool, error)
+	React(reactingUser, reactionType, photoUser, timestamp string) (*quickphotos.Reaction, error)
+}
+
+var _ Backend = (*quickphotos.Store)(nil)
+
+// クライアントにそのまま返してよいエラー
+// それ以外は内容を隠して internal error にする
+var domainErrors = []error{
+	quickphotos.ErrUserNotFound,
+	quickphotos.ErrPhotoNotFound,
+	quickphotos.ErrAlreadyFollowing,
+	quickphotos.ErrAlreadyRequested,
+	quickphotos.ErrAlreadyReacted,
+	quickphotos.ErrBlocked,
+	quickphotos.ErrCannotFollowSelf,
+	quickphotos.ErrInvalidReactionType,
+	quickphotos.ErrInvalidCursor,
+	quickphotos.ErrConcurrentModification,
+}
+
+var errInternal = errors.New("internal error")
+
+// 引数の誤りもそのまま返す
+type argumentError struct {
+	message string
+}
+
+func (e argumentError) Error() string {
+	return e.message
+}
+
+type schemaBuilder struct {
+	backend  Backend
+	errorLog *log.Logger
+}
+
+func (b *schemaBuilder) publicError(err error) error {
+	var aerr argumentError
+	if errors.As(err, &aerr) {
+		return aerr
+	}
+	for _, e := range domainErrors {
+		if errors.Is(err, e) {
+			return e
+		}
+	}
+	if b.errorLog != nil {
+		b.errorLog.Printf("graphqlapi: %s", err)
+	}
+	return errInternal
+}
+
+// リゾルバーのエラーと、リゾルバーが返した関数のエラーのどちらも publicError を通す
+func (b *schemaBuilder) resolve(fn graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		v, err := fn(p)
+		if err != nil {
+			return nil, b.publicError(err)
+		}
+		if thunk, ok := v.(func() (interface{}, error)); ok {
+			return func() (interface{}, error) {
+				v, err := thunk()
+				if err != nil {
+					return nil, b.publicError(err)
+				}
+				return v, nil
+			}, nil
+		}
+		return v, nil
+	}
+}
+
+func pageArgs() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"first": &graphql.ArgumentConfig{
+			Type:         graphql.Int,
+			DefaultValue: DEFAULT_PAGE_SIZE,
+		},
+		"after": &graphql.ArgumentConfig{
+			Type:         graphql.String,
+			DefaultValue: "",
+		},
+	}
+}
+
+func pageParams(p graphql.ResolveParams) (int, string, error) {
+	first, _ := p.Args["first"].(int)
+	after, _ := p.Args["after"].(string)
+	if first < 1 || first > MAX_PAGE_SIZE {
+		return 0, "", argumentError{fmt.Sprintf("first must be between 1 and %d", MAX_PAGE_SIZE)}
+	}
+	return first, after, nil
+}
+
+type page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor"`
+}
+
+func pageType(name string, item graphql.Type) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: name,
+		Fields: graphql.Fields{
+			"items": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(item))),
+			},
+			// 続きがなければ null
+			"nextCursor": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if next := p.Source.(page).NextCursor; next != "" {
+						return next, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+}
+
+func NewSchema(backend Backend, errorLog *log.Logger) (graphql.Schema, error) {
+	b := &schemaBuilder{backend: backend, errorLog: errorLog}
+
+	var userType, photoType *graphql.Object
+	reactionCountType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ReactionCount",
+		Fields: graphql.Fields{
+			"reactionType": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"count":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	friendshipType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Friendship",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"followedUsername": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(quickphotos.Friendship).FollowedUser, nil
+					},
+				},
+				"followingUsername": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(quickphotos.Friendship).FollowingUser, nil
+					},
+				},
+				"timestamp": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"followedUser": &graphql.Field{
+					Type: userType,
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						return loadUser(p.Context, p.Source.(quickphotos.Friendship).FollowedUser), nil
+					}),
+				},
+				"followingUser": &graphql.Field{
+					Type: userType,
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						return loadUser(p.Context, p.Source.(quickphotos.Friendship).FollowingUser), nil
+					}),
+				},
+			}
+		}),
+	})
+	reactionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Reaction",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"reactingUsername": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return reactionSource(p).ReactingUser, nil
+					},
+				},
+				"reactionType": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"timestamp":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"photoId": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return reactionSource(p).Photo, nil
+					},
+				},
+				"reactingUser": &graphql.Field{
+					Type: userType,
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						return loadUser(p.Context, reactionSource(p).ReactingUser), nil
+					}),
+				},
+				"photo": &graphql.Field{
+					Type: photoType,
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						username, timestamp, ok := quickphotos.ParsePhotoID(reactionSource(p).Photo)
+						if !ok {
+							return nil, nil
+						}
+						return loadPhoto(p.Context, username, timestamp), nil
+					}),
+				},
+			}
+		}),
+	})
+	friendshipPage := pageType("FriendshipPage", friendshipType)
+	reactionPage := pageType("ReactionPage", reactionType)
+
+	photoType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Photo",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(*quickphotos.Photo).ID(), nil
+					},
+				},
+				"username":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"timestamp": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"location":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"caption":   &graphql.Field{Type: graphql.String},
+				// 種類の順番は ReactionTypes のとおり
+				"reactionCounts": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(reactionCountType))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						photo := p.Source.(*quickphotos.Photo)
+						counts := make([]map[string]interface{}, 0, len(quickphotos.ReactionTypes))
+						for _, t := range quickphotos.ReactionTypes {
+							counts = append(counts, map[string]interface{}{
+								"reactionType": t,
+								"count":        photo.Reactions[t],
+							})
+						}
+						return counts, nil
+					},
+				},
+				"owner": &graphql.Field{
+					Type: userType,
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						return loadUser(p.Context, p.Source.(*quickphotos.Photo).Username), nil
+					}),
+				},
+				"reactions": &graphql.Field{
+					Type: graphql.NewNonNull(reactionPage),
+					Args: pageArgs(),
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						limit, cursor, err := pageParams(p)
+						if err != nil {
+							return nil, err
+						}
+						photo := p.Source.(*quickphotos.Photo)
+						reactions, next, err := b.backend.ListReactions(photo.Username, photo.Timestamp, limit, cursor)
+						if err != nil {
+							return nil, err
+						}
+						return page{reactions, next}, nil
+					}),
+				},
+			}
+		}),
+	})
+	photoPage := pageType("PhotoPage", photoType)
+
+	userType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"username":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"email":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"birthdate":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"address":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"status":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+				"interests":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+				"followers":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				"following":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				"private":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+				"pinnedImage": &graphql.Field{Type: graphql.String},
+				"photos": &graphql.Field{
+					Type: graphql.NewNonNull(photoPage),
+					Args: pageArgs(),
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						limit, cursor, err := pageParams(p)
+						if err != nil {
+							return nil, err
+						}
+						photos, next, err := b.backend.ListPhotos(p.Source.(*quickphotos.User).Username, limit, cursor)
+						if err != nil {
+							return nil, err
+						}
+						items := make([]*quickphotos.Photo, 0, len(photos))
+						for i := range photos {
+							items = append(items, &photos[i])
+						}
+						return page{items, next}, nil
+					}),
+				},
+				"followerList": &graphql.Field{
+					Type: graphql.NewNonNull(friendshipPage),
+					Args: pageArgs(),
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						limit, cursor, err := pageParams(p)
+						if err != nil {
+							return nil, err
+						}
+						friendships, next, err := b.backend.ListFollowers(p.Source.(*quickphotos.User).Username, limit, cursor)
+						if err != nil {
+							return nil, err
+						}
+						return page{friendships, next}, nil
+					}),
+				},
+				"followingList": &graphql.Field{
+					Type: graphql.NewNonNull(friendshipPage),
+					Args: pageArgs(),
+					Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+						limit, cursor, err := pageParams(p)
+						if err != nil {
+							return nil, err
+						}
+						friendships, next, err := b.backend.ListFollowing(p.Source.(*quickphotos.User).Username, limit, cursor)
+						if err != nil {
+							return nil, err
+						}
+						return page{friendships, next}, nil
+					}),
+				},
+			}
+		}),
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			// 存在しなければ null
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"username": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+					return loadUser(p.Context, p.Args["username"].(string)), nil
+				}),
+			},
+			"photo": &graphql.Field{
+				Type: photoType,
+				Args: graphql.FieldConfigArgument{
+					"username":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"timestamp": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+					return loadPhoto(p.Context, p.Args["username"].(string), p.Args["timestamp"].(string)), nil
+				}),
+			},
+		},
+	})
+
+	followResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "FollowResult",
+		Fields: graphql.Fields{
+			"followedUsername":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"followingUsername": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// following か、非公開アカウントへのフォローリクエストなら requested
+			"status": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"follow": &graphql.Field{
+				Type: graphql.NewNonNull(followResultType),
+				Args: graphql.FieldConfigArgument{
+					"followedUsername":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"followingUsername": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+					followed := p.Args["followedUsername"].(string)
+					following := p.Args["followingUsername"].(string)
+					requested, err := b.backend.Follow(followed, following)
+					if err != nil {
+						return nil, err
+					}
+					status := "following"
+					if requested {
+						status = "requested"
+					}
+					return map[string]interface{}{
+						"followedUsername":  followed,
+						"followingUsername": following,
+						"status":            status,
+					}, nil
+				}),
+			},
+			"react": &graphql.Field{
+				Type: graphql.NewNonNull(reactionType),
+				Args: graphql.FieldConfigArgument{
+					"username":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"reactionType":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"photoUsername": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"timestamp":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: b.resolve(func(p graphql.ResolveParams) (interface{}, error) {
+					return b.backend.React(
+						p.Args["username"].(string),
+						p.Args["reactionType"].(string),
+						p.Args["photoUsername"].(string),
+						p.Args["timestamp"].(string),
+					)
+				}),
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    query,
+		Mutation: mutation,
+	})
+}
+
+// 一覧からは値で、react ミューテーションからはポインターで渡される
+func reactionSource(p graphql.ResolveParams) quickphotos.Reaction {
+	if r, ok := p.Source.(*quickphotos.Reaction); ok {
+		return *r
+	}
+	return p.Source.(quickphotos.Reaction)
+}
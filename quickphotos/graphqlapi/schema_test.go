@@ -0,0 +1,293 @@
+package graphqlapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// メモリー上のユーザー、写真、リアクションを返し、呼ばれた操作と引数を記録する Backend
+// err に登録した操作は、そのエラーを返す
+type countingBackend struct {
+	users     map[string]*quickphotos.User
+	photos    []quickphotos.Photo
+	reactions map[string][]quickphotos.Reaction
+	err       map[string]error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (b *countingBackend) record(op string, args ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, fmt.Sprintf("%s %s", op, strings.Join(args, ",")))
+	return b.err[op]
+}
+
+// op の呼び出しを、呼ばれた順に引数だけにして返す
+func (b *countingBackend) callsOf(op string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var result []string
+	for _, c := range b.calls {
+		if strings.HasPrefix(c, op+" ") {
+			result = append(result, strings.TrimPrefix(c, op+" "))
+		}
+	}
+	return result
+}
+
+// ローダーが渡すキーの順番は決まっていないので、並べてから記録する
+func sorted(keys []string) []string {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *countingBackend) BatchGetUsers(usernames []string) (map[string]*quickphotos.User, error) {
+	if err := b.record("BatchGetUsers", sorted(usernames)...); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*quickphotos.User)
+	for _, u := range usernames {
+		if user, ok := b.users[u]; ok {
+			result[u] = user
+		}
+	}
+	return result, nil
+}
+
+func (b *countingBackend) BatchGetPhotos(ids []string) (map[string]*quickphotos.Photo, error) {
+	if err := b.record("BatchGetPhotos", sorted(ids)...); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*quickphotos.Photo)
+	for _, id := range ids {
+		for i := range b.photos {
+			if b.photos[i].ID() == id {
+				result[id] = &b.photos[i]
+			}
+		}
+	}
+	return result, nil
+}
+
+func (b *countingBackend) ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error) {
+	if err := b.record("ListPhotos", username); err != nil {
+		return nil, "", err
+	}
+	var result []quickphotos.Photo
+	for _, p := range b.photos {
+		if p.Username == username {
+			result = append(result, p)
+		}
+	}
+	return result, "", nil
+}
+
+func (b *countingBackend) ListFollowers(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error) {
+	return nil, "", b.record("ListFollowers", username)
+}
+
+func (b *countingBackend) ListFollowing(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error) {
+	return nil, "", b.record("ListFollowing", username)
+}
+
+func (b *countingBackend) ListReactions(username, timestamp string, limit int, cursor string) ([]quickphotos.Reaction, string, error) {
+	if err := b.record("ListReactions", username, timestamp); err != nil {
+		return nil, "", err
+	}
+	return b.reactions[quickphotos.PhotoID(username, timestamp)], "", nil
+}
+
+func (b *countingBackend) Follow(followedUser, followingUser string) (bool, error) {
+	return false, b.record("Follow", followedUser, followingUser)
+}
+
+func (b *countingBackend) React(reactingUser, reactionType, photoUser, timestamp string) (*quickphotos.Reaction, error) {
+	if err := b.record("React", reactingUser, reactionType, photoUser, timestamp); err != nil {
+		return nil, err
+	}
+	return &quickphotos.Reaction{ReactingUser: reactingUser, ReactionType: reactionType, Photo: quickphotos.PhotoID(photoUser, timestamp)}, nil
+}
+
+// a の写真 2 枚に、b、c、d と a 自身がリアクションしている
+func newCountingBackend() *countingBackend {
+	b := &countingBackend{
+		users:     make(map[string]*quickphotos.User),
+		reactions: make(map[string][]quickphotos.Reaction),
+		err:       make(map[string]error),
+	}
+	for _, u := range []string{"a", "b", "c", "d"} {
+		b.users[u] = &quickphotos.User{Username: u}
+	}
+	for _, ts := range []string{"2020-01-01T00:00:00Z", "2020-01-02T00:00:00Z"} {
+		b.photos = append(b.photos, quickphotos.Photo{Username: "a", Timestamp: ts})
+	}
+	photo1 := quickphotos.PhotoID("a", "2020-01-01T00:00:00Z")
+	photo2 := quickphotos.PhotoID("a", "2020-01-02T00:00:00Z")
+	b.reactions[photo1] = []quickphotos.Reaction{
+		{ReactingUser: "b", ReactionType: "heart", Photo: photo1},
+		{ReactingUser: "c", ReactionType: "smiley", Photo: photo1},
+	}
+	b.reactions[photo2] = []quickphotos.Reaction{
+		{ReactingUser: "c", ReactionType: "heart", Photo: photo2},
+		{ReactingUser: "d", ReactionType: "+1", Photo: photo2},
+		{ReactingUser: "a", ReactionType: "+1", Photo: photo2},
+	}
+	return b
+}
+
+type response struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (r response) messages() []string {
+	messages := make([]string, 0, len(r.Errors))
+	for _, e := range r.Errors {
+		messages = append(messages, e.Message)
+	}
+	return messages
+}
+
+func query(t *testing.T, h *Handler, q string) response {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"query": q})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// 入れ子のユーザーと写真は、階層ごとに 1 回の Batch でまとめて読み込む
+// 同じ階層に現れたユーザーは 1 回だけ、前の階層で読み込んだユーザーは読み込み直さない
+func TestOneBatchPerLevel(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		query  string
+		users  []string
+		photos []string
+	}{
+		{
+			name:  "user, photos, reactions and reacting users",
+			query: `{ user(username: "a") { photos { items { reactions { items { reactingUser { username } } } } } } }`,
+			users: []string{"a", "b,c,d"},
+		},
+		{
+			name:  "owners and reacting users on the same level",
+			query: `{ user(username: "a") { photos { items { owner { username } reactions { items { reactingUser { username } } } } } } }`,
+			users: []string{"a", "b,c,d"},
+		},
+		{
+			name:   "photos of reactions",
+			query:  `{ photo(username: "a", timestamp: "2020-01-02T00:00:00Z") { reactions { items { photo { id } reactingUser { username } } } } }`,
+			users:  []string{"a,c,d"},
+			photos: []string{"PHOTO#a#2020-01-02T00:00:00Z"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newCountingBackend()
+			h, err := New(backend, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := query(t, h, tc.query)
+			if len(resp.Errors) > 0 {
+				t.Fatalf("errors = %v", resp.messages())
+			}
+			if got := backend.callsOf("BatchGetUsers"); fmt.Sprint(got) != fmt.Sprint(tc.users) {
+				t.Errorf("BatchGetUsers calls = %q, want %q", got, tc.users)
+			}
+			if got := backend.callsOf("BatchGetPhotos"); fmt.Sprint(got) != fmt.Sprint(tc.photos) {
+				t.Errorf("BatchGetPhotos calls = %q, want %q", got, tc.photos)
+			}
+		})
+	}
+}
+
+// ドメインのエラーと引数の誤りはそのまま返し、それ以外は internal error にしてエラーログにだけ出す
+func TestErrorsAreMasked(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		op      string
+		err     error
+		query   string
+		message string
+		logged  bool
+	}{
+		{
+			name:    "domain error from a list",
+			op:      "ListPhotos",
+			err:     quickphotos.ErrInvalidCursor,
+			query:   `{ user(username: "a") { photos(after: "x") { items { id } } } }`,
+			message: "invalid cursor",
+		},
+		{
+			name:    "wrapped domain error from a mutation",
+			op:      "Follow",
+			err:     fmt.Errorf("follow a: %w", quickphotos.ErrBlocked),
+			query:   `mutation { follow(followedUsername: "a", followingUsername: "b") { status } }`,
+			message: "blocked",
+		},
+		{
+			name:    "argument error",
+			query:   `{ user(username: "a") { photos(first: 0) { items { id } } } }`,
+			message: fmt.Sprintf("first must be between 1 and %d", MAX_PAGE_SIZE),
+		},
+		{
+			name:    "unexpected error from a list",
+			op:      "ListReactions",
+			err:     errors.New("ProvisionedThroughputExceededException: table quick-photos"),
+			query:   `{ photo(username: "a", timestamp: "2020-01-01T00:00:00Z") { reactions { items { reactionType } } } }`,
+			message: "internal error",
+			logged:  true,
+		},
+		{
+			name:    "unexpected error from a batch",
+			op:      "BatchGetUsers",
+			err:     errors.New("RequestError: send request failed"),
+			query:   `{ user(username: "a") { username } }`,
+			message: "internal error",
+			logged:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newCountingBackend()
+			if tc.op != "" {
+				backend.err[tc.op] = tc.err
+			}
+			var logs bytes.Buffer
+			h, err := New(backend, log.New(&logs, "", 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := query(t, h, tc.query)
+			if got := resp.messages(); len(got) != 1 || got[0] != tc.message {
+				t.Errorf("errors = %q, want [%q]", got, tc.message)
+			}
+			if tc.logged != strings.Contains(logs.String(), fmt.Sprint(tc.err)) {
+				t.Errorf("error log = %q, want logged %v", logs.String(), tc.logged)
+			}
+		})
+	}
+}
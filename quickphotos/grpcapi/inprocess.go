@@ -0,0 +1,41 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/grpcapi/quickphotospb"
+)
+
+const bufferSize = 1024 * 1024
+
+// ネットワークを使わずに、同じプロセスの中でサーバーと生成したクライアントをつなぐ
+// テストや、ほかのサービスからローカルで呼び出すときに使う
+// 戻り値の関数でクライアントとサーバーを止める
+func NewInProcess(server *Server, opts ...grpc.ServerOption) (pb.QuickPhotosClient, func(), error) {
+	lis := bufconn.Listen(bufferSize)
+	srv := grpc.NewServer(opts...)
+	pb.RegisterQuickPhotosServer(srv, server)
+	go srv.Serve(lis)
+
+	conn, err := grpc.NewClient(
+		"passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		srv.Stop()
+		return nil, nil, err
+	}
+	stop := func() {
+		conn.Close()
+		srv.Stop()
+	}
+	return pb.NewQuickPhotosClient(conn), stop, nil
+}
@@ -0,0 +1,532 @@
+// チュートリアルのアクセスパターンを、同じチームのバックエンドサービスから型付きで使うための定義
+//
+// grpcapi ディレクトリで go generate を実行すると、protoc でコードを作り直す
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: quickphotospb/quickphotos.proto
+
+package quickphotospb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	QuickPhotos_GetUser_FullMethodName         = "/quickphotos.v1.QuickPhotos/GetUser"
+	QuickPhotos_ListPhotos_FullMethodName      = "/quickphotos.v1.QuickPhotos/ListPhotos"
+	QuickPhotos_GetPhoto_FullMethodName        = "/quickphotos.v1.QuickPhotos/GetPhoto"
+	QuickPhotos_ListReactions_FullMethodName   = "/quickphotos.v1.QuickPhotos/ListReactions"
+	QuickPhotos_Follow_FullMethodName          = "/quickphotos.v1.QuickPhotos/Follow"
+	QuickPhotos_Unfollow_FullMethodName        = "/quickphotos.v1.QuickPhotos/Unfollow"
+	QuickPhotos_React_FullMethodName           = "/quickphotos.v1.QuickPhotos/React"
+	QuickPhotos_StreamFollowers_FullMethodName = "/quickphotos.v1.QuickPhotos/StreamFollowers"
+	QuickPhotos_StreamFollowing_FullMethodName = "/quickphotos.v1.QuickPhotos/StreamFollowing"
+	QuickPhotos_StreamFeed_FullMethodName      = "/quickphotos.v1.QuickPhotos/StreamFeed"
+)
+
+// QuickPhotosClient is the client API for QuickPhotos service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type QuickPhotosClient interface {
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error)
+	ListPhotos(ctx context.Context, in *ListPhotosRequest, opts ...grpc.CallOption) (*ListPhotosResponse, error)
+	GetPhoto(ctx context.Context, in *GetPhotoRequest, opts ...grpc.CallOption) (*Photo, error)
+	ListReactions(ctx context.Context, in *ListReactionsRequest, opts ...grpc.CallOption) (*ListReactionsResponse, error)
+	Follow(ctx context.Context, in *FollowRequest, opts ...grpc.CallOption) (*FollowResponse, error)
+	Unfollow(ctx context.Context, in *UnfollowRequest, opts ...grpc.CallOption) (*UnfollowResponse, error)
+	React(ctx context.Context, in *ReactRequest, opts ...grpc.CallOption) (*Reaction, error)
+	// 件数の多い一覧は、サーバー側でページをたどりながらストリームで返す
+	StreamFollowers(ctx context.Context, in *StreamFriendshipsRequest, opts ...grpc.CallOption) (QuickPhotos_StreamFollowersClient, error)
+	StreamFollowing(ctx context.Context, in *StreamFriendshipsRequest, opts ...grpc.CallOption) (QuickPhotos_StreamFollowingClient, error)
+	// フォローしているユーザーの写真を新しい順に返す
+	StreamFeed(ctx context.Context, in *StreamFeedRequest, opts ...grpc.CallOption) (QuickPhotos_StreamFeedClient, error)
+}
+
+type quickPhotosClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewQuickPhotosClient(cc grpc.ClientConnInterface) QuickPhotosClient {
+	return &quickPhotosClient{cc}
+}
+
+func (c *quickPhotosClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error) {
+	out := new(User)
+	err := c.cc.Invoke(ctx, QuickPhotos_GetUser_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) ListPhotos(ctx context.Context, in *ListPhotosRequest, opts ...grpc.CallOption) (*ListPhotosResponse, error) {
+	out := new(ListPhotosResponse)
+	err := c.cc.Invoke(ctx, QuickPhotos_ListPhotos_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) GetPhoto(ctx context.Context, in *GetPhotoRequest, opts ...grpc.CallOption) (*Photo, error) {
+	out := new(Photo)
+	err := c.cc.Invoke(ctx, QuickPhotos_GetPhoto_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) ListReactions(ctx context.Context, in *ListReactionsRequest, opts ...grpc.CallOption) (*ListReactionsResponse, error) {
+	out := new(ListReactionsResponse)
+	err := c.cc.Invoke(ctx, QuickPhotos_ListReactions_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) Follow(ctx context.Context, in *FollowRequest, opts ...grpc.CallOption) (*FollowResponse, error) {
+	out := new(FollowResponse)
+	err := c.cc.Invoke(ctx, QuickPhotos_Follow_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) Unfollow(ctx context.Context, in *UnfollowRequest, opts ...grpc.CallOption) (*UnfollowResponse, error) {
+	out := new(UnfollowResponse)
+	err := c.cc.Invoke(ctx, QuickPhotos_Unfollow_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) React(ctx context.Context, in *ReactRequest, opts ...grpc.CallOption) (*Reaction, error) {
+	out := new(Reaction)
+	err := c.cc.Invoke(ctx, QuickPhotos_React_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *quickPhotosClient) StreamFollowers(ctx context.Context, in *StreamFriendshipsRequest, opts ...grpc.CallOption) (QuickPhotos_StreamFollowersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &QuickPhotos_ServiceDesc.Streams[0], QuickPhotos_StreamFollowers_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &quickPhotosStreamFollowersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type QuickPhotos_StreamFollowersClient interface {
+	Recv() (*Friendship, error)
+	grpc.ClientStream
+}
+
+type quickPhotosStreamFollowersClient struct {
+	grpc.ClientStream
+}
+
+func (x *quickPhotosStreamFollowersClient) Recv() (*Friendship, error) {
+	m := new(Friendship)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *quickPhotosClient) StreamFollowing(ctx context.Context, in *StreamFriendshipsRequest, opts ...grpc.CallOption) (QuickPhotos_StreamFollowingClient, error) {
+	stream, err := c.cc.NewStream(ctx, &QuickPhotos_ServiceDesc.Streams[1], QuickPhotos_StreamFollowing_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &quickPhotosStreamFollowingClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type QuickPhotos_StreamFollowingClient interface {
+	Recv() (*Friendship, error)
+	grpc.ClientStream
+}
+
+type quickPhotosStreamFollowingClient struct {
+	grpc.ClientStream
+}
+
+func (x *quickPhotosStreamFollowingClient) Recv() (*Friendship, error) {
+	m := new(Friendship)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *quickPhotosClient) StreamFeed(ctx context.Context, in *StreamFeedRequest, opts ...grpc.CallOption) (QuickPhotos_StreamFeedClient, error) {
+	stream, err := c.cc.NewStream(ctx, &QuickPhotos_ServiceDesc.Streams[2], QuickPhotos_StreamFeed_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &quickPhotosStreamFeedClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type QuickPhotos_StreamFeedClient interface {
+	Recv() (*Photo, error)
+	grpc.ClientStream
+}
+
+type quickPhotosStreamFeedClient struct {
+	grpc.ClientStream
+}
+
+func (x *quickPhotosStreamFeedClient) Recv() (*Photo, error) {
+	m := new(Photo)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// QuickPhotosServer is the server API for QuickPhotos service.
+// All implementations must embed UnimplementedQuickPhotosServer
+// for forward compatibility
+type QuickPhotosServer interface {
+	GetUser(context.Context, *GetUserRequest) (*User, error)
+	ListPhotos(context.Context, *ListPhotosRequest) (*ListPhotosResponse, error)
+	GetPhoto(context.Context, *GetPhotoRequest) (*Photo, error)
+	ListReactions(context.Context, *ListReactionsRequest) (*ListReactionsResponse, error)
+	Follow(context.Context, *FollowRequest) (*FollowResponse, error)
+	Unfollow(context.Context, *UnfollowRequest) (*UnfollowResponse, error)
+	React(context.Context, *ReactRequest) (*Reaction, error)
+	// 件数の多い一覧は、サーバー側でページをたどりながらストリームで返す
+	StreamFollowers(*StreamFriendshipsRequest, QuickPhotos_StreamFollowersServer) error
+	StreamFollowing(*StreamFriendshipsRequest, QuickPhotos_StreamFollowingServer) error
+	// フォローしているユーザーの写真を新しい順に返す
+	StreamFeed(*StreamFeedRequest, QuickPhotos_StreamFeedServer) error
+	mustEmbedUnimplementedQuickPhotosServer()
+}
+
+// UnimplementedQuickPhotosServer must be embedded to have forward compatible implementations.
+type UnimplementedQuickPhotosServer struct {
+}
+
+func (UnimplementedQuickPhotosServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedQuickPhotosServer) ListPhotos(context.Context, *ListPhotosRequest) (*ListPhotosResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPhotos not implemented")
+}
+func (UnimplementedQuickPhotosServer) GetPhoto(context.Context, *GetPhotoRequest) (*Photo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPhoto not implemented")
+}
+func (UnimplementedQuickPhotosServer) ListReactions(context.Context, *ListReactionsRequest) (*ListReactionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListReactions not implemented")
+}
+func (UnimplementedQuickPhotosServer) Follow(context.Context, *FollowRequest) (*FollowResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Follow not implemented")
+}
+func (UnimplementedQuickPhotosServer) Unfollow(context.Context, *UnfollowRequest) (*UnfollowResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Unfollow not implemented")
+}
+func (UnimplementedQuickPhotosServer) React(context.Context, *ReactRequest) (*Reaction, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method React not implemented")
+}
+func (UnimplementedQuickPhotosServer) StreamFollowers(*StreamFriendshipsRequest, QuickPhotos_StreamFollowersServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFollowers not implemented")
+}
+func (UnimplementedQuickPhotosServer) StreamFollowing(*StreamFriendshipsRequest, QuickPhotos_StreamFollowingServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFollowing not implemented")
+}
+func (UnimplementedQuickPhotosServer) StreamFeed(*StreamFeedRequest, QuickPhotos_StreamFeedServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamFeed not implemented")
+}
+func (UnimplementedQuickPhotosServer) mustEmbedUnimplementedQuickPhotosServer() {}
+
+// UnsafeQuickPhotosServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to QuickPhotosServer will
+// result in compilation errors.
+type UnsafeQuickPhotosServer interface {
+	mustEmbedUnimplementedQuickPhotosServer()
+}
+
+func RegisterQuickPhotosServer(s grpc.ServiceRegistrar, srv QuickPhotosServer) {
+	s.RegisterService(&QuickPhotos_ServiceDesc, srv)
+}
+
+func _QuickPhotos_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_GetUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_ListPhotos_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPhotosRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).ListPhotos(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_ListPhotos_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).ListPhotos(ctx, req.(*ListPhotosRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_GetPhoto_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPhotoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).GetPhoto(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_GetPhoto_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).GetPhoto(ctx, req.(*GetPhotoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_ListReactions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListReactionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).ListReactions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_ListReactions_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).ListReactions(ctx, req.(*ListReactionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_Follow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FollowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).Follow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_Follow_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).Follow(ctx, req.(*FollowRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_Unfollow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnfollowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).Unfollow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_Unfollow_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).Unfollow(ctx, req.(*UnfollowRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_React_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReactRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QuickPhotosServer).React(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QuickPhotos_React_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QuickPhotosServer).React(ctx, req.(*ReactRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QuickPhotos_StreamFollowers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamFriendshipsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QuickPhotosServer).StreamFollowers(m, &quickPhotosStreamFollowersServer{stream})
+}
+
+type QuickPhotos_StreamFollowersServer interface {
+	Send(*Friendship) error
+	grpc.ServerStream
+}
+
+type quickPhotosStreamFollowersServer struct {
+	grpc.ServerStream
+}
+
+func (x *quickPhotosStreamFollowersServer) Send(m *Friendship) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _QuickPhotos_StreamFollowing_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamFriendshipsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QuickPhotosServer).StreamFollowing(m, &quickPhotosStreamFollowingServer{stream})
+}
+
+type QuickPhotos_StreamFollowingServer interface {
+	Send(*Friendship) error
+	grpc.ServerStream
+}
+
+type quickPhotosStreamFollowingServer struct {
+	grpc.ServerStream
+}
+
+func (x *quickPhotosStreamFollowingServer) Send(m *Friendship) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _QuickPhotos_StreamFeed_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamFeedRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QuickPhotosServer).StreamFeed(m, &quickPhotosStreamFeedServer{stream})
+}
+
+type QuickPhotos_StreamFeedServer interface {
+	Send(*Photo) error
+	grpc.ServerStream
+}
+
+type quickPhotosStreamFeedServer struct {
+	grpc.ServerStream
+}
+
+func (x *quickPhotosStreamFeedServer) Send(m *Photo) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// QuickPhotos_ServiceDesc is the grpc.ServiceDesc for QuickPhotos service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var QuickPhotos_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "quickphotos.v1.QuickPhotos",
+	HandlerType: (*QuickPhotosServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetUser",
+			Handler:    _QuickPhotos_GetUser_Handler,
+		},
+		{
+			MethodName: "ListPhotos",
+			Handler:    _QuickPhotos_ListPhotos_Handler,
+		},
+		{
+			MethodName: "GetPhoto",
+			Handler:    _QuickPhotos_GetPhoto_Handler,
+		},
+		{
+			MethodName: "ListReactions",
+			Handler:    _QuickPhotos_ListReactions_Handler,
+		},
+		{
+			MethodName: "Follow",
+			Handler:    _QuickPhotos_Follow_Handler,
+		},
+		{
+			MethodName: "Unfollow",
+			Handler:    _QuickPhotos_Unfollow_Handler,
+		},
+		{
+			MethodName: "React",
+			Handler:    _QuickPhotos_React_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamFollowers",
+			Handler:       _QuickPhotos_StreamFollowers_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamFollowing",
+			Handler:       _QuickPhotos_StreamFollowing_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamFeed",
+			Handler:       _QuickPhotos_StreamFeed_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "quickphotospb/quickphotos.proto",
+}
@@ -0,0 +1,427 @@
+// Package grpcapi は、quickphotos のアクセスパターンをバックエンドサービス向けの gRPC サービスとして公開する
+// サービスの定義は quickphotospb/quickphotos.proto にある
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative quickphotospb/quickphotos.proto
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	pb "github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/grpcapi/quickphotospb"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+	// ストリームを返すときに、1 回の Query で読み込む件数
+	STREAM_PAGE_SIZE = 100
+)
+
+// *quickphotos.Store が満たす
+type Backend interface {
+	GetUser(username string) (*quickphotos.User, error)
+	ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error)
+	ListFollowers(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	ListFollowing(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	Follow(followedUser, followingUser string) (bool, error)
+	Unfollow(followedUser, followingUser string) error
+	GetPhoto(username, timestamp string) (*quickphotos.Photo, error)
+	ListReactions(username, timestamp string, limit int, cursor string) ([]quickphotos.Reaction, string, error)
+	React(reactingUser, reactionType, photoUser, timestamp string) (*quickphotos.Reaction, error)
+}
+
+var _ Backend = (*quickphotos.Store)(nil)
+
+type Server struct {
+	pb.UnimplementedQuickPhotosServer
+	backend Backend
+	// Internal を返したときの元のエラーを出力する。nil なら出力しない
+	ErrorLog *log.Logger
+}
+
+func New(backend Backend) *Server {
+	return &Server{backend: backend}
+}
+
+// ドメインのエラーを gRPC のステータスに変換する
+// 想定外のエラーは内容を返さずに Internal にする
+func (s *Server) toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, quickphotos.ErrCannotFollowSelf),
+		errors.Is(err, quickphotos.ErrInvalidReactionType),
+		errors.Is(err, quickphotos.ErrInvalidCursor):
+		code = codes.InvalidArgument
+	case errors.Is(err, quickphotos.ErrUserNotFound),
+		errors.Is(err, quickphotos.ErrPhotoNotFound),
+		errors.Is(err, quickphotos.ErrNotFollowing):
+		code = codes.NotFound
+	case errors.Is(err, quickphotos.ErrAlreadyFollowing),
+		errors.Is(err, quickphotos.ErrAlreadyRequested),
+		errors.Is(err, quickphotos.ErrAlreadyReacted):
+		code = codes.AlreadyExists
+	case errors.Is(err, quickphotos.ErrConcurrentModification):
+		code = codes.Aborted
+	case errors.Is(err, quickphotos.ErrBlocked):
+		code = codes.PermissionDenied
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	}
+	if code == codes.Internal {
+		if s.ErrorLog != nil {
+			s.ErrorLog.Printf("grpcapi: %s", err)
+		}
+		return status.Error(code, "internal error")
+	}
+	return status.Error(code, err.Error())
+}
+
+func required(values ...string) error {
+	for i := 0; i < len(values); i += 2 {
+		if values[i+1] == "" {
+			return status.Errorf(codes.InvalidArgument, "%s is required", values[i])
+		}
+	}
+	return nil
+}
+
+func pageSize(n int32) (int, error) {
+	if n == 0 {
+		return DEFAULT_PAGE_SIZE, nil
+	}
+	if n < 0 || n > MAX_PAGE_SIZE {
+		return 0, status.Errorf(codes.InvalidArgument, "page_size must be between 1 and %d", MAX_PAGE_SIZE)
+	}
+	return int(n), nil
+}
+
+func toUser(u *quickphotos.User) *pb.User {
+	return &pb.User{
+		Username:    u.Username,
+		Name:        u.Name,
+		Email:       u.Email,
+		Birthdate:   u.Birthdate,
+		Address:     u.Address,
+		Status:      u.Status,
+		Interests:   u.Interests,
+		Followers:   int64(u.Followers),
+		Following:   int64(u.Following),
+		PinnedImage: u.PinnedImage,
+		Private:     u.Private,
+	}
+}
+
+func toPhoto(p *quickphotos.Photo) *pb.Photo {
+	reactions := make(map[string]int64, len(p.Reactions))
+	for t, n := range p.Reactions {
+		reactions[t] = int64(n)
+	}
+	return &pb.Photo{
+		Username:  p.Username,
+		Timestamp: p.Timestamp,
+		Location:  p.Location,
+		Caption:   p.Caption,
+		Reactions: reactions,
+	}
+}
+
+func toReaction(r *quickphotos.Reaction) *pb.Reaction {
+	return &pb.Reaction{
+		ReactingUser: r.ReactingUser,
+		Photo:        r.Photo,
+		ReactionType: r.ReactionType,
+		Timestamp:    r.Timestamp,
+	}
+}
+
+func toFriendship(f *quickphotos.Friendship) *pb.Friendship {
+	return &pb.Friendship{
+		FollowedUser:  f.FollowedUser,
+		FollowingUser: f.FollowingUser,
+		Timestamp:     f.Timestamp,
+	}
+}
+
+func (s *Server) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.User, error) {
+	if err := required("username", req.Username); err != nil {
+		return nil, err
+	}
+	user, err := s.backend.GetUser(req.Username)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return toUser(user), nil
+}
+
+func (s *Server) ListPhotos(ctx context.Context, req *pb.ListPhotosRequest) (*pb.ListPhotosResponse, error) {
+	if err := required("username", req.Username); err != nil {
+		return nil, err
+	}
+	limit, err := pageSize(req.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	photos, next, err := s.backend.ListPhotos(req.Username, limit, req.Cursor)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	resp := &pb.ListPhotosResponse{
+		Photos:     make([]*pb.Photo, 0, len(photos)),
+		NextCursor: next,
+	}
+	for i := range photos {
+		resp.Photos = append(resp.Photos, toPhoto(&photos[i]))
+	}
+	return resp, nil
+}
+
+func (s *Server) GetPhoto(ctx context.Context, req *pb.GetPhotoRequest) (*pb.Photo, error) {
+	if err := required("username", req.Username, "timestamp", req.Timestamp); err != nil {
+		return nil, err
+	}
+	photo, err := s.backend.GetPhoto(req.Username, req.Timestamp)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return toPhoto(photo), nil
+}
+
+func (s *Server) ListReactions(ctx context.Context, req *pb.ListReactionsRequest) (*pb.ListReactionsResponse, error) {
+	if err := required("username", req.Username, "timestamp", req.Timestamp); err != nil {
+		return nil, err
+	}
+	limit, err := pageSize(req.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	reactions, next, err := s.backend.ListReactions(req.Username, req.Timestamp, limit, req.Cursor)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	resp := &pb.ListReactionsResponse{
+		Reactions:  make([]*pb.Reaction, 0, len(reactions)),
+		NextCursor: next,
+	}
+	for i := range reactions {
+		resp.Reactions = append(resp.Reactions, toReaction(&reactions[i]))
+	}
+	return resp, nil
+}
+
+func (s *Server) Follow(ctx context.Context, req *pb.FollowRequest) (*pb.FollowResponse, error) {
+	if err := required("followed_user", req.FollowedUser, "following_user", req.FollowingUser); err != nil {
+		return nil, err
+	}
+	requested, err := s.backend.Follow(req.FollowedUser, req.FollowingUser)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	if requested {
+		return &pb.FollowResponse{Status: pb.FollowResponse_STATUS_REQUESTED}, nil
+	}
+	return &pb.FollowResponse{Status: pb.FollowResponse_STATUS_FOLLOWING}, nil
+}
+
+func (s *Server) Unfollow(ctx context.Context, req *pb.UnfollowRequest) (*pb.UnfollowResponse, error) {
+	if err := required("followed_user", req.FollowedUser, "following_user", req.FollowingUser); err != nil {
+		return nil, err
+	}
+	if err := s.backend.Unfollow(req.FollowedUser, req.FollowingUser); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &pb.UnfollowResponse{}, nil
+}
+
+func (s *Server) React(ctx context.Context, req *pb.ReactRequest) (*pb.Reaction, error) {
+	err := required(
+		"reacting_user", req.ReactingUser,
+		"reaction_type", req.ReactionType,
+		"photo_user", req.PhotoUser,
+		"timestamp", req.Timestamp,
+	)
+	if err != nil {
+		return nil, err
+	}
+	reaction, err := s.backend.React(req.ReactingUser, req.ReactionType, req.PhotoUser, req.Timestamp)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return toReaction(reaction), nil
+}
+
+type friendshipStream interface {
+	Context() context.Context
+	Send(*pb.Friendship) error
+}
+
+// クライアントが切断したら、次のページを読み込む前にやめる
+func (s *Server) streamFriendships(list func(string, int, string) ([]quickphotos.Friendship, string, error), username string, stream friendshipStream) error {
+	if err := required("username", username); err != nil {
+		return err
+	}
+	cursor := ""
+	for {
+		if err := stream.Context().Err(); err != nil {
+			return s.toStatus(err)
+		}
+		friendships, next, err := list(username, STREAM_PAGE_SIZE, cursor)
+		if err != nil {
+			return s.toStatus(err)
+		}
+		for i := range friendships {
+			if err := stream.Send(toFriendship(&friendships[i])); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (s *Server) StreamFollowers(req *pb.StreamFriendshipsRequest, stream pb.QuickPhotos_StreamFollowersServer) error {
+	return s.streamFriendships(s.backend.ListFollowers, req.Username, stream)
+}
+
+func (s *Server) StreamFollowing(req *pb.StreamFriendshipsRequest, stream pb.QuickPhotos_StreamFollowingServer) error {
+	return s.streamFriendships(s.backend.ListFollowing, req.Username, stream)
+}
+
+// フォローしているユーザーごとの写真を、1 ページずつ読み込みながら新しい順に並べる
+// 最初のページは先頭の 1 件だけ読み、残りは送り切ってから読み込む
+type photoCursor struct {
+	username string
+	photos   []quickphotos.Photo
+	next     string
+	started  bool
+}
+
+type feedHeap []*photoCursor
+
+func (h feedHeap) Len() int { return len(h) }
+
+// タイムスタンプは固定長の UTC なので、文字列の比較で新しい順に並べられる
+func (h feedHeap) Less(i, j int) bool {
+	a, b := h[i].photos[0], h[j].photos[0]
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp > b.Timestamp
+	}
+	return a.Username < b.Username
+}
+
+func (h feedHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *feedHeap) Push(x interface{}) { *h = append(*h, x.(*photoCursor)) }
+
+func (h *feedHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// 写真が残っていなければ次のページを limit 件まで読み込む
+// 読み込んでも空なら false を返す
+func (s *Server) fill(c *photoCursor, limit int) (bool, error) {
+	for len(c.photos) == 0 {
+		if c.started && c.next == "" {
+			return false, nil
+		}
+		photos, next, err := s.backend.ListPhotos(c.username, limit, c.next)
+		if err != nil {
+			return false, err
+		}
+		c.photos, c.next, c.started = photos, next, true
+	}
+	return true, nil
+}
+
+// 2 ページ目以降に読み込む件数。残りの limit より多くは読まない
+func feedPageSize(limit, sent int32) int {
+	if limit > 0 && limit-sent < STREAM_PAGE_SIZE {
+		return int(limit - sent)
+	}
+	return STREAM_PAGE_SIZE
+}
+
+func (s *Server) StreamFeed(req *pb.StreamFeedRequest, stream pb.QuickPhotos_StreamFeedServer) error {
+	if err := required("username", req.Username); err != nil {
+		return err
+	}
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	ctx := stream.Context()
+
+	h := &feedHeap{}
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return s.toStatus(err)
+		}
+		following, next, err := s.backend.ListFollowing(req.Username, STREAM_PAGE_SIZE, cursor)
+		if err != nil {
+			return s.toStatus(err)
+		}
+		for _, f := range following {
+			c := &photoCursor{username: f.FollowedUser}
+			ok, err := s.fill(c, 1)
+			if errors.Is(err, quickphotos.ErrUserNotFound) {
+				continue
+			}
+			if err != nil {
+				return s.toStatus(err)
+			}
+			if ok {
+				*h = append(*h, c)
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	heap.Init(h)
+
+	sent := int32(0)
+	for h.Len() > 0 && (req.Limit == 0 || sent < req.Limit) {
+		if err := ctx.Err(); err != nil {
+			return s.toStatus(err)
+		}
+		c := (*h)[0]
+		if err := stream.Send(toPhoto(&c.photos[0])); err != nil {
+			return err
+		}
+		sent++
+		c.photos = c.photos[1:]
+		if len(c.photos) == 0 && req.Limit != 0 && sent == req.Limit {
+			break
+		}
+		ok, err := s.fill(c, feedPageSize(req.Limit, sent))
+		if err != nil {
+			return s.toStatus(err)
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
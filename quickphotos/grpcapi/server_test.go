@@ -0,0 +1,216 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/localdynamo"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+	pb "github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos/grpcapi/quickphotospb"
+)
+
+// STREAM_PAGE_SIZE を超えるフォロワーを持つユーザー
+const FOLLOWERS = STREAM_PAGE_SIZE + 30
+
+func photoLine(username, timestamp string) string {
+	return fmt.Sprintf(`{"PK":"USER#%s","SK":"PHOTO#%s#%s","username":"%s","timestamp":"%s","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}`, username, username, timestamp, username, timestamp)
+}
+
+func followLine(followed, following string) string {
+	return fmt.Sprintf(`{"PK":"USER#%s","SK":"#FRIEND#%s","followedUser":"%s","followingUser":"%s","timestamp":"2020-01-01T00:00:00Z"}`, followed, following, followed, following)
+}
+
+// reader は a と b をフォローしていて、a と b は写真を交互に投稿している
+// b は非公開アカウントで、a には FOLLOWERS 人のフォロワーがいる
+func testItems() string {
+	lines := []string{
+		`{"PK":"USER#a","SK":"#METADATA#a","username":"a","followers":0,"following":0}`,
+		`{"PK":"USER#b","SK":"#METADATA#b","username":"b","followers":0,"following":0,"private":true}`,
+		`{"PK":"USER#reader","SK":"#METADATA#reader","username":"reader","followers":0,"following":2}`,
+		followLine("b", "reader"),
+	}
+	for i := 0; i < FOLLOWERS; i++ {
+		lines = append(lines, followLine("a", fmt.Sprintf("f%03d", i)))
+	}
+	lines = append(lines, followLine("a", "reader"))
+	for day := 1; day <= 6; day++ {
+		username := "a"
+		if day%2 == 0 {
+			username = "b"
+		}
+		lines = append(lines, photoLine(username, fmt.Sprintf("2020-01-0%dT00:00:00Z", day)))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ListPhotos に渡された件数を記録する
+type recordingBackend struct {
+	*quickphotos.Store
+	photoLimits []int
+}
+
+func (b *recordingBackend) ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error) {
+	b.photoLimits = append(b.photoLimits, limit)
+	return b.Store.ListPhotos(username, limit, cursor)
+}
+
+// localdynamo にテスト用のアイテムを読み込んだバックエンドで、同じプロセスのサーバーにつなぐ
+func newTestClient(t *testing.T) (pb.QuickPhotosClient, *recordingBackend) {
+	t.Helper()
+	api, stop, err := localdynamo.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	store := quickphotos.New(api, quickphotos.DEFAULT_TABLE)
+	if _, err := store.ApplySchema(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(strings.NewReader(testItems())); err != nil {
+		t.Fatal(err)
+	}
+	backend := &recordingBackend{Store: store}
+	client, stop, err := NewInProcess(New(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return client, backend
+}
+
+func TestStatusCodes(t *testing.T) {
+	client, _ := newTestClient(t)
+	ctx := context.Background()
+	call := func(name string, want codes.Code, err error) {
+		t.Helper()
+		if got := status.Code(err); got != want {
+			t.Errorf("%s: code = %s (%v), want %s", name, got, err, want)
+		}
+	}
+
+	_, err := client.GetUser(ctx, &pb.GetUserRequest{Username: "a"})
+	call("user", codes.OK, err)
+	_, err = client.GetUser(ctx, &pb.GetUserRequest{Username: "nobody"})
+	call("missing user", codes.NotFound, err)
+	_, err = client.GetUser(ctx, &pb.GetUserRequest{})
+	call("no username", codes.InvalidArgument, err)
+	_, err = client.GetPhoto(ctx, &pb.GetPhotoRequest{Username: "a", Timestamp: "2019-01-01T00:00:00Z"})
+	call("missing photo", codes.NotFound, err)
+	_, err = client.ListPhotos(ctx, &pb.ListPhotosRequest{Username: "a", PageSize: MAX_PAGE_SIZE + 1})
+	call("page size", codes.InvalidArgument, err)
+	_, err = client.ListPhotos(ctx, &pb.ListPhotosRequest{Username: "a", Cursor: "nope"})
+	call("invalid cursor", codes.InvalidArgument, err)
+
+	react := &pb.ReactRequest{ReactingUser: "reader", ReactionType: "heart", PhotoUser: "a", Timestamp: "2020-01-01T00:00:00Z"}
+	_, err = client.React(ctx, react)
+	call("react", codes.OK, err)
+	_, err = client.React(ctx, react)
+	call("already reacted", codes.AlreadyExists, err)
+	react.ReactionType = "nope"
+	_, err = client.React(ctx, react)
+	call("invalid reaction type", codes.InvalidArgument, err)
+
+	resp, err := client.Follow(ctx, &pb.FollowRequest{FollowedUser: "b", FollowingUser: "a"})
+	call("follow request", codes.OK, err)
+	if resp.GetStatus() != pb.FollowResponse_STATUS_REQUESTED {
+		t.Errorf("follow status = %s, want requested", resp.GetStatus())
+	}
+	_, err = client.Follow(ctx, &pb.FollowRequest{FollowedUser: "b", FollowingUser: "a"})
+	call("already requested", codes.AlreadyExists, err)
+	_, err = client.Follow(ctx, &pb.FollowRequest{FollowedUser: "a", FollowingUser: "a"})
+	call("follow self", codes.InvalidArgument, err)
+	_, err = client.Unfollow(ctx, &pb.UnfollowRequest{FollowedUser: "b", FollowingUser: "a"})
+	call("not following", codes.NotFound, err)
+}
+
+// ページをまたいでも、ListFollowers と同じ順にすべてのフォロワーが届く
+func TestStreamFollowers(t *testing.T) {
+	client, backend := newTestClient(t)
+	want := make([]string, 0)
+	cursor := ""
+	for {
+		friendships, next, err := backend.ListFollowers("a", 7, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range friendships {
+			want = append(want, f.FollowingUser)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(want) != FOLLOWERS+1 {
+		t.Fatalf("fixture has %d followers, want %d", len(want), FOLLOWERS+1)
+	}
+
+	stream, err := client.StreamFollowers(context.Background(), &pb.StreamFriendshipsRequest{Username: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for {
+		f, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, f.FollowingUser)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("followers = %v, want %v", got, want)
+	}
+}
+
+func receiveFeed(t *testing.T, client pb.QuickPhotosClient, limit int32) []string {
+	t.Helper()
+	stream, err := client.StreamFeed(context.Background(), &pb.StreamFeedRequest{Username: "reader", Limit: limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for {
+		p, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, p.Username+"@"+p.Timestamp[:10])
+	}
+}
+
+func TestStreamFeed(t *testing.T) {
+	client, backend := newTestClient(t)
+	got := receiveFeed(t, client, 0)
+	want := "b@2020-01-06,a@2020-01-05,b@2020-01-04,a@2020-01-03,b@2020-01-02,a@2020-01-01"
+	if strings.Join(got, ",") != want {
+		t.Errorf("feed = %v, want %s", got, want)
+	}
+	// 最初は各ユーザーの先頭の 1 件だけを読む
+	if len(backend.photoLimits) < 2 || backend.photoLimits[0] != 1 || backend.photoLimits[1] != 1 {
+		t.Errorf("first ListPhotos limits = %v, want 1 per followed user", backend.photoLimits)
+	}
+
+	backend.photoLimits = nil
+	got = receiveFeed(t, client, 3)
+	if strings.Join(got, ",") != "b@2020-01-06,a@2020-01-05,b@2020-01-04" {
+		t.Errorf("limited feed = %v", got)
+	}
+	for _, limit := range backend.photoLimits {
+		if limit > 3 {
+			t.Errorf("ListPhotos read %d photos for a feed of 3", limit)
+		}
+	}
+}
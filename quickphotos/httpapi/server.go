@@ -0,0 +1,356 @@
+// Package httpapi は、quickphotos のアクセスパターンをモバイルアプリ向けの JSON API として公開する
+//
+//	GET    /users/{user}
+//	GET    /users/{user}/photos
+//	GET    /users/{user}/followers
+//	GET    /users/{user}/following
+//	POST   /users/{user}/followers              {"username": "<フォローするユーザー>"}
+//	DELETE /users/{user}/followers/{follower}
+//	GET    /photos/{user}/{timestamp}
+//	GET    /photos/{user}/{timestamp}/reactions
+//	POST   /photos/{user}/{timestamp}/reactions {"username": "<リアクションするユーザー>", "reactionType": "heart"}
+//
+// 一覧は ?limit= と ?cursor= でページングし、続きがあれば nextCursor を返す
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+const (
+	DEFAULT_PAGE_SIZE = 20
+	MAX_PAGE_SIZE     = 100
+	MAX_BODY_SIZE     = 64 * 1024
+)
+
+// *quickphotos.Store が満たす
+// テスト (server_test.go) では localdynamo に向けた Store を渡している
+type Backend interface {
+	GetUser(username string) (*quickphotos.User, error)
+	ListPhotos(username string, limit int, cursor string) ([]quickphotos.Photo, string, error)
+	ListFollowers(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	ListFollowing(username string, limit int, cursor string) ([]quickphotos.Friendship, string, error)
+	Follow(followedUser, followingUser string) (bool, error)
+	Unfollow(followedUser, followingUser string) error
+	GetPhoto(username, timestamp string) (*quickphotos.Photo, error)
+	ListReactions(username, timestamp string, limit int, cursor string) ([]quickphotos.Reaction, string, error)
+	React(reactingUser, reactionType, photoUser, timestamp string) (*quickphotos.Reaction, error)
+}
+
+var _ Backend = (*quickphotos.Store)(nil)
+
+type Server struct {
+	backend Backend
+	// 500 を返したときの元のエラーを出力する。nil なら出力しない
+	ErrorLog *log.Logger
+}
+
+func New(backend Backend) *Server {
+	return &Server{backend: backend}
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e apiError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// ドメインのエラーを HTTP のステータスに変換する
+// 想定外のエラーは内容を返さずに 500 にする
+func statusCode(err error) int {
+	var aerr apiError
+	switch {
+	case errors.As(err, &aerr):
+		return aerr.status
+	case errors.Is(err, quickphotos.ErrCannotFollowSelf),
+		errors.Is(err, quickphotos.ErrInvalidReactionType),
+		errors.Is(err, quickphotos.ErrInvalidCursor):
+		return http.StatusBadRequest
+	case errors.Is(err, quickphotos.ErrUserNotFound),
+		errors.Is(err, quickphotos.ErrPhotoNotFound),
+		errors.Is(err, quickphotos.ErrNotFollowing):
+		return http.StatusNotFound
+	case errors.Is(err, quickphotos.ErrAlreadyFollowing),
+		errors.Is(err, quickphotos.ErrAlreadyRequested),
+		errors.Is(err, quickphotos.ErrAlreadyReacted),
+		errors.Is(err, quickphotos.ErrConcurrentModification):
+		return http.StatusConflict
+	case errors.Is(err, quickphotos.ErrBlocked):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+type route struct {
+	method  string
+	pattern []string
+	handle  func(s *Server, r *http.Request, params []string) (int, interface{}, error)
+}
+
+// パターンの "*" は 1 つのパスセグメントにマッチし、その値がハンドラーに渡される
+var routes = []route{
+	{http.MethodGet, []string{"users", "*"}, (*Server).getUser},
+	{http.MethodGet, []string{"users", "*", "photos"}, (*Server).listPhotos},
+	{http.MethodGet, []string{"users", "*", "followers"}, (*Server).listFollowers},
+	{http.MethodGet, []string{"users", "*", "following"}, (*Server).listFollowing},
+	{http.MethodPost, []string{"users", "*", "followers"}, (*Server).follow},
+	{http.MethodDelete, []string{"users", "*", "followers", "*"}, (*Server).unfollow},
+	{http.MethodGet, []string{"photos", "*", "*"}, (*Server).getPhoto},
+	{http.MethodGet, []string{"photos", "*", "*", "reactions"}, (*Server).listReactions},
+	{http.MethodPost, []string{"photos", "*", "*", "reactions"}, (*Server).react},
+}
+
+// ユーザー名やタイムスタンプに / が含まれていてもよいように、エスケープされたままのパスで分割する
+func splitPath(r *http.Request) ([]string, error) {
+	raw := strings.Trim(r.URL.EscapedPath(), "/")
+	if raw == "" {
+		return nil, nil
+	}
+	segments := strings.Split(raw, "/")
+	for i, seg := range segments {
+		v, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, badRequest("invalid path: %s", err)
+		}
+		segments[i] = v
+	}
+	return segments, nil
+}
+
+func match(pattern, segments []string) ([]string, bool) {
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+	params := make([]string, 0, len(pattern))
+	for i, p := range pattern {
+		if p == "*" {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params = append(params, segments[i])
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitPath(r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	allowed := make([]string, 0)
+	for _, rt := range routes {
+		params, ok := match(rt.pattern, segments)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		status, body, err := rt.handle(s, r, params)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		writeJSON(w, status, body)
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		s.writeError(w, apiError{http.StatusMethodNotAllowed, "method not allowed"})
+		return
+	}
+	s.writeError(w, apiError{http.StatusNotFound, "not found"})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(body)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err error) {
+	status := statusCode(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		if s.ErrorLog != nil {
+			s.ErrorLog.Printf("httpapi: %s", err)
+		}
+		message = http.StatusText(status)
+	}
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func pageParams(r *http.Request) (int, string, error) {
+	q := r.URL.Query()
+	limit := DEFAULT_PAGE_SIZE
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MAX_PAGE_SIZE {
+			return 0, "", badRequest("limit must be between 1 and %d", MAX_PAGE_SIZE)
+		}
+		limit = n
+	}
+	return limit, q.Get("cursor"), nil
+}
+
+type page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, MAX_BODY_SIZE))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("invalid request body: %s", err)
+	}
+	return nil
+}
+
+func (s *Server) getUser(r *http.Request, params []string) (int, interface{}, error) {
+	user, err := s.backend.GetUser(params[0])
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, user, nil
+}
+
+func (s *Server) listPhotos(r *http.Request, params []string) (int, interface{}, error) {
+	limit, cursor, err := pageParams(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	photos, next, err := s.backend.ListPhotos(params[0], limit, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, page{photos, next}, nil
+}
+
+func (s *Server) listFollowers(r *http.Request, params []string) (int, interface{}, error) {
+	limit, cursor, err := pageParams(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	friendships, next, err := s.backend.ListFollowers(params[0], limit, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, page{friendships, next}, nil
+}
+
+func (s *Server) listFollowing(r *http.Request, params []string) (int, interface{}, error) {
+	limit, cursor, err := pageParams(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	friendships, next, err := s.backend.ListFollowing(params[0], limit, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, page{friendships, next}, nil
+}
+
+type followRequest struct {
+	Username string `json:"username"`
+}
+
+type followResponse struct {
+	FollowedUser  string `json:"followedUser"`
+	FollowingUser string `json:"followingUser"`
+	Status        string `json:"status"`
+}
+
+// 非公開アカウントへのフォローはリクエストになるので、承認待ちとして 202 を返す
+func (s *Server) follow(r *http.Request, params []string) (int, interface{}, error) {
+	var req followRequest
+	if err := decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.Username == "" {
+		return 0, nil, badRequest("username is required")
+	}
+	requested, err := s.backend.Follow(params[0], req.Username)
+	if err != nil {
+		return 0, nil, err
+	}
+	if requested {
+		return http.StatusAccepted, followResponse{params[0], req.Username, "requested"}, nil
+	}
+	return http.StatusCreated, followResponse{params[0], req.Username, "following"}, nil
+}
+
+func (s *Server) unfollow(r *http.Request, params []string) (int, interface{}, error) {
+	if err := s.backend.Unfollow(params[0], params[1]); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+func (s *Server) getPhoto(r *http.Request, params []string) (int, interface{}, error) {
+	photo, err := s.backend.GetPhoto(params[0], params[1])
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, photo, nil
+}
+
+func (s *Server) listReactions(r *http.Request, params []string) (int, interface{}, error) {
+	limit, cursor, err := pageParams(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	reactions, next, err := s.backend.ListReactions(params[0], params[1], limit, cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, page{reactions, next}, nil
+}
+
+type reactRequest struct {
+	Username     string `json:"username"`
+	ReactionType string `json:"reactionType"`
+}
+
+func (s *Server) react(r *http.Request, params []string) (int, interface{}, error) {
+	var req reactRequest
+	if err := decodeBody(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.Username == "" || req.ReactionType == "" {
+		return 0, nil, badRequest("username and reactionType are required")
+	}
+	reaction, err := s.backend.React(req.Username, req.ReactionType, params[0], params[1])
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, reaction, nil
+}
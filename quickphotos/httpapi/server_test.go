@@ -0,0 +1,159 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/localdynamo"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// a は公開アカウントで写真が 5 枚、b は非公開アカウント、c は写真もフォローもない
+const testItems = `{"PK":"USER#a","SK":"#METADATA#a","username":"a","followers":0,"following":0}
+{"PK":"USER#b","SK":"#METADATA#b","username":"b","followers":0,"following":0,"private":true}
+{"PK":"USER#c","SK":"#METADATA#c","username":"c","followers":0,"following":0}
+{"PK":"USER#a","SK":"PHOTO#a#2020-01-01T00:00:00Z","username":"a","timestamp":"2020-01-01T00:00:00Z","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}
+{"PK":"USER#a","SK":"PHOTO#a#2020-01-02T00:00:00Z","username":"a","timestamp":"2020-01-02T00:00:00Z","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}
+{"PK":"USER#a","SK":"PHOTO#a#2020-01-03T00:00:00Z","username":"a","timestamp":"2020-01-03T00:00:00Z","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}
+{"PK":"USER#a","SK":"PHOTO#a#2020-01-04T00:00:00Z","username":"a","timestamp":"2020-01-04T00:00:00Z","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}
+{"PK":"USER#a","SK":"PHOTO#a#2020-01-05T00:00:00Z","username":"a","timestamp":"2020-01-05T00:00:00Z","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}
+`
+
+// localdynamo にテスト用のアイテムを読み込んだ quickphotos.Store で API を立ち上げる
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	client, stop, err := localdynamo.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	store := quickphotos.New(client, quickphotos.DEFAULT_TABLE)
+	if _, err := store.ApplySchema(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(strings.NewReader(testItems)); err != nil {
+		t.Fatal(err)
+	}
+	api := httptest.NewServer(New(store))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func do(t *testing.T, api *httptest.Server, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	decoded := map[string]interface{}{}
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode, decoded
+}
+
+func TestStatusCodes(t *testing.T) {
+	api := newTestServer(t)
+	reaction := `{"username":"c","reactionType":"heart"}`
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"user", http.MethodGet, "/users/a", "", http.StatusOK},
+		{"missing user", http.MethodGet, "/users/nobody", "", http.StatusNotFound},
+		{"photo", http.MethodGet, "/photos/a/2020-01-01T00:00:00Z", "", http.StatusOK},
+		{"missing photo", http.MethodGet, "/photos/a/2019-01-01T00:00:00Z", "", http.StatusNotFound},
+		{"react to missing photo", http.MethodPost, "/photos/a/2019-01-01T00:00:00Z/reactions", reaction, http.StatusNotFound},
+		{"react", http.MethodPost, "/photos/a/2020-01-01T00:00:00Z/reactions", reaction, http.StatusCreated},
+		{"already reacted", http.MethodPost, "/photos/a/2020-01-01T00:00:00Z/reactions", reaction, http.StatusConflict},
+		{"invalid reaction type", http.MethodPost, "/photos/a/2020-01-01T00:00:00Z/reactions", `{"username":"c","reactionType":"nope"}`, http.StatusBadRequest},
+		{"follow", http.MethodPost, "/users/a/followers", `{"username":"c"}`, http.StatusCreated},
+		{"already following", http.MethodPost, "/users/a/followers", `{"username":"c"}`, http.StatusConflict},
+		{"follow request", http.MethodPost, "/users/b/followers", `{"username":"c"}`, http.StatusAccepted},
+		{"already requested", http.MethodPost, "/users/b/followers", `{"username":"c"}`, http.StatusConflict},
+		{"follow self", http.MethodPost, "/users/a/followers", `{"username":"a"}`, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/users/a/followers", `{"user":"c"}`, http.StatusBadRequest},
+		{"unfollow", http.MethodDelete, "/users/a/followers/c", "", http.StatusNoContent},
+		{"not following", http.MethodDelete, "/users/a/followers/c", "", http.StatusNotFound},
+		{"invalid limit", http.MethodGet, "/users/a/photos?limit=0", "", http.StatusBadRequest},
+		{"invalid cursor", http.MethodGet, "/users/a/photos?cursor=nope", "", http.StatusBadRequest},
+		{"method not allowed", http.MethodPut, "/users/a", "", http.StatusMethodNotAllowed},
+		{"unknown path", http.MethodGet, "/nope", "", http.StatusNotFound},
+	} {
+		status, body := do(t, api, tc.method, tc.path, tc.body)
+		if status != tc.status {
+			t.Errorf("%s: %s %s = %d %v, want %d", tc.name, tc.method, tc.path, status, body, tc.status)
+		}
+	}
+}
+
+func TestFollowRequestResponse(t *testing.T) {
+	api := newTestServer(t)
+	_, body := do(t, api, http.MethodPost, "/users/b/followers", `{"username":"c"}`)
+	if body["status"] != "requested" {
+		t.Errorf("status = %v, want requested", body["status"])
+	}
+	// リクエストの段階ではフォロワーにならない
+	_, followers := do(t, api, http.MethodGet, "/users/b/followers", "")
+	if items := followers["items"].([]interface{}); len(items) != 0 {
+		t.Errorf("followers = %v, want none", items)
+	}
+}
+
+// limit ごとにページを辿ると、すべての写真が新しいものから 1 度ずつ返る
+func TestPhotoPaging(t *testing.T) {
+	api := newTestServer(t)
+	got := make([]string, 0)
+	sizes := make([]int, 0)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("paging does not end")
+		}
+		path := "/users/a/photos?limit=2"
+		if cursor != "" {
+			path += "&cursor=" + cursor
+		}
+		status, body := do(t, api, http.MethodGet, path, "")
+		if status != http.StatusOK {
+			t.Fatalf("GET %s = %d %v", path, status, body)
+		}
+		items := body["items"].([]interface{})
+		sizes = append(sizes, len(items))
+		for _, item := range items {
+			got = append(got, item.(map[string]interface{})["timestamp"].(string))
+		}
+		next, _ := body["nextCursor"].(string)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	want := []string{
+		"2020-01-05T00:00:00Z",
+		"2020-01-04T00:00:00Z",
+		"2020-01-03T00:00:00Z",
+		"2020-01-02T00:00:00Z",
+		"2020-01-01T00:00:00Z",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("photos = %v, want %v", got, want)
+	}
+	if sizes[0] != 2 || sizes[1] != 2 {
+		t.Errorf("page sizes = %v, want pages of 2", sizes)
+	}
+}
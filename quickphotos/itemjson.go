@@ -0,0 +1,118 @@
+package quickphotos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// アイテムを DynamoDB の API と同じ型つきの JSON ({"PK":{"S":"..."}}) にする
+// セット、数値の桁や書き方、空文字列をそのまま残せるので、書き出したものを読み込み直すと同じアイテムになる
+func EncodeItem(item map[string]*dynamodb.AttributeValue) ([]byte, error) {
+	return jsonutil.BuildJSON(item)
+}
+
+// 1 行分の JSON をアイテムにする
+// EncodeItem の型つきの JSON と、scripts/items.json のような型のない JSON のどちらも読める
+// PK が文字列なら型のない JSON、オブジェクトなら型つきの JSON として扱う
+func DecodeItem(line []byte) (map[string]*dynamodb.AttributeValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	// 数値を float64 にすると、大きな整数の桁や "1.50" のような書き方が失われる
+	dec.UseNumber()
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, typed := v["PK"].(map[string]interface{}); typed {
+		// jsonutil はトップレベルの map には書き込めないので、PutRequest の Item として読む
+		req := &dynamodb.PutRequest{}
+		wrapped := append(append([]byte(`{"Item":`), line...), '}')
+		if err := jsonutil.UnmarshalJSON(req, bytes.NewReader(wrapped)); err != nil {
+			return nil, err
+		}
+		// 知らない型の名前は読み飛ばされて、値のない属性になる
+		for name, av := range req.Item {
+			if err := checkTyped(av); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return req.Item, nil
+	}
+	if _, ok := v["PK"].(string); !ok {
+		return nil, errors.New("item has no string PK")
+	}
+	item := make(map[string]*dynamodb.AttributeValue, len(v))
+	for name, value := range v {
+		av, err := attributeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		item[name] = av
+	}
+	return item, nil
+}
+
+func attributeValue(v interface{}) (*dynamodb.AttributeValue, error) {
+	switch v := v.(type) {
+	case nil:
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}, nil
+	case string:
+		return &dynamodb.AttributeValue{S: aws.String(v)}, nil
+	case json.Number:
+		return &dynamodb.AttributeValue{N: aws.String(v.String())}, nil
+	case bool:
+		return &dynamodb.AttributeValue{BOOL: aws.Bool(v)}, nil
+	case []interface{}:
+		list := make([]*dynamodb.AttributeValue, 0, len(v))
+		for _, e := range v {
+			av, err := attributeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, av)
+		}
+		return &dynamodb.AttributeValue{L: list}, nil
+	case map[string]interface{}:
+		m := make(map[string]*dynamodb.AttributeValue, len(v))
+		for name, e := range v {
+			av, err := attributeValue(e)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			m[name] = av
+		}
+		return &dynamodb.AttributeValue{M: m}, nil
+	}
+	return nil, fmt.Errorf("unsupported JSON value %T", v)
+}
+
+func checkTyped(av *dynamodb.AttributeValue) error {
+	if av == nil {
+		return errors.New("missing value")
+	}
+	set := 0
+	for _, ok := range []bool{av.S != nil, av.N != nil, av.B != nil, av.BOOL != nil, av.NULL != nil, av.SS != nil, av.NS != nil, av.BS != nil, av.M != nil, av.L != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("value must have exactly one type")
+	}
+	for _, e := range av.L {
+		if err := checkTyped(e); err != nil {
+			return err
+		}
+	}
+	for name, e := range av.M {
+		if err := checkTyped(e); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
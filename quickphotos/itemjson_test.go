@@ -0,0 +1,64 @@
+package quickphotos
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestEncodeDecodeItemRoundTrip(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"PK":        {S: aws.String("USER#a")},
+		"SK":        {S: aws.String("#METADATA#a")},
+		"tags":      {SS: aws.StringSlice([]string{"beach", "sunset"})},
+		"big":       {N: aws.String("123456789012345678901")},
+		"price":     {N: aws.String("1.50")},
+		"status":    {S: aws.String("")},
+		"raw":       {B: []byte{0, 1, 2}},
+		"reactions": {M: map[string]*dynamodb.AttributeValue{"+1": {N: aws.String("0")}}},
+		"history":   {L: []*dynamodb.AttributeValue{{NULL: aws.Bool(true)}, {BOOL: aws.Bool(false)}}},
+	}
+	b, err := EncodeItem(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.ContainsRune(b, '\n') {
+		t.Fatalf("encoded item spans lines: %s", b)
+	}
+	got, err := DecodeItem(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, item) {
+		t.Errorf("round trip changed the item\nwant %v\ngot  %v", item, got)
+	}
+}
+
+func TestDecodeItemPlainJSON(t *testing.T) {
+	got, err := DecodeItem([]byte(`{"PK":"USER#a","SK":"PHOTO#a#x","n":123456789012345678901,"r":{"+1":1.50},"e":"","i":["x"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*dynamodb.AttributeValue{
+		"PK": {S: aws.String("USER#a")},
+		"SK": {S: aws.String("PHOTO#a#x")},
+		"n":  {N: aws.String("123456789012345678901")},
+		"r":  {M: map[string]*dynamodb.AttributeValue{"+1": {N: aws.String("1.50")}}},
+		"e":  {S: aws.String("")},
+		"i":  {L: []*dynamodb.AttributeValue{{S: aws.String("x")}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v\ngot  %v", want, got)
+	}
+}
+
+func TestDecodeItemErrors(t *testing.T) {
+	for _, line := range []string{`{"PK":`, `{"SK":"x"}`, `{"PK":{"X":"y"}}`} {
+		if _, err := DecodeItem([]byte(line)); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package itemview
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// パーティションごとに見出しを出し、その下にソートキー、エンティティ、属性を 1 行ずつ並べる
+func (v *View) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "%s  (partition key %s, sort key %s)  %d items in %d partitions\n",
+		v.Name(), v.HashKey, v.RangeKey, v.Items, len(v.Collections))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range v.Collections {
+		// 見出しの行にはタブがないので、列の幅はパーティションごとにそろう
+		fmt.Fprintf(tw, "\n%s  (%d items)\n", c.Key, len(c.Rows))
+		for _, row := range c.Rows {
+			attrs := make([]string, 0, len(row.Attributes))
+			for _, a := range row.Attributes {
+				attrs = append(attrs, a.Name+"="+a.Value)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", row.Sort, row.Entity, strings.Join(attrs, "  "))
+		}
+	}
+	return tw.Flush()
+}
+
+// 外部のファイルを読まずに開ける 1 枚の HTML
+func (v *View) WriteHTML(w io.Writer) error {
+	return page.Execute(w, v)
+}
+
+var page = template.Must(template.New("itemview").Funcs(template.FuncMap{
+	"lower": strings.ToLower,
+}).Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; font-size: 13px; margin: 24px; color: #16191f; }
+h1 { font-size: 18px; margin: 0 0 4px; }
+p.summary { color: #545b64; margin: 0 0 16px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #d5dbdb; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f2f3f3; position: sticky; top: 0; }
+td.key { font-family: monospace; white-space: nowrap; }
+td.partition { background: #fafafa; font-weight: bold; }
+span.attr { display: inline-block; margin: 0 12px 2px 0; }
+span.attr b { color: #545b64; font-weight: normal; margin-right: 4px; }
+span.entity { border-radius: 3px; padding: 0 6px; color: #fff; background: #879596; }
+span.entity.user { background: #0073bb; }
+span.entity.photo { background: #1d8102; }
+span.entity.reaction { background: #d45b07; }
+span.entity.reactionshard { background: #b7742a; }
+span.entity.friendship { background: #8a3ab9; }
+span.entity.followrequest { background: #b0579c; }
+span.entity.block { background: #d13212; }
+span.entity.notification { background: #2e7d8c; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p class="summary">Partition key: {{.HashKey}} / Sort key: {{.RangeKey}} / {{.Items}} items in {{len .Collections}} partitions</p>
+<table>
+<thead>
+<tr><th>{{.HashKey}}</th><th>{{.RangeKey}}</th><th>Entity</th><th>Attributes</th></tr>
+</thead>
+{{- range .Collections}}
+<tbody>
+{{- $rows := len .Rows}}
+{{- range $i, $row := .Rows}}
+<tr>
+{{- if eq $i 0}}<td class="key partition" rowspan="{{$rows}}">{{$row.Partition}}</td>{{end}}
+<td class="key">{{$row.Sort}}</td>
+<td><span class="entity {{lower $row.Entity}}">{{$row.Entity}}</span></td>
+<td>{{range $row.Attributes}}<span class="attr" title="{{.Full}}"><b>{{.Name}}</b>{{.Value}}</span>{{end}}</td>
+</tr>
+{{- end}}
+</tbody>
+{{- end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,162 @@
+// Package itemview は、シングルテーブルのアイテムをパーティションごとにまとめて表示する
+// NoSQL Workbench のアイテム表示のように、同じ PK のアイテムを SK の順に並べる
+// InvertedIndex を指定すると、GSI から見たまとめ方 (SK ごとに PK の順) で並べ直す
+package itemview
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// 表に出す属性の値の最大文字数。HTML では title に全体を入れる
+const MAX_VALUE_WIDTH = 40
+
+type Attribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Full  string `json:"-"`
+}
+
+// 1 アイテム。Partition と Sort は表示しているインデックスのキーの値
+type Row struct {
+	Partition  string      `json:"partition"`
+	Sort       string      `json:"sort"`
+	Entity     string      `json:"entity"`
+	Attributes []Attribute `json:"attributes"`
+}
+
+// 同じパーティションキーを持つアイテムのまとまり
+type Collection struct {
+	Key  string `json:"key"`
+	Rows []Row  `json:"rows"`
+}
+
+type View struct {
+	Table       string       `json:"table"`
+	Index       string       `json:"index,omitempty"`
+	HashKey     string       `json:"hashKey"`
+	RangeKey    string       `json:"rangeKey"`
+	Items       int          `json:"items"`
+	Collections []Collection `json:"collections"`
+}
+
+// index が空ならベーステーブルのキーでまとめる
+// GSI のキーを持たないアイテムはインデックスに入らないので、表示にも含めない
+func Build(table, index string, items []map[string]*dynamodb.AttributeValue) (*View, error) {
+	def, ok := quickphotos.FindIndex(index)
+	if !ok {
+		return nil, fmt.Errorf("unknown index %q", index)
+	}
+	view := &View{
+		Table:       table,
+		Index:       index,
+		HashKey:     def.HashKey,
+		RangeKey:    def.RangeKey,
+		Collections: []Collection{},
+	}
+	byKey := make(map[string]int)
+	for _, item := range items {
+		hash, rng := item[def.HashKey], item[def.RangeKey]
+		if hash == nil || hash.S == nil || rng == nil || rng.S == nil {
+			continue
+		}
+		row, err := newRow(item, def)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := byKey[row.Partition]
+		if !ok {
+			i = len(view.Collections)
+			view.Collections = append(view.Collections, Collection{Key: row.Partition})
+			byKey[row.Partition] = i
+		}
+		view.Collections[i].Rows = append(view.Collections[i].Rows, row)
+		view.Items++
+	}
+	// DynamoDB と同じく、キーは UTF-8 のバイト順で並べる
+	sort.Slice(view.Collections, func(i, j int) bool {
+		return view.Collections[i].Key < view.Collections[j].Key
+	})
+	for _, c := range view.Collections {
+		sort.Slice(c.Rows, func(i, j int) bool {
+			return c.Rows[i].Sort < c.Rows[j].Sort
+		})
+	}
+	return view, nil
+}
+
+func newRow(item map[string]*dynamodb.AttributeValue, def quickphotos.IndexDefinition) (Row, error) {
+	pk, sk := aws.StringValue(item["PK"].S), aws.StringValue(item["SK"].S)
+	row := Row{
+		Partition: aws.StringValue(item[def.HashKey].S),
+		Sort:      aws.StringValue(item[def.RangeKey].S),
+		Entity:    quickphotos.EntityOf(pk, sk),
+	}
+	names := make([]string, 0, len(item))
+	for name := range item {
+		if name != "PK" && name != "SK" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	row.Attributes = make([]Attribute, 0, len(names))
+	for _, name := range names {
+		var v interface{}
+		if err := dynamodbattribute.Unmarshal(item[name], &v); err != nil {
+			return Row{}, fmt.Errorf("%s / %s: %s: %w", pk, sk, name, err)
+		}
+		// HTML はテンプレートがエスケープするので、テキストの表示に合わせて < や & はそのまま出す
+		var buf strings.Builder
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return Row{}, fmt.Errorf("%s / %s: %s: %w", pk, sk, name, err)
+		}
+		value := strings.TrimSuffix(buf.String(), "\n")
+		row.Attributes = append(row.Attributes, Attribute{
+			Name:  name,
+			Value: truncate(value),
+			Full:  value,
+		})
+	}
+	return row, nil
+}
+
+func truncate(s string) string {
+	if utf8.RuneCountInString(s) <= MAX_VALUE_WIDTH {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:MAX_VALUE_WIDTH-1]) + "…"
+}
+
+// 表示しているインデックスの名前
+func (v *View) Name() string {
+	if v.Index == "" {
+		return v.Table
+	}
+	return v.Table + " / " + v.Index
+}
+
+// key のパーティションだけを残した View
+func (v *View) Partition(key string) *View {
+	filtered := *v
+	filtered.Collections = []Collection{}
+	filtered.Items = 0
+	for _, c := range v.Collections {
+		if c.Key == key {
+			filtered.Collections = append(filtered.Collections, c)
+			filtered.Items += len(c.Rows)
+		}
+	}
+	return &filtered
+}
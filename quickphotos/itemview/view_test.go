@@ -0,0 +1,99 @@
+package itemview
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/e2e"
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// 表示を意図して変えたときは、go test ./quickphotos/itemview -update で golden ファイルを書き直す
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+const goldenDir = "testdata"
+
+func s(v string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{S: aws.String(v)} }
+func n(v string) *dynamodb.AttributeValue { return &dynamodb.AttributeValue{N: aws.String(v)} }
+
+// ユーザー 2 人と、a の写真 2 枚、b から両方の写真へのリアクション、b が a をフォローする関係
+// 最後の 2 つは SK を持たないアイテムと SK が文字列でないアイテムで、どのインデックスにも入らない
+var items = []map[string]*dynamodb.AttributeValue{
+	{"PK": s("USER#b"), "SK": s("#METADATA#b"), "name": s("Bob"), "followers": n("0")},
+	{"PK": s("REACTION#a#2020-01-01T00:00:00Z"), "SK": s("REACTION#b#heart"), "reactingUser": s("b")},
+	{"PK": s("USER#a"), "SK": s("PHOTO#a#2020-01-01T00:00:00Z"), "location": s(strings.Repeat("Tokyo ", 10))},
+	{"PK": s("USER#a"), "SK": s("#METADATA#a"), "name": s("<Alice>"), "followers": n("1"), "interests": {SS: aws.StringSlice([]string{"go"})}},
+	{"PK": s("USER#a"), "SK": s("#FRIEND#b"), "followedUser": s("a"), "followingUser": s("b")},
+	{"PK": s("REACTION#a#2020-01-02T00:00:00Z"), "SK": s("REACTION#b#heart"), "reactingUser": s("b")},
+	{"PK": s("USER#a"), "SK": s("PHOTO#a#2020-01-02T00:00:00Z"), "url": s("https://example.com/2.jpg")},
+	{"PK": s("USER#c"), "name": s("no sort key")},
+	{"PK": s("USER#d"), "SK": n("1"), "name": s("numeric sort key")},
+}
+
+// 同じアイテムを、ベーステーブルと InvertedIndex のまとめ方、1 つのパーティションだけで表示する
+func TestGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		index     string
+		partition string
+	}{
+		{name: "table"},
+		{name: "table_partition", partition: "USER#a"},
+		{name: "inverted_index", index: "InvertedIndex"},
+		{name: "inverted_index_partition", index: "InvertedIndex", partition: "REACTION#b#heart"},
+		{name: "unknown_partition", partition: "USER#x"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			view, err := Build(quickphotos.DEFAULT_TABLE, tc.index, items)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.partition != "" {
+				view = view.Partition(tc.partition)
+			}
+			var text, html bytes.Buffer
+			if err := view.WriteText(&text); err != nil {
+				t.Fatal(err)
+			}
+			if err := view.WriteHTML(&html); err != nil {
+				t.Fatal(err)
+			}
+			compare(t, tc.name+".txt", text.Bytes())
+			compare(t, tc.name+".html", html.Bytes())
+		})
+	}
+}
+
+func compare(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join(goldenDir, name)
+	if *update {
+		if err := os.MkdirAll(goldenDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s does not match\n%s", path, e2e.Diff(string(want), string(got)))
+	}
+}
+
+func TestBuildRejectsUnknownIndex(t *testing.T) {
+	if _, err := Build(quickphotos.DEFAULT_TABLE, "ByEmail", items); err == nil {
+		t.Error("err = nil, want an unknown index")
+	}
+}
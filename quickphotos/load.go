@@ -0,0 +1,109 @@
+package quickphotos
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/cenkalti/backoff/v4"
+)
+
+const maxLineBufferSize = 1024 * 1024
+
+// scripts/items.json のような 1 行 1 アイテムの JSONL を BatchWriteItem で書き込む
+// 戻り値は書き込んだアイテム数
+func (s *Store) Load(r io.Reader) (int, error) {
+	s = s.metered("Load")
+	loaded := 0
+	batch := make([]*dynamodb.WriteRequest, 0, MAX_BATCH_WRITE)
+	err := scanItems(r, func(item map[string]*dynamodb.AttributeValue) error {
+		batch = append(batch, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{Item: item},
+		})
+		if len(batch) < MAX_BATCH_WRITE {
+			return nil
+		}
+		if err := s.batchWrite(batch); err != nil {
+			return err
+		}
+		loaded += len(batch)
+		batch = batch[:0]
+		return nil
+	})
+	if err != nil {
+		return loaded, err
+	}
+	if len(batch) > 0 {
+		if err := s.batchWrite(batch); err != nil {
+			return loaded, err
+		}
+		loaded += len(batch)
+	}
+	return loaded, nil
+}
+
+// 型のない JSON も EncodeItem の型つきの JSON も読める (DecodeItem を参照)
+// テーブルに書き込まずに JSONL のアイテムを読み込む
+func ReadItems(r io.Reader) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+	err := scanItems(r, func(item map[string]*dynamodb.AttributeValue) error {
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func scanItems(r io.Reader, fn func(item map[string]*dynamodb.AttributeValue) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBufferSize)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		item, err := DecodeItem(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+var errUnprocessed = errors.New("unprocessed items remain after retries")
+
+// UnprocessedItems や UnprocessedKeys はスループットが足りないときに返るので、すぐに送り直さずに間隔を広げながら送り直す
+// fn は送り直すものが残っていれば true を返す
+func retryUnprocessed(fn func() (bool, error)) error {
+	return backoff.Retry(func() error {
+		remaining, err := fn()
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		if remaining {
+			return errUnprocessed
+		}
+		return nil
+	}, backoff.NewExponentialBackOff())
+}
+
+func (s *Store) batchWrite(requests []*dynamodb.WriteRequest) error {
+	input := &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{
+			s.table: requests,
+		},
+	}
+	return retryUnprocessed(func() (bool, error) {
+		out, err := s.api.BatchWriteItem(input)
+		if err != nil {
+			return false, err
+		}
+		input = &dynamodb.BatchWriteItemInput{RequestItems: out.UnprocessedItems}
+		return len(input.RequestItems) > 0, nil
+	})
+}
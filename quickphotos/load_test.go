@@ -0,0 +1,65 @@
+package quickphotos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// 1 回目の BatchWriteItem では最後のアイテムを UnprocessedItems として返す
+type throttledWriter struct {
+	dynamodbiface.DynamoDBAPI
+	calls int
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (w *throttledWriter) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	w.calls++
+	out := &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}
+	for table, requests := range input.RequestItems {
+		if w.calls == 1 && len(requests) > 1 {
+			out.UnprocessedItems[table] = requests[len(requests)-1:]
+			requests = requests[:len(requests)-1]
+		}
+		for _, r := range requests {
+			w.items = append(w.items, r.PutRequest.Item)
+		}
+	}
+	return out, nil
+}
+
+func TestLoadRetriesUnprocessedItemsAndKeepsTypes(t *testing.T) {
+	input := strings.Join([]string{
+		`{"PK":{"S":"USER#a"},"SK":{"S":"#METADATA#a"},"interests":{"SS":["x","y"]},"followers":{"N":"12345678901234567890"}}`,
+		``,
+		`{"PK":"USER#a","SK":"PHOTO#a#2020-01-01T00:00:00Z","location":""}`,
+	}, "\n")
+	w := &throttledWriter{}
+	n, err := New(w, DEFAULT_TABLE).Load(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(w.items) != 2 || w.calls != 2 {
+		t.Fatalf("loaded %d, wrote %d items in %d calls", n, len(w.items), w.calls)
+	}
+	user := w.items[0]
+	if got := aws.StringValueSlice(user["interests"].SS); len(got) != 2 {
+		t.Errorf("interests = %v, want a string set", user["interests"])
+	}
+	if got := aws.StringValue(user["followers"].N); got != "12345678901234567890" {
+		t.Errorf("followers = %s", got)
+	}
+	if got := w.items[1]["location"]; got == nil || got.S == nil || *got.S != "" {
+		t.Errorf("location = %v, want an empty string", got)
+	}
+}
+
+func TestLoadReportsLineOfBadItem(t *testing.T) {
+	_, err := New(&throttledWriter{}, DEFAULT_TABLE).Load(strings.NewReader("{\"PK\":\"USER#a\"}\n{\"SK\":\"x\"}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("err = %v, want an error for line 2", err)
+	}
+}
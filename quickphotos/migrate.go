@@ -0,0 +1,581 @@
+package quickphotos
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// 適用済みのマイグレーションとロックは、テーブルの予約したアイテムに置く
+	MIGRATION_PK       = "#MIGRATION"
+	MIGRATION_STATE_SK = "#STATE"
+	MIGRATION_LOCK_SK  = "#LOCK"
+	// ロックを持ったまま止まっても、この時間が過ぎればほかの実行がロックを取れる
+	// 実行中は MIGRATION_LOCK_RENEW_INTERVAL ごとと、マイグレーションを 1 つ終えるたびに延長する
+	MIGRATION_LOCK_LEASE          = 15 * time.Minute
+	MIGRATION_LOCK_RENEW_INTERVAL = MIGRATION_LOCK_LEASE / 3
+)
+
+// テストで短くできるように変数にしておく
+var migrationLockRenewInterval = MIGRATION_LOCK_RENEW_INTERVAL
+
+var (
+	ErrMigrationLocked   = errors.New("migrations are locked by another run")
+	ErrMigrationLockLost = errors.New("migration lock was taken over by another run")
+)
+
+// 何度実行しても同じ結果になるように書く。途中で失敗しても、もう一度実行すれば続きから進む
+// dryRun のときは何も変更せずに、必要な変更だけを返す
+type Migration struct {
+	Version int
+	Name    string
+	Run     func(s *Store, dryRun bool) ([]string, error)
+}
+
+// 番号順に実行する。一度公開した番号の中身は変えず、変更は新しい番号で追加する
+//
+// scripts のうち次の 2 つは、一度だけ適用する変更ではないので含めない
+//   - 10_migrate_timestamps.go: 古い時刻は読み込むときに TIMESTAMP_LAYOUT にするので、移行しなくても動く
+//     書き換えるには古い時刻のタイムゾーン (-legacy-zone) を決める必要があり、JSONL のファイルも書き換える
+//   - 11_compact_reaction_shards.go: シャードにはリアクションのたびに値が溜まるので、定期的に何度も実行する
+var Migrations = []Migration{
+	{Version: 1, Name: "create_table", Run: func(s *Store, dryRun bool) ([]string, error) { return s.createTable(dryRun) }},
+	{Version: 2, Name: "add_inverted_index", Run: (*Store).createInvertedIndex},
+	{Version: 3, Name: "enable_ttl", Run: (*Store).enableTTL},
+	{Version: 4, Name: "backfill_reaction_counts", Run: (*Store).backfillReactionCounts},
+	{Version: 5, Name: "backfill_interest_index", Run: (*Store).backfillInterestIndex},
+}
+
+type MigrationStatus struct {
+	Version   int      `json:"version"`
+	Name      string   `json:"name"`
+	AppliedAt string   `json:"appliedAt,omitempty"`
+	AppliedBy string   `json:"appliedBy,omitempty"`
+	Changes   []string `json:"changes,omitempty"`
+}
+
+func (m MigrationStatus) Applied() bool {
+	return m.AppliedAt != ""
+}
+
+type MigrationLock struct {
+	Owner      string `json:"owner" dynamodbav:"owner"`
+	AcquiredAt string `json:"acquiredAt" dynamodbav:"acquiredAt"`
+	ExpiresAt  int64  `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+func (l *MigrationLock) String() string {
+	return fmt.Sprintf("held by %s until %s", l.Owner, time.Unix(l.ExpiresAt, 0).UTC().Format(TIMESTAMP_LAYOUT))
+}
+
+type appliedMigration struct {
+	Name      string `dynamodbav:"name"`
+	AppliedAt string `dynamodbav:"appliedAt"`
+	AppliedBy string `dynamodbav:"appliedBy"`
+}
+
+func migrationKey(sk string) map[string]*dynamodb.AttributeValue {
+	return itemKey(MIGRATION_PK, sk)
+}
+
+// テーブルがなければ、すべて未適用として返す
+// ロックを持っている実行がなければ lock は nil
+func (s *Store) MigrationStatus() ([]MigrationStatus, *MigrationLock, error) {
+	s = s.metered("MigrationStatus")
+	desc, err := s.describeTable()
+	if err != nil {
+		return nil, nil, err
+	}
+	applied := map[string]appliedMigration{}
+	var lock *MigrationLock
+	if desc != nil {
+		if applied, err = s.appliedMigrations(); err != nil {
+			return nil, nil, err
+		}
+		if lock, err = s.migrationLock(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(Migrations))
+	known := make(map[string]bool, len(Migrations))
+	for _, m := range Migrations {
+		version := strconv.Itoa(m.Version)
+		known[version] = true
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := applied[version]; ok {
+			status.AppliedAt, status.AppliedBy = a.AppliedAt, a.AppliedBy
+		}
+		statuses = append(statuses, status)
+	}
+	// 新しいバージョンのコードで適用されたものも表示する
+	for version, a := range applied {
+		if known[version] {
+			continue
+		}
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid migration version %q in state item", version)
+		}
+		statuses = append(statuses, MigrationStatus{Version: v, Name: a.Name, AppliedAt: a.AppliedAt, AppliedBy: a.AppliedBy})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, lock, nil
+}
+
+func (s *Store) appliedMigrations() (map[string]appliedMigration, error) {
+	out, err := s.api.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            migrationKey(MIGRATION_STATE_SK),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	applied := map[string]appliedMigration{}
+	if v, ok := out.Item["applied"]; ok {
+		if err := dynamodbattribute.Unmarshal(v, &applied); err != nil {
+			return nil, err
+		}
+	}
+	return applied, nil
+}
+
+func (s *Store) migrationLock() (*MigrationLock, error) {
+	out, err := s.api.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            migrationKey(MIGRATION_LOCK_SK),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	lock := &MigrationLock{}
+	if err := dynamodbattribute.UnmarshalMap(out.Item, lock); err != nil {
+		return nil, err
+	}
+	// 期限の切れたロックは TTL で消えるまで残っているが、持っていないのと同じ
+	if lock.ExpiresAt <= s.now().Unix() {
+		return nil, nil
+	}
+	return lock, nil
+}
+
+// 未適用のマイグレーションを番号順に実行し、実行したものを返す
+// dryRun のときはロックを取らず、何も変更せずに、それぞれで必要な変更を返す
+// owner はロックと適用の記録に残す、実行した人や環境の名前
+func (s *Store) Migrate(owner string, dryRun bool) ([]MigrationStatus, error) {
+	s = s.metered("Migrate")
+	statuses, _, err := s.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return s.runMigrations(statuses, owner, true, nil)
+	}
+
+	// テーブルがないとロックも状態も置けないので、テーブルを作るマイグレーションだけはロックの前に実行する
+	// ほかの実行と同時に作ろうとしても、どちらか一方が作るだけで結果は同じ
+	bootstrap, err := s.createTable(false)
+	var inUse *dynamodb.ResourceInUseException
+	if errors.As(err, &inUse) {
+		err = s.waitUntilActive()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.acquireMigrationLock(owner); err != nil {
+		return nil, err
+	}
+	defer s.releaseMigrationLock(owner)
+	stop := s.keepMigrationLock(owner)
+	// ロックを待っている間にほかの実行が進めているかもしれないので、ロックを取ってから読み直す
+	if statuses, _, err = s.MigrationStatus(); err != nil {
+		stop()
+		return nil, err
+	}
+	ran, err := s.runMigrations(statuses, owner, false, bootstrap)
+	if lost := stop(); err == nil && lost != nil {
+		err = lost
+	}
+	return ran, err
+}
+
+// 1 つのマイグレーションが長くかかっても期限が切れないように、実行中は定期的にロックを延長する
+// 戻り値の関数で延長をやめる。その間にロックを失っていれば ErrMigrationLockLost を返す
+// 一時的なエラーで延長できなかったときは、次の間隔でもう一度延長する
+func (s *Store) keepMigrationLock(owner string) func() error {
+	done := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(migrationLockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				result <- nil
+				return
+			case <-ticker.C:
+				if err := s.renewMigrationLock(owner); errors.Is(err, ErrMigrationLockLost) {
+					result <- err
+					return
+				}
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
+
+func (s *Store) renewMigrationLock(owner string) error {
+	renewal := s.lockRenewal(owner)
+	_, err := s.api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 renewal.TableName,
+		Key:                       renewal.Key,
+		UpdateExpression:          renewal.UpdateExpression,
+		ConditionExpression:       renewal.ConditionExpression,
+		ExpressionAttributeNames:  renewal.ExpressionAttributeNames,
+		ExpressionAttributeValues: renewal.ExpressionAttributeValues,
+	})
+	if isConditionFailed(err) {
+		return ErrMigrationLockLost
+	}
+	return err
+}
+
+// ロックをまだ持っていれば、期限を今から MIGRATION_LOCK_LEASE 後にする
+func (s *Store) lockRenewal(owner string) *dynamodb.Update {
+	return &dynamodb.Update{
+		TableName:           aws.String(s.table),
+		Key:                 migrationKey(MIGRATION_LOCK_SK),
+		UpdateExpression:    aws.String("SET #expiresAt = :expiresAt"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expiresAt": aws.String(TTL_ATTRIBUTE),
+			"#owner":     aws.String("owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expiresAt": {N: aws.String(strconv.FormatInt(s.now().Add(MIGRATION_LOCK_LEASE).Unix(), 10))},
+			":owner":     {S: aws.String(owner)},
+		},
+	}
+}
+
+func (s *Store) runMigrations(statuses []MigrationStatus, owner string, dryRun bool, bootstrap []string) ([]MigrationStatus, error) {
+	applied := make(map[int]bool, len(statuses))
+	for _, status := range statuses {
+		applied[status.Version] = status.Applied()
+	}
+	ran := make([]MigrationStatus, 0)
+	for _, m := range Migrations {
+		if applied[m.Version] {
+			continue
+		}
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		changes, err := m.Run(s, dryRun)
+		if m.Version == Migrations[0].Version {
+			changes = append(bootstrap, changes...)
+		}
+		status.Changes = changes
+		if err != nil {
+			return ran, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		if !dryRun {
+			if status.AppliedAt, err = s.recordMigration(m, owner); err != nil {
+				return ran, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			}
+			status.AppliedBy = owner
+		}
+		ran = append(ran, status)
+	}
+	return ran, nil
+}
+
+func (s *Store) acquireMigrationLock(owner string) error {
+	now := s.now()
+	item, err := dynamodbattribute.MarshalMap(MigrationLock{
+		Owner:      owner,
+		AcquiredAt: now.UTC().Format(TIMESTAMP_LAYOUT),
+		ExpiresAt:  now.Add(MIGRATION_LOCK_LEASE).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range migrationKey(MIGRATION_LOCK_SK) {
+		item[k] = v
+	}
+	_, err = s.api.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(s.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PK) OR #expiresAt <= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expiresAt": aws.String(TTL_ATTRIBUTE),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	if !isConditionFailed(err) {
+		return err
+	}
+	lock, err := s.migrationLock()
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		// 確かめる間に解放された
+		return ErrMigrationLocked
+	}
+	return fmt.Errorf("%w: %s", ErrMigrationLocked, lock)
+}
+
+// ほかの実行に取られていたら何もしない
+func (s *Store) releaseMigrationLock(owner string) error {
+	_, err := s.api.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 migrationKey(MIGRATION_LOCK_SK),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(owner)},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// ロックをまだ持っていることを確かめて延長し、同じトランザクションで適用済みにする
+func (s *Store) recordMigration(m Migration, owner string) (string, error) {
+	// 状態のアイテムがまだなければ、空の applied を作っておく
+	_, err := s.api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              migrationKey(MIGRATION_STATE_SK),
+		UpdateExpression: aws.String("SET applied = if_not_exists(applied, :empty)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":empty": {M: map[string]*dynamodb.AttributeValue{}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	now := s.now()
+	appliedAt := now.UTC().Format(TIMESTAMP_LAYOUT)
+	record, err := dynamodbattribute.Marshal(appliedMigration{Name: m.Name, AppliedAt: appliedAt, AppliedBy: owner})
+	if err != nil {
+		return "", err
+	}
+	_, err = s.api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				Update: s.lockRenewal(owner),
+			},
+			{
+				Update: &dynamodb.Update{
+					TableName:        aws.String(s.table),
+					Key:              migrationKey(MIGRATION_STATE_SK),
+					UpdateExpression: aws.String("SET applied.#version = :record"),
+					ExpressionAttributeNames: map[string]*string{
+						"#version": aws.String(strconv.Itoa(m.Version)),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":record": record,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", translateTransactionError(err, map[int]error{0: ErrMigrationLockLost})
+	}
+	return appliedAt, nil
+}
+
+func isConditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// reactions の無い写真や、一部のリアクションの種類が無い写真に 0 を入れる
+// あとから増えたリアクションの種類を GetPhoto で数えられるようにするためのもの
+func (s *Store) backfillReactionCounts(dryRun bool) ([]string, error) {
+	type photo struct {
+		key     map[string]*dynamodb.AttributeValue
+		hasMap  bool
+		missing []string
+	}
+	// dry-run でテーブルをまだ作っていなければ、埋めるものもない
+	desc, err := s.describeTable()
+	if err != nil || desc == nil {
+		return nil, err
+	}
+	photos := make([]photo, 0)
+	err = s.api.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(s.table),
+		FilterExpression:     aws.String("begins_with(PK, :user) AND begins_with(SK, :photo)"),
+		ProjectionExpression: aws.String("PK, SK, reactions"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user":  {S: aws.String("USER#")},
+			":photo": {S: aws.String("PHOTO#")},
+		},
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			p := photo{key: itemKey(stringValue(item, "PK"), stringValue(item, "SK"))}
+			reactions := item["reactions"]
+			p.hasMap = reactions != nil && reactions.M != nil
+			for _, t := range ReactionTypes {
+				if !p.hasMap || reactions.M[t] == nil {
+					p.missing = append(p.missing, t)
+				}
+			}
+			if len(p.missing) > 0 {
+				photos = append(photos, p)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(photos) == 0 {
+		return nil, nil
+	}
+	changes := []string{changed(dryRun, "update", fmt.Sprintf("%d photo(s) missing reaction counts", len(photos)))}
+	if dryRun {
+		return changes, nil
+	}
+
+	for _, p := range photos {
+		if !p.hasMap {
+			if err := s.fillReactions(p.key, "SET reactions = if_not_exists(reactions, :empty)", nil, map[string]*dynamodb.AttributeValue{
+				":empty": {M: map[string]*dynamodb.AttributeValue{}},
+			}); err != nil {
+				return changes, err
+			}
+		}
+		// 同じ式で reactions と reactions.#t を両方は書けないので、入れ物を作ってから種類ごとに入れる
+		sets := make([]string, 0, len(p.missing))
+		names := make(map[string]*string, len(p.missing))
+		for i, t := range p.missing {
+			name := fmt.Sprintf("#t%d", i)
+			sets = append(sets, fmt.Sprintf("reactions.%s = if_not_exists(reactions.%s, :zero)", name, name))
+			names[name] = aws.String(t)
+		}
+		if err := s.fillReactions(p.key, "SET "+strings.Join(sets, ", "), names, map[string]*dynamodb.AttributeValue{
+			":zero": {N: aws.String("0")},
+		}); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// スキャンのあとに消された写真は作り直さない
+func (s *Store) fillReactions(key map[string]*dynamodb.AttributeValue, update string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.table),
+		Key:                       key,
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(PK)"),
+		ExpressionAttributeValues: values,
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+	_, err := s.api.UpdateItem(input)
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// scripts/04_backfill_interest_index.go と同じように、ユーザーの interests から INTEREST#<interest> / USER#<user> のアイテムを作る
+// すでにあるアイテムは書き込まないので、何度実行しても足りない分だけを作る
+// interests から外された関心のアイテムは消さない
+func (s *Store) backfillInterestIndex(dryRun bool) ([]string, error) {
+	desc, err := s.describeTable()
+	if err != nil || desc == nil {
+		return nil, err
+	}
+	items := make(map[string]map[string]*dynamodb.AttributeValue)
+	err = s.api.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(s.table),
+		FilterExpression:     aws.String("begins_with(SK, :metadata)"),
+		ProjectionExpression: aws.String("PK, SK, username, interests"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":metadata": {S: aws.String("#METADATA#")},
+		},
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			username := stringValue(item, "username")
+			for _, interest := range interestsValue(item["interests"]) {
+				key := itemKey("INTEREST#"+interest, "USER#"+username)
+				key["username"] = &dynamodb.AttributeValue{S: aws.String(username)}
+				key["interest"] = &dynamodb.AttributeValue{S: aws.String(interest)}
+				items["INTEREST#"+interest+"|USER#"+username] = key
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, itemKey(stringValue(item, "PK"), stringValue(item, "SK")))
+	}
+	existing, err := s.batchGet(keys, "PK, SK", true)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range existing {
+		delete(items, stringValue(item, "PK")+"|"+stringValue(item, "SK"))
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	users := make(map[string]bool)
+	for _, item := range items {
+		users[stringValue(item, "username")] = true
+	}
+	changes := []string{changed(dryRun, "create", fmt.Sprintf("%d interest item(s) for %d user(s)", len(items), len(users)))}
+	if dryRun {
+		return changes, nil
+	}
+
+	batch := make([]*dynamodb.WriteRequest, 0, MAX_BATCH_WRITE)
+	for _, item := range items {
+		batch = append(batch, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+		if len(batch) == MAX_BATCH_WRITE {
+			if err := s.batchWrite(batch); err != nil {
+				return changes, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := s.batchWrite(batch); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
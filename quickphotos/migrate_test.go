@@ -0,0 +1,99 @@
+package quickphotos
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestMigrateBackfillsInterestIndex(t *testing.T) {
+	store := New(newLocalAPI(t, ""), DEFAULT_TABLE)
+	ran, err := store.Migrate("test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != len(Migrations) {
+		t.Fatalf("ran %d migrations, want %d", len(ran), len(Migrations))
+	}
+	users := `{"PK":"USER#a","SK":"#METADATA#a","username":"a","interests":["go","ski"]}
+{"PK":"USER#b","SK":"#METADATA#b","username":"b","interests":["go"]}
+{"PK":"INTEREST#go","SK":"USER#a","username":"a","interest":"go"}
+`
+	if _, err := store.Load(strings.NewReader(users)); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := store.backfillInterestIndex(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0] != "would create 2 interest item(s) for 2 user(s)" {
+		t.Errorf("dry-run changes = %v", changes)
+	}
+	if _, err := store.backfillInterestIndex(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][2]string{{"INTEREST#go", "USER#a"}, {"INTEREST#go", "USER#b"}, {"INTEREST#ski", "USER#a"}} {
+		out, err := store.api.GetItem(&dynamodb.GetItemInput{TableName: aws.String(store.table), Key: itemKey(key[0], key[1])})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stringValue(out.Item, "interest") != strings.TrimPrefix(key[0], "INTEREST#") {
+			t.Errorf("%v = %v", key, out.Item)
+		}
+	}
+	if changes, err := store.backfillInterestIndex(true); err != nil || len(changes) != 0 {
+		t.Errorf("after the backfill: changes = %v, err = %v", changes, err)
+	}
+}
+
+// マイグレーションが長くかかっても、終わるのを待たずにロックを延長する
+func TestMigrateRenewsLockDuringLongMigration(t *testing.T) {
+	store := New(newLocalAPI(t, ""), DEFAULT_TABLE)
+	if _, err := store.Migrate("test", false); err != nil {
+		t.Fatal(err)
+	}
+	// 呼ぶたびに 1 分進む時計
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.SetClock(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Minute)
+		return now
+	})
+
+	interval, migrations := migrationLockRenewInterval, Migrations
+	t.Cleanup(func() { migrationLockRenewInterval, Migrations = interval, migrations })
+	migrationLockRenewInterval = 5 * time.Millisecond
+	var acquired, renewed *MigrationLock
+	Migrations = append(Migrations[:len(Migrations):len(Migrations)], Migration{
+		Version: 99,
+		Name:    "slow",
+		Run: func(s *Store, dryRun bool) ([]string, error) {
+			var err error
+			if acquired, err = s.migrationLock(); err != nil {
+				return nil, err
+			}
+			time.Sleep(50 * time.Millisecond)
+			renewed, err = s.migrationLock()
+			return nil, err
+		},
+	})
+	if _, err := store.Migrate("test", false); err != nil {
+		t.Fatal(err)
+	}
+	if acquired == nil || renewed == nil {
+		t.Fatalf("lock = %v, %v", acquired, renewed)
+	}
+	if renewed.ExpiresAt <= acquired.ExpiresAt {
+		t.Errorf("lock was not renewed during the migration: %s -> %s", acquired, renewed)
+	}
+	if lock, err := store.migrationLock(); err != nil || lock != nil {
+		t.Errorf("lock after the run = %v, %v", lock, err)
+	}
+}
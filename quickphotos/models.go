@@ -0,0 +1,166 @@
+package quickphotos
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type User struct {
+	Username    string   `json:"username"`
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Birthdate   string   `json:"birthdate"`
+	Address     string   `json:"address"`
+	Status      string   `json:"status"`
+	Interests   []string `json:"interests"`
+	Followers   int      `json:"followers"`
+	Following   int      `json:"following"`
+	PinnedImage string   `json:"pinnedImage,omitempty"`
+	Private     bool     `json:"private"`
+	Photos      []Photo  `json:"photos,omitempty"`
+}
+
+func (u User) String() string {
+	return fmt.Sprintf("User<%s -- %s>", u.Username, u.Name)
+}
+
+type Photo struct {
+	Username  string         `json:"username"`
+	Timestamp string         `json:"timestamp"`
+	Location  string         `json:"location"`
+	Caption   string         `json:"caption,omitempty"`
+	Reactions map[string]int `json:"reactions"`
+}
+
+func (p Photo) String() string {
+	return fmt.Sprintf("Photo<%s -- %s>", p.Username, p.Timestamp)
+}
+
+func (p Photo) ID() string {
+	return PhotoID(p.Username, p.Timestamp)
+}
+
+type Reaction struct {
+	ReactingUser string `json:"reactingUser"`
+	Photo        string `json:"photo"`
+	ReactionType string `json:"reactionType"`
+	Timestamp    string `json:"timestamp"`
+}
+
+func (r Reaction) String() string {
+	return fmt.Sprintf("Reaction<%s -- %s -- %s>", r.ReactingUser, r.Photo, r.ReactionType)
+}
+
+type Friendship struct {
+	FollowedUser  string `json:"followedUser"`
+	FollowingUser string `json:"followingUser"`
+	Timestamp     string `json:"timestamp"`
+}
+
+func (f Friendship) String() string {
+	return fmt.Sprintf("Friendship<%s -- %s>", f.FollowedUser, f.FollowingUser)
+}
+
+func stringValue(item map[string]*dynamodb.AttributeValue, name string) string {
+	if val, ok := item[name]; ok {
+		return aws.StringValue(val.S)
+	}
+	return ""
+}
+
+func intValue(item map[string]*dynamodb.AttributeValue, name string) int {
+	if val, ok := item[name]; ok {
+		n, _ := strconv.Atoi(aws.StringValue(val.N))
+		return n
+	}
+	return 0
+}
+
+// 古い形式で書き込まれた時刻も、TIMESTAMP_LAYOUT の形式にして返す
+// legacy はタイムゾーンの無い形式を読むときのタイムゾーン
+func timestampValue(item map[string]*dynamodb.AttributeValue, name string, legacy *time.Location) string {
+	return CanonicalTimestampIn(stringValue(item, name), legacy)
+}
+
+// guregu/dynamo で投入した場合は L、String Set として投入した場合は SS になる
+func interestsValue(av *dynamodb.AttributeValue) []string {
+	interests := make([]string, 0)
+	if av == nil {
+		return interests
+	}
+	for _, v := range av.L {
+		interests = append(interests, aws.StringValue(v.S))
+	}
+	for _, v := range av.SS {
+		interests = append(interests, aws.StringValue(v))
+	}
+	return interests
+}
+
+func addReactionCounts(counts map[string]int, av *dynamodb.AttributeValue) {
+	if av == nil {
+		return
+	}
+	for reactionType, v := range av.M {
+		n, err := strconv.Atoi(aws.StringValue(v.N))
+		if err != nil {
+			continue
+		}
+		counts[reactionType] += n
+	}
+}
+
+func newUser(item map[string]*dynamodb.AttributeValue) User {
+	user := User{
+		Username:    stringValue(item, "username"),
+		Name:        stringValue(item, "name"),
+		Email:       stringValue(item, "email"),
+		Birthdate:   stringValue(item, "birthdate"),
+		Address:     stringValue(item, "address"),
+		Status:      stringValue(item, "status"),
+		Interests:   interestsValue(item["interests"]),
+		Followers:   intValue(item, "followers"),
+		Following:   intValue(item, "following"),
+		PinnedImage: stringValue(item, "pinnedImage"),
+	}
+	if val, ok := item["private"]; ok {
+		user.Private = aws.BoolValue(val.BOOL)
+	}
+	return user
+}
+
+func newPhoto(item map[string]*dynamodb.AttributeValue, legacy *time.Location) Photo {
+	photo := Photo{
+		Username:  stringValue(item, "username"),
+		Timestamp: timestampValue(item, "timestamp", legacy),
+		Location:  stringValue(item, "location"),
+		Caption:   stringValue(item, "caption"),
+		Reactions: make(map[string]int),
+	}
+	for _, t := range ReactionTypes {
+		photo.Reactions[t] = 0
+	}
+	addReactionCounts(photo.Reactions, item["reactions"])
+	return photo
+}
+
+func newReaction(item map[string]*dynamodb.AttributeValue, legacy *time.Location) Reaction {
+	return Reaction{
+		ReactingUser: stringValue(item, "reactingUser"),
+		Photo:        stringValue(item, "photo"),
+		ReactionType: stringValue(item, "reactionType"),
+		Timestamp:    timestampValue(item, "timestamp", legacy),
+	}
+}
+
+func newFriendship(item map[string]*dynamodb.AttributeValue, legacy *time.Location) Friendship {
+	return Friendship{
+		FollowedUser:  stringValue(item, "followedUser"),
+		FollowingUser: stringValue(item, "followingUser"),
+		Timestamp:     timestampValue(item, "timestamp", legacy),
+	}
+}
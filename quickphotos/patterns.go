@@ -0,0 +1,566 @@
+package quickphotos
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// エンティティの種類。キーの形から判断する
+const (
+	ENTITY_USER           = "User"
+	ENTITY_PHOTO          = "Photo"
+	ENTITY_REACTION       = "Reaction"
+	ENTITY_REACTION_SHARD = "ReactionShard"
+	ENTITY_FRIENDSHIP     = "Friendship"
+	ENTITY_FOLLOW_REQUEST = "FollowRequest"
+	ENTITY_BLOCK          = "Block"
+	ENTITY_NOTIFICATION   = "Notification"
+	ENTITY_INTEREST       = "Interest"
+	ENTITY_TAG            = "Tag"
+	ENTITY_MIGRATION      = "Migration"
+	ENTITY_UNKNOWN        = "Unknown"
+)
+
+// EntityOf が返すエンティティの種類すべて
+var EntityTypes = []string{
+	ENTITY_USER,
+	ENTITY_PHOTO,
+	ENTITY_REACTION,
+	ENTITY_REACTION_SHARD,
+	ENTITY_FRIENDSHIP,
+	ENTITY_FOLLOW_REQUEST,
+	ENTITY_BLOCK,
+	ENTITY_NOTIFICATION,
+	ENTITY_INTEREST,
+	ENTITY_TAG,
+	ENTITY_MIGRATION,
+	ENTITY_UNKNOWN,
+}
+
+// ソートキーの条件
+const (
+	RANGE_BEGINS_WITH = "begins_with"
+	RANGE_BETWEEN     = "BETWEEN"
+	RANGE_AFTER       = ">"
+)
+
+// 値の中の {username} のようなプレースホルダーは、実行するときに引数で置き換える
+type KeyCondition struct {
+	HashKey     string
+	HashValue   string
+	RangeKey    string
+	RangeOp     string
+	RangeValues []string
+}
+
+func (k KeyCondition) String() string {
+	s := fmt.Sprintf("%s = %q", k.HashKey, k.HashValue)
+	switch k.RangeOp {
+	case RANGE_BEGINS_WITH:
+		s += fmt.Sprintf(" AND begins_with(%s, %q)", k.RangeKey, k.RangeValues[0])
+	case RANGE_BETWEEN:
+		s += fmt.Sprintf(" AND %s BETWEEN %q AND %q", k.RangeKey, k.RangeValues[0], k.RangeValues[1])
+	case RANGE_AFTER:
+		s += fmt.Sprintf(" AND %s > %q", k.RangeKey, k.RangeValues[0])
+	}
+	return s
+}
+
+// アクセスパターンは 1 か所でだけ宣言し、aws-sdk と guregu/dynamo のどちらのクエリもここから組み立てる
+type AccessPattern struct {
+	Name   string
+	Entity string
+	// 空ならベーステーブルを使う
+	Index   string
+	Key     KeyCondition
+	Forward bool
+	// 結果に含まれてよいエンティティ
+	Results []string
+	// 検証で実際に実行するときの引数。scripts/items.json にあるデータを指す
+	Example map[string]string
+	// scripts/items.json に無いアイテムを読むパターンは、アイテムを作る処理を書いておく
+	// 読み込んだだけのテーブルでは例の結果が空になるので、検証では空を問題にしない
+	CreatedBy string
+}
+
+var (
+	PatternUserWithPhotos = &AccessPattern{
+		Name:   "user and photos",
+		Entity: ENTITY_USER,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "USER#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BETWEEN,
+			RangeValues: []string{"#METADATA#{username}", "PHOTO$"},
+		},
+		Forward: true,
+		Results: []string{ENTITY_USER, ENTITY_PHOTO},
+		Example: map[string]string{"username": "jacksonjason"},
+	}
+	PatternPhotosByUser = &AccessPattern{
+		Name:   "photos by user",
+		Entity: ENTITY_PHOTO,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "USER#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"PHOTO#"},
+		},
+		Forward: false,
+		Results: []string{ENTITY_PHOTO},
+		Example: map[string]string{"username": "jacksonjason"},
+	}
+	PatternReactionsForPhoto = &AccessPattern{
+		Name:   "reactions for photo",
+		Entity: ENTITY_REACTION,
+		Index:  INVERTED_INDEX,
+		Key: KeyCondition{
+			HashKey:     "SK",
+			HashValue:   "PHOTO#{username}#{timestamp}",
+			RangeKey:    "PK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"REACTION#"},
+		},
+		Forward: true,
+		Results: []string{ENTITY_REACTION},
+		Example: map[string]string{"username": "david25", "timestamp": "2019-03-02T09:11:30Z"},
+	}
+	PatternFollowing = &AccessPattern{
+		Name:   "following for user",
+		Entity: ENTITY_FRIENDSHIP,
+		Index:  INVERTED_INDEX,
+		Key: KeyCondition{
+			HashKey:   "SK",
+			HashValue: "#FRIEND#{username}",
+		},
+		Forward: true,
+		Results: []string{ENTITY_FRIENDSHIP},
+		Example: map[string]string{"username": "haroldwatkins"},
+	}
+	PatternFollowers = &AccessPattern{
+		Name:   "followers for user",
+		Entity: ENTITY_FRIENDSHIP,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "USER#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"#FRIEND#"},
+		},
+		Forward: true,
+		Results: []string{ENTITY_FRIENDSHIP},
+		Example: map[string]string{"username": "haroldwatkins"},
+	}
+	PatternUsersByInterest = &AccessPattern{
+		Name:   "users by interest",
+		Entity: ENTITY_INTEREST,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "INTEREST#{interest}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"USER#"},
+		},
+		Forward:   true,
+		Results:   []string{ENTITY_INTEREST},
+		Example:   map[string]string{"interest": "green"},
+		CreatedBy: "migration 5 backfill_interest_index",
+	}
+	PatternInterestsOfUser = &AccessPattern{
+		Name:   "interests of user",
+		Entity: ENTITY_INTEREST,
+		Index:  INVERTED_INDEX,
+		Key: KeyCondition{
+			HashKey:     "SK",
+			HashValue:   "USER#{username}",
+			RangeKey:    "PK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"INTEREST#"},
+		},
+		Forward:   true,
+		Results:   []string{ENTITY_INTEREST},
+		Example:   map[string]string{"username": "haroldwatkins"},
+		CreatedBy: "migration 5 backfill_interest_index",
+	}
+	// タグは小文字で保存しているので、引数も小文字にして渡す
+	PatternPhotosByTag = &AccessPattern{
+		Name:   "photos by tag",
+		Entity: ENTITY_TAG,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "TAG#{tag}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"TIMESTAMP#"},
+		},
+		Forward:   false,
+		Results:   []string{ENTITY_TAG},
+		Example:   map[string]string{"tag": "sunset"},
+		CreatedBy: "application/09_photo_captions_and_hashtags.go",
+	}
+	PatternNotifications = &AccessPattern{
+		Name:   "notifications for user",
+		Entity: ENTITY_NOTIFICATION,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "INBOX#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"NOTIFICATION#"},
+		},
+		Forward:   false,
+		Results:   []string{ENTITY_NOTIFICATION},
+		Example:   map[string]string{"username": "haroldwatkins"},
+		CreatedBy: "Store.Follow, Store.React",
+	}
+	// after には既読位置の通知の SK を渡す。#READ は NOTIFICATION# より前に並ぶので、後ろはすべて通知
+	PatternUnreadNotifications = &AccessPattern{
+		Name:   "unread notifications for user",
+		Entity: ENTITY_NOTIFICATION,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "INBOX#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_AFTER,
+			RangeValues: []string{"{after}"},
+		},
+		Forward:   true,
+		Results:   []string{ENTITY_NOTIFICATION},
+		Example:   map[string]string{"username": "haroldwatkins", "after": "NOTIFICATION#"},
+		CreatedBy: "Store.Follow, Store.React",
+	}
+	PatternFollowRequests = &AccessPattern{
+		Name:   "follow requests for user",
+		Entity: ENTITY_FOLLOW_REQUEST,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "USER#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"#FOLLOWREQUEST#"},
+		},
+		Forward:   true,
+		Results:   []string{ENTITY_FOLLOW_REQUEST},
+		Example:   map[string]string{"username": "tmartinez"},
+		CreatedBy: "Store.Follow",
+	}
+	PatternSentFollowRequests = &AccessPattern{
+		Name:   "follow requests sent by user",
+		Entity: ENTITY_FOLLOW_REQUEST,
+		Index:  INVERTED_INDEX,
+		Key: KeyCondition{
+			HashKey:   "SK",
+			HashValue: "#FOLLOWREQUEST#{username}",
+		},
+		Forward:   true,
+		Results:   []string{ENTITY_FOLLOW_REQUEST},
+		Example:   map[string]string{"username": "john42"},
+		CreatedBy: "Store.Follow",
+	}
+	PatternBlocks = &AccessPattern{
+		Name:   "blocks by user",
+		Entity: ENTITY_BLOCK,
+		Key: KeyCondition{
+			HashKey:     "PK",
+			HashValue:   "USER#{username}",
+			RangeKey:    "SK",
+			RangeOp:     RANGE_BEGINS_WITH,
+			RangeValues: []string{"#BLOCK#"},
+		},
+		Forward:   true,
+		Results:   []string{ENTITY_BLOCK},
+		Example:   map[string]string{"username": "tmartinez"},
+		CreatedBy: "application/10_block_user.go",
+	}
+)
+
+var AccessPatterns = []*AccessPattern{
+	PatternUserWithPhotos,
+	PatternPhotosByUser,
+	PatternReactionsForPhoto,
+	PatternFollowing,
+	PatternFollowers,
+	PatternUsersByInterest,
+	PatternInterestsOfUser,
+	PatternPhotosByTag,
+	PatternNotifications,
+	PatternUnreadNotifications,
+	PatternFollowRequests,
+	PatternSentFollowRequests,
+	PatternBlocks,
+}
+
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+func expand(template string, args map[string]string) (string, error) {
+	var missing string
+	s := placeholder.ReplaceAllStringFunc(template, func(m string) string {
+		name := m[1 : len(m)-1]
+		v, ok := args[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("access pattern: missing argument %q", missing)
+	}
+	return s, nil
+}
+
+// プレースホルダーを置き換えたハッシュキーとソートキーの値
+func (p *AccessPattern) Bind(args map[string]string) (string, []string, error) {
+	hash, err := expand(p.Key.HashValue, args)
+	if err != nil {
+		return "", nil, err
+	}
+	values := make([]string, 0, len(p.Key.RangeValues))
+	for _, template := range p.Key.RangeValues {
+		v, err := expand(template, args)
+		if err != nil {
+			return "", nil, err
+		}
+		values = append(values, v)
+	}
+	return hash, values, nil
+}
+
+// aws-sdk で使う QueryInput
+func (p *AccessPattern) QueryInput(table string, args map[string]string) (*dynamodb.QueryInput, error) {
+	hash, values, err := p.Bind(args)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:        aws.String(table),
+		ScanIndexForward: aws.Bool(p.Forward),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hash": {S: aws.String(hash)},
+		},
+	}
+	if p.Index != "" {
+		input.IndexName = aws.String(p.Index)
+	}
+	condition := fmt.Sprintf("%s = :hash", p.Key.HashKey)
+	switch p.Key.RangeOp {
+	case RANGE_BEGINS_WITH:
+		condition += fmt.Sprintf(" AND begins_with(%s, :r0)", p.Key.RangeKey)
+	case RANGE_BETWEEN:
+		condition += fmt.Sprintf(" AND %s BETWEEN :r0 AND :r1", p.Key.RangeKey)
+	case RANGE_AFTER:
+		condition += fmt.Sprintf(" AND %s > :r0", p.Key.RangeKey)
+	}
+	for i, v := range values {
+		input.ExpressionAttributeValues[fmt.Sprintf(":r%d", i)] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	input.KeyConditionExpression = aws.String(condition)
+	return input, nil
+}
+
+// キーの形からエンティティの種類を判断する
+func EntityOf(pk, sk string) string {
+	switch {
+	case strings.HasPrefix(sk, "#METADATA#"):
+		return ENTITY_USER
+	case strings.HasPrefix(pk, "REACTIONSHARD#"):
+		return ENTITY_REACTION_SHARD
+	case strings.HasPrefix(pk, "REACTION#"):
+		return ENTITY_REACTION
+	case strings.HasPrefix(pk, "USER#") && strings.HasPrefix(sk, "PHOTO#"):
+		return ENTITY_PHOTO
+	case strings.HasPrefix(sk, "#FRIEND#"):
+		return ENTITY_FRIENDSHIP
+	case strings.HasPrefix(sk, "#FOLLOWREQUEST#"):
+		return ENTITY_FOLLOW_REQUEST
+	case strings.HasPrefix(sk, "#BLOCK#"):
+		return ENTITY_BLOCK
+	case strings.HasPrefix(pk, "INBOX#"):
+		return ENTITY_NOTIFICATION
+	case strings.HasPrefix(pk, "INTEREST#"):
+		return ENTITY_INTEREST
+	case strings.HasPrefix(pk, "TAG#"):
+		return ENTITY_TAG
+	case pk == MIGRATION_PK:
+		return ENTITY_MIGRATION
+	}
+	return ENTITY_UNKNOWN
+}
+
+// テーブルと GSI のキー
+type IndexDefinition struct {
+	Name       string
+	HashKey    string
+	RangeKey   string
+	Projection string
+}
+
+// schema.go で作るテーブルと GSI
+func Indexes() []IndexDefinition {
+	indexes := []IndexDefinition{{Name: "", HashKey: "PK", RangeKey: "SK", Projection: dynamodb.ProjectionTypeAll}}
+	return append(indexes, indexDefinition(invertedIndex().IndexName, invertedIndex().KeySchema, invertedIndex().Projection))
+}
+
+// name が空ならベーステーブル
+func FindIndex(name string) (IndexDefinition, bool) {
+	for _, idx := range Indexes() {
+		if idx.Name == name {
+			return idx, true
+		}
+	}
+	return IndexDefinition{}, false
+}
+
+func indexDefinition(name *string, keys []*dynamodb.KeySchemaElement, projection *dynamodb.Projection) IndexDefinition {
+	def := IndexDefinition{Name: aws.StringValue(name), Projection: dynamodb.ProjectionTypeAll}
+	for _, k := range keys {
+		switch aws.StringValue(k.KeyType) {
+		case dynamodb.KeyTypeHash:
+			def.HashKey = aws.StringValue(k.AttributeName)
+		case dynamodb.KeyTypeRange:
+			def.RangeKey = aws.StringValue(k.AttributeName)
+		}
+	}
+	if projection != nil {
+		def.Projection = aws.StringValue(projection.ProjectionType)
+	}
+	return def
+}
+
+// DescribeTable の結果からテーブルと GSI のキーを取り出す
+func DescribedIndexes(desc *dynamodb.TableDescription) []IndexDefinition {
+	indexes := []IndexDefinition{indexDefinition(nil, desc.KeySchema, nil)}
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		indexes = append(indexes, indexDefinition(gsi.IndexName, gsi.KeySchema, gsi.Projection))
+	}
+	return indexes
+}
+
+// アクセスパターンが Scan なしで、テーブルか定義済みの GSI の Query で処理できることを確かめる
+// 問題がなければ空を返す
+func VerifyPatterns(patterns []*AccessPattern, indexes []IndexDefinition) []error {
+	byName := make(map[string]IndexDefinition, len(indexes))
+	for _, idx := range indexes {
+		byName[idx.Name] = idx
+	}
+	var errs []error
+	names := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("%s: %s", p.Name, fmt.Sprintf(format, args...)))
+		}
+		if names[p.Name] {
+			fail("declared more than once")
+		}
+		names[p.Name] = true
+
+		idx, ok := byName[p.Index]
+		if !ok {
+			fail("index %s is not defined", p.Index)
+			continue
+		}
+		if p.Key.HashKey != idx.HashKey {
+			fail("hash key %s does not match %s (hash key %s); this would need a Scan", p.Key.HashKey, idx.label(), idx.HashKey)
+		}
+		if p.Key.HashValue == "" {
+			fail("hash key value is empty")
+		}
+		switch p.Key.RangeOp {
+		case "":
+			if p.Key.RangeKey != "" || len(p.Key.RangeValues) > 0 {
+				fail("range key condition without an operator")
+			}
+		case RANGE_BEGINS_WITH, RANGE_BETWEEN, RANGE_AFTER:
+			if p.Key.RangeKey != idx.RangeKey {
+				fail("range key %s does not match %s (range key %s)", p.Key.RangeKey, idx.label(), idx.RangeKey)
+			}
+			want := 1
+			if p.Key.RangeOp == RANGE_BETWEEN {
+				want = 2
+			}
+			if len(p.Key.RangeValues) != want {
+				fail("%s needs %d value(s)", p.Key.RangeOp, want)
+			}
+		default:
+			fail("unknown range operator %s", p.Key.RangeOp)
+		}
+		if idx.Projection != dynamodb.ProjectionTypeAll {
+			fail("%s projects %s, but entities need all attributes", idx.label(), idx.Projection)
+		}
+		if len(p.Results) == 0 {
+			fail("no result entities declared")
+		}
+		if _, _, err := p.Bind(p.Example); err != nil {
+			fail("example: %s", err)
+		}
+	}
+	return errs
+}
+
+func (idx IndexDefinition) label() string {
+	if idx.Name == "" {
+		return "the table"
+	}
+	return "index " + idx.Name
+}
+
+// 結果のアイテムに、宣言していないエンティティが含まれていないかを確かめる
+func (p *AccessPattern) CheckResults(items []map[string]*dynamodb.AttributeValue) error {
+	allowed := make(map[string]bool, len(p.Results))
+	for _, e := range p.Results {
+		allowed[e] = true
+	}
+	unexpected := make(map[string]bool)
+	for _, item := range items {
+		if e := EntityOf(stringValue(item, "PK"), stringValue(item, "SK")); !allowed[e] {
+			unexpected[e] = true
+		}
+	}
+	if len(unexpected) == 0 {
+		return nil
+	}
+	entities := make([]string, 0, len(unexpected))
+	for e := range unexpected {
+		entities = append(entities, e)
+	}
+	sort.Strings(entities)
+	return fmt.Errorf("%s: unexpected entities in result: %s", p.Name, strings.Join(entities, ", "))
+}
+
+// 宣言と実際のテーブルを照らし合わせ、例の引数で各パターンを実行して結果のエンティティも確かめる
+func (s *Store) VerifyPatterns() ([]error, error) {
+	s = s.metered("VerifyPatterns")
+	desc, err := s.api.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return nil, err
+	}
+	errs := VerifyPatterns(AccessPatterns, DescribedIndexes(desc.Table))
+	if len(errs) > 0 {
+		return errs, nil
+	}
+	for _, p := range AccessPatterns {
+		input, err := p.QueryInput(s.table, p.Example)
+		if err != nil {
+			return nil, err
+		}
+		items, _, err := s.query(input, 0, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name, err)
+		}
+		if len(items) == 0 && p.CreatedBy == "" {
+			errs = append(errs, fmt.Errorf("%s: example returned no items", p.Name))
+		}
+		if err := p.CheckResults(items); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs, nil
+}
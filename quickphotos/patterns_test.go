@@ -0,0 +1,147 @@
+package quickphotos
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestAccessPatternsMatchSchema(t *testing.T) {
+	for _, err := range VerifyPatterns(AccessPatterns, Indexes()) {
+		t.Error(err)
+	}
+}
+
+func TestVerifyPatternsReportsProblems(t *testing.T) {
+	valid := func() *AccessPattern {
+		p := *PatternFollowRequests
+		p.Key.RangeValues = append([]string(nil), p.Key.RangeValues...)
+		return &p
+	}
+	for _, tc := range []struct {
+		name    string
+		change  func(p *AccessPattern)
+		indexes []IndexDefinition
+		want    []string
+	}{
+		{
+			name:   "valid",
+			change: func(p *AccessPattern) {},
+		},
+		{
+			name:   "hash key of another index",
+			change: func(p *AccessPattern) { p.Key.HashKey = "SK" },
+			want:   []string{"hash key SK does not match the table (hash key PK); this would need a Scan"},
+		},
+		{
+			name:   "undefined index",
+			change: func(p *AccessPattern) { p.Index = "ByEmail" },
+			want:   []string{"index ByEmail is not defined"},
+		},
+		{
+			name: "range key of another index",
+			change: func(p *AccessPattern) {
+				p.Key.RangeKey = "PK"
+			},
+			want: []string{"range key PK does not match the table (range key SK)"},
+		},
+		{
+			name: "between with one value",
+			change: func(p *AccessPattern) {
+				p.Key.RangeOp = RANGE_BETWEEN
+			},
+			want: []string{"BETWEEN needs 2 value(s)"},
+		},
+		{
+			name: "range key without an operator",
+			change: func(p *AccessPattern) {
+				p.Key.RangeOp = ""
+			},
+			want: []string{"range key condition without an operator"},
+		},
+		{
+			name:   "unknown operator",
+			change: func(p *AccessPattern) { p.Key.RangeOp = "<" },
+			want:   []string{"unknown range operator <"},
+		},
+		{
+			name:   "no result entities",
+			change: func(p *AccessPattern) { p.Results = nil },
+			want:   []string{"no result entities declared"},
+		},
+		{
+			name:   "example without an argument",
+			change: func(p *AccessPattern) { p.Example = map[string]string{"user": "tmartinez"} },
+			want:   []string{`example: access pattern: missing argument "username"`},
+		},
+		{
+			name:   "keys only projection",
+			change: func(p *AccessPattern) {},
+			indexes: []IndexDefinition{
+				{HashKey: "PK", RangeKey: "SK", Projection: dynamodb.ProjectionTypeKeysOnly},
+			},
+			want: []string{"the table projects KEYS_ONLY, but entities need all attributes"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := valid()
+			tc.change(p)
+			indexes := tc.indexes
+			if indexes == nil {
+				indexes = Indexes()
+			}
+			errs := VerifyPatterns([]*AccessPattern{p}, indexes)
+			if len(errs) != len(tc.want) {
+				t.Fatalf("errors = %v, want %q", errs, tc.want)
+			}
+			for i, err := range errs {
+				if want := p.Name + ": " + tc.want[i]; err.Error() != want {
+					t.Errorf("error = %q, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyPatternsReportsDuplicateNames(t *testing.T) {
+	errs := VerifyPatterns([]*AccessPattern{PatternBlocks, PatternBlocks}, Indexes())
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "declared more than once") {
+		t.Errorf("errors = %v, want one duplicate", errs)
+	}
+}
+
+// scripts/items.json を読み込んだテーブルで、宣言したパターンを例の引数で実行する
+// 書き込みで作られるアイテムは、書き込んだ後に同じパターンで読めることを確かめる
+func TestStoreVerifyPatternsOnSeedItems(t *testing.T) {
+	items, err := os.ReadFile(filepath.Join("..", "scripts", "items.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := New(newLocalAPI(t, string(items)), DEFAULT_TABLE)
+	problems, err := store.VerifyPatterns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+
+	if _, err := store.Follow("haroldwatkins", "jacksonjason"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*AccessPattern{PatternNotifications, PatternUnreadNotifications} {
+		got, _, err := store.queryPattern(p, p.Example, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 {
+			t.Errorf("%s: got %d items, want the follow notification", p.Name, len(got))
+		}
+		if err := p.CheckResults(got); err != nil {
+			t.Error(err)
+		}
+	}
+}
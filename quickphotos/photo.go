@@ -0,0 +1,198 @@
+package quickphotos
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func (s *Store) getPhotoItem(username, timestamp string) (map[string]*dynamodb.AttributeValue, error) {
+	resp, err := s.api.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            photoKey(username, timestamp),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, ErrPhotoNotFound
+	}
+	return resp.Item, nil
+}
+
+// シャード付きカウンターの写真は、写真の reactions にシャードの合計を足したものがリアクション数になる
+func (s *Store) GetPhoto(username, timestamp string) (*Photo, error) {
+	s = s.metered("GetPhoto")
+	item, err := s.getPhotoItem(username, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	photos := []Photo{newPhoto(item, s.legacy)}
+	if err := s.addShardTotals(photos, []map[string]*dynamodb.AttributeValue{item}, true); err != nil {
+		return nil, err
+	}
+	return &photos[0], nil
+}
+
+// リアクションは REACTION#<user>#<type> / PHOTO#<owner>#<timestamp> に置くので、InvertedIndex を写真の ID で引く
+// 同じパーティションには写真とシャードも入るので、PK が REACTION# のものだけに絞る
+func (s *Store) ListReactions(username, timestamp string, limit int, cursor string) ([]Reaction, string, error) {
+	s = s.metered("ListReactions")
+	items, next, err := s.queryPattern(PatternReactionsForPhoto, map[string]string{"username": username, "timestamp": timestamp}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) == 0 && cursor == "" {
+		if _, err := s.getPhotoItem(username, timestamp); err != nil {
+			return nil, "", err
+		}
+	}
+	reactions := make([]Reaction, 0, len(items))
+	for _, item := range items {
+		reactions = append(reactions, newReaction(item, s.legacy))
+	}
+	return reactions, next, nil
+}
+
+func validReactionType(reactionType string) bool {
+	for _, t := range ReactionTypes {
+		if t == reactionType {
+			return true
+		}
+	}
+	return false
+}
+
+// 写真への加算は、シャード付きカウンターならランダムに選んだシャードに、そうでなければ写真に行う
+// 読み込み後にモードが切り替わっていれば条件チェックで失敗する
+func (s *Store) React(reactingUser, reactionType, photoUser, timestamp string) (*Reaction, error) {
+	s = s.metered("React")
+	if !validReactionType(reactionType) {
+		return nil, ErrInvalidReactionType
+	}
+	photoItem, err := s.getPhotoItem(photoUser, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	shards := intValue(photoItem, "reactionShards")
+
+	photoStr := PhotoID(photoUser, timestamp)
+	reactionStr := reactionPK(reactingUser, reactionType)
+	now := s.timestamp()
+	counter := &dynamodb.Update{
+		TableName:        aws.String(s.table),
+		Key:              photoKey(photoUser, timestamp),
+		UpdateExpression: aws.String("SET reactions.#t = reactions.#t + :i"),
+		ConditionExpression: aws.String(
+			"attribute_exists(SK) AND attribute_not_exists(reactionShards)",
+		),
+		ExpressionAttributeNames: map[string]*string{
+			"#t": aws.String(reactionType),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":i": {
+				N: aws.String("1"),
+			},
+		},
+	}
+
+	items := []*dynamodb.TransactWriteItem{
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(s.table),
+				Item: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(reactionStr),
+					},
+					"SK": {
+						S: aws.String(photoStr),
+					},
+					"reactingUser": {
+						S: aws.String(reactingUser),
+					},
+					"reactionType": {
+						S: aws.String(reactionType),
+					},
+					"photo": {
+						S: aws.String(photoStr),
+					},
+					"timestamp": {
+						S: aws.String(now),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			Update: counter,
+		},
+	}
+	if shards > 0 {
+		// 同じアイテムを 1 つのトランザクションで 2 回は扱えないので、シャードを加算するときだけ写真を条件チェックする
+		counter.Key = reactionShardKey(photoUser, timestamp, rand.Intn(shards))
+		counter.ConditionExpression = aws.String("attribute_exists(SK)")
+		items = append(items, &dynamodb.TransactWriteItem{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(s.table),
+				Key:                 photoKey(photoUser, timestamp),
+				ConditionExpression: aws.String("reactionShards = :n"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":n": {
+						N: aws.String(strconv.Itoa(shards)),
+					},
+				},
+			},
+		})
+	}
+	blockIndex := len(items)
+	items = append(items, s.blockChecks(photoUser, reactingUser)...)
+	// 写真の投稿者の受信箱に通知を書き込む
+	items = append(items, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(s.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(inboxPK(photoUser)),
+				},
+				"SK": {
+					S: aws.String(fmt.Sprintf("NOTIFICATION#%s#%s#%s", now, reactionStr, photoStr)),
+				},
+				"type": {
+					S: aws.String("reaction"),
+				},
+				"actor": {
+					S: aws.String(reactingUser),
+				},
+				"photo": {
+					S: aws.String(photoStr),
+				},
+				"reactionType": {
+					S: aws.String(reactionType),
+				},
+				"timestamp": {
+					S: aws.String(now),
+				},
+				"expiresAt": {
+					N: aws.String(strconv.FormatInt(s.now().Add(NOTIFICATION_TTL).Unix(), 10)),
+				},
+			},
+		},
+	})
+
+	_, err = s.api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		return nil, translateTransactionError(err, map[int]error{
+			0:              ErrAlreadyReacted,
+			blockIndex:     ErrBlocked,
+			blockIndex + 1: ErrBlocked,
+		})
+	}
+	reaction := newReaction(items[0].Put.Item, s.legacy)
+	return &reaction, nil
+}
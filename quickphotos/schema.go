@@ -0,0 +1,204 @@
+package quickphotos
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	READ_CAPACITY  = 10
+	WRITE_CAPACITY = 10
+)
+
+func throughput() *dynamodb.ProvisionedThroughput {
+	return &dynamodb.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(READ_CAPACITY),
+		WriteCapacityUnits: aws.Int64(WRITE_CAPACITY),
+	}
+}
+
+func invertedIndex() *dynamodb.GlobalSecondaryIndex {
+	return &dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String(INVERTED_INDEX),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("SK"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("PK"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		Projection: &dynamodb.Projection{
+			ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+		},
+		ProvisionedThroughput: throughput(),
+	}
+}
+
+func keyAttributes() []*dynamodb.AttributeDefinition {
+	return []*dynamodb.AttributeDefinition{
+		{AttributeName: aws.String("PK"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		{AttributeName: aws.String("SK"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+	}
+}
+
+// scripts/01_create_table.go、03_add_inverted_index.go、05_enable_ttl.go をまとめて行う
+// すでにあるものは作り直さないので、何度実行してもよい
+// 戻り値は変更した内容
+func (s *Store) ApplySchema() ([]string, error) {
+	s = s.metered("ApplySchema")
+	changes := make([]string, 0)
+	steps := []func() ([]string, error){
+		func() ([]string, error) { return s.createTable(false, invertedIndex()) },
+		func() ([]string, error) { return s.createInvertedIndex(false) },
+		func() ([]string, error) { return s.enableTTL(false) },
+	}
+	for _, step := range steps {
+		more, err := step()
+		changes = append(changes, more...)
+		if err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
+
+// テーブルがなければ nil を返す
+func (s *Store) describeTable() (*dynamodb.TableDescription, error) {
+	desc, err := s.api.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(s.table),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return desc.Table, nil
+}
+
+// dryRun のときは何も変更せずに、必要な変更だけを返す
+func changed(dryRun bool, verb, object string) string {
+	if dryRun {
+		return "would " + verb + " " + object
+	}
+	return verb + "d " + object
+}
+
+func (s *Store) waitUntilActive() error {
+	return s.api.WaitUntilTableExists(&dynamodb.DescribeTableInput{
+		TableName: aws.String(s.table),
+	})
+}
+
+// indexes に渡した GSI はテーブルと一緒に作る
+func (s *Store) createTable(dryRun bool, indexes ...*dynamodb.GlobalSecondaryIndex) ([]string, error) {
+	desc, err := s.describeTable()
+	if err != nil || desc != nil {
+		return nil, err
+	}
+	changes := []string{changed(dryRun, "create", "table "+s.table)}
+	for _, index := range indexes {
+		changes = append(changes, changed(dryRun, "create", "index "+aws.StringValue(index.IndexName)))
+	}
+	if dryRun {
+		return changes, nil
+	}
+	input := &dynamodb.CreateTableInput{
+		TableName:            aws.String(s.table),
+		AttributeDefinitions: keyAttributes(),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("PK"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("SK"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		ProvisionedThroughput: throughput(),
+	}
+	if len(indexes) > 0 {
+		input.GlobalSecondaryIndexes = indexes
+	}
+	if _, err := s.api.CreateTable(input); err != nil {
+		return nil, err
+	}
+	return changes, s.waitUntilActive()
+}
+
+func (s *Store) createInvertedIndex(dryRun bool) ([]string, error) {
+	desc, err := s.describeTable()
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil && !dryRun {
+		return nil, fmt.Errorf("table %s does not exist", s.table)
+	}
+	if desc != nil {
+		for _, index := range desc.GlobalSecondaryIndexes {
+			if aws.StringValue(index.IndexName) == INVERTED_INDEX {
+				return nil, nil
+			}
+		}
+	}
+	changes := []string{changed(dryRun, "create", "index "+INVERTED_INDEX)}
+	if dryRun {
+		return changes, nil
+	}
+	// 作ったばかりのテーブルは ACTIVE になるまで変更できない
+	if err := s.waitUntilActive(); err != nil {
+		return nil, err
+	}
+	index := invertedIndex()
+	_, err = s.api.UpdateTable(&dynamodb.UpdateTableInput{
+		TableName:            aws.String(s.table),
+		AttributeDefinitions: keyAttributes(),
+		GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+			{
+				Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+					IndexName:             index.IndexName,
+					KeySchema:             index.KeySchema,
+					Projection:            index.Projection,
+					ProvisionedThroughput: index.ProvisionedThroughput,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, s.waitUntilActive()
+}
+
+func (s *Store) enableTTL(dryRun bool) ([]string, error) {
+	changes := []string{changed(dryRun, "enable", "TTL on "+TTL_ATTRIBUTE)}
+	desc, err := s.describeTable()
+	if err != nil {
+		return nil, err
+	}
+	if desc == nil {
+		if dryRun {
+			return changes, nil
+		}
+		return nil, fmt.Errorf("table %s does not exist", s.table)
+	}
+	ttl, err := s.api.DescribeTimeToLive(&dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(s.table),
+	})
+	if err != nil {
+		return nil, err
+	}
+	status := aws.StringValue(ttl.TimeToLiveDescription.TimeToLiveStatus)
+	if status == dynamodb.TimeToLiveStatusEnabled || status == dynamodb.TimeToLiveStatusEnabling {
+		return nil, nil
+	}
+	if dryRun {
+		return changes, nil
+	}
+	_, err = s.api.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(s.table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(TTL_ATTRIBUTE),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,359 @@
+// Package quickphotos は、チュートリアルの各ステップで書いたアクセスパターンを 1 つにまとめたもの
+// cmd/quickphotos の CLI などから使う
+package quickphotos
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	DEFAULT_TABLE   = "quick-photos"
+	INVERTED_INDEX  = "InvertedIndex"
+	TTL_ATTRIBUTE   = "expiresAt"
+	MAX_BATCH_WRITE = 25
+	// 通知は TTL で消える
+	NOTIFICATION_TTL = 30 * 24 * time.Hour
+	// 承認されないフォローリクエストは TTL で消える
+	FOLLOW_REQUEST_TTL = 14 * 24 * time.Hour
+)
+
+var ReactionTypes = []string{"+1", "smiley", "sunglasses", "heart"}
+
+// 呼び出し側が種類ごとに扱いを変えられるように、ドメインのエラーは変数として公開する
+var (
+	ErrUserNotFound           = errors.New("user not found")
+	ErrPhotoNotFound          = errors.New("photo not found")
+	ErrAlreadyFollowing       = errors.New("already following")
+	ErrNotFollowing           = errors.New("not following")
+	ErrAlreadyRequested       = errors.New("follow request already exists")
+	ErrAlreadyReacted         = errors.New("already reacted")
+	ErrBlocked                = errors.New("blocked")
+	ErrCannotFollowSelf       = errors.New("cannot follow yourself")
+	ErrInvalidReactionType    = errors.New("invalid reaction type")
+	ErrInvalidCursor          = errors.New("invalid cursor")
+	ErrConcurrentModification = errors.New("item was modified concurrently")
+)
+
+type Store struct {
+	api dynamodbiface.DynamoDBAPI
+	// キャッシュやイベントを流すクライアントで包む前のクライアントと、包んだ順番
+	base     dynamodbiface.DynamoDBAPI
+	wrappers []func(api dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI
+	table    string
+	now      func() time.Time
+	legacy   *time.Location
+	meter    *CapacityMeter
+	// 計測中の公開メソッドの名前
+	operation string
+}
+
+// New に渡して Store の振る舞いを変える
+type Option func(s *Store)
+
+// タイムゾーンの無い古い形式の時刻を loc のタイムゾーンとして読む
+// 指定しなければ DEFAULT_LEGACY_ZONE として読む
+func WithLegacyLocation(loc *time.Location) Option {
+	return func(s *Store) {
+		s.legacy = loc
+	}
+}
+
+// Store を通した書き込みを、前後のイメージを持つ ChangeEvent として stream に流す
+// localdynamo.Server.OnWrite でイベントを流しているときは、同じイベントが 2 回流れるので使わない
+func WithChangeStream(stream ChangeStream) Option {
+	return func(s *Store) {
+		s.wrap(func(api dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI {
+			return NewStreamingClient(api, stream)
+		})
+	}
+}
+
+// 公開メソッドごとに、メソッド名をアクセスパターンの名前として消費キャパシティを meter に記録する
+// 公開メソッドの中で呼んだ別の公開メソッドの分は、外側のメソッドに含める
+func WithCapacityMeter(meter *CapacityMeter) Option {
+	return func(s *Store) {
+		s.meter = meter
+	}
+}
+
+func New(api dynamodbiface.DynamoDBAPI, table string, opts ...Option) *Store {
+	s := &Store{
+		api:    api,
+		base:   api,
+		table:  table,
+		now:    time.Now,
+		legacy: defaultLegacyLocation,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// GetUser と BatchGetUsers がユーザーのメタデータをキャッシュから返すようにする
+// Store を通した書き込みは、書き込んだアイテムのキャッシュを捨てる
+// 同じ cache を複数の Store で共有してもよい
+func (s *Store) UseMetadataCache(cache *MetadataCache) {
+	s.wrap(func(api dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI {
+		return NewCachingClient(api, cache)
+	})
+}
+
+func (s *Store) wrap(wrapper func(api dynamodbiface.DynamoDBAPI) dynamodbiface.DynamoDBAPI) {
+	s.wrappers = append(s.wrappers, wrapper)
+	s.api = wrapper(s.api)
+}
+
+// 書き込みに記録する時刻を固定したいときに使う
+func (s *Store) SetClock(now func() time.Time) {
+	s.now = now
+}
+
+func (s *Store) Table() string {
+	return s.table
+}
+
+// 公開メソッドの最初で呼び、operation として計測するクライアントに差し替えた Store を返す
+// キャッシュやイベントを流すクライアントの内側で計測するので、DynamoDB に届いた呼び出しだけを数える
+func (s *Store) metered(operation string) *Store {
+	if s.meter == nil || s.operation != "" {
+		return s
+	}
+	m := *s
+	m.api = s.meter.Pattern(s.base, operation)
+	for _, wrapper := range s.wrappers {
+		m.api = wrapper(m.api)
+	}
+	m.operation = operation
+	return &m
+}
+
+func (s *Store) timestamp() string {
+	return NewTimestamp(s.now()).String()
+}
+
+func itemKey(pk, sk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(pk),
+		},
+		"SK": {
+			S: aws.String(sk),
+		},
+	}
+}
+
+func userPK(username string) string {
+	return fmt.Sprintf("USER#%s", username)
+}
+
+func metadataKey(username string) map[string]*dynamodb.AttributeValue {
+	return itemKey(userPK(username), fmt.Sprintf("#METADATA#%s", username))
+}
+
+func PhotoID(username, timestamp string) string {
+	return fmt.Sprintf("PHOTO#%s#%s", username, timestamp)
+}
+
+func photoKey(username, timestamp string) map[string]*dynamodb.AttributeValue {
+	return itemKey(userPK(username), PhotoID(username, timestamp))
+}
+
+func friendSK(followingUser string) string {
+	return fmt.Sprintf("#FRIEND#%s", followingUser)
+}
+
+func friendKey(followedUser, followingUser string) map[string]*dynamodb.AttributeValue {
+	return itemKey(userPK(followedUser), friendSK(followingUser))
+}
+
+func blockKey(blockingUser, blockedUser string) map[string]*dynamodb.AttributeValue {
+	return itemKey(userPK(blockingUser), fmt.Sprintf("#BLOCK#%s", blockedUser))
+}
+
+func followRequestKey(followedUser, followingUser string) map[string]*dynamodb.AttributeValue {
+	return itemKey(userPK(followedUser), fmt.Sprintf("#FOLLOWREQUEST#%s", followingUser))
+}
+
+func reactionPK(reactingUser, reactionType string) string {
+	return fmt.Sprintf("REACTION#%s#%s", reactingUser, reactionType)
+}
+
+func reactionShardKey(username, timestamp string, shard int) map[string]*dynamodb.AttributeValue {
+	id := PhotoID(username, timestamp)
+	return itemKey(ReactionShardPK(id, shard), id)
+}
+
+// シャードの PK は写真の ID の "PHOTO#" を置き換えたもので、ソートキーは写真の ID
+// 古い形式の時刻を含む写真でも、写真のアイテムの SK から作れば同じキーになる
+func ReactionShardPK(photoID string, shard int) string {
+	return fmt.Sprintf("REACTIONSHARD#%s#%d", strings.TrimPrefix(photoID, "PHOTO#"), shard)
+}
+
+func inboxPK(username string) string {
+	return fmt.Sprintf("INBOX#%s", username)
+}
+
+// どちらかがブロックしていれば失敗する ConditionCheck
+func (s *Store) blockChecks(a, b string) []*dynamodb.TransactWriteItem {
+	return []*dynamodb.TransactWriteItem{
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(s.table),
+				Key:                 blockKey(a, b),
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+		{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String(s.table),
+				Key:                 blockKey(b, a),
+				ConditionExpression: aws.String("attribute_not_exists(SK)"),
+			},
+		},
+	}
+}
+
+// TransactWriteItems の失敗理由を、アイテムの順番どおりに返す
+// 失敗していないアイテムは "None" になる
+func cancellationReasons(err error) []string {
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return nil
+	}
+	reasons := make([]string, 0, len(canceled.CancellationReasons))
+	for _, r := range canceled.CancellationReasons {
+		reasons = append(reasons, aws.StringValue(r.Code))
+	}
+	return reasons
+}
+
+// 条件チェックで失敗したアイテムの位置を、ドメインのエラーに変換する
+// 条件チェック以外の理由 (競合など) で失敗した場合は元のエラーを返す
+func translateTransactionError(err error, errs map[int]error) error {
+	reasons := cancellationReasons(err)
+	if reasons == nil {
+		return err
+	}
+	for i, reason := range reasons {
+		if reason != "ConditionalCheckFailed" {
+			continue
+		}
+		if e, ok := errs[i]; ok {
+			return e
+		}
+		return ErrConcurrentModification
+	}
+	return err
+}
+
+// LastEvaluatedKey をそのまま渡さずに済むように、不透明な文字列にして返す
+func encodeCursor(key map[string]*dynamodb.AttributeValue) string {
+	if len(key) == 0 {
+		return ""
+	}
+	values := make(map[string]string, len(key))
+	for k, v := range key {
+		values[k] = aws.StringValue(v.S)
+	}
+	b, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	values := make(map[string]string)
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	key := make(map[string]*dynamodb.AttributeValue, len(values))
+	for k, v := range values {
+		key[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return key, nil
+}
+
+// limit が 0 以下なら最後まで読み込む
+func (s *Store) query(input *dynamodb.QueryInput, limit int, cursor string) ([]map[string]*dynamodb.AttributeValue, string, error) {
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	input.ExclusiveStartKey = start
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+	for {
+		if limit > 0 {
+			input.Limit = aws.Int64(int64(limit - len(items)))
+		}
+		out, err := s.api.Query(input)
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, out.Items...)
+		if len(out.LastEvaluatedKey) == 0 {
+			return items, "", nil
+		}
+		if limit > 0 && len(items) >= limit {
+			return items, encodeCursor(out.LastEvaluatedKey), nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// アクセスパターンの宣言から Query を組み立てて実行する
+func (s *Store) queryPattern(p *AccessPattern, args map[string]string, limit int, cursor string) ([]map[string]*dynamodb.AttributeValue, string, error) {
+	input, err := p.QueryInput(s.table, args)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.query(input, limit, cursor)
+}
+
+// index のキーで partition に入っているアイテムをすべて返す。partition が空ならテーブル全体を Scan する
+func (s *Store) Items(index, partition string) ([]map[string]*dynamodb.AttributeValue, error) {
+	s = s.metered("Items")
+	if partition == "" {
+		items := make([]map[string]*dynamodb.AttributeValue, 0)
+		err := s.api.ScanPages(&dynamodb.ScanInput{
+			TableName: aws.String(s.table),
+		}, func(out *dynamodb.ScanOutput, last bool) bool {
+			items = append(items, out.Items...)
+			return true
+		})
+		return items, err
+	}
+	def, ok := FindIndex(index)
+	if !ok {
+		return nil, fmt.Errorf("unknown index %q", index)
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("#hash = :partition"),
+		ExpressionAttributeNames: map[string]*string{
+			"#hash": aws.String(def.HashKey),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":partition": {S: aws.String(partition)},
+		},
+	}
+	if index != "" {
+		input.IndexName = aws.String(index)
+	}
+	items, _, err := s.query(input, 0, "")
+	return items, err
+}
@@ -0,0 +1,44 @@
+package quickphotos
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/localdynamo"
+)
+
+// a と b の 2 人のユーザーと、a の写真が 1 枚
+const testItems = `{"PK":"USER#a","SK":"#METADATA#a","username":"a","followers":0,"following":0}
+{"PK":"USER#b","SK":"#METADATA#b","username":"b","followers":0,"following":0}
+{"PK":"USER#a","SK":"PHOTO#a#2020-01-01T00:00:00Z","username":"a","timestamp":"2020-01-01T00:00:00Z","reactions":{"+1":0,"smiley":0,"sunglasses":0,"heart":0}}
+`
+
+// テストごとに localdynamo を立ち上げて、つないだクライアントを返す
+// items が空でなければテーブルを作って読み込む。空ならテーブルも作らない
+func newLocalAPI(t *testing.T, items string) *dynamodb.DynamoDB {
+	t.Helper()
+	return newServerAPI(t, localdynamo.New(), items)
+}
+
+// OnWrite を設定したサーバーのように、作っておいた server を使う newLocalAPI
+func newServerAPI(t *testing.T, server *localdynamo.Server, items string) *dynamodb.DynamoDB {
+	t.Helper()
+	api, stop, err := localdynamo.StartServer(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	if items == "" {
+		return api
+	}
+	store := New(api, DEFAULT_TABLE)
+	if _, err := store.ApplySchema(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(strings.NewReader(items)); err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
@@ -0,0 +1,353 @@
+package quickphotos
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDB Streams の eventName と同じ値を使う
+const (
+	EVENT_INSERT = "INSERT"
+	EVENT_MODIFY = "MODIFY"
+	EVENT_REMOVE = "REMOVE"
+)
+
+// DynamoDB Streams の NEW_AND_OLD_IMAGES と同じ形のイベント
+// Entity は EntityOf でキーから判断した ENTITY_ の値
+type ChangeEvent struct {
+	EventName string
+	Table     string
+	Entity    string
+	Keys      map[string]*dynamodb.AttributeValue
+	OldImage  map[string]*dynamodb.AttributeValue
+	NewImage  map[string]*dynamodb.AttributeValue
+}
+
+func (e ChangeEvent) String() string {
+	return fmt.Sprintf(
+		"ChangeEvent<%s -- %s -- %s -- %s>",
+		e.EventName,
+		e.Entity,
+		aws.StringValue(e.Keys["PK"].S),
+		aws.StringValue(e.Keys["SK"].S),
+	)
+}
+
+// 書き込みの前後のイメージからイベントを作る。アイテムが変わっていなければ false を返す
+// 条件付きの書き込みが何も変えなかったときや、同じ値での上書きはイベントにしない
+// DynamoDB Streams も、アイテムが変わらなかった書き込みはレコードにしない
+func newChangeEvent(table string, old, new map[string]*dynamodb.AttributeValue) (ChangeEvent, bool) {
+	if reflect.DeepEqual(old, new) {
+		return ChangeEvent{}, false
+	}
+	event := ChangeEvent{
+		Table:    table,
+		OldImage: old,
+		NewImage: new,
+	}
+	switch {
+	case old == nil:
+		event.EventName = EVENT_INSERT
+		event.Keys = keyOf(new)
+	case new == nil:
+		event.EventName = EVENT_REMOVE
+		event.Keys = keyOf(old)
+	default:
+		event.EventName = EVENT_MODIFY
+		event.Keys = keyOf(new)
+	}
+	event.Entity = EntityOf(aws.StringValue(event.Keys["PK"].S), aws.StringValue(event.Keys["SK"].S))
+	return event, true
+}
+
+type ChangeHandler func(ChangeEvent)
+
+type ErrorHandler func(error)
+
+type ChangeStream interface {
+	Subscribe(entity string, handler ChangeHandler)
+	Publish(event ChangeEvent)
+	// イベントを作れなかったときのエラーを流す
+	PublishError(err error)
+}
+
+// 書き込みの前後のイメージを読み込めなかったときのエラー
+// 書き込み自体の結果はそのまま呼び出し元に返すので、このエラーのときはイベントだけが欠ける
+type SnapshotError struct {
+	Phase string // "before" か "after"
+	Keys  []map[string]*dynamodb.AttributeValue
+	Err   error
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("snapshot %s write of %d items: %s", e.Phase, len(e.Keys), e.Err)
+}
+
+func (e *SnapshotError) Unwrap() error {
+	return e.Err
+}
+
+// プロセス内で同期的にイベントを配る ChangeStream
+// 書き込みが成功した後に呼ばれるので、ハンドラーの副作用は書き込みと同じトランザクションにはならない
+type LocalChangeStream struct {
+	mu            sync.RWMutex
+	handlers      map[string][]ChangeHandler
+	all           []ChangeHandler
+	errorHandlers []ErrorHandler
+}
+
+func NewLocalChangeStream() *LocalChangeStream {
+	return &LocalChangeStream{
+		handlers: make(map[string][]ChangeHandler),
+	}
+}
+
+func (s *LocalChangeStream) Subscribe(entity string, handler ChangeHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[entity] = append(s.handlers[entity], handler)
+}
+
+// エンティティの種類によらず、すべてのイベントとエラーを sink に流す
+func (s *LocalChangeStream) SubscribeAll(sink *MemorySink) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.all = append(s.all, sink.Handle)
+	s.errorHandlers = append(s.errorHandlers, sink.HandleError)
+}
+
+func (s *LocalChangeStream) Publish(event ChangeEvent) {
+	s.mu.RLock()
+	handlers := append(append([]ChangeHandler(nil), s.handlers[event.Entity]...), s.all...)
+	s.mu.RUnlock()
+	for _, h := range handlers {
+		h(event)
+	}
+}
+
+func (s *LocalChangeStream) SubscribeErrors(handler ErrorHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorHandlers = append(s.errorHandlers, handler)
+}
+
+func (s *LocalChangeStream) PublishError(err error) {
+	s.mu.RLock()
+	handlers := s.errorHandlers
+	s.mu.RUnlock()
+	for _, h := range handlers {
+		h(err)
+	}
+}
+
+// 書き込みの前後のイメージを受け取ってイベントを流す
+// localdynamo.Server.OnWrite に渡すと、StreamingClient を挟まずにすべての書き込みがイベントになる
+func (s *LocalChangeStream) Record(table string, old, new map[string]*dynamodb.AttributeValue) {
+	if event, ok := newChangeEvent(table, old, new); ok {
+		s.Publish(event)
+	}
+}
+
+// 受け取ったイベントとエラーを順に溜めておくシンク。流れたイベントをテストやデバッグで確かめるのに使う
+type MemorySink struct {
+	mu     sync.Mutex
+	events []ChangeEvent
+	errors []error
+}
+
+func (s *MemorySink) Handle(event ChangeEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *MemorySink) HandleError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, err)
+}
+
+func (s *MemorySink) Events() []ChangeEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ChangeEvent(nil), s.events...)
+}
+
+func (s *MemorySink) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error(nil), s.errors...)
+}
+
+// ユーザーのメタデータが変わったら、キャッシュを捨てる
+// CachingClient を通さない書き込み (ほかのプロセスや guregu/dynamo のクライアント) でも、古い値を返さなくなる
+func (c *MetadataCache) InvalidateOn(stream ChangeStream) {
+	stream.Subscribe(ENTITY_USER, func(e ChangeEvent) {
+		c.Invalidate(cacheKey(e.Table, e.Keys))
+	})
+}
+
+type writtenKey struct {
+	table string
+	key   map[string]*dynamodb.AttributeValue
+}
+
+// 書き込み API を横取りして、書き込みの前後のイメージから ChangeEvent を作る dynamodbiface.DynamoDBAPI
+// WithChangeStream で Store に組み込むか、guregu/dynamo には dynamo.NewFromIface で渡す
+// イメージは書き込みの前後に GetItem で読むので、同じアイテムへのほかの書き込みと重なると正確でないことがある
+type StreamingClient struct {
+	dynamodbiface.DynamoDBAPI
+	stream ChangeStream
+}
+
+func NewStreamingClient(api dynamodbiface.DynamoDBAPI, stream ChangeStream) *StreamingClient {
+	return &StreamingClient{
+		DynamoDBAPI: api,
+		stream:      stream,
+	}
+}
+
+func (c *StreamingClient) snapshot(ctx aws.Context, keys []writtenKey) ([]map[string]*dynamodb.AttributeValue, error) {
+	images := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for _, k := range keys {
+		resp, err := c.DynamoDBAPI.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(k.table),
+			Key:            k.key,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, resp.Item)
+	}
+	return images, nil
+}
+
+func snapshotError(phase string, keys []writtenKey, err error) error {
+	e := &SnapshotError{Phase: phase, Err: err}
+	for _, k := range keys {
+		e.Keys = append(e.Keys, k.key)
+	}
+	return e
+}
+
+// 前後のイメージを読み込みながら write を実行する
+// 戻り値はいつも write 自体の結果で、イメージを読み込めなかったときはイベントを流さずにエラーの経路へ流す
+func (c *StreamingClient) track(ctx aws.Context, keys []writtenKey, write func() error) error {
+	olds, snapshotErr := c.snapshot(ctx, keys)
+	if err := write(); err != nil {
+		return err
+	}
+	if snapshotErr != nil {
+		c.stream.PublishError(snapshotError("before", keys, snapshotErr))
+		return nil
+	}
+	news, err := c.snapshot(ctx, keys)
+	if err != nil {
+		c.stream.PublishError(snapshotError("after", keys, err))
+		return nil
+	}
+	for i, k := range keys {
+		if event, ok := newChangeEvent(k.table, olds[i], news[i]); ok {
+			c.stream.Publish(event)
+		}
+	}
+	return nil
+}
+
+// Store は WithContext の無い API を、guregu/dynamo は WithContext の API を呼ぶので、どちらも横取りする
+func (c *StreamingClient) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	var out *dynamodb.PutItemOutput
+	keys := []writtenKey{{aws.StringValue(input.TableName), keyOf(input.Item)}}
+	err := c.track(ctx, keys, func() (err error) {
+		out, err = c.DynamoDBAPI.PutItemWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *StreamingClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return c.PutItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *StreamingClient) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	var out *dynamodb.UpdateItemOutput
+	keys := []writtenKey{{aws.StringValue(input.TableName), input.Key}}
+	err := c.track(ctx, keys, func() (err error) {
+		out, err = c.DynamoDBAPI.UpdateItemWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *StreamingClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return c.UpdateItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *StreamingClient) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	var out *dynamodb.DeleteItemOutput
+	keys := []writtenKey{{aws.StringValue(input.TableName), input.Key}}
+	err := c.track(ctx, keys, func() (err error) {
+		out, err = c.DynamoDBAPI.DeleteItemWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *StreamingClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	return c.DeleteItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *StreamingClient) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	keys := make([]writtenKey, 0, len(input.TransactItems))
+	for _, item := range input.TransactItems {
+		switch {
+		case item.Put != nil:
+			keys = append(keys, writtenKey{aws.StringValue(item.Put.TableName), keyOf(item.Put.Item)})
+		case item.Update != nil:
+			keys = append(keys, writtenKey{aws.StringValue(item.Update.TableName), item.Update.Key})
+		case item.Delete != nil:
+			keys = append(keys, writtenKey{aws.StringValue(item.Delete.TableName), item.Delete.Key})
+		}
+	}
+	var out *dynamodb.TransactWriteItemsOutput
+	err := c.track(ctx, keys, func() (err error) {
+		out, err = c.DynamoDBAPI.TransactWriteItemsWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *StreamingClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return c.TransactWriteItemsWithContext(aws.BackgroundContext(), input)
+}
+
+func (c *StreamingClient) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	keys := make([]writtenKey, 0)
+	for table, requests := range input.RequestItems {
+		for _, r := range requests {
+			switch {
+			case r.PutRequest != nil:
+				keys = append(keys, writtenKey{table, keyOf(r.PutRequest.Item)})
+			case r.DeleteRequest != nil:
+				keys = append(keys, writtenKey{table, r.DeleteRequest.Key})
+			}
+		}
+	}
+	var out *dynamodb.BatchWriteItemOutput
+	err := c.track(ctx, keys, func() (err error) {
+		out, err = c.DynamoDBAPI.BatchWriteItemWithContext(ctx, input, opts...)
+		return err
+	})
+	return out, err
+}
+
+func (c *StreamingClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return c.BatchWriteItemWithContext(aws.BackgroundContext(), input)
+}
@@ -0,0 +1,228 @@
+package quickphotos
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/localdynamo"
+)
+
+// 0 より大きければ、その回数だけ GetItem に成功した後は失敗させる
+type failingGets struct {
+	dynamodbiface.DynamoDBAPI
+	getsBeforeFailure int
+	gets              int
+}
+
+func (f *failingGets) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	f.gets++
+	if f.getsBeforeFailure > 0 && f.gets > f.getsBeforeFailure {
+		return nil, errors.New("get failed")
+	}
+	return f.DynamoDBAPI.GetItemWithContext(ctx, input, opts...)
+}
+
+func userItem(username, status string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK":     {S: aws.String(fmt.Sprintf("USER#%s", username))},
+		"SK":     {S: aws.String(fmt.Sprintf("#METADATA#%s", username))},
+		"status": {S: aws.String(status)},
+	}
+}
+
+func newStreamingTestClient(api dynamodbiface.DynamoDBAPI) (*StreamingClient, *MemorySink) {
+	stream := NewLocalChangeStream()
+	sink := &MemorySink{}
+	stream.SubscribeAll(sink)
+	return NewStreamingClient(api, stream), sink
+}
+
+// "INSERT Friendship USER#a / #FRIEND#b" のように並べて、順番を問わずに比べる
+func eventNames(events []ChangeEvent) []string {
+	names := make([]string, 0, len(events))
+	for _, e := range events {
+		names = append(names, fmt.Sprintf("%s %s %s / %s", e.EventName, e.Entity, aws.StringValue(e.Keys["PK"].S), aws.StringValue(e.Keys["SK"].S)))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestStreamingClientEmitsEvents(t *testing.T) {
+	c, sink := newStreamingTestClient(newLocalAPI(t, testItems))
+	item := userItem("c", "hello")
+
+	put := func(item map[string]*dynamodb.AttributeValue) {
+		t.Helper()
+		if _, err := c.PutItem(&dynamodb.PutItemInput{TableName: aws.String(DEFAULT_TABLE), Item: item}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(item)
+	put(userItem("c", "bye"))
+	// 同じ値での上書きはイベントにならない
+	put(userItem("c", "bye"))
+	if _, err := c.DeleteItem(&dynamodb.DeleteItemInput{TableName: aws.String(DEFAULT_TABLE), Key: keyOf(item)}); err != nil {
+		t.Fatal(err)
+	}
+	// 存在しないアイテムの削除もイベントにならない
+	if _, err := c.DeleteItem(&dynamodb.DeleteItemInput{TableName: aws.String(DEFAULT_TABLE), Key: keyOf(item)}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.Events()
+	want := []string{EVENT_INSERT, EVENT_MODIFY, EVENT_REMOVE}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events %v, want %v", len(events), events, want)
+	}
+	for i, e := range events {
+		if e.EventName != want[i] || e.Entity != ENTITY_USER || e.Table != DEFAULT_TABLE {
+			t.Errorf("event %d = %v, want %s of %s", i, e, want[i], ENTITY_USER)
+		}
+	}
+	if got := aws.StringValue(events[1].OldImage["status"].S); got != "hello" {
+		t.Errorf("old status = %q", got)
+	}
+	if got := aws.StringValue(events[1].NewImage["status"].S); got != "bye" {
+		t.Errorf("new status = %q", got)
+	}
+	if events[2].NewImage != nil {
+		t.Errorf("remove has a new image: %v", events[2].NewImage)
+	}
+	if errs := sink.Errors(); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestStreamingClientReturnsWriteError(t *testing.T) {
+	c, sink := newStreamingTestClient(newLocalAPI(t, testItems))
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(DEFAULT_TABLE),
+		Item:                userItem("c", "hello"),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	}
+	if _, err := c.PutItem(input); err != nil {
+		t.Fatal(err)
+	}
+	_, err := c.PutItem(input)
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		t.Fatalf("err = %v, want the conditional check failure", err)
+	}
+	if events := sink.Events(); len(events) != 1 {
+		t.Errorf("got %d events %v, want only the insert", len(events), events)
+	}
+}
+
+func TestStreamingClientReportsSnapshotFailure(t *testing.T) {
+	api := newLocalAPI(t, testItems)
+	// 書き込み前のイメージだけ読める
+	c, sink := newStreamingTestClient(&failingGets{DynamoDBAPI: api, getsBeforeFailure: 1})
+	_, err := c.PutItem(&dynamodb.PutItemInput{TableName: aws.String(DEFAULT_TABLE), Item: userItem("c", "hello")})
+	if err != nil {
+		t.Fatalf("write succeeded but got %v", err)
+	}
+	got, err := api.GetItem(&dynamodb.GetItemInput{TableName: aws.String(DEFAULT_TABLE), Key: keyOf(userItem("c", ""))})
+	if err != nil || got.Item == nil {
+		t.Fatalf("item was not written: %v", err)
+	}
+	if events := sink.Events(); len(events) != 0 {
+		t.Errorf("got events %v without an after image", events)
+	}
+	errs := sink.Errors()
+	var serr *SnapshotError
+	if len(errs) != 1 || !errors.As(errs[0], &serr) || serr.Phase != "after" {
+		t.Fatalf("errors = %v, want one snapshot error after the write", errs)
+	}
+}
+
+// StreamingClient を通した Store の書き込みと、localdynamo が直接流すイベントが同じになる
+func TestStoreAndLocalDynamoPublishTheSameEvents(t *testing.T) {
+	want := []string{
+		"INSERT Friendship USER#a / #FRIEND#b",
+		"INSERT Notification INBOX#a / NOTIFICATION#2020-01-01T00:00:00Z##FRIEND#b",
+		"MODIFY User USER#a / #METADATA#a",
+		"MODIFY User USER#b / #METADATA#b",
+	}
+	clock := func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	streamed := NewLocalChangeStream()
+	sink := &MemorySink{}
+	streamed.SubscribeAll(sink)
+	store := New(newLocalAPI(t, testItems), DEFAULT_TABLE, WithChangeStream(streamed))
+	store.SetClock(clock)
+	if _, err := store.Follow("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(sink.Events()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("StreamingClient events = %q, want %q", got, want)
+	}
+
+	server := localdynamo.New()
+	local := NewLocalChangeStream()
+	server.OnWrite(local.Record)
+	api := newServerAPI(t, server, testItems)
+	localSink := &MemorySink{}
+	// テーブルに読み込んだアイテムのイベントは数えない
+	local.SubscribeAll(localSink)
+	store = New(api, DEFAULT_TABLE)
+	store.SetClock(clock)
+	if _, err := store.Follow("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(localSink.Events()); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("localdynamo events = %q, want %q", got, want)
+	}
+	// 条件で失敗した書き込みはイベントにならない
+	if _, err := store.Follow("a", "b"); !errors.Is(err, ErrAlreadyFollowing) {
+		t.Fatalf("err = %v, want %v", err, ErrAlreadyFollowing)
+	}
+	if n := len(localSink.Events()); n != len(want) {
+		t.Errorf("got %d events after the failed follow, want %d", n, len(want))
+	}
+}
+
+// Store を通さない書き込みでも、イベントを受け取ったキャッシュは古い値を返さない
+func TestMetadataCacheInvalidatesOnChangeEvents(t *testing.T) {
+	server := localdynamo.New()
+	stream := NewLocalChangeStream()
+	server.OnWrite(stream.Record)
+	api := newServerAPI(t, server, testItems)
+	store := New(api, DEFAULT_TABLE)
+	cache := NewMetadataCache(10, time.Minute)
+	store.UseMetadataCache(cache)
+	cache.InvalidateOn(stream)
+
+	if _, err := store.GetUser("a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(DEFAULT_TABLE),
+		Key:              metadataKey("a"),
+		UpdateExpression: aws.String("SET #s = :s"),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {S: aws.String("changed elsewhere")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := store.GetUser("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Status != "changed elsewhere" {
+		t.Errorf("status = %q, want the value written without the Store", user.Status)
+	}
+}
@@ -0,0 +1,111 @@
+package quickphotos
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// UTC で秒までの固定長なので、文字列の順番と時刻の順番が一致する
+const TIMESTAMP_LAYOUT = "2006-01-02T15:04:05Z"
+
+// 過去に書き込まれた形式
+//   - raw SDK の経路: "2006-01-02T15:04:05" (タイムゾーンなし)
+//   - guregu/dynamo の経路: "2006-01-02T15:04:05+09:00"
+//
+// RFC3339 は TIMESTAMP_LAYOUT の形式も読める
+var legacyLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+}
+
+// タイムゾーンの無い古い形式は、書き込んだ raw SDK の経路が time.Now() の現地時刻で作っていた
+// 動かしていたのは ap-northeast-1 なので、指定がなければ日本時間として読む
+// guregu/dynamo の経路の +09:00 と同じ時刻になり、並び順が揃う
+const DEFAULT_LEGACY_ZONE = "Asia/Tokyo"
+
+// 日本には夏時間が無いので、tzdata が無い環境でも読めるように固定のオフセットにする
+var defaultLegacyLocation = time.FixedZone(DEFAULT_LEGACY_ZONE, 9*60*60)
+
+// DEFAULT_LEGACY_ZONE を返す。WithLegacyLocation に渡す値の既定値
+func DefaultLegacyLocation() *time.Location {
+	return defaultLegacyLocation
+}
+
+// 書き込むときは TIMESTAMP_LAYOUT の形式にし、読み込むときは古い形式も読む時刻
+// Unmarshal はタイムゾーンの無い古い形式を DEFAULT_LEGACY_ZONE として読む
+type Timestamp struct {
+	time.Time
+}
+
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{t.UTC().Truncate(time.Second)}
+}
+
+// タイムゾーンの無い古い形式は DEFAULT_LEGACY_ZONE として読む
+func ParseTimestamp(s string) (Timestamp, error) {
+	return ParseTimestampIn(s, defaultLegacyLocation)
+}
+
+// タイムゾーンの無い古い形式を legacy のタイムゾーンとして読む
+func ParseTimestampIn(s string, legacy *time.Location) (Timestamp, error) {
+	for _, layout := range legacyLayouts {
+		t, err := time.ParseInLocation(layout, s, legacy)
+		if err == nil {
+			return NewTimestamp(t), nil
+		}
+	}
+	return Timestamp{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// 古い形式の時刻を TIMESTAMP_LAYOUT の形式にする
+// 時刻として読めない値 (空文字列など) はそのまま返す
+func CanonicalTimestamp(s string) string {
+	return CanonicalTimestampIn(s, defaultLegacyLocation)
+}
+
+// タイムゾーンの無い古い形式を legacy のタイムゾーンとして読む CanonicalTimestamp
+func CanonicalTimestampIn(s string, legacy *time.Location) string {
+	t, err := ParseTimestampIn(s, legacy)
+	if err != nil {
+		return s
+	}
+	return t.String()
+}
+
+func (t Timestamp) String() string {
+	return t.UTC().Format(TIMESTAMP_LAYOUT)
+}
+
+func (t Timestamp) MarshalDynamo() (*dynamodb.AttributeValue, error) {
+	return &dynamodb.AttributeValue{S: aws.String(t.String())}, nil
+}
+
+func (t *Timestamp) UnmarshalDynamo(av *dynamodb.AttributeValue) error {
+	parsed, err := ParseTimestamp(aws.StringValue(av.S))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	s := ""
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
@@ -0,0 +1,71 @@
+package quickphotos
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestCanonicalTimestamp(t *testing.T) {
+	for in, want := range map[string]string{
+		"2019-03-02T09:11:30Z":      "2019-03-02T09:11:30Z",
+		"2019-03-02T18:11:30+09:00": "2019-03-02T09:11:30Z",
+		// タイムゾーンの無い形式は DEFAULT_LEGACY_ZONE (日本時間) として読む
+		"2019-03-02T18:11:30": "2019-03-02T09:11:30Z",
+		"":                    "",
+		"not a time":          "not a time",
+	} {
+		if got := CanonicalTimestamp(in); got != want {
+			t.Errorf("CanonicalTimestamp(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := CanonicalTimestampIn("2019-03-02T09:11:30", time.UTC); got != "2019-03-02T09:11:30Z" {
+		t.Errorf("CanonicalTimestampIn(UTC) = %q", got)
+	}
+}
+
+func TestModelsReadLegacyTimestamps(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"username":  {S: aws.String("a")},
+		"timestamp": {S: aws.String("2019-03-02T18:11:30+09:00")},
+	}
+	want := "2019-03-02T09:11:30Z"
+	if got := newPhoto(item, time.UTC).Timestamp; got != want {
+		t.Errorf("photo timestamp = %q, want %q", got, want)
+	}
+	if got := newReaction(item, time.UTC).Timestamp; got != want {
+		t.Errorf("reaction timestamp = %q, want %q", got, want)
+	}
+	if got := newFriendship(item, time.UTC).Timestamp; got != want {
+		t.Errorf("friendship timestamp = %q, want %q", got, want)
+	}
+}
+
+// 同じ時刻を raw SDK の経路 (タイムゾーンなし) と guregu/dynamo の経路 (+09:00) で書き込んでも、同じ時刻として読む
+func TestStoreReadsNaiveTimestampsInLegacyLocation(t *testing.T) {
+	api := newLocalAPI(t, `{"PK":"USER#a","SK":"#METADATA#a","username":"a"}
+{"PK":"USER#a","SK":"PHOTO#a#2019-03-02T18:11:30","username":"a","timestamp":"2019-03-02T18:11:30"}
+{"PK":"USER#a","SK":"PHOTO#a#2019-03-02T18:11:31+09:00","username":"a","timestamp":"2019-03-02T18:11:31+09:00"}
+`)
+	for _, tc := range []struct {
+		store *Store
+		want  string
+	}{
+		{New(api, DEFAULT_TABLE), "2019-03-02T09:11:30Z"},
+		{New(api, DEFAULT_TABLE, WithLegacyLocation(time.UTC)), "2019-03-02T18:11:30Z"},
+	} {
+		photos, _, err := tc.store.ListPhotos("a", 10, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]bool{}
+		for _, p := range photos {
+			got[p.Timestamp] = true
+		}
+		if len(photos) != 2 || !got[tc.want] || !got["2019-03-02T09:11:31Z"] {
+			t.Errorf("timestamps = %v, want %s and 2019-03-02T09:11:31Z", got, tc.want)
+		}
+	}
+}
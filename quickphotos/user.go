@@ -0,0 +1,70 @@
+package quickphotos
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func (s *Store) GetUser(username string) (*User, error) {
+	s = s.metered("GetUser")
+	resp, err := s.api.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key:       metadataKey(username),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item == nil {
+		return nil, ErrUserNotFound
+	}
+	user := newUser(resp.Item)
+	return &user, nil
+}
+
+// ユーザーと写真は同じパーティションにあるので、1 回の Query でまとめて取得できる
+// "#METADATA#<user>" から "PHOTO$" までの範囲に、メタデータと写真だけが入る
+// シャード付きカウンターの写真があれば、シャードを BatchGetItem でまとめて取得して足す
+func (s *Store) GetUserWithPhotos(username string) (*User, error) {
+	s = s.metered("GetUserWithPhotos")
+	items, _, err := s.queryPattern(PatternUserWithPhotos, map[string]string{"username": username}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 || !strings.HasPrefix(stringValue(items[0], "SK"), "#METADATA#") {
+		return nil, ErrUserNotFound
+	}
+	user := newUser(items[0])
+	user.Photos = make([]Photo, 0, len(items)-1)
+	for _, item := range items[1:] {
+		user.Photos = append(user.Photos, newPhoto(item, s.legacy))
+	}
+	if err := s.addShardTotals(user.Photos, items[1:], false); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// 写真は新しいものから返す。シャードの合計はページごとに 1 回の BatchGetItem で足す
+// 写真が 1 枚もないときは、ユーザーがいないのかどうかを確かめる
+func (s *Store) ListPhotos(username string, limit int, cursor string) ([]Photo, string, error) {
+	s = s.metered("ListPhotos")
+	items, next, err := s.queryPattern(PatternPhotosByUser, map[string]string{"username": username}, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) == 0 && cursor == "" {
+		if _, err := s.GetUser(username); err != nil {
+			return nil, "", err
+		}
+	}
+	photos := make([]Photo, 0, len(items))
+	for _, item := range items {
+		photos = append(photos, newPhoto(item, s.legacy))
+	}
+	if err := s.addShardTotals(photos, items, false); err != nil {
+		return nil, "", err
+	}
+	return photos, next, nil
+}
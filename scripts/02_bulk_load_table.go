@@ -6,42 +6,18 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"os"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
 )
 
-type QuickPhoto struct {
-	PK            string   `dynamo:"PK,hash" json:"PK"`
-	SK            string   `dynamo:",range" json:"SK"`
-	Address       string   `dynamo:"address" json:"address"`
-	Birthdate     string   `dynamo:"birthdate" json:"birthdate"`
-	Email         string   `dynamo:"email" json:"email"`
-	Name          string   `dynamo:"name" json:"name"`
-	Username      string   `dynamo:"username" json:"username"`
-	Status        string   `dynamo:"status" json:"status"`
-	Interests     []string `dynamo:"interests" json:"interests"`
-	Followers     int      `dynamo:"followers" json:"followers"`
-	Following     int      `dynamo:"following" json:"following"`
-	PinnedImage   string   `dynamo:"pinnedImage" json:"pinnedImage"`
-	Timestamp     string   `dynamo:"timestamp" json:"timestamp"`
-	FollowedUser  string   `dynamo:"followedUser" json:"followedUser"`
-	FollowingUser string   `dynamo:"followingUser" json:"followingUser"`
-	Location      string   `dynamo:"location" json:"location"`
-	Reactions     struct {
-		PlusOne    int `dynamo:"+1" json:"+1"`
-		Smiley     int `dynamo:"smiley" json:"smiley"`
-		Sunglasses int `dynamo:"sunglasses" json:"sunglasses"`
-		Heart      int `dynamo:"heart" json:"heart"`
-	} `dynamo:"reactions" json:"reactions"`
-	ReactingUser string `dynamo:"reactingUser" json:"reactingUser"`
-	Photo        string `dynamo:"photo" json:"photo"`
-	ReactionType string `dynamo:"reactionType" json:"reactionType"`
-}
+const maxLineBufferSize = 1024 * 1024
 
 func main() {
 	sess := session.Must(session.NewSession())
@@ -52,23 +28,46 @@ func main() {
 			// LogLevel: aws.LogLevel(aws.LogDebug),
 		},
 	)
-	t := db.Table("quick-photos")
+	client := db.Client()
 
-	f, err := os.Open("./scripts/items.json")
+	// 引数でファイルを渡すと、09_export_table.go の出力 (型つきの JSON) も読み込める
+	path := "./scripts/items.json"
+	if len(os.Args) > 1 {
+		path = os.Args[1]
+	}
+	f, err := os.Open(path)
 	if err != nil {
 		fmt.Print("Open file error:")
 		panic(err)
 	}
 	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBufferSize)
+	n := 0
 	for scanner.Scan() {
-		v := QuickPhoto{}
-		json.Unmarshal(scanner.Bytes(), &v)
-		err = t.Put(v).Run()
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		// 構造体や interface{} を通さずにアイテムへ変換し、そのまま書き込む
+		// これで 09_export_table.go の出力を読み込み直したときに、元のテーブルと同じ内容になる
+		item, err := quickphotos.DecodeItem(scanner.Bytes())
+		if err != nil {
+			fmt.Printf("Decode error at line %d:", n)
+			panic(err)
+		}
+		_, err = client.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String("quick-photos"),
+			Item:      item,
+		})
 		if err != nil {
 			fmt.Print("Put item error:")
 			panic(err)
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		fmt.Print("Read file error:")
+		panic(err)
+	}
 
 	fmt.Println("Successful bulk load items")
 }
@@ -0,0 +1,67 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+)
+
+// quickphotos の Migrations にも 5 番 (backfill_interest_index) として同じ処理があり、quickphotos migrate up で適用できる
+
+type QuickPhoto struct {
+	PK        string   `dynamo:"PK,hash"`
+	SK        string   `dynamo:",range"`
+	Username  string   `dynamo:"username"`
+	Interests []string `dynamo:"interests"`
+}
+
+type InterestItem struct {
+	PK       string `dynamo:"PK,hash"`
+	SK       string `dynamo:",range"`
+	Username string `dynamo:"username"`
+	Interest string `dynamo:"interest"`
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table("quick-photos")
+
+	users := make([]QuickPhoto, 0)
+	err := t.Scan().
+		Filter("begins_with(SK, ?)", "#METADATA#").
+		All(&users)
+	if err != nil {
+		fmt.Print("Scan error:")
+		panic(err)
+	}
+
+	items := make([]interface{}, 0)
+	for _, u := range users {
+		for _, interest := range u.Interests {
+			items = append(items, InterestItem{
+				PK:       fmt.Sprintf("INTEREST#%s", interest),
+				SK:       fmt.Sprintf("USER#%s", u.Username),
+				Username: u.Username,
+				Interest: interest,
+			})
+		}
+	}
+
+	wrote, err := t.Batch().Write().Put(items...).Run()
+	if err != nil {
+		fmt.Print("Batch write error:")
+		panic(err)
+	}
+
+	fmt.Println(fmt.Sprintf("Backfilled %d interest items for %d users", wrote, len(users)))
+}
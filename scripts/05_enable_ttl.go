@@ -0,0 +1,31 @@
+//go:build ignore
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+)
+
+func main() {
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+
+	// expiresAt (UNIX 秒) を過ぎたアイテムは DynamoDB が非同期に削除する
+	t := db.Table("quick-photos")
+	err := t.UpdateTTL("expiresAt", true).Run()
+	if err != nil {
+		fmt.Print("Could not enable TTL. Err:")
+		panic(err)
+	}
+
+	fmt.Println("TTL enabled successfully.")
+}
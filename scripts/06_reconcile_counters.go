@@ -0,0 +1,217 @@
+//go:build ignore
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+var reactionTypes = []string{"+1", "smiley", "sunglasses", "heart"}
+
+type QuickPhoto struct {
+	PK            string         `dynamo:"PK,hash"`
+	SK            string         `dynamo:",range"`
+	Username      string         `dynamo:"username"`
+	Followers     int            `dynamo:"followers"`
+	Following     int            `dynamo:"following"`
+	Followed      *int           `dynamo:"followed"`
+	FollowedUser  string         `dynamo:"followedUser"`
+	FollowingUser string         `dynamo:"followingUser"`
+	Reactions     map[string]int `dynamo:"reactions"`
+	ReactionType  string         `dynamo:"reactionType"`
+}
+
+type Drift struct {
+	PK       string
+	SK       string
+	Field    string
+	Stored   int
+	Expected int
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("Drift<%s -- %s -- %s: stored %d, expected %d>", d.PK, d.SK, d.Field, d.Stored, d.Expected)
+}
+
+func reconcile(items []QuickPhoto) ([]Drift, []QuickPhoto) {
+	followers, following, reactions := expectedCounts(items)
+	sharded := shardTotals(items)
+	users := make([]QuickPhoto, 0)
+	photos := make([]QuickPhoto, 0)
+	for _, item := range items {
+		switch {
+		case strings.HasPrefix(item.PK, "USER#") && strings.HasPrefix(item.SK, "#METADATA#"):
+			users = append(users, item)
+		case strings.HasPrefix(item.PK, "USER#") && strings.HasPrefix(item.SK, "PHOTO#"):
+			photos = append(photos, item)
+		}
+	}
+
+	drifts := make([]Drift, 0)
+	drifted := make([]QuickPhoto, 0)
+	for _, u := range users {
+		ds := make([]Drift, 0)
+		if u.Followers != followers[u.Username] {
+			ds = append(ds, Drift{u.PK, u.SK, "followers", u.Followers, followers[u.Username]})
+		}
+		if u.Following != following[u.Username] {
+			ds = append(ds, Drift{u.PK, u.SK, "following", u.Following, following[u.Username]})
+		}
+		// guregu/dynamo のフォロー処理が書き込んでいた、存在しないはずの属性
+		if u.Followed != nil {
+			ds = append(ds, Drift{u.PK, u.SK, "followed", *u.Followed, 0})
+		}
+		if len(ds) > 0 {
+			drifts = append(drifts, ds...)
+			drifted = append(drifted, u)
+		}
+	}
+	for _, p := range photos {
+		ds := make([]Drift, 0)
+		for _, t := range reactionTypes {
+			if p.Reactions[t]+sharded[p.SK][t] != reactions[p.SK][t] {
+				ds = append(ds, Drift{p.PK, p.SK, fmt.Sprintf("reactions.%s", t), p.Reactions[t] + sharded[p.SK][t], reactions[p.SK][t]})
+			}
+		}
+		if len(ds) > 0 {
+			drifts = append(drifts, ds...)
+			drifted = append(drifted, p)
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].PK != drifts[j].PK {
+			return drifts[i].PK < drifts[j].PK
+		}
+		if drifts[i].SK != drifts[j].SK {
+			return drifts[i].SK < drifts[j].SK
+		}
+		return drifts[i].Field < drifts[j].Field
+	})
+	return drifts, drifted
+}
+
+func expectedCounts(items []QuickPhoto) (map[string]int, map[string]int, map[string]map[string]int) {
+	followers := make(map[string]int)
+	following := make(map[string]int)
+	reactions := make(map[string]map[string]int)
+	for _, item := range items {
+		switch {
+		case strings.HasPrefix(item.PK, "USER#") && strings.HasPrefix(item.SK, "#FRIEND#"):
+			followers[item.FollowedUser]++
+			following[item.FollowingUser]++
+		case strings.HasPrefix(item.PK, "REACTION#"):
+			if reactions[item.SK] == nil {
+				reactions[item.SK] = make(map[string]int)
+			}
+			reactions[item.SK][item.ReactionType]++
+		}
+	}
+	return followers, following, reactions
+}
+
+// シャード付きカウンターの写真は、写真の reactions とシャードの合計がリアクション数になる
+func shardTotals(items []QuickPhoto) map[string]map[string]int {
+	totals := make(map[string]map[string]int)
+	for _, item := range items {
+		if !strings.HasPrefix(item.PK, "REACTIONSHARD#") {
+			continue
+		}
+		if totals[item.SK] == nil {
+			totals[item.SK] = make(map[string]int)
+		}
+		for t, n := range item.Reactions {
+			totals[item.SK][t] += n
+		}
+	}
+	return totals
+}
+
+// 読み込んだ値から変わっていない場合だけ上書きする
+// スキャン中に別のリクエストでカウンターが動いていれば条件チェックで失敗するので、もう一度実行すればよい
+func fix(t dynamo.Table, items []QuickPhoto, drifted []QuickPhoto) error {
+	followers, following, reactions := expectedCounts(items)
+	sharded := shardTotals(items)
+	for _, item := range drifted {
+		var err error
+		if strings.HasPrefix(item.SK, "#METADATA#") {
+			u := t.Update("PK", item.PK).
+				Range("SK", item.SK).
+				Set("followers", followers[item.Username]).
+				Set("following", following[item.Username]).
+				Remove("followed").
+				If("attribute_not_exists(followers) OR followers = ?", item.Followers).
+				If("attribute_not_exists(following) OR following = ?", item.Following)
+			err = u.Run()
+		} else {
+			counts := make(map[string]int)
+			for _, rt := range reactionTypes {
+				counts[rt] = reactions[item.SK][rt] - sharded[item.SK][rt]
+			}
+			u := t.Update("PK", item.PK).
+				Range("SK", item.SK).
+				Set("reactions", counts)
+			for _, rt := range reactionTypes {
+				u = u.If("attribute_not_exists(reactions.$) OR reactions.$ = ?", rt, rt, item.Reactions[rt])
+			}
+			err = u.Run()
+		}
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				fmt.Println(fmt.Sprintf("Skipped %s %s: changed during reconciliation", item.PK, item.SK))
+				continue
+			}
+			return err
+		}
+		fmt.Println(fmt.Sprintf("Fixed %s %s", item.PK, item.SK))
+	}
+	return nil
+}
+
+func main() {
+	table := flag.String("table", "quick-photos", "table name")
+	doFix := flag.Bool("fix", false, "repair drifted counters with conditional updates")
+	flag.Parse()
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(*table)
+
+	items := make([]QuickPhoto, 0)
+	err := t.Scan().Consistent(true).All(&items)
+	if err != nil {
+		fmt.Print("Scan error:")
+		panic(err)
+	}
+
+	drifts, drifted := reconcile(items)
+	for _, d := range drifts {
+		fmt.Println(d)
+	}
+	fmt.Println(fmt.Sprintf("%d drifted counters on %d items", len(drifts), len(drifted)))
+	if len(drifts) == 0 {
+		return
+	}
+	if !*doFix {
+		os.Exit(1)
+	}
+	if err := fix(t, items, drifted); err != nil {
+		fmt.Print("Fix error:")
+		panic(err)
+	}
+}
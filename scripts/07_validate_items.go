@@ -0,0 +1,357 @@
+//go:build ignore
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+var (
+	userPattern       = regexp.MustCompile(`^USER#([^#]+)$`)
+	metadataPattern   = regexp.MustCompile(`^#METADATA#([^#]+)$`)
+	photoPattern      = regexp.MustCompile(`^PHOTO#([^#]+)#([^#]+)$`)
+	friendPattern     = regexp.MustCompile(`^#FRIEND#([^#]+)$`)
+	reactionPattern   = regexp.MustCompile(`^REACTION#([^#]+)#([^#]+)$`)
+	shardPattern      = regexp.MustCompile(`^REACTIONSHARD#([^#]+)#([^#]+)#\d+$`)
+	followReqPattern  = regexp.MustCompile(`^#FOLLOWREQUEST#([^#]+)$`)
+	blockPattern      = regexp.MustCompile(`^#BLOCK#([^#]+)$`)
+	inboxPattern      = regexp.MustCompile(`^INBOX#([^#]+)$`)
+	interestPattern   = regexp.MustCompile(`^INTEREST#([^#]+)$`)
+	tagPattern        = regexp.MustCompile(`^TAG#([^#]+)$`)
+	tagSKPattern      = regexp.MustCompile(`^TIMESTAMP#([^#]+)#([^#]+)$`)
+	timestampLayouts  = []string{"2006-01-02T15:04:05", time.RFC3339}
+	reactionTypes     = map[string]bool{"+1": true, "smiley": true, "sunglasses": true, "heart": true}
+	birthdateLayout   = "2006-01-02"
+	defaultItemsPath  = "./scripts/items.json"
+	maxLineBufferSize = 1024 * 1024
+)
+
+type QuickPhoto struct {
+	PK            string          `json:"PK"`
+	SK            string          `json:"SK"`
+	Username      string          `json:"username"`
+	Birthdate     string          `json:"birthdate"`
+	PinnedImage   string          `json:"pinnedImage"`
+	Timestamp     string          `json:"timestamp"`
+	FollowedUser  string          `json:"followedUser"`
+	FollowingUser string          `json:"followingUser"`
+	ReactingUser  string          `json:"reactingUser"`
+	Photo         string          `json:"photo"`
+	ReactionType  string          `json:"reactionType"`
+	Interests     json.RawMessage `json:"interests"`
+}
+
+type Problem struct {
+	Line    int
+	Message string
+}
+
+type line struct {
+	number int
+	item   QuickPhoto
+}
+
+func validTimestamp(ts string) bool {
+	for _, layout := range timestampLayouts {
+		if _, err := time.Parse(layout, ts); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 1 行ずつ形式を確認し、参照の確認に使うアイテムを返す
+func validateLine(n int, item QuickPhoto) []Problem {
+	problems := make([]Problem, 0)
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{n, fmt.Sprintf(format, args...)})
+	}
+
+	if item.PK == "" || item.SK == "" {
+		report("missing PK or SK")
+		return problems
+	}
+
+	// エンティティの種類はアプリケーションと同じ quickphotos.EntityOf で判断し、種類ごとにキーの中身を確かめる
+	switch quickphotos.EntityOf(item.PK, item.SK) {
+	case quickphotos.ENTITY_REACTION:
+		m := reactionPattern.FindStringSubmatch(item.PK)
+		if m == nil {
+			report("reaction PK %q is not a REACTION#<user>#<type> key", item.PK)
+			return problems
+		}
+		if !photoPattern.MatchString(item.SK) {
+			report("reaction SK %q is not a PHOTO#<user>#<timestamp> key", item.SK)
+		}
+		if item.ReactingUser != m[1] {
+			report("reactingUser %q does not match PK %q", item.ReactingUser, item.PK)
+		}
+		if item.ReactionType != m[2] {
+			report("reactionType %q does not match PK %q", item.ReactionType, item.PK)
+		}
+		if !reactionTypes[m[2]] {
+			report("unknown reaction type %q", m[2])
+		}
+		if item.Photo != item.SK {
+			report("photo %q does not match SK %q", item.Photo, item.SK)
+		}
+		if !validTimestamp(item.Timestamp) {
+			report("invalid timestamp %q", item.Timestamp)
+		}
+		return problems
+
+	case quickphotos.ENTITY_REACTION_SHARD:
+		m := shardPattern.FindStringSubmatch(item.PK)
+		if m == nil {
+			report("reaction shard PK %q is not a REACTIONSHARD#<user>#<timestamp>#<n> key", item.PK)
+			return problems
+		}
+		if item.SK != fmt.Sprintf("PHOTO#%s#%s", m[1], m[2]) {
+			report("reaction shard SK %q does not match PK %q", item.SK, item.PK)
+		}
+		if item.Photo != item.SK {
+			report("photo %q does not match SK %q", item.Photo, item.SK)
+		}
+		return problems
+
+	case quickphotos.ENTITY_NOTIFICATION:
+		if !inboxPattern.MatchString(item.PK) {
+			report("notification PK %q is not an INBOX#<user> key", item.PK)
+		}
+		if item.SK != "#READ" && !strings.HasPrefix(item.SK, "NOTIFICATION#") {
+			report("unknown SK format %q for PK %q", item.SK, item.PK)
+		}
+		return problems
+
+	case quickphotos.ENTITY_INTEREST:
+		if !interestPattern.MatchString(item.PK) {
+			report("interest PK %q is not an INTEREST#<interest> key", item.PK)
+		}
+		um := userPattern.FindStringSubmatch(item.SK)
+		if um == nil {
+			report("interest SK %q is not a USER#<username> key", item.SK)
+		} else if item.Username != um[1] {
+			report("username %q does not match SK %q", item.Username, item.SK)
+		}
+		return problems
+
+	case quickphotos.ENTITY_TAG:
+		if !tagPattern.MatchString(item.PK) {
+			report("tag PK %q is not a TAG#<tag> key", item.PK)
+		}
+		tm := tagSKPattern.FindStringSubmatch(item.SK)
+		if tm == nil {
+			report("tag SK %q is not a TIMESTAMP#<timestamp>#<user> key", item.SK)
+		} else if !validTimestamp(tm[1]) {
+			report("invalid timestamp %q in SK", tm[1])
+		}
+		return problems
+
+	case quickphotos.ENTITY_MIGRATION:
+		if item.SK != quickphotos.MIGRATION_STATE_SK && item.SK != quickphotos.MIGRATION_LOCK_SK {
+			report("unknown SK format %q for PK %q", item.SK, item.PK)
+		}
+		return problems
+
+	case quickphotos.ENTITY_UNKNOWN:
+		report("unknown key format %q / %q", item.PK, item.SK)
+		return problems
+	}
+
+	// ここから先はユーザーのパーティションに置くエンティティ
+	m := userPattern.FindStringSubmatch(item.PK)
+	if m == nil {
+		report("unknown PK format %q", item.PK)
+		return problems
+	}
+	username := m[1]
+
+	switch quickphotos.EntityOf(item.PK, item.SK) {
+	case quickphotos.ENTITY_USER:
+		if metadataPattern.FindStringSubmatch(item.SK) == nil || metadataPattern.FindStringSubmatch(item.SK)[1] != username {
+			report("metadata SK %q does not match PK %q", item.SK, item.PK)
+		}
+		if item.Username != username {
+			report("username %q does not match PK %q", item.Username, item.PK)
+		}
+		if item.Birthdate != "" {
+			if _, err := time.Parse(birthdateLayout, item.Birthdate); err != nil {
+				report("invalid birthdate %q", item.Birthdate)
+			}
+		}
+		if len(item.Interests) > 0 {
+			interests := make([]string, 0)
+			if err := json.Unmarshal(item.Interests, &interests); err != nil {
+				report("interests must be a list of strings")
+			}
+		}
+		if item.PinnedImage != "" {
+			pm := photoPattern.FindStringSubmatch(item.PinnedImage)
+			if pm == nil {
+				report("pinnedImage %q is not a PHOTO#<user>#<timestamp> key", item.PinnedImage)
+			} else if pm[1] != username {
+				report("pinnedImage %q belongs to another user", item.PinnedImage)
+			}
+		}
+	case quickphotos.ENTITY_PHOTO:
+		pm := photoPattern.FindStringSubmatch(item.SK)
+		if pm == nil {
+			report("photo SK %q is not a PHOTO#<user>#<timestamp> key", item.SK)
+			return problems
+		}
+		if pm[1] != username {
+			report("photo SK %q does not match PK %q", item.SK, item.PK)
+		}
+		if item.Username != username {
+			report("photo username %q does not match PK %q", item.Username, item.PK)
+		}
+		if !validTimestamp(pm[2]) {
+			report("invalid timestamp %q in SK", pm[2])
+		}
+		if item.Timestamp != pm[2] {
+			report("timestamp %q does not match SK %q", item.Timestamp, item.SK)
+		}
+	case quickphotos.ENTITY_FRIENDSHIP:
+		fm := friendPattern.FindStringSubmatch(item.SK)
+		if fm == nil {
+			report("friend SK %q is not a #FRIEND#<user> key", item.SK)
+			return problems
+		}
+		following := fm[1]
+		if following == username {
+			report("user %q follows themselves", username)
+		}
+		if item.FollowedUser != username {
+			report("followedUser %q does not match PK %q", item.FollowedUser, item.PK)
+		}
+		if item.FollowingUser != following {
+			report("followingUser %q does not match SK %q", item.FollowingUser, item.SK)
+		}
+		if !validTimestamp(item.Timestamp) {
+			report("invalid timestamp %q", item.Timestamp)
+		}
+	case quickphotos.ENTITY_FOLLOW_REQUEST:
+		rm := followReqPattern.FindStringSubmatch(item.SK)
+		if rm == nil {
+			report("follow request SK %q is not a #FOLLOWREQUEST#<user> key", item.SK)
+		} else if rm[1] == username {
+			report("user %q requests to follow themselves", username)
+		}
+	case quickphotos.ENTITY_BLOCK:
+		bm := blockPattern.FindStringSubmatch(item.SK)
+		if bm == nil {
+			report("block SK %q is not a #BLOCK#<user> key", item.SK)
+		} else if bm[1] == username {
+			report("user %q blocks themselves", username)
+		}
+	}
+	return problems
+}
+
+func validate(path string) ([]Problem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	problems := make([]Problem, 0)
+	lines := make([]line, 0)
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBufferSize)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		item := QuickPhoto{}
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			problems = append(problems, Problem{n, fmt.Sprintf("invalid JSON: %s", err)})
+			continue
+		}
+		key := fmt.Sprintf("%s | %s", item.PK, item.SK)
+		if first, ok := seen[key]; ok {
+			problems = append(problems, Problem{n, fmt.Sprintf("duplicate key %s (first seen on line %d)", key, first)})
+			continue
+		}
+		seen[key] = n
+		problems = append(problems, validateLine(n, item)...)
+		lines = append(lines, line{n, item})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// 参照先はファイル全体を読んでから確認する
+	photos := make(map[string]bool)
+	users := make(map[string]bool)
+	for _, l := range lines {
+		if strings.HasPrefix(l.item.PK, "USER#") && strings.HasPrefix(l.item.SK, "PHOTO#") {
+			photos[l.item.SK] = true
+		}
+		if strings.HasPrefix(l.item.SK, "#METADATA#") {
+			users[l.item.Username] = true
+		}
+	}
+	for _, l := range lines {
+		item := l.item
+		switch {
+		case strings.HasPrefix(item.PK, "REACTION#"), strings.HasPrefix(item.PK, "REACTIONSHARD#"):
+			if item.Photo != "" && !photos[item.Photo] {
+				problems = append(problems, Problem{l.number, fmt.Sprintf("photo %q does not exist", item.Photo)})
+			}
+		case strings.HasPrefix(item.SK, "#METADATA#"):
+			if item.PinnedImage != "" && !photos[item.PinnedImage] {
+				problems = append(problems, Problem{l.number, fmt.Sprintf("pinnedImage %q does not exist", item.PinnedImage)})
+			}
+		case strings.HasPrefix(item.SK, "#FRIEND#"):
+			if !users[item.FollowingUser] {
+				problems = append(problems, Problem{l.number, fmt.Sprintf("following user %q does not exist", item.FollowingUser)})
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+	return problems, nil
+}
+
+func main() {
+	flag.Parse()
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{defaultItemsPath}
+	}
+
+	failed := false
+	for _, path := range paths {
+		problems, err := validate(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		for _, p := range problems {
+			fmt.Println(fmt.Sprintf("%s:%d: %s", path, p.Line, p.Message))
+		}
+		if len(problems) > 0 {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("All items are valid.")
+}
@@ -0,0 +1,340 @@
+//go:build ignore
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+var (
+	reactionTypes = []string{"+1", "smiley", "sunglasses", "heart"}
+	words         = []string{
+		"green", "third", "billion", "offer", "near", "allow", "step", "north", "travel", "music",
+		"coffee", "sunset", "beach", "mountain", "city", "food", "art", "books", "running", "cats",
+	}
+	startTime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	endTime   = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// items.json と同じ順番でキーを出力するため、エンティティごとに構造体を分ける
+type UserItem struct {
+	PK          string   `json:"PK"`
+	SK          string   `json:"SK"`
+	Address     string   `json:"address"`
+	Birthdate   string   `json:"birthdate"`
+	Email       string   `json:"email"`
+	Name        string   `json:"name"`
+	Username    string   `json:"username"`
+	Status      string   `json:"status"`
+	Interests   []string `json:"interests"`
+	Followers   int      `json:"followers"`
+	Following   int      `json:"following"`
+	PinnedImage string   `json:"pinnedImage,omitempty"`
+}
+
+type PhotoItem struct {
+	PK        string         `json:"PK"`
+	SK        string         `json:"SK"`
+	Username  string         `json:"username"`
+	Timestamp string         `json:"timestamp"`
+	Location  string         `json:"location"`
+	Reactions map[string]int `json:"reactions"`
+}
+
+type FriendItem struct {
+	PK            string `json:"PK"`
+	SK            string `json:"SK"`
+	FollowedUser  string `json:"followedUser"`
+	FollowingUser string `json:"followingUser"`
+	Timestamp     string `json:"timestamp"`
+}
+
+type ReactionItem struct {
+	PK           string `json:"PK"`
+	SK           string `json:"SK"`
+	ReactingUser string `json:"reactingUser"`
+	Photo        string `json:"photo"`
+	ReactionType string `json:"reactionType"`
+	Timestamp    string `json:"timestamp"`
+}
+
+type Config struct {
+	Users             int
+	ZipfS             float64
+	PhotosPerUser     float64
+	ReactionsPerPhoto float64
+	ReactionMix       []float64
+}
+
+func parseMix(s string) ([]float64, error) {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid reaction mix %q", part)
+		}
+		w, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight for %q", kv[0])
+		}
+		weights[kv[0]] = w
+	}
+	mix := make([]float64, len(reactionTypes))
+	total := 0.0
+	for i, t := range reactionTypes {
+		mix[i] = weights[t]
+		total += mix[i]
+		delete(weights, t)
+	}
+	for t := range weights {
+		return nil, fmt.Errorf("unknown reaction type %q", t)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("reaction mix must have a positive weight")
+	}
+	return mix, nil
+}
+
+type generator struct {
+	r   *rand.Rand
+	cfg Config
+}
+
+func (g *generator) timestamp(after time.Time) time.Time {
+	span := endTime.Sub(after)
+	if span <= 0 {
+		return after
+	}
+	return after.Add(time.Duration(g.r.Int63n(int64(span))))
+}
+
+// 平均 mean の指数分布から非負の整数を引く
+func (g *generator) count(mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+	return int(math.Round(g.r.ExpFloat64() * mean))
+}
+
+func (g *generator) reactionType() string {
+	total := 0.0
+	for _, w := range g.cfg.ReactionMix {
+		total += w
+	}
+	x := g.r.Float64() * total
+	for i, w := range g.cfg.ReactionMix {
+		if x < w {
+			return reactionTypes[i]
+		}
+		x -= w
+	}
+	return reactionTypes[len(reactionTypes)-1]
+}
+
+// 他のユーザーから重複なく n 人選ぶ
+func (g *generator) pick(n int, exclude int, total int) []int {
+	if n > total-1 {
+		n = total - 1
+	}
+	picked := make(map[int]bool)
+	out := make([]int, 0, n)
+	for len(out) < n {
+		i := g.r.Intn(total)
+		if i == exclude || picked[i] {
+			continue
+		}
+		picked[i] = true
+		out = append(out, i)
+	}
+	sort.Ints(out)
+	return out
+}
+
+func (g *generator) generate(w *bufio.Writer) error {
+	n := g.cfg.Users
+	usernames := make([]string, n)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user%05d", i)
+	}
+
+	// フォロワー数はべき乗則に従わせる。人気ユーザーがどこに来るかはシャッフルで決める
+	zipf := rand.NewZipf(g.r, g.cfg.ZipfS, 1, uint64(max(n-1, 0)))
+	order := g.r.Perm(n)
+	followersOf := make([][]int, n)
+	followingCount := make([]int, n)
+	for _, i := range order {
+		followersOf[i] = g.pick(int(zipf.Uint64()), i, n)
+		for _, f := range followersOf[i] {
+			followingCount[f]++
+		}
+	}
+
+	photosOf := make([][]PhotoItem, n)
+	reactions := make([]ReactionItem, 0)
+	for i, u := range usernames {
+		count := g.count(g.cfg.PhotosPerUser)
+		seen := make(map[string]bool)
+		for len(photosOf[i]) < count {
+			ts := g.timestamp(startTime).Format(quickphotos.TIMESTAMP_LAYOUT)
+			if seen[ts] {
+				continue
+			}
+			seen[ts] = true
+			sk := fmt.Sprintf("PHOTO#%s#%s", u, ts)
+			photo := PhotoItem{
+				PK:        fmt.Sprintf("USER#%s", u),
+				SK:        sk,
+				Username:  u,
+				Timestamp: ts,
+				Location:  fmt.Sprintf("s3://quick-photos/photos/%s/%s.png", u, ts),
+				Reactions: map[string]int{"+1": 0, "smiley": 0, "sunglasses": 0, "heart": 0},
+			}
+
+			// リアクションのキーは (ユーザー, 種類, 写真) で一意なので、重複は引き直さずに捨てる
+			posted, _ := time.Parse(quickphotos.TIMESTAMP_LAYOUT, ts)
+			reacted := make(map[string]bool)
+			for _, r := range g.pick(g.count(g.cfg.ReactionsPerPhoto), i, n) {
+				rt := g.reactionType()
+				pk := fmt.Sprintf("REACTION#%s#%s", usernames[r], rt)
+				if reacted[pk] {
+					continue
+				}
+				reacted[pk] = true
+				photo.Reactions[rt]++
+				reactions = append(reactions, ReactionItem{
+					PK:           pk,
+					SK:           sk,
+					ReactingUser: usernames[r],
+					Photo:        sk,
+					ReactionType: rt,
+					Timestamp:    g.timestamp(posted).Format(quickphotos.TIMESTAMP_LAYOUT),
+				})
+			}
+			photosOf[i] = append(photosOf[i], photo)
+		}
+		sort.Slice(photosOf[i], func(a, b int) bool {
+			return photosOf[i][a].SK < photosOf[i][b].SK
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for i, u := range usernames {
+		interests := make([]string, 0, 3)
+		for _, j := range g.r.Perm(len(words))[:3] {
+			interests = append(interests, words[j])
+		}
+		user := UserItem{
+			PK:        fmt.Sprintf("USER#%s", u),
+			SK:        fmt.Sprintf("#METADATA#%s", u),
+			Address:   fmt.Sprintf("%d Generated Street\nSynthetic City", g.r.Intn(9999)),
+			Birthdate: g.timestamp(time.Date(1920, 1, 1, 0, 0, 0, 0, time.UTC)).Format("2006-01-02"),
+			Email:     fmt.Sprintf("%s@example.com", u),
+			Name:      fmt.Sprintf("User %05d", i),
+			Username:  u,
+			Status:    fmt.Sprintf("Generated user number %d.", i),
+			Interests: interests,
+			Followers: len(followersOf[i]),
+			Following: followingCount[i],
+		}
+		if len(photosOf[i]) > 0 {
+			user.PinnedImage = photosOf[i][g.r.Intn(len(photosOf[i]))].SK
+		}
+		if err := enc.Encode(user); err != nil {
+			return err
+		}
+		for _, p := range photosOf[i] {
+			if err := enc.Encode(p); err != nil {
+				return err
+			}
+		}
+		for _, f := range followersOf[i] {
+			friend := FriendItem{
+				PK:            fmt.Sprintf("USER#%s", u),
+				SK:            fmt.Sprintf("#FRIEND#%s", usernames[f]),
+				FollowedUser:  u,
+				FollowingUser: usernames[f],
+				Timestamp:     g.timestamp(startTime).Format(quickphotos.TIMESTAMP_LAYOUT),
+			}
+			if err := enc.Encode(friend); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range reactions {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	users := flag.Int("users", 20, "number of users")
+	seed := flag.Int64("seed", 0, "random seed (0 uses the current time)")
+	out := flag.String("out", "", "output file (default stdout)")
+	zipfS := flag.Float64("zipf", 1.5, "power-law exponent for follower counts (> 1)")
+	photos := flag.Float64("photos", 5, "mean photos per user")
+	reactionsPerPhoto := flag.Float64("reactions", 3, "mean reactions per photo")
+	mix := flag.String("mix", "+1=1,smiley=1,sunglasses=1,heart=1", "reaction type weights")
+	flag.Parse()
+
+	if *users < 1 {
+		fmt.Fprintln(os.Stderr, "-users must be positive")
+		os.Exit(2)
+	}
+	if *zipfS <= 1 {
+		fmt.Fprintln(os.Stderr, "-zipf must be greater than 1")
+		os.Exit(2)
+	}
+	reactionMix, err := parseMix(*mix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+		fmt.Fprintln(os.Stderr, fmt.Sprintf("seed: %d", *seed))
+	}
+
+	f := os.Stdout
+	if *out != "" {
+		f, err = os.Create(*out)
+		if err != nil {
+			fmt.Print("Create file error:")
+			panic(err)
+		}
+		defer f.Close()
+	}
+
+	w := bufio.NewWriter(f)
+	g := &generator{
+		r: rand.New(rand.NewSource(*seed)),
+		cfg: Config{
+			Users:             *users,
+			ZipfS:             *zipfS,
+			PhotosPerUser:     *photos,
+			ReactionsPerPhoto: *reactionsPerPhoto,
+			ReactionMix:       reactionMix,
+		},
+	}
+	if err := g.generate(w); err != nil {
+		fmt.Print("Generate error:")
+		panic(err)
+	}
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,345 @@
+//go:build ignore
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// セグメントごとの進捗。Offset までがセグメントファイルに書き込み済みで、LastEvaluatedKey の続きから再開する
+// セグメント数とエンティティの種類が変わると、書き込み済みの行と続きのスキャンが合わなくなるので一緒に記録する
+type Checkpoint struct {
+	Segment          int                                 `json:"segment"`
+	TotalSegments    int                                 `json:"totalSegments"`
+	Types            []string                            `json:"types,omitempty"`
+	Offset           int64                               `json:"offset"`
+	LastEvaluatedKey map[string]*dynamodb.AttributeValue `json:"lastEvaluatedKey,omitempty"`
+	Done             bool                                `json:"done"`
+}
+
+type exporter struct {
+	api      dynamodbiface.DynamoDBAPI
+	table    string
+	segments int
+	dir      string
+	types    map[string]bool
+	limiter  <-chan time.Time
+}
+
+// -types の値を quickphotos.EntityOf の種類に変換する。大文字と小文字は区別しない
+func parseTypes(value string) (map[string]bool, error) {
+	known := make(map[string]string, len(quickphotos.EntityTypes))
+	for _, t := range quickphotos.EntityTypes {
+		known[strings.ToLower(t)] = t
+	}
+	types := make(map[string]bool)
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		entity, ok := known[strings.ToLower(t)]
+		if !ok {
+			return nil, fmt.Errorf("unknown entity type %q (one of %s)", t, strings.Join(quickphotos.EntityTypes, ", "))
+		}
+		types[entity] = true
+	}
+	return types, nil
+}
+
+func (e *exporter) typeList() []string {
+	types := make([]string, 0, len(e.types))
+	for t := range e.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (e *exporter) segmentPath(segment int) string {
+	return filepath.Join(e.dir, fmt.Sprintf("segment-%04d.jsonl", segment))
+}
+
+func (e *exporter) checkpointPath(segment int) string {
+	return filepath.Join(e.dir, fmt.Sprintf("segment-%04d.checkpoint.json", segment))
+}
+
+func (e *exporter) loadCheckpoint(segment int) (*Checkpoint, error) {
+	b, err := os.ReadFile(e.checkpointPath(segment))
+	if os.IsNotExist(err) {
+		return &Checkpoint{Segment: segment, TotalSegments: e.segments, Types: e.typeList()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// 一時ファイルに書いてから rename するので、途中で落ちても壊れたチェックポイントは残らない
+func (e *exporter) saveCheckpoint(cp *Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := e.checkpointPath(cp.Segment) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.checkpointPath(cp.Segment))
+}
+
+// 前回と違う -segments や -types で再開すると、行の抜けや重複したエクスポートになるので始める前に止める
+func (e *exporter) checkCheckpoints() error {
+	paths, err := filepath.Glob(filepath.Join(e.dir, "segment-*.checkpoint.json"))
+	if err != nil {
+		return err
+	}
+	types := strings.Join(e.typeList(), ",")
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		cp := &Checkpoint{}
+		if err := json.Unmarshal(b, cp); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if cp.TotalSegments != e.segments || strings.Join(cp.Types, ",") != types {
+			return fmt.Errorf(
+				"%s was written with -segments %d -types %q; run with the same flags or remove %s to start over",
+				path, cp.TotalSegments, strings.Join(cp.Types, ","), e.dir,
+			)
+		}
+	}
+	return nil
+}
+
+func retryable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException,
+		dynamodb.ErrCodeRequestLimitExceeded,
+		"ThrottlingException":
+		return true
+	}
+	return false
+}
+
+func (e *exporter) scanPage(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	var out *dynamodb.ScanOutput
+	err := backoff.Retry(func() error {
+		if e.limiter != nil {
+			<-e.limiter
+		}
+		var err error
+		out, err = e.api.Scan(input)
+		if err != nil && !retryable(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.NewExponentialBackOff())
+	return out, err
+}
+
+func (e *exporter) exportSegment(segment int) (int, error) {
+	cp, err := e.loadCheckpoint(segment)
+	if err != nil {
+		return 0, err
+	}
+	if cp.Done {
+		return 0, nil
+	}
+
+	f, err := os.OpenFile(e.segmentPath(segment), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// チェックポイントより後ろに書かれた行は、再開時にもう一度スキャンされるので捨てる
+	if err := f.Truncate(cp.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	for {
+		input := &dynamodb.ScanInput{
+			TableName:         aws.String(e.table),
+			Segment:           aws.Int64(int64(segment)),
+			TotalSegments:     aws.Int64(int64(e.segments)),
+			ExclusiveStartKey: cp.LastEvaluatedKey,
+			ConsistentRead:    aws.Bool(true),
+		}
+		out, err := e.scanPage(input)
+		if err != nil {
+			return exported, err
+		}
+
+		w := bufio.NewWriter(f)
+		for _, item := range out.Items {
+			if len(e.types) > 0 && !e.types[quickphotos.EntityOf(aws.StringValue(item["PK"].S), aws.StringValue(item["SK"].S))] {
+				continue
+			}
+			// 型つきの JSON で書き出すので、セットや数値の書き方も含めて元のアイテムに戻せる
+			b, err := quickphotos.EncodeItem(item)
+			if err != nil {
+				return exported, err
+			}
+			w.Write(b)
+			if err := w.WriteByte('\n'); err != nil {
+				return exported, err
+			}
+			exported++
+		}
+		if err := w.Flush(); err != nil {
+			return exported, err
+		}
+		if err := f.Sync(); err != nil {
+			return exported, err
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return exported, err
+		}
+
+		cp.Offset = offset
+		cp.LastEvaluatedKey = out.LastEvaluatedKey
+		cp.Done = len(out.LastEvaluatedKey) == 0
+		if err := e.saveCheckpoint(cp); err != nil {
+			return exported, err
+		}
+		if cp.Done {
+			return exported, nil
+		}
+	}
+}
+
+// すべてのセグメントが終わったら、セグメント順に 1 つのファイルへまとめる
+func (e *exporter) merge(out string) error {
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for segment := 0; segment < e.segments; segment++ {
+		sf, err := os.Open(e.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, sf)
+		sf.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func main() {
+	table := flag.String("table", "quick-photos", "table name")
+	out := flag.String("out", "./export.jsonl", "output JSONL file")
+	segments := flag.Int("segments", 4, "number of parallel scan segments")
+	dir := flag.String("checkpoint-dir", "./export.checkpoint", "directory for segment files and checkpoints")
+	rps := flag.Int("rps", 0, "maximum scan requests per second across all segments (0 means unlimited)")
+	types := flag.String("types", "", "comma separated entity types to export (user, photo, reaction, friendship, ...)")
+	flag.Parse()
+
+	if *segments < 1 {
+		fmt.Fprintln(os.Stderr, "-segments must be positive")
+		os.Exit(2)
+	}
+	entityTypes, err := parseTypes(*types)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		panic(err)
+	}
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+
+	e := &exporter{
+		api:      db.Client(),
+		table:    *table,
+		segments: *segments,
+		dir:      *dir,
+		types:    entityTypes,
+	}
+	if err := e.checkCheckpoints(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *rps > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rps))
+		defer ticker.Stop()
+		e.limiter = ticker.C
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	failed := false
+	for segment := 0; segment < *segments; segment++ {
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			n, err := e.exportSegment(segment)
+			mu.Lock()
+			defer mu.Unlock()
+			total += n
+			if err != nil {
+				failed = true
+				fmt.Fprintln(os.Stderr, fmt.Sprintf("segment %d failed: %s", segment, err))
+			}
+		}(segment)
+	}
+	wg.Wait()
+	if failed {
+		fmt.Fprintln(os.Stderr, "Export incomplete. Run the same command again to resume.")
+		os.Exit(1)
+	}
+
+	if err := e.merge(*out); err != nil {
+		fmt.Print("Merge error:")
+		panic(err)
+	}
+	if err := os.RemoveAll(*dir); err != nil {
+		panic(err)
+	}
+	fmt.Println(fmt.Sprintf("Exported %d items to %s", total, *out))
+}
@@ -0,0 +1,321 @@
+//go:build ignore
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/guregu/dynamo"
+
+	"github.com/s14t284/dynamodb-tutorial-for-mobile-app/quickphotos"
+)
+
+// キーや参照に埋め込まれた時刻も含めて書き換える属性
+// location は S3 のオブジェクトキーなので書き換えない
+var timestampAttributes = []string{"PK", "SK", "timestamp", "photo", "pinnedImage", "readUntil"}
+
+var timestampPattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})?`)
+
+// legacy はタイムゾーンの無い古い形式を読むときのタイムゾーン
+func canonicalize(s string, legacy *time.Location) string {
+	return timestampPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return quickphotos.CanonicalTimestampIn(m, legacy)
+	})
+}
+
+// 書き換えが必要な属性だけを返す。何も返らなければ移行済み
+func changedAttributes(get func(name string) (string, bool), legacy *time.Location) map[string]string {
+	changed := make(map[string]string)
+	for _, name := range timestampAttributes {
+		v, ok := get(name)
+		if !ok {
+			continue
+		}
+		if c := canonicalize(v, legacy); c != v {
+			changed[name] = c
+		}
+	}
+	return changed
+}
+
+// item の属性がすべて読み込んだときの値のままであることを確かめる条件
+// 読み込んだ後に追加された属性までは確かめられない
+func unchangedCondition(item map[string]*dynamodb.AttributeValue) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	attrs := make([]string, 0, len(item))
+	for k := range item {
+		attrs = append(attrs, k)
+	}
+	sort.Strings(attrs)
+	names := make(map[string]*string, len(attrs))
+	values := make(map[string]*dynamodb.AttributeValue, len(attrs))
+	condition := ""
+	for i, k := range attrs {
+		if i > 0 {
+			condition += " AND "
+		}
+		names[fmt.Sprintf("#a%d", i)] = aws.String(k)
+		values[fmt.Sprintf(":v%d", i)] = item[k]
+		condition += fmt.Sprintf("#a%d = :v%d", i, i)
+	}
+	return condition, names, values
+}
+
+type migrator struct {
+	api    dynamodbiface.DynamoDBAPI
+	table  string
+	dryRun bool
+	legacy *time.Location
+}
+
+// キーが変わるアイテムは、古いキーの削除と新しいキーの書き込みを 1 つのトランザクションで行う
+// キーが変わらないアイテムは、読み込んだ値から変わっていない場合だけ更新する
+func (m *migrator) migrateItem(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	changed := changedAttributes(func(name string) (string, bool) {
+		av, ok := item[name]
+		if !ok || av.S == nil {
+			return "", false
+		}
+		return *av.S, true
+	}, m.legacy)
+	if len(changed) == 0 {
+		return false, nil
+	}
+	fmt.Println(fmt.Sprintf("%s | %s: %v", aws.StringValue(item["PK"].S), aws.StringValue(item["SK"].S), changed))
+	if m.dryRun {
+		return true, nil
+	}
+
+	oldKey := map[string]*dynamodb.AttributeValue{
+		"PK": item["PK"],
+		"SK": item["SK"],
+	}
+	_, pkChanged := changed["PK"]
+	_, skChanged := changed["SK"]
+	if pkChanged || skChanged {
+		newItem := make(map[string]*dynamodb.AttributeValue)
+		for k, v := range item {
+			newItem[k] = v
+		}
+		for k, v := range changed {
+			newItem[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+		}
+		// 新しいキーには読み込んだときの値を書き込むので、読み込んだ後に古いアイテムが書き換えられていたら移さない
+		condition, names, values := unchangedCondition(item)
+		_, err := m.api.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Delete: &dynamodb.Delete{
+						TableName:                 aws.String(m.table),
+						Key:                       oldKey,
+						ConditionExpression:       aws.String(condition),
+						ExpressionAttributeNames:  names,
+						ExpressionAttributeValues: values,
+					},
+				},
+				{
+					Put: &dynamodb.Put{
+						TableName:           aws.String(m.table),
+						Item:                newItem,
+						ConditionExpression: aws.String("attribute_not_exists(SK)"),
+					},
+				},
+			},
+		})
+		return true, err
+	}
+
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+	set := ""
+	condition := ""
+	i := 0
+	for k, v := range changed {
+		if i > 0 {
+			set += ", "
+			condition += " AND "
+		}
+		names[fmt.Sprintf("#a%d", i)] = aws.String(k)
+		values[fmt.Sprintf(":new%d", i)] = &dynamodb.AttributeValue{S: aws.String(v)}
+		values[fmt.Sprintf(":old%d", i)] = item[k]
+		set += fmt.Sprintf("#a%d = :new%d", i, i)
+		condition += fmt.Sprintf("#a%d = :old%d", i, i)
+		i++
+	}
+	_, err := m.api.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(m.table),
+		Key:                       oldKey,
+		UpdateExpression:          aws.String("SET " + set),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return true, err
+}
+
+func (m *migrator) migrateTable() (int, error) {
+	migrated := 0
+	var migrateErr error
+	err := m.api.ScanPages(&dynamodb.ScanInput{
+		TableName:      aws.String(m.table),
+		ConsistentRead: aws.Bool(true),
+	}, func(out *dynamodb.ScanOutput, _ bool) bool {
+		for _, item := range out.Items {
+			ok, err := m.migrateItem(item)
+			if err != nil {
+				migrateErr = err
+				return false
+			}
+			if ok {
+				migrated++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return migrated, err
+	}
+	return migrated, migrateErr
+}
+
+// 1 行分のアイテムの時刻を書き換える。書き換えるものが無ければ行をそのまま返す
+// 09_export_table.go の型つきの JSON はそのまま型つきで、items.json のような型のない JSON は型のないまま書き出す
+func migrateLine(line []byte, legacy *time.Location) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	v := map[string]interface{}{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, typed := v["PK"].(map[string]interface{}); typed {
+		item, err := quickphotos.DecodeItem(line)
+		if err != nil {
+			return nil, err
+		}
+		changed := changedAttributes(func(name string) (string, bool) {
+			av, ok := item[name]
+			if !ok || av.S == nil {
+				return "", false
+			}
+			return *av.S, true
+		}, legacy)
+		if len(changed) == 0 {
+			return line, nil
+		}
+		for k, c := range changed {
+			item[k] = &dynamodb.AttributeValue{S: aws.String(c)}
+		}
+		return quickphotos.EncodeItem(item)
+	}
+
+	changed := changedAttributes(func(name string) (string, bool) {
+		s, ok := v[name].(string)
+		return s, ok
+	}, legacy)
+	if len(changed) == 0 {
+		return line, nil
+	}
+	for k, c := range changed {
+		v[k] = c
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// items.json のようなシードファイルを書き換えて標準出力に出す
+// 書き換えた行は属性の名前の順に並び直る
+func migrateFile(path string, legacy *time.Location) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	n := 0
+	for scanner.Scan() {
+		n++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		line, err := migrateLine(scanner.Bytes(), legacy)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		w.Write(line)
+		w.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func main() {
+	table := flag.String("table", "quick-photos", "table name")
+	dryRun := flag.Bool("dry-run", false, "print the items that would change without writing")
+	file := flag.String("file", "", "rewrite a JSONL seed file to stdout instead of the table")
+	zone := flag.String("legacy-zone", quickphotos.DEFAULT_LEGACY_ZONE, "time zone of timestamps written without an offset")
+	flag.Parse()
+
+	// 既定のタイムゾーンは tzdata が無くても読めるものを使う
+	loc := quickphotos.DefaultLegacyLocation()
+	if *zone != quickphotos.DEFAULT_LEGACY_ZONE {
+		var err error
+		if loc, err = time.LoadLocation(*zone); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if *file != "" {
+		if err := migrateFile(*file, loc); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+
+	m := &migrator{
+		api:    db.Client(),
+		table:  *table,
+		dryRun: *dryRun,
+		legacy: loc,
+	}
+	migrated, err := m.migrateTable()
+	if err != nil {
+		fmt.Print("Migration error:")
+		panic(err)
+	}
+	if *dryRun {
+		fmt.Println(fmt.Sprintf("%d items would be migrated", migrated))
+		return
+	}
+	fmt.Println(fmt.Sprintf("Migrated %d items", migrated))
+}
@@ -0,0 +1,120 @@
+//go:build ignore
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+var reactionTypes = []string{"+1", "smiley", "sunglasses", "heart"}
+
+type ReactionShard struct {
+	PK        string         `dynamo:"PK,hash"`
+	SK        string         `dynamo:",range"`
+	Photo     string         `dynamo:"photo"`
+	Shard     int            `dynamo:"shard"`
+	Reactions map[string]int `dynamo:"reactions"`
+}
+
+// PHOTO#<user>#<timestamp> から写真アイテムのパーティションキーを作る
+func photoPK(sk string) (string, error) {
+	parts := strings.SplitN(sk, "#", 3)
+	if len(parts) != 3 || parts[0] != "PHOTO" {
+		return "", fmt.Errorf("invalid photo key %q", sk)
+	}
+	return fmt.Sprintf("USER#%s", parts[1]), nil
+}
+
+// シャードの値を減らし、同じ値を写真の reactions に足す
+// シャードは減算なので、スキャン後にリアクションが増えていても条件チェックは通り、増えた分はシャードに残る
+func compact(db *dynamo.DB, t dynamo.Table, shard ReactionShard) error {
+	pk, err := photoPK(shard.SK)
+	if err != nil {
+		return err
+	}
+	su := t.Update("PK", shard.PK).Range("SK", shard.SK)
+	pu := t.Update("PK", pk).Range("SK", shard.SK).If("attribute_exists(reactionShards)")
+	for _, rt := range reactionTypes {
+		n := shard.Reactions[rt]
+		if n == 0 {
+			continue
+		}
+		su = su.SetExpr("reactions.$ = reactions.$ - ?", rt, rt, n).
+			If("reactions.$ >= ?", rt, n)
+		pu = pu.SetExpr("reactions.$ = reactions.$ + ?", rt, rt, n)
+	}
+	return db.WriteTx().Update(su).Update(pu).Run()
+}
+
+func main() {
+	table := flag.String("table", "quick-photos", "table name")
+	dryRun := flag.Bool("dry-run", false, "print the shard totals without folding them into the photos")
+	flag.Parse()
+
+	sess := session.Must(session.NewSession())
+	db := dynamo.New(
+		sess,
+		&aws.Config{
+			Region: aws.String("ap-northeast-1"),
+		},
+	)
+	t := db.Table(*table)
+
+	shards := make([]ReactionShard, 0)
+	err := t.Scan().
+		Filter("begins_with($, ?)", "PK", "REACTIONSHARD#").
+		Consistent(true).
+		All(&shards)
+	if err != nil {
+		fmt.Print("Scan error:")
+		panic(err)
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].SK != shards[j].SK {
+			return shards[i].SK < shards[j].SK
+		}
+		return shards[i].Shard < shards[j].Shard
+	})
+
+	compacted := 0
+	skipped := 0
+	for _, shard := range shards {
+		total := 0
+		for _, rt := range reactionTypes {
+			total += shard.Reactions[rt]
+		}
+		if total == 0 {
+			continue
+		}
+		fmt.Println(fmt.Sprintf("%s | %s: %v", shard.PK, shard.SK, shard.Reactions))
+		if *dryRun {
+			compacted++
+			continue
+		}
+		if err := compact(db, t, shard); err != nil {
+			// 同時に動いているリアクションのトランザクションと衝突した場合は、次の実行に回す
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeTransactionCanceledException {
+				fmt.Println(fmt.Sprintf("Skipped %s %s: %s", shard.PK, shard.SK, aerr.Message()))
+				skipped++
+				continue
+			}
+			fmt.Print("Compaction error:")
+			panic(err)
+		}
+		compacted++
+	}
+	if *dryRun {
+		fmt.Println(fmt.Sprintf("%d shards would be compacted", compacted))
+		return
+	}
+	fmt.Println(fmt.Sprintf("Compacted %d shards, skipped %d", compacted, skipped))
+}